@@ -164,6 +164,7 @@ func (e *bincEncDriver) encSpFloat(f float64) (done bool) {
 }
 
 func (e *bincEncDriver) EncodeFloat32(f float32) {
+	e.e.checkFloatSpecial(float64(f))
 	if !e.encSpFloat(float64(f)) {
 		e.e.encWr.writen1(bincVdFloat<<4 | bincFlBin32)
 		bigen.writeUint32(e.e.w(), math.Float32bits(f))
@@ -171,6 +172,7 @@ func (e *bincEncDriver) EncodeFloat32(f float32) {
 }
 
 func (e *bincEncDriver) EncodeFloat64(f float64) {
+	e.e.checkFloatSpecial(f)
 	if e.encSpFloat(f) {
 		return
 	}
@@ -354,7 +356,7 @@ func (e *bincEncDriver) EncodeString(v string) {
 		}
 		return
 	}
-	e.EncodeStringEnc(cUTF8, v)
+	e.EncodeStringEnc(cUTF8, e.e.encodeUTF8(v))
 }
 
 func (e *bincEncDriver) EncodeStringEnc(c charEncoding, v string) {
@@ -379,6 +381,21 @@ func (e *bincEncDriver) EncodeStringBytesRaw(v []byte) {
 	}
 }
 
+// WriteBytesStart writes the start of a byte string of a known length, as EncodeStringBytesRaw does.
+func (e *bincEncDriver) WriteBytesStart(length int64) bool {
+	if length < 0 {
+		return false
+	}
+	e.encLen(bincVdByteArray<<4, uint64(length))
+	return true
+}
+
+func (e *bincEncDriver) WriteBytesChunk(v []byte) {
+	e.e.encWr.writeb(v)
+}
+
+func (e *bincEncDriver) WriteBytesEnd() {}
+
 func (e *bincEncDriver) encBytesLen(c charEncoding, length uint64) {
 	// MARKER: we currently only support UTF-8 (string) and RAW (bytearray).
 	// We should consider supporting bincUnicodeOther.
@@ -686,6 +703,8 @@ func (d *bincDecDriver) DecodeBool() (b bool) {
 		// b = false
 	} else if d.bd == (bincVdSpecial | bincSpTrue) {
 		b = true
+	} else if d.bd == (bincVdSpecial|bincSpZero) || d.vd == bincVdSmallInt || d.vd == bincVdPosInt {
+		return d.d.boolFromInt()
 	} else {
 		d.d.errorf("bool - %s %x-%x/%s", msgBadDesc, d.vd, d.vs, bincdesc(d.vd, d.vs))
 	}
@@ -5,6 +5,7 @@ package codec
 
 import (
 	"math"
+	"math/big"
 	"reflect"
 	"time"
 )
@@ -122,6 +123,8 @@ type cborEncDriver struct {
 	encDriverNoopContainerWriter
 	h *CborHandle
 
+	bsi bool // writing an indefinite-length byte string in pieces (see WriteBytesStart)
+
 	e Encoder
 }
 
@@ -142,6 +145,7 @@ func (e *cborEncDriver) EncodeBool(b bool) {
 }
 
 func (e *cborEncDriver) EncodeFloat32(f float32) {
+	e.e.checkFloatSpecial(float64(f))
 	b := math.Float32bits(f)
 	if e.h.OptimumSize {
 		if h := floatToHalfFloatBits(b); halfFloatToFloatBits(h) == b {
@@ -155,6 +159,7 @@ func (e *cborEncDriver) EncodeFloat32(f float32) {
 }
 
 func (e *cborEncDriver) EncodeFloat64(f float64) {
+	e.e.checkFloatSpecial(f)
 	if e.h.OptimumSize {
 		if f32 := float32(f); float64(f32) == f {
 			e.EncodeFloat32(f32)
@@ -165,6 +170,15 @@ func (e *cborEncDriver) EncodeFloat64(f float64) {
 	bigen.writeUint64(e.e.w(), math.Float64bits(f))
 }
 
+func (e *cborEncDriver) EncodeSharedValue() {
+	e.encUint(28, cborBaseTag)
+}
+
+func (e *cborEncDriver) EncodeSharedRef(id uint64) {
+	e.encUint(29, cborBaseTag)
+	e.encUint(id, cborBaseUint)
+}
+
 func (e *cborEncDriver) encUint(v uint64, bd byte) {
 	if v <= 0x17 {
 		e.e.encWr.writen1(byte(v) + bd)
@@ -216,6 +230,35 @@ func (e *cborEncDriver) EncodeTime(t time.Time) {
 	}
 }
 
+// EncodeDecimal encodes a decimal fraction (tag 4) i.e. [exp, mantissa],
+// where the mantissa is a bignum (tag 2 or 3) if it does not fit in 64 bits.
+//
+// It is always written with definite lengths (even if IndefiniteLength).
+func (e *cborEncDriver) EncodeDecimal(exp int64, mantissa *big.Int) {
+	e.encUint(4, cborBaseTag)
+	e.encLen(cborBaseArray, 2)
+	e.EncodeInt(exp)
+	if mantissa.IsInt64() {
+		e.EncodeInt(mantissa.Int64())
+	} else if mantissa.IsUint64() {
+		e.EncodeUint(mantissa.Uint64())
+	} else if mantissa.Sign() > 0 {
+		e.encUint(2, cborBaseTag)
+		e.encBignum(mantissa)
+	} else { // a negative bignum n is encoded as -1-n
+		var v big.Int
+		v.Neg(mantissa).Sub(&v, big.NewInt(1))
+		e.encUint(3, cborBaseTag)
+		e.encBignum(&v)
+	}
+}
+
+func (e *cborEncDriver) encBignum(v *big.Int) {
+	bs := v.Bytes()
+	e.encLen(cborBaseBytes, len(bs))
+	e.e.encWr.writeb(bs)
+}
+
 func (e *cborEncDriver) EncodeExt(rv interface{}, basetype reflect.Type, xtag uint64, ext Ext) {
 	e.encUint(uint64(xtag), cborBaseTag)
 	if ext == SelfExt {
@@ -253,6 +296,14 @@ func (e *cborEncDriver) WriteMapStart(length int) {
 	}
 }
 
+func (e *cborEncDriver) WriteMapStartIndefinite() {
+	e.e.encWr.writen1(cborBdIndefiniteMap)
+}
+
+func (e *cborEncDriver) WriteMapEndIndefinite() {
+	e.e.encWr.writen1(cborBdBreak)
+}
+
 func (e *cborEncDriver) WriteMapEnd() {
 	if e.h.IndefiniteLength {
 		e.e.encWr.writen1(cborBdBreak)
@@ -269,6 +320,8 @@ func (e *cborEncDriver) EncodeString(v string) {
 	bb := cborBaseString
 	if e.h.StringToRaw {
 		bb = cborBaseBytes
+	} else {
+		v = e.e.encodeUTF8(v)
 	}
 	e.encStringBytesS(bb, v)
 }
@@ -314,6 +367,31 @@ func (e *cborEncDriver) encStringBytesS(bb byte, v string) {
 	}
 }
 
+// WriteBytesStart writes an indefinite-length byte string if the length is unknown
+// (or IndefiniteLength), whose pieces are each written as a definite-length chunk.
+func (e *cborEncDriver) WriteBytesStart(length int64) bool {
+	if e.bsi = length < 0 || e.h.IndefiniteLength; e.bsi {
+		e.e.encWr.writen1(cborBdIndefiniteBytes)
+	} else {
+		e.encUint(uint64(length), cborBaseBytes)
+	}
+	return true
+}
+
+func (e *cborEncDriver) WriteBytesChunk(v []byte) {
+	if e.bsi {
+		e.encLen(cborBaseBytes, len(v))
+	}
+	e.e.encWr.writeb(v)
+}
+
+func (e *cborEncDriver) WriteBytesEnd() {
+	if e.bsi {
+		e.e.encWr.writen1(cborBdBreak)
+		e.bsi = false
+	}
+}
+
 // ----------------------
 
 type cborDecDriver struct {
@@ -526,6 +604,8 @@ func (d *cborDecDriver) DecodeBool() (b bool) {
 	if d.bd == cborBdTrue {
 		b = true
 	} else if d.bd == cborBdFalse {
+	} else if d.bd>>5 == cborMajorUint {
+		return d.d.boolFromInt()
 	} else {
 		d.d.errorf("not bool - %s %x/%s", msgBadDesc, d.bd, cbordesc(d.bd))
 	}
@@ -0,0 +1,89 @@
+// Copyright (c) 2012-2020 Ugorji Nwoke. All rights reserved.
+// Use of this source code is governed by a MIT license found in the LICENSE file.
+
+package codec
+
+import (
+	"hash/crc32"
+	"math/bits"
+)
+
+// appendChecksum appends the checksum of b to out, as a fixed-width big-endian trailer.
+func appendChecksum(out []byte, c ChecksumTrailer, b []byte) []byte {
+	switch c {
+	case ChecksumCRC32:
+		v := bigen.PutUint32(crc32.ChecksumIEEE(b))
+		return append(out, v[:]...)
+	case ChecksumXXHash64:
+		v := bigen.PutUint64(xxHash64(b))
+		return append(out, v[:]...)
+	}
+	halt.errorf("unknown ChecksumTrailer: %d", c)
+	return out
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxHash64 returns the XXH64 hash of b (with a seed of 0).
+func xxHash64(b []byte) (h uint64) {
+	n := len(b)
+	if n >= 32 {
+		var v1, v2, v3, v4 uint64 = xxPrime1, xxPrime2, 0, 0
+		v1 += xxPrime2 // wraps
+		v4 -= xxPrime1
+		for ; len(b) >= 32; b = b[32:] {
+			v1 = xxRound(v1, xxLE64(b[0:8]))
+			v2 = xxRound(v2, xxLE64(b[8:16]))
+			v3 = xxRound(v3, xxLE64(b[16:24]))
+			v4 = xxRound(v4, xxLE64(b[24:32]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) +
+			bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxRound(0, xxLE64(b[:8]))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(uint32(b[0])|uint32(b[1])<<8|uint32(b[2])<<16|uint32(b[3])<<24) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return
+}
+
+func xxRound(acc, v uint64) uint64 {
+	return bits.RotateLeft64(acc+v*xxPrime2, 31) * xxPrime1
+}
+
+func xxMergeRound(acc, v uint64) uint64 {
+	return (acc^xxRound(0, v))*xxPrime1 + xxPrime4
+}
+
+func xxLE64(b []byte) uint64 {
+	_ = b[7]
+	return uint64(b[0]) | uint64(b[1])<<8 | uint64(b[2])<<16 | uint64(b[3])<<24 |
+		uint64(b[4])<<32 | uint64(b[5])<<40 | uint64(b[6])<<48 | uint64(b[7])<<56
+}
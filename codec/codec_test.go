@@ -25,12 +25,17 @@ package codec
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/gob"
 	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/big"
 	"math/rand"
 	"net"
 	"net/rpc"
@@ -38,11 +43,13 @@ import (
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 func init() {
@@ -898,6 +905,18 @@ func testHandleCopy(h Handle) (h2 Handle) {
 	return
 }
 
+// testHandleUninited returns a shallow copy of h which has not been initialized,
+// so options only consulted at initialization time can be configured on it.
+//
+// Note: the runtime state (extensions, interface mappings, etc) is not carried over.
+func testHandleUninited(h Handle) (h2 Handle) {
+	h2 = testHandleCopy(h)
+	bh := testBasicHandle(h2)
+	bh.basicHandleRuntimeState = nil
+	bh.clearInited()
+	return
+}
+
 func testMarshal(v interface{}, h Handle) (bs []byte, err error) {
 	// return testCodecEncode(v, nil, testByteBuf, h)
 	return testCodecEncode(v, testGetBytes(), testByteBuf, h, false)
@@ -2927,6 +2946,8 @@ func doTestScalars(t *testing.T, h Handle) {
 		bh.Canonical = true
 		defer func() { bh.Canonical = false }()
 	}
+	defer func(b bool) { bh.AllowUintptr = b }(bh.AllowUintptr)
+	bh.AllowUintptr = true // the scalars include a uintptr
 
 	var bzero = testMarshalErr(nil, h, t, "nil-enc")
 
@@ -3471,7 +3492,12 @@ func doTestRawToStringToRawEtc(t *testing.T, h Handle) {
 	m8 := map[interface{}]interface{}{"key": bv0}
 
 	// StringToRaw=true
-	fne(m1, m4, true)
+	// json object keys are always strings, so compare to encoded m5 for json
+	if jok {
+		fne(m1, m5, true)
+	} else {
+		fne(m1, m4, true)
+	}
 
 	// StringToRaw=false
 	// compare encoded m2 to encoded m5
@@ -4577,863 +4603,8090 @@ func doTestMsgpackDecodeMapAndExtSizeMismatch(t *testing.T, h Handle) {
 	// fn(t, b, &s)
 }
 
-func TestMapRangeIndex(t *testing.T) {
-	defer testSetup(t, nil)()
-	// t.Skip()
+func doTestStructTagName(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	if testBasicHandle(h).StructToArray {
+		t.Skipf("skipping StructTagName test when StructToArray=true")
+	}
 	type T struct {
-		I int
-		S string
-		B bool
-		M map[int]T
+		A int    `db:"a" codec:"codecA"`
+		B string `db:"b,omitempty" json:"jsonB"`
+		C bool   `codec:"codecC"`
+		D int    `db:"-"`
 	}
+	h = testHandleUninited(h)
+	bh := testBasicHandle(h)
+	bh.StructTagName = "db"
+	bh.Canonical = true
 
-	t1 := T{I: 1, B: true, S: "11", M: map[int]T{11: T{I: 11}}}
-	t2 := T{I: 1, B: true, S: "12", M: map[int]T{12: T{I: 12}}}
+	v := T{A: 1, C: true, D: 4}
+	b := testMarshalErr(v, h, t, name+"-struct-tag-name")
+	var m map[string]interface{}
+	testUnmarshalErr(&m, b, h, t, name+"-struct-tag-name-map")
+	testDeepEqualErr(len(m), 2, t, name+"-struct-tag-name-len")
+	if _, ok := m["a"]; !ok {
+		t.Fatalf("%s: expected key: a, got %v", name, m)
+	}
+	if _, ok := m["C"]; !ok {
+		t.Fatalf("%s: expected key: C, got %v", name, m)
+	}
 
-	// ------
+	var v2 T
+	testUnmarshalErr(&v2, b, h, t, name+"-struct-tag-name-dec")
+	v.D = 0
+	testDeepEqualErr(v, v2, t, name+"-struct-tag-name-cmp")
+	testReleaseBytes(b)
+}
 
-	var m1 = map[string]*T{
-		"11": &t1,
-		"12": &t2,
-	}
-	var m1c = make(map[string]T)
-	for k, v := range m1 {
-		m1c[k] = *v
+func TestVarint(t *testing.T) {
+	defer testSetup(t, nil)()
+	var b []byte
+	for _, v := range []uint64{0, 1, 127, 128, 300, 16383, 16384, math.MaxUint32, math.MaxUint64} {
+		b = AppendVarint(b[:0], v)
+		v2, n := DecodeVarint(b)
+		testDeepEqualErr(v2, v, t, "varint")
+		testDeepEqualErr(n, len(b), t, "varint-len")
 	}
+	// protobuf docs: 150 is encoded as 0x96 0x01
+	testDeepEqualErr(AppendVarint(nil, 150), []byte{0x96, 0x01}, t, "varint-150")
 
-	fnrv := func(r1, r2 reflect.Value) reflect.Value {
-		if r1.IsValid() {
-			return r1
-		}
-		return r2
+	for _, v := range []int64{0, -1, 1, -2, 2, -64, 64, math.MinInt64, math.MaxInt64} {
+		b = AppendZigzagVarint(b[:0], v)
+		v2, n := DecodeZigzagVarint(b)
+		testDeepEqualErr(v2, v, t, "zigzag")
+		testDeepEqualErr(n, len(b), t, "zigzag-len")
 	}
+	testDeepEqualErr(AppendZigzagVarint(nil, -1), []byte{0x01}, t, "zigzag-minus-1")
+	testDeepEqualErr(AppendZigzagVarint(nil, 1), []byte{0x02}, t, "zigzag-1")
 
-	// var vx reflect.Value
+	if _, n := DecodeVarint([]byte{0x80, 0x80}); n != 0 {
+		t.Fatalf("expected n=0 for truncated varint, got %d", n)
+	}
+	b = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x02}
+	if _, n := DecodeVarint(b); n >= 0 {
+		t.Fatalf("expected n<0 for overflowing varint, got %d", n)
+	}
+}
 
-	mt := reflect.TypeOf(m1)
-	rvk := mapAddrLoopvarRV(mt.Key(), mt.Key().Kind())
-	rvv := mapAddrLoopvarRV(mt.Elem(), mt.Elem().Kind())
-	var it mapIter
-	mapRange(&it, reflect.ValueOf(m1), rvk, rvv, true)
-	for it.Next() {
-		k := fnrv(it.Key(), rvk).Interface().(string)
-		v := fnrv(it.Value(), rvv).Interface().(*T)
-		testDeepEqualErr(m1[k], v, t, "map-key-eq-it-key")
-		if _, ok := m1c[k]; ok {
-			delete(m1c, k)
-		} else {
-			t.Logf("unexpected key in map: %v", k)
-			t.FailNow()
-		}
+func doTestTypeFieldName(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	type Circle struct{ Radius int }
+	type Props map[string]int
+	type Other struct{ X int }
+	type T struct {
+		A, B, C interface{}
+		D       []fmt.Stringer
+	}
+	h = testHandleUninited(h)
+	bh := testBasicHandle(h)
+	bh.StructToArray = false
+	bh.Canonical = true
+	bh.TypeFieldName = "type"
+	testCheckErr(t, bh.SetTypeName(reflect.TypeOf(&Circle{}), "circle"))
+	testCheckErr(t, bh.SetTypeName(reflect.TypeOf(Props{}), "props"))
+	testCheckErr(t, bh.SetTypeName(reflect.TypeOf(time.Duration(0)), "duration"))
+	if err := bh.SetTypeName(reflect.TypeOf((*fmt.Stringer)(nil)).Elem(), "stringer"); err == nil {
+		t.Fatalf("%s: expected error registering an interface type", name)
+	}
+
+	v := T{
+		A: &Circle{Radius: 2},
+		B: Props{"p": 1},
+		C: Other{X: 3},
+		D: []fmt.Stringer{time.Duration(5)},
+	}
+	b := testMarshalErr(v, h, t, name+"-type-field-name")
+
+	var m map[string]interface{}
+	testUnmarshalErr(&m, b, h, t, name+"-type-field-name-dec")
+	testDeepEqualErr(len(m), 4, t, name+"-type-field-name-len")
+
+	// type name is written first, so the value can be dispatched on while decoding.
+	// The expected values are not of registered types, as those would be wrapped too.
+	var m2 map[string]interface{}
+	var b2 []byte
+	NewEncoderBytes(&b2, h).MustEncode(map[string]interface{}{
+		"A": testMbsT{"type", "circle", "data", map[string]int{"Radius": 2}},
+		"B": testMbsT{"type", "props", "data", map[string]int{"p": 1}},
+		"C": Other{X: 3},
+		"D": []interface{}{testMbsT{"type", "duration", "data", 5}},
+	})
+	testDeepEqualErr(b, b2, t, name+"-type-field-name-cmp")
+	testUnmarshalErr(&m2, b2, h, t, name+"-type-field-name-dec2")
+	testDeepEqualErr(m, m2, t, name+"-type-field-name-cmp-map")
+
+	// changing the value key
+	bh.TypeValueFieldName = "value"
+	b = testMarshalErr(struct{ A interface{} }{&Circle{1}}, h, t, name+"-type-value-field-name")
+	b2 = nil
+	NewEncoderBytes(&b2, h).MustEncode(map[string]interface{}{
+		"A": testMbsT{"type", "circle", "value", map[string]int{"Radius": 1}},
+	})
+	testDeepEqualErr(b, b2, t, name+"-type-value-field-name-cmp")
+
+	// interface elements of fastpath containers are also wrapped
+	b = testMarshalErr([]interface{}{&Circle{3}, 1}, h, t, name+"-type-field-name-slice")
+	b2 = nil
+	NewEncoderBytes(&b2, h).MustEncode([]interface{}{testMbsT{"type", "circle", "value", map[string]int{"Radius": 3}}, 1})
+	testDeepEqualErr(b, b2, t, name+"-type-field-name-slice-cmp")
+	b = testMarshalErr(map[string]interface{}{"a": &Circle{3}}, h, t, name+"-type-field-name-map")
+	b2 = nil
+	NewEncoderBytes(&b2, h).MustEncode(map[string]testMbsT{"a": {"type", "circle", "value", map[string]int{"Radius": 3}}})
+	testDeepEqualErr(b, b2, t, name+"-type-field-name-map-cmp")
+}
+
+func doTestMapDecorator(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	if codecgen {
+		t.Skipf("skipping MapDecorator tests as it is not honored by codecgen")
+	}
+	type T1 struct {
+		A int
+	}
+	type T2 struct {
+		A  int
+		B  string `codec:",omitempty"`
+		T1 T1
+		S  []T1
+	}
+	bh := testBasicHandle(h)
+	defer func(s2a bool, md func(reflect.Type) map[string]interface{}, mdd int) {
+		bh.StructToArray, bh.MapDecorator, bh.MapDecoratorMaxDepth = s2a, md, mdd
+	}(bh.StructToArray, bh.MapDecorator, bh.MapDecoratorMaxDepth)
+	bh.StructToArray = false
+	bh.MapDecorator = func(rt reflect.Type) map[string]interface{} {
+		return map[string]interface{}{"_version": 2, "_type": rt.Name(), "A": "collides"}
 	}
-	it.Done()
-	testDeepEqualErr(len(m1c), 0, t, "all-keys-not-consumed")
 
-	// ------
+	fn := func(v interface{}, v2 interface{}, suffix string) {
+		b := testMarshalErr(v, h, t, name+suffix)
+		var m, m2 map[string]interface{}
+		testUnmarshalErr(&m, b, h, t, name+suffix+"-dec")
+		testReleaseBytes(b)
+		b = testMarshalErr(v2, h, t, name+suffix+"-2")
+		testUnmarshalErr(&m2, b, h, t, name+suffix+"-dec-2")
+		testReleaseBytes(b)
+		testDeepEqualErr(m, m2, t, name+suffix+"-cmp")
+	}
 
-	var m2 = map[*T]T{
-		&t1: t1,
-		&t2: t2,
+	v := T2{A: 1, T1: T1{A: 2}, S: []T1{{A: 3}}}
+	v1m := func(a int) map[string]interface{} {
+		return map[string]interface{}{"A": a, "_version": 2, "_type": "T1"}
 	}
-	var m2c = make(map[*T]*T)
-	for k := range m2 {
-		m2c[k] = k
+	fn(v, map[string]interface{}{
+		"A": 1, "_version": 2, "_type": "T2",
+		"T1": v1m(2),
+		"S":  []interface{}{v1m(3)},
+	}, "-map-decorator")
+	// kStructNoOmitempty path
+	fn(T1{A: 4}, v1m(4), "-map-decorator-no-omitempty")
+
+	bh.MapDecoratorMaxDepth = 1
+	fn(v, map[string]interface{}{
+		"A": 1, "_version": 2, "_type": "T2",
+		"T1": map[string]interface{}{"A": 2},
+		"S":  []interface{}{map[string]interface{}{"A": 3}},
+	}, "-map-decorator-depth")
+}
+
+func doTestJsonFloatAsString(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	jh := h.(*JsonHandle)
+	if jh.StructToArray {
+		t.Skipf("skipping FloatAsString test when StructToArray=true")
 	}
+	defer func(fas bool, ind int8) { jh.FloatAsString, jh.Indent = fas, ind }(jh.FloatAsString, jh.Indent)
+	jh.FloatAsString = true
+	jh.Indent = 0
 
-	mt = reflect.TypeOf(m2)
-	rvk = mapAddrLoopvarRV(mt.Key(), mt.Key().Kind())
-	rvv = mapAddrLoopvarRV(mt.Elem(), mt.Elem().Kind())
-	it = mapIter{} // zero it out first, before calling mapRange
-	mapRange(&it, reflect.ValueOf(m2), rvk, rvv, true)
-	for it.Next() {
-		k := fnrv(it.Key(), rvk).Interface().(*T)
-		v := fnrv(it.Value(), rvv).Interface().(T)
-		testDeepEqualErr(m2[k], v, t, "map-key-eq-it-key")
-		if _, ok := m2c[k]; ok {
-			delete(m2c, k)
-		} else {
-			t.Logf("unexpected key in map: %v", k)
-			t.FailNow()
+	type T struct {
+		F64 float64
+		F32 float32
+		I   int
+	}
+	for _, v := range []T{
+		{0.1, 0.1, 1},
+		{1, 1e-7, 2},
+		{123456789.12345678, 3.4e38, 3},
+		{math.MaxFloat64, math.SmallestNonzeroFloat32, 4},
+	} {
+		var b []byte
+		NewEncoderBytes(&b, jh).MustEncode(v)
+		var m map[string]interface{}
+		testUnmarshalErr(&m, b, jh, t, "float-as-string-map")
+		if _, ok := m["F64"].(string); !ok {
+			t.Fatalf("expected F64 encoded as string, got: %s", b)
 		}
+		if _, ok := m["F32"].(string); !ok {
+			t.Fatalf("expected F32 encoded as string, got: %s", b)
+		}
+		if _, ok := m["I"].(string); ok {
+			t.Fatalf("expected I encoded as number, got: %s", b)
+		}
+		var v2 T
+		testUnmarshalErr(&v2, b, jh, t, "float-as-string-dec")
+		testDeepEqualErr(v, v2, t, "float-as-string-cmp")
 	}
-	it.Done()
-	testDeepEqualErr(len(m2c), 0, t, "all-keys-not-consumed")
 
-	// ---- test mapGet
-
-	fnTestMapIndex := func(mi ...interface{}) {
-		for _, m0 := range mi {
-			m := reflect.ValueOf(m0)
-			mkt := m.Type().Key()
-			mvt := m.Type().Elem()
-			kfast := mapKeyFastKindFor(mkt.Kind())
-			rvv := mapAddrLoopvarRV(mvt, mvt.Kind())
-			visindirect := mapStoresElemIndirect(mvt.Size())
-			visref := refBitset.isset(byte(mvt.Kind()))
+	var b []byte
+	NewEncoderBytes(&b, jh).MustEncode([]float64{1, 0.5, math.NaN()})
+	testDeepEqualErr(string(b), `["1.0","0.5",null]`, t, "float-as-string-literal")
+}
 
-			for _, k := range m.MapKeys() {
-				mg := mapGet(m, k, rvv, kfast, visindirect, visref).Interface()
-				testDeepEqualErr(m.MapIndex(k).Interface(), mg, t, "map-index-eq")
+func doTestIterative(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical, iterative bool) {
+		bh.Canonical, bh.Iterative = canonical, iterative
+	}(bh.Canonical, bh.Iterative)
+	bh.Canonical = true // so map ordering is deterministic
+
+	// randv returns a random tree of interfaces, slices and maps
+	var randv func(r *rand.Rand, depth int) interface{}
+	randv = func(r *rand.Rand, depth int) interface{} {
+		k := r.Intn(8)
+		if depth <= 0 {
+			k %= 4
+		}
+		switch k {
+		case 0:
+			return nil
+		case 1:
+			return r.Int63n(1000) - 500
+		case 2:
+			return strconv.Itoa(r.Intn(100))
+		case 3:
+			return r.Intn(2) == 0
+		case 4, 5:
+			v := make([]interface{}, r.Intn(4))
+			for i := range v {
+				v[i] = randv(r, depth-1)
+			}
+			return v
+		default:
+			v := make(map[string]interface{})
+			for i := r.Intn(4); i > 0; i-- {
+				v[strconv.Itoa(r.Intn(100))] = randv(r, depth-1)
 			}
+			return v
 		}
 	}
 
-	fnTestMapIndex(m1, m1c, m2, m2c)
-
-	// var s string = "hello"
-	// var tt = &T{I: 3}
-	// ttTyp := reflect.TypeOf(tt)
-	// _, _ = tt, ttTyp
-	// mv := reflect.ValueOf(m)
-	// it := mapRange(mv, reflect.ValueOf(&s).Elem(), reflect.ValueOf(&tt).Elem(), true) //ok
-	// it := mapRange(mv, reflect.New(reflect.TypeOf(s)).Elem(), reflect.New(reflect.TypeOf(T{})).Elem(), true) // ok
-	// it := mapRange(mv, reflect.New(reflect.TypeOf(s)).Elem(), reflect.New(ttTyp.Elem()), true) // !ok
-	// it := mapRange(mv, reflect.New(reflect.TypeOf(s)).Elem(), reflect.New(reflect.TypeOf(T{})), true) !ok
-	// it := mapRange(mv, reflect.New(reflect.TypeOf(s)).Elem(), reflect.New(reflect.TypeOf(T{})).Elem(), true) // ok
+	var deep interface{} = "leaf"
+	for i := 0; i < 1000; i++ {
+		deep = []interface{}{deep, map[string]interface{}{"a": i}}
+	}
 
-	// fmt.Printf("key: %#v\n", it.Key())
-	// fmt.Printf("exp: %#v\n", mv.MapIndex(it.Key()))
-	// fmt.Printf("val: %#v\n", it.Value())
-	// testDeepEqualErr(mv.MapIndex(it.Key()), it.Value().Interface()
+	// a new value is created for each encoding, as encoding a chan drains it
+	vs := []func() interface{}{
+		func() interface{} { return deep },
+		func() interface{} {
+			return newTestStrucFlex(testDepth, testNumRepeatString, false, !testSkipIntf, testMapStringKeyOnly)
+		},
+		func() interface{} {
+			return newTestStruc(testDepth, testNumRepeatString, false, !testSkipIntf, testMapStringKeyOnly)
+		},
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		v := randv(r, 6)
+		vs = append(vs, func() interface{} { return v })
+	}
+	for i, v := range vs {
+		bh.Iterative = false
+		b1 := testMarshalErr(v(), h, t, name+"-recursive")
+		bh.Iterative = true
+		b2 := testMarshalErr(v(), h, t, name+"-iterative")
+		if !bytes.Equal(b1, b2) {
+			j := 0
+			for j < len(b1)-1 && j < len(b2)-1 && b1[j] == b2[j] {
+				j++
+			}
+			t.Fatalf("%d: iterative output differs from recursive output at offset %d: %q, %q",
+				i, j, b1[:j+1], b2[:j+1])
+		}
+		testReleaseBytes(b1)
+		testReleaseBytes(b2)
+	}
 }
 
-// ----------
+func doTestEncodeWithFieldOffsets(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping EncodeWithFieldOffsets tests as it is not honored by codecgen")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(s2a bool, wbs int) {
+		bh.StructToArray, bh.WriterBufferSize = s2a, wbs
+	}(bh.StructToArray, bh.WriterBufferSize)
+	bh.StructToArray = false
+	bh.WriterBufferSize = 16 // so some bytes are flushed before the offsets are captured
 
-func TestBincCodecsTable(t *testing.T) {
-	doTestCodecTableOne(t, testBincH)
-}
+	type T1 struct {
+		A int
+		B string
+	}
+	type T2 struct {
+		I  int64
+		S  string
+		T  T1
+		L  []T1
+		M  map[string]uint
+		E  string `codec:",omitempty"`
+		Pi *int
+	}
+	v := T2{
+		I: -12345,
+		S: "hello",
+		T: T1{1, "one"},
+		L: []T1{{2, "two"}, {3, "three"}},
+		M: map[string]uint{"x": 9},
+	}
+	var buf bytes.Buffer
+	var b []byte
+	for i, e := range []*Encoder{NewEncoderBytes(&b, h), NewEncoder(&buf, h)} {
+		offs, err := e.EncodeWithFieldOffsets(&v)
+		testCheckErr(t, err)
+		if i == 1 {
+			b = buf.Bytes()
+		}
+		if len(offs) != 6 {
+			t.Fatalf("%s: expected 6 field offsets, got: %v", name, offs)
+		}
+		var v2 T2
+		for fname, fv := range map[string]interface{}{
+			"I": &v2.I, "S": &v2.S, "T": &v2.T, "L": &v2.L, "M": &v2.M, "Pi": &v2.Pi,
+		} {
+			off, ok := offs[fname]
+			if !ok {
+				t.Fatalf("%s: no offset for field: %s", name, fname)
+			}
+			testUnmarshalErr(fv, b[off:], h, t, name+"-"+fname)
+		}
+		testDeepEqualErr(v, v2, t, name+"-field-offsets")
+	}
 
-func TestBincCodecsMisc(t *testing.T) {
-	doTestCodecMiscOne(t, testBincH)
+	// only top-level struct fields are captured
+	b = nil
+	offs, err := NewEncoderBytes(&b, h).EncodeWithFieldOffsets([]T1{{1, "one"}})
+	testCheckErr(t, err)
+	testDeepEqualErr(len(offs), 0, t, name+"-field-offsets-slice")
 }
 
-func TestBincCodecsEmbeddedPointer(t *testing.T) {
-	doTestCodecEmbeddedPointer(t, testBincH)
+func doTestEncodeReflectValue(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	type T struct {
+		A int
+	}
+	type T2 struct {
+		V reflect.Value
+	}
+	var intf interface{}
+	var rv0 reflect.Value
+	var tp *T
+	for i, v := range [][2]interface{}{
+		{reflect.Value{}, nil},
+		{reflect.ValueOf(tp), nil},
+		{reflect.ValueOf(&intf).Elem(), nil},
+		{reflect.ValueOf(reflect.Value{}), nil},
+		{reflect.ValueOf(reflect.ValueOf(tp)), nil},
+		{&rv0, nil},
+		{reflect.ValueOf(&T{5}), &T{5}},
+		{[]reflect.Value{{}, reflect.ValueOf(1), reflect.ValueOf(tp)}, []interface{}{nil, 1, nil}},
+		{T2{reflect.ValueOf("x")}, map[string]interface{}{"V": "x"}},
+		{T2{}, map[string]interface{}{"V": nil}},
+	} {
+		if _, ok := v[0].(T2); ok && testBasicHandle(h).StructToArray {
+			v[1] = []interface{}{v[1].(map[string]interface{})["V"]}
+		}
+		b1 := testMarshalErr(v[0], h, t, name+"-reflect-value")
+		b2 := testMarshalErr(v[1], h, t, name+"-reflect-value-expected")
+		testDeepEqualErr(b1, b2, t, fmt.Sprintf("%s-reflect-value-%d", name, i))
+		testReleaseBytes(b1)
+		testReleaseBytes(b2)
+	}
 }
 
-func TestBincStdEncIntf(t *testing.T) {
-	doTestStdEncIntf(t, testBincH)
-}
+func doTestStringKeyLess(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical, iterative bool, less func(a, b string) bool) {
+		bh.Canonical, bh.Iterative, bh.StringKeyLess = canonical, iterative, less
+	}(bh.Canonical, bh.Iterative, bh.StringKeyLess)
+	bh.Canonical = true
+	bh.StringKeyLess = func(a, b string) bool { return strings.ToLower(a) < strings.ToLower(b) }
 
-func TestSimpleCodecsTable(t *testing.T) {
-	doTestCodecTableOne(t, testSimpleH)
+	type T struct {
+		I int
+	}
+	m1 := map[string]int{"b": 1, "A": 2, "a": 3, "C": 4}
+	m2 := map[string]T{"b": {1}, "A": {2}, "a": {3}, "C": {4}} // not a fastpath type
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		b1 := testMarshalErr(m1, h, t, name+"-string-key-less")
+		b2 := testMarshalErr(testMbsT{"A", 2, "a", 3, "b", 1, "C", 4}, h, t, name+"-string-key-less-expected")
+		testDeepEqualErr(b1, b2, t, name+"-string-key-less-fastpath")
+		b1 = testMarshalErr(m2, h, t, name+"-string-key-less")
+		b2 = testMarshalErr(testMbsT{"A", T{2}, "a", T{3}, "b", T{1}, "C", T{4}}, h, t, name+"-string-key-less-expected")
+		testDeepEqualErr(b1, b2, t, name+"-string-key-less-reflection")
+	}
 }
 
-func TestSimpleCodecsMisc(t *testing.T) {
-	doTestCodecMiscOne(t, testSimpleH)
-}
+func doTestImageExt(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	h = testHandleUninited(h)
+	testCheckErr(t, SetImageExts(h, 100))
 
-func TestSimpleCodecsEmbeddedPointer(t *testing.T) {
-	doTestCodecEmbeddedPointer(t, testSimpleH)
-}
+	type T struct {
+		P  image.Point
+		R  image.Rectangle
+		C  color.RGBA
+		Ps []image.Point
+		Rp *image.Rectangle
+	}
+	v := T{
+		P:  image.Pt(-3, 1<<40),
+		R:  image.Rectangle{Min: image.Pt(10, 20), Max: image.Pt(-1, 2)}, // not canonical
+		C:  color.RGBA{1, 2, 254, 255},
+		Ps: []image.Point{{1, 2}, {0, -1}},
+		Rp: &image.Rectangle{Max: image.Pt(3, 4)},
+	}
+	b := testMarshalErr(v, h, t, name+"-image-ext")
+	var v2 T
+	testUnmarshalErr(&v2, b, h, t, name+"-image-ext")
+	testDeepEqualErr(v, v2, t, name+"-image-ext")
+	testReleaseBytes(b)
 
-func TestSimpleStdEncIntf(t *testing.T) {
-	doTestStdEncIntf(t, testSimpleH)
+	if _, ok := h.(*JsonHandle); ok {
+		b = testMarshalErr(color.RGBA{1, 2, 3, 4}, h, t, name+"-image-ext-color")
+		testDeepEqualErr(strings.Join(strings.Fields(string(b)), ""), "[1,2,3,4]", t, name+"-image-ext-color")
+	}
 }
 
-func TestMsgpackCodecsTable(t *testing.T) {
-	doTestCodecTableOne(t, testMsgpackH)
-}
+func doTestJsonWriteBOM(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	jh := h.(*JsonHandle)
+	defer func(bom bool, ind int8) { jh.WriteBOM, jh.Indent = bom, ind }(jh.WriteBOM, jh.Indent)
+	jh.WriteBOM = true
+	jh.Indent = 0
 
-func TestMsgpackCodecsMisc(t *testing.T) {
-	doTestCodecMiscOne(t, testMsgpackH)
-}
+	const bom = "\xef\xbb\xbf"
+	var b []byte
+	e := NewEncoderBytes(&b, jh)
+	e.MustEncode(map[string]int{"a": 1})
+	e.MustEncode([]int{1})                // not written mid-stream
+	e.MustEncode(testMbsT{"b", []int{2}}) // nor for nested values
+	exp := bom + `{"a":1}[1]{"b":[2]}`
+	if jh.TermWhitespace {
+		exp = bom + "{\"a\":1}\n[1]\n{\"b\":[2]}\n"
+	}
+	testDeepEqualErr(string(b), exp, t, "write-bom")
 
-func TestMsgpackCodecsEmbeddedPointer(t *testing.T) {
-	doTestCodecEmbeddedPointer(t, testMsgpackH)
+	// Reset re-arms it
+	var buf bytes.Buffer
+	e.Reset(&buf)
+	e.MustEncode(true)
+	if !strings.HasPrefix(buf.String(), bom+"true") {
+		t.Fatalf("expected BOM before value after Reset, got: %q", buf.Bytes())
+	}
 }
 
-func TestMsgpackStdEncIntf(t *testing.T) {
-	doTestStdEncIntf(t, testMsgpackH)
-}
+func doTestEncodeSliceAsMap(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical bool) { bh.Canonical = canonical }(bh.Canonical)
+	bh.Canonical = true
 
-func TestCborCodecsTable(t *testing.T) {
-	doTestCodecTableOne(t, testCborH)
+	type Item struct {
+		ID   string `codec:"id"`
+		N    int
+		Tags []string
+	}
+	items := []*Item{{"b", 1, nil}, {"c", 2, []string{"x"}}, {"a", 3, nil}}
+	var b []byte
+	testCheckErr(t, NewEncoderBytes(&b, h).EncodeSliceAsMap(items, "id"))
+	var m map[string]Item
+	testUnmarshalErr(&m, b, h, t, name+"-slice-as-map")
+	testDeepEqualErr(m, map[string]Item{"a": *items[2], "b": *items[0], "c": *items[1]}, t, name+"-slice-as-map")
+	// same output as encoding a map (which is sorted, as Canonical)
+	testDeepEqualErr(b, testMarshalErr(m, h, t, name+"-slice-as-map-2"), t, name+"-slice-as-map-canonical")
+
+	b = nil
+	testCheckErr(t, NewEncoderBytes(&b, h).EncodeSliceAsMap([...]Item{{N: 7}, {N: -1}}, "N"))
+	var m2 map[int]Item
+	testUnmarshalErr(&m2, b, h, t, name+"-slice-as-map-int")
+	testDeepEqualErr(m2, map[int]Item{7: {N: 7}, -1: {N: -1}}, t, name+"-slice-as-map-int")
+
+	for i, v := range []struct {
+		slice interface{}
+		key   string
+	}{
+		{[]Item{{ID: "a"}, {ID: "a"}}, "id"}, // duplicate keys
+		{[]int{1, 2}, "id"},                  // non-struct elements
+		{[]*Item{nil}, "id"},                 // nil element
+		{[]Item{{ID: "a"}}, "ID"},            // not the encoded name
+		{Item{}, "id"},                       // not a slice
+	} {
+		b = nil
+		if err := NewEncoderBytes(&b, h).EncodeSliceAsMap(v.slice, v.key); err == nil {
+			t.Fatalf("%s: %d: expected error encoding slice as map", name, i)
+		}
+	}
+}
+
+func doTestKeyDictionary(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping KeyDictionary tests as it is not honored by codecgen")
+	}
+	name := h.Name()
+	h0 := h
+	h = testHandleUninited(h)
+	bh := testBasicHandle(h)
+	bh.StructToArray = false
+	bh.Canonical = true
+	bh.KeyDictionary = map[string]string{"FirstName": "z", "LastName": "y", "Extra": "x"}
+
+	type T1 struct {
+		A int
+	}
+	type T struct {
+		FirstName string
+		LastName  string
+		Age       int
+		M         map[string]int
+		N         map[string]T1 // not a fastpath type
+	}
+	v := T{"Ugorji", "Nwoke", 40, map[string]int{"Extra": 1, "b": 2}, map[string]T1{"LastName": {}}}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		b := testMarshalErr(v, h, t, name+"-key-dictionary")
+		var v2 T
+		testUnmarshalErr(&v2, b, h, t, name+"-key-dictionary")
+		testDeepEqualErr(v, v2, t, name+"-key-dictionary")
+
+		// the codes are written (sorted, as Canonical)
+		var m map[string]interface{}
+		testUnmarshalErr(&m, b, h0, t, name+"-key-dictionary-map")
+		if _, ok := m["z"]; !ok {
+			t.Fatalf("%s: expected code z for FirstName, got: %v", name, m)
+		}
+		b2 := testMarshalErr(testMbsT{
+			"Age", 40,
+			"M", testMbsT{"b", 2, "x", 1},
+			"N", testMbsT{"y", T1{}},
+			"y", "Nwoke",
+			"z", "Ugorji",
+		}, h, t, name+"-key-dictionary-expected")
+		testDeepEqualErr(b, b2, t, name+"-key-dictionary-canonical")
+	}
+
+	// a key which is the same as a code cannot be encoded
+	_, err := testMarshal(map[string]int{"z": 1}, h)
+	if err == nil {
+		t.Fatalf("%s: expected error encoding a key which collides with a code", name)
+	}
+}
+
+func doTestTimePrecision(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(precision time.Duration) {
+		bh.TimePrecision = precision
+	}(bh.TimePrecision)
+
+	type T struct {
+		T  time.Time
+		Tp *time.Time
+		M  map[time.Time]int
+	}
+	mk := func(tm time.Time) T {
+		return T{T: tm, Tp: &tm, M: map[time.Time]int{tm: 1}}
+	}
+	tm := time.Date(2020, 2, 3, 4, 5, 6, 123456789, time.UTC)
+	for _, v := range []struct {
+		p    time.Duration
+		in   time.Time
+		want time.Time
+	}{
+		{time.Millisecond, tm, time.Date(2020, 2, 3, 4, 5, 6, 123000000, time.UTC)},
+		{time.Second, tm, time.Date(2020, 2, 3, 4, 5, 6, 0, time.UTC)},
+		{time.Millisecond, time.Time{}, time.Time{}},
+	} {
+		bh.TimePrecision = 0
+		b2 := testMarshalErr(mk(v.want), h, t, name+"-time-precision-expected")
+		b3 := testMarshalErr(v.want, h, t, name+"-time-precision-expected")
+		bh.TimePrecision = v.p
+		b1 := testMarshalErr(mk(v.in), h, t, name+"-time-precision")
+		testDeepEqualErr(b1, b2, t, name+"-time-precision-"+v.p.String())
+		b1 = testMarshalErr(&v.in, h, t, name+"-time-precision")
+		testDeepEqualErr(b1, b3, t, name+"-time-precision-ptr-"+v.p.String())
+	}
+}
+
+func doTestMsgpackTimeExt(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	mh := h.(*MsgpackHandle)
+	defer func(writeExt, timeExt bool) {
+		mh.WriteExt, mh.TimeExt = writeExt, timeExt
+	}(mh.WriteExt, mh.TimeExt)
+	mh.WriteExt = false
+	mh.TimeExt = true
+
+	// test vectors per the timestamp extension in the msgpack spec
+	for i, v := range []struct {
+		t time.Time
+		b []byte
+	}{
+		{time.Unix(0, 0), []byte{0xd6, 0xff, 0, 0, 0, 0}},
+		{time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC),
+			[]byte{0xd6, 0xff, 0x5a, 0x4a, 0xf6, 0xa5}},
+		{time.Date(2018, 1, 2, 3, 4, 5, 678901234, time.UTC),
+			[]byte{0xd7, 0xff, 0xa1, 0xdc, 0xd7, 0xc8, 0x5a, 0x4a, 0xf6, 0xa5}},
+		{time.Unix(1<<32, 0), // does not fit 32-bits
+			[]byte{0xd7, 0xff, 0, 0, 0, 1, 0, 0, 0, 0}},
+		{time.Unix(1<<34, 0), // does not fit 34-bits
+			[]byte{0xc7, 0x0c, 0xff, 0, 0, 0, 0, 0, 0, 0, 0x04, 0, 0, 0, 0}},
+		{time.Unix(-1, 0), // pre-1970
+			[]byte{0xc7, 0x0c, 0xff, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{time.Unix(-1, 999999999),
+			[]byte{0xc7, 0x0c, 0xff, 0x3b, 0x9a, 0xc9, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{time.Time{}, []byte{0xc0}},
+	} {
+		name := fmt.Sprintf("msgpack-time-ext-%d", i)
+		b := testMarshalErr(v.t, h, t, name)
+		testDeepEqualErr(b, v.b, t, name)
+		var t2 time.Time
+		testUnmarshalErr(&t2, b, h, t, name)
+		if !t2.Equal(v.t) {
+			t.Fatalf("%s: expected %v, got %v", name, v.t, t2)
+		}
+		var v2 interface{}
+		testUnmarshalErr(&v2, b, h, t, name)
+		if t3, _ := v2.(time.Time); !v.t.IsZero() && !t3.Equal(v.t) {
+			t.Fatalf("%s: expected %v, got %v (%T)", name, v.t, v2, v2)
+		}
+	}
+}
+
+func doTestStructFieldSet(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(iterative bool) {
+		bh.Iterative = iterative
+	}(bh.Iterative)
+
+	type T struct {
+		S []string `codec:",set"`
+		A [4]int   `codec:",set"`
+		P *[]int8  `codec:",set"`
+		N []string `codec:",set"`
+		L []string // not a set
+	}
+	type T2 struct {
+		S []string
+		A []int
+		P []int8
+		N []string
+		L []string
+	}
+	p1, p2 := []int8{3, -1, 3, 0}, []int8{0, 3, -1}
+	v1 := T{S: []string{"b", "c", "a", "b"}, A: [4]int{400, 1, 400, -2}, P: &p1, L: []string{"b", "a", "b"}}
+	v2 := T{S: []string{"a", "c", "b"}, A: [4]int{-2, 1, 1, 400}, P: &p2, L: []string{"b", "a", "b"}}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		b1 := testMarshalErr(v1, h, t, name+"-set")
+		b2 := testMarshalErr(v2, h, t, name+"-set")
+		testDeepEqualErr(b1, b2, t, name+"-set-canonical")
+
+		var v3 T2
+		testUnmarshalErr(&v3, b1, h, t, name+"-set")
+		if len(v3.S) != 3 || len(v3.A) != 3 || len(v3.P) != 3 || v3.N != nil || len(v3.L) != 3 {
+			t.Fatalf("%s: expected de-duplicated sets, got: %v", name, v3)
+		}
+		if name == "json" {
+			testDeepEqualErr(v3.S, []string{"a", "b", "c"}, t, name+"-set-sorted")
+		}
+	}
+
+	type T3 struct {
+		S [][]int `codec:",set"`
+	}
+	type T4 struct {
+		S int `codec:",set"`
+	}
+	for _, v := range []interface{}{T3{S: [][]int{{1}}}, T4{S: 1}} {
+		var b []byte
+		if err := NewEncoderBytes(&b, h).Encode(v); err == nil {
+			t.Fatalf("%s: expected error encoding %T as a set", name, v)
+		}
+	}
+}
+
+func doTestEmptyArrayAsNull(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(emptyArrayAsNull, iterative bool) {
+		bh.EmptyArrayAsNull, bh.Iterative = emptyArrayAsNull, iterative
+	}(bh.EmptyArrayAsNull, bh.Iterative)
+
+	type T struct {
+		S []string
+		A [0]int
+		I []interface{}
+		M []map[string]int
+		B []byte
+		C []int `codec:",set"`
+		L []int
+	}
+	type T2 struct {
+		S []string
+		A *[0]int
+		I []interface{}
+		M []map[string]int
+		B []byte
+		C []int
+		L []int
+	}
+	v := T{S: []string{}, I: []interface{}{}, M: []map[string]int{}, B: []byte{}, C: []int{}, L: []int{1}}
+	bh.EmptyArrayAsNull = false
+	b0 := testMarshalErr(v, h, t, name+"-empty-array")
+	b2 := testMarshalErr(T2{B: []byte{}, L: []int{1}}, h, t, name+"-empty-array-expected")
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bh.EmptyArrayAsNull = true
+		b1 := testMarshalErr(v, h, t, name+"-empty-array-as-null")
+		testDeepEqualErr(b1, b2, t, name+"-empty-array-as-null")
+		var v2 T
+		testUnmarshalErr(&v2, b1, h, t, name+"-empty-array-as-null")
+		if v2.S != nil || v2.I != nil || v2.C != nil {
+			t.Fatalf("%s: expected nil slices, got: %#v", name, v2)
+		}
+		b1 = testMarshalErr([]string{}, h, t, name+"-empty-array-as-null")
+		b3 := testMarshalErr(nil, h, t, name+"-empty-array-as-null-expected")
+		testDeepEqualErr(b1, b3, t, name+"-empty-array-as-null-top-level")
+		bh.EmptyArrayAsNull = false
+		b1 = testMarshalErr(v, h, t, name+"-empty-array")
+		testDeepEqualErr(b1, b0, t, name+"-empty-array")
+	}
+}
+
+func doTestRecordPrefixSuffix(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(prefix, suffix []byte) {
+		bh.RecordPrefix, bh.RecordSuffix = prefix, suffix
+	}(bh.RecordPrefix, bh.RecordSuffix)
+
+	v1, v2 := map[string]int{"a": 1}, []interface{}{"b", map[string]int{"c": 2}}
+	bh.RecordPrefix, bh.RecordSuffix = nil, nil
+	b1 := testMarshalErr(v1, h, t, name+"-record-expected")
+	b2 := testMarshalErr(v2, h, t, name+"-record-expected")
+
+	bh.RecordPrefix, bh.RecordSuffix = []byte("data: "), []byte("\n\n")
+	var b []byte
+	e := NewEncoderBytes(&b, h)
+	e.MustEncode(v1)
+	e.MustEncode(v2)
+	exp := "data: " + string(b1) + "\n\n" + "data: " + string(b2) + "\n\n"
+	testDeepEqualErr(string(b), exp, t, name+"-record-prefix-suffix")
+
+	// only a prefix, through a writer
+	bh.RecordSuffix = nil
+	var buf bytes.Buffer
+	testCheckErr(t, NewEncoder(&buf, h).Encode(v1))
+	testDeepEqualErr(buf.String(), "data: "+string(b1), t, name+"-record-prefix")
+
+	if jh, ok := h.(*JsonHandle); ok {
+		// the prefix comes after the BOM
+		defer func(bom bool) { jh.WriteBOM = bom }(jh.WriteBOM)
+		jh.WriteBOM = true
+		b = nil
+		testCheckErr(t, NewEncoderBytes(&b, h).Encode(v1))
+		testDeepEqualErr(string(b), "\xef\xbb\xbfdata: "+string(b1), t, name+"-record-prefix-bom")
+	}
+}
+
+func doTestEncoderResetState(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(bufsize int) { bh.WriterBufferSize = bufsize }(bh.WriterBufferSize)
+	bh.WriterBufferSize = 256
+	if bch, ok := h.(*BincHandle); ok {
+		defer func(v uint8) { bch.AsSymbols = v }(bch.AsSymbols)
+		bch.AsSymbols = 1 // so the symbol table is reused by a subsequent value
+	}
+
+	v := []map[string]int{{"aaa": 1}, {"bbb": 2}, {"aaa": 3}}
+	b1 := testMarshalErr(v, h, t, name+"-reset-state-expected")
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf, h)
+	testCheckErr(t, e.Encode(v))
+	e.ResetState()
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(buf.Bytes(), append(append([]byte{}, b1...), b1...), t, name+"-reset-state")
+
+	if name == "binc" {
+		// without ResetState, the symbols from the first value are reused
+		buf.Reset()
+		e.Reset(&buf)
+		testCheckErr(t, e.Encode(v))
+		testCheckErr(t, e.Encode(v))
+		if bytes.Equal(buf.Bytes(), append(append([]byte{}, b1...), b1...)) {
+			t.Fatalf("%s: expected symbols to be reused without ResetState", name)
+		}
+		return
+	}
+
+	if jh, ok := h.(*JsonHandle); ok {
+		defer func(bom bool) { jh.WriteBOM = bom }(jh.WriteBOM)
+		jh.WriteBOM = true
+		var b []byte
+		e = NewEncoderBytes(&b, h)
+		e.ResetState() // nothing written yet, so the BOM is still written
+		testCheckErr(t, e.Encode(v))
+		e.ResetState()
+		testCheckErr(t, e.Encode(v))
+		testDeepEqualErr(b, append(append([]byte("\xef\xbb\xbf"), b1...), b1...), t, name+"-reset-state-bom")
+	}
+}
+
+func doTestEncodeUintptr(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(allow, iterative bool) {
+		bh.AllowUintptr, bh.Iterative = allow, iterative
+	}(bh.AllowUintptr, bh.Iterative)
+
+	type T struct { // like reflect.SliceHeader
+		Data uintptr
+		Len  int
+	}
+	type T2 struct {
+		P unsafe.Pointer
+	}
+	var i int
+	x := uintptr(1)
+	enc := func(v interface{}) (err error) {
+		var b []byte
+		return NewEncoderBytes(&b, h).Encode(v)
+	}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bh.AllowUintptr = false
+		for _, v := range []interface{}{x, &x, []uintptr{x}, map[uintptr]int{x: 1}, map[string]uintptr{"a": x}, T{}, &T{}, []T{{}}} {
+			if err := enc(v); err == nil {
+				t.Fatalf("%s: expected error encoding %T without AllowUintptr", name, v)
+			}
+		}
+		if err := enc(T{}); err == nil || !strings.Contains(err.Error(), "Data") {
+			t.Fatalf("%s: expected error naming the uintptr field, got: %v", name, err)
+		}
+		bh.AllowUintptr = true
+		for _, v := range []interface{}{x, &x, []uintptr{x}, map[uintptr]int{x: 1}, T{x, 2}} {
+			testCheckErr(t, enc(v))
+		}
+		var v2 T
+		testUnmarshalErr(&v2, testMarshalErr(T{x, 2}, h, t, name+"-uintptr"), h, t, name+"-uintptr")
+		testDeepEqualErr(v2, T{x, 2}, t, name+"-uintptr")
+
+		// unsafe.Pointer always errors
+		for _, v := range []interface{}{unsafe.Pointer(&i), T2{unsafe.Pointer(&i)}, &T2{}, []T2{{}}} {
+			if err := enc(v); err == nil {
+				t.Fatalf("%s: expected error encoding %T", name, v)
+			}
+		}
+	}
+}
+
+func doTestCanonicalKeyBufHint(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical bool, hint int) {
+		bh.Canonical, bh.CanonicalKeyBufHint = canonical, hint
+	}(bh.Canonical, bh.CanonicalKeyBufHint)
+	bh.Canonical = true
+
+	type K struct {
+		A int
+		B string
+	}
+	m := make(map[K]int, 256)
+	for i := 0; i < 256; i++ {
+		m[K{i, strings.Repeat("x", i%7)}] = i
+	}
+	bh.CanonicalKeyBufHint = 0
+	b0 := testMarshalErr(m, h, t, name+"-canonical-key-buf-hint")
+	var b []byte
+	e := NewEncoderBytes(&b, h)
+	for _, hint := range []int{1, 64, -1} {
+		bh.CanonicalKeyBufHint = hint
+		for i := 0; i < 2; i++ { // the second encode reuses the pooled buffers
+			b = nil
+			e.ResetBytes(&b)
+			testCheckErr(t, e.Encode(m))
+			testDeepEqualErr(b, b0, t, fmt.Sprintf("%s-canonical-key-buf-hint-%d", name, hint))
+		}
+	}
+}
+
+func doTestEncodeToBytesBuffer(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(bufsize int) { bh.WriterBufferSize = bufsize }(bh.WriterBufferSize)
+	bh.WriterBufferSize = 16 // ignored for a *bytes.Buffer
+
+	v := []interface{}{"a", strings.Repeat("abc", 100), map[string]int{"b": 1}, int64(-2), true, 1.5}
+	b1 := testMarshalErr(v, h, t, name+"-bytes-buffer-expected")
+
+	buf := bytes.NewBufferString("xyz")
+	e := NewEncoder(buf, h)
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(buf.String(), "xyz"+string(b1), t, name+"-bytes-buffer")
+	testDeepEqualErr(e.NumBytesWritten(), len(b1), t, name+"-bytes-buffer-num-written")
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(buf.String(), "xyz"+string(b1)+string(b1), t, name+"-bytes-buffer-continuous")
+
+	// Reset to a non-bytes.Buffer writer uses the internal buffer again
+	var buf2 bytes.Buffer
+	e.Reset(struct{ io.Writer }{&buf2})
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(buf2.Bytes(), b1, t, name+"-bytes-buffer-reset")
+
+	// Close does not close the previous (non-bytes.Buffer) writer
+	e.Reset(struct{ io.Writer }{&buf2})
+	e.Reset(buf)
+	testCheckErr(t, e.Close())
+}
+
+// BenchmarkEncodeToBytesBuffer encodes to a *bytes.Buffer, written to directly,
+// against the same buffer hidden behind an io.Writer, written to through the internal buffer.
+// The value is mostly long strings, so the time is mostly spent writing (copying) them.
+func BenchmarkEncodeToBytesBuffer(b *testing.B) {
+	testOnce.Do(testInitAll)
+	// many small tokens, so the cost of each write (not of copying the bytes) dominates
+	type T struct {
+		A, B int
+		C, D bool
+		S    string
+		L    []int
+	}
+	v := make([]T, 2048)
+	for i := range v {
+		v[i] = T{i, -i, true, false, "abc", []int{1, 2, 3}}
+	}
+	for _, h := range []Handle{testJsonH, testCborH, testMsgpackH} {
+		for _, direct := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/direct=%v", h.Name(), direct), func(b *testing.B) {
+				b.ReportAllocs()
+				var buf bytes.Buffer
+				var w io.Writer = &buf
+				if !direct {
+					w = struct{ io.Writer }{&buf}
+				}
+				e := NewEncoder(w, h)
+				for i := 0; i < b.N; i++ {
+					buf.Reset()
+					e.Reset(w)
+					if err := e.Encode(v); err != nil {
+						b.Fatal(err)
+					}
+					b.SetBytes(int64(buf.Len()))
+				}
+			})
+		}
+	}
+}
+
+func doTestMapKeyFilter(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical, iterative bool, filter func(reflect.Value) bool) {
+		bh.Canonical, bh.Iterative, bh.MapKeyFilter = canonical, iterative, filter
+	}(bh.Canonical, bh.Iterative, bh.MapKeyFilter)
+
+	type T struct {
+		S string
+	}
+	bh.MapKeyFilter = func(k reflect.Value) bool {
+		switch k.Kind() {
+		case reflect.String:
+			return !strings.HasPrefix(k.String(), "secret")
+		case reflect.Int:
+			return k.Int() >= 0
+		}
+		return true
+	}
+	m1 := map[string]string{"a": "1", "secret.key": "x", "b": "2", "secret": "y"} // fastpath
+	m2 := map[string]T{"a": {"1"}, "secret": {"x"}, "b": {"2"}}                   // reflection
+	m3 := map[int]bool{1: true, -1: false, 2: false}
+	m4 := map[string]int{"secret": 1}
+	for _, canonical := range []bool{false, true} {
+		for _, iterative := range []bool{false, true} {
+			bh.Canonical, bh.Iterative = canonical, iterative
+			var v1 map[string]string
+			testUnmarshalErr(&v1, testMarshalErr(m1, h, t, name+"-map-key-filter"), h, t, name+"-map-key-filter")
+			testDeepEqualErr(v1, map[string]string{"a": "1", "b": "2"}, t, name+"-map-key-filter-fastpath")
+			var v2 map[string]T
+			testUnmarshalErr(&v2, testMarshalErr(m2, h, t, name+"-map-key-filter"), h, t, name+"-map-key-filter")
+			testDeepEqualErr(v2, map[string]T{"a": {"1"}, "b": {"2"}}, t, name+"-map-key-filter-reflection")
+			var v3 map[int]bool
+			testUnmarshalErr(&v3, testMarshalErr(m3, h, t, name+"-map-key-filter"), h, t, name+"-map-key-filter")
+			testDeepEqualErr(v3, map[int]bool{1: true, 2: false}, t, name+"-map-key-filter-int")
+			testDeepEqualErr(testMarshalErr(m4, h, t, name+"-map-key-filter"),
+				testMarshalErr(map[string]int{}, h, t, name+"-map-key-filter"), t, name+"-map-key-filter-all")
+			if canonical {
+				testDeepEqualErr(testMarshalErr(m1, h, t, name+"-map-key-filter"),
+					testMarshalErr(testMbsT{"a", "1", "b", "2"}, h, t, name+"-map-key-filter"), t, name+"-map-key-filter-canonical")
+			}
+		}
+	}
+}
+
+func doTestOnUnsupported(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(iterative bool, fn func(reflect.Value) (interface{}, bool)) {
+		bh.Iterative, bh.OnUnsupported = iterative, fn
+	}(bh.Iterative, bh.OnUnsupported)
+
+	type T struct {
+		P unsafe.Pointer
+		I int
+	}
+	var i int
+	fn := func(int) {}
+	var calls int
+	bh.OnUnsupported = func(rv reflect.Value) (interface{}, bool) {
+		calls++
+		switch rv.Kind() {
+		case reflect.Func:
+			return "func", true
+		case reflect.UnsafePointer:
+			if rv.Pointer() == 0 {
+				return nil, false
+			}
+			return unsafe.Pointer(&i), true // unsupported substitute
+		}
+		return nil, false
+	}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		testDeepEqualErr(testMarshalErr([]interface{}{fn, 1}, h, t, name+"-on-unsupported"),
+			testMarshalErr([]interface{}{"func", 1}, h, t, name+"-on-unsupported-expected"), t, name+"-on-unsupported-func")
+		testDeepEqualErr(testMarshalErr(map[string]interface{}{"f": fn}, h, t, name+"-on-unsupported"),
+			testMarshalErr(map[string]interface{}{"f": "func"}, h, t, name+"-on-unsupported-expected"), t, name+"-on-unsupported-func-map")
+
+		// the substitute for a non-nil unsafe.Pointer is itself unsupported, so errors (without recursing)
+		for _, v := range []interface{}{unsafe.Pointer(&i), &T{P: unsafe.Pointer(&i)}, &T{}} {
+			calls = 0
+			var b []byte
+			if err := NewEncoderBytes(&b, h).Encode(v); err == nil {
+				t.Fatalf("%s: expected error encoding %T", name, v)
+			}
+			testDeepEqualErr(calls, 1, t, name+"-on-unsupported-calls")
+		}
+	}
+
+	// without a substitute, a func is encoded as nil
+	bh.OnUnsupported = func(rv reflect.Value) (interface{}, bool) { return nil, false }
+	testDeepEqualErr(testMarshalErr([]interface{}{fn}, h, t, name+"-on-unsupported"),
+		testMarshalErr([]interface{}{nil}, h, t, name+"-on-unsupported-expected"), t, name+"-on-unsupported-none")
+}
+
+func doTestEncoderResetMulti(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(bufsize int) { bh.WriterBufferSize = bufsize }(bh.WriterBufferSize)
+	bh.WriterBufferSize = 64 // so there are multiple flushes
+
+	v := []interface{}{"a", strings.Repeat("abc", 100), int64(-2), true}
+	b1 := testMarshalErr(v, h, t, name+"-reset-multi-expected")
+
+	var buf1, buf2 bytes.Buffer
+	e := NewEncoder(nil, h)
+	e.ResetMulti(&buf1, ioWriterWrapper{&buf2})
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(buf1.Bytes(), b1, t, name+"-reset-multi-1")
+	testDeepEqualErr(buf2.Bytes(), b1, t, name+"-reset-multi-2")
+
+	// an error in any writer is returned
+	buf1.Reset()
+	e.ResetMulti(&buf1, new(testErrWriter))
+	err := e.Encode(v)
+	if ev, ok := err.(*codecError); ok {
+		err = ev.Cause()
+	}
+	if err != testErrWriterErr {
+		t.Fatalf("%s: expected testErrWriterErr, got: %v", name, err)
+	}
+
+	// no writers is an error, rather than discarding the output
+	e.ResetMulti()
+	if err = e.Encode(v); err != errEncoderNoWriters {
+		t.Fatalf("%s: expected errEncoderNoWriters, got: %v", name, err)
+	}
+	buf1.Reset()
+	e.ResetMulti(&buf1)
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(buf1.Bytes(), b1, t, name+"-reset-multi-after-none")
+}
+
+func doTestStructUnexportedEmbedded(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+
+	type base struct{ X int }
+	type T struct {
+		base
+		Y int
+	}
+	type TP struct {
+		*base
+		Y int
+	}
+	type TN struct {
+		base `codec:"b"`
+		Y    int
+	}
+	type T2 struct {
+		X int
+		Y int
+	}
+	type T2N struct {
+		B T2 `codec:"b"`
+		Y int
+	}
+
+	// the exported fields of base are promoted, as in encoding/json
+	b := testMarshalErr(T{base{1}, 2}, h, t, name+"-embedded")
+	var v2 T2
+	testUnmarshalErr(&v2, b, h, t, name+"-embedded")
+	testDeepEqualErr(v2, T2{1, 2}, t, name+"-embedded")
+
+	var v T
+	testUnmarshalErr(&v, testMarshalErr(T2{3, 4}, h, t, name+"-embedded"), h, t, name+"-embedded")
+	testDeepEqualErr(v, T{base{3}, 4}, t, name+"-embedded")
+
+	b = testMarshalErr(TP{&base{1}, 2}, h, t, name+"-embedded-ptr")
+	v2 = T2{}
+	testUnmarshalErr(&v2, b, h, t, name+"-embedded-ptr")
+	testDeepEqualErr(v2, T2{1, 2}, t, name+"-embedded-ptr")
+
+	vp := TP{base: &base{}}
+	testUnmarshalErr(&vp, testMarshalErr(T2{3, 4}, h, t, name+"-embedded-ptr"), h, t, name+"-embedded-ptr")
+	testDeepEqualErr(vp, TP{&base{3}, 4}, t, name+"-embedded-ptr")
+
+	// a nil pointer to an unexported struct cannot be set, so decoding into it fails
+	vp = TP{}
+	err := NewDecoderBytes(testMarshalErr(T2{3, 4}, h, t, name+"-embedded-ptr"), h).Decode(&vp)
+	if err == nil || !strings.Contains(err.Error(), "embedded pointer to unexported struct") {
+		t.Fatalf("%s: expected error decoding into nil embedded pointer, got: %v", name, err)
+	}
+
+	// a name in the struct tag makes it a named field
+	b = testMarshalErr(TN{base{1}, 2}, h, t, name+"-embedded-named")
+	var v2n T2N
+	testUnmarshalErr(&v2n, b, h, t, name+"-embedded-named")
+	testDeepEqualErr(v2n, T2N{T2{X: 1}, 2}, t, name+"-embedded-named")
+}
+
+func doTestEncodeErrorPath(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(iterative, canonical bool) {
+		bh.Iterative, bh.Canonical = iterative, canonical
+	}(bh.Iterative, bh.Canonical)
+
+	type Meta struct {
+		TS interface{} `codec:"ts"`
+	}
+	type Item struct {
+		Meta Meta `codec:"meta"`
+	}
+	type Root struct {
+		Items []Item `codec:"items"`
+	}
+	type Pair struct {
+		_struct bool        `codec:",toarray"`
+		X, Y    interface{} // Y is second
+	}
+	v := Root{Items: make([]Item, 5)}
+	bad := make(chan<- int) // a send-only channel cannot be encoded
+	v.Items[3].Meta.TS = bad
+
+	for _, x := range []struct {
+		v    interface{}
+		path string
+	}{
+		{v, "items[3].meta.ts"},
+		{map[string]interface{}{"a": 1, "bad": bad}, "bad"},
+		{map[int]interface{}{7: bad}, "[7]"},
+		{map[string][]interface{}{"k": {1, bad}}, "k[1]"},
+		{[]interface{}{1, []interface{}{bad}}, "[1][0]"},
+		{[2]interface{}{nil, bad}, "[1]"},
+		{map[string]Meta{"m": {TS: bad}}, "m.ts"},
+		{map[int8]Meta{3: {TS: bad}}, "[3].ts"},
+		{[]Pair{{}, {Y: bad}}, "[1].Y"},
+	} {
+		for _, iterative := range []bool{false, true} {
+			for _, canonical := range []bool{false, true} {
+				bh.Iterative, bh.Canonical = iterative, canonical
+				var b []byte
+				err := NewEncoderBytes(&b, h).Encode(x.v)
+				if err == nil || !strings.Contains(err.Error(), "error: "+x.path+": ") {
+					t.Fatalf("%s: iterative=%v, canonical=%v: expected error with path %s, got: %v",
+						name, iterative, canonical, x.path, err)
+				}
+			}
+		}
+	}
+	bh.Canonical = false
+
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		var b []byte
+		e := NewEncoderBytes(&b, h)
+		err := e.Encode(v)
+		if err == nil || !strings.Contains(err.Error(), "items[3].meta.ts: ") {
+			t.Fatalf("%s: expected error with path items[3].meta.ts, got: %v", name, err)
+		}
+
+		// the path is cleared on Reset
+		e.ResetBytes(&b)
+		err = e.Encode(make(chan<- int))
+		if ev, ok := err.(*codecError); !ok || ev.path != "" {
+			t.Fatalf("%s: expected error without a path, got: %v", name, err)
+		}
+	}
+}
+
+func doTestTaggedInterfaces(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	type Circle struct{ Radius int }
+	type Square struct{ Side int }
+	type T struct {
+		A []interface{}
+		B interface{}
+		C map[string]interface{}
+	}
+	h0 := h
+	h = testHandleUninited(h)
+	bh := testBasicHandle(h)
+	bh.TaggedInterfaces = true
+	testCheckErr(t, bh.RegisterCompactType(1, &Circle{}))
+	testCheckErr(t, bh.RegisterCompactType(2, Square{}))
+	testCheckErr(t, bh.RegisterCompactType(3, ""))
+	if err := bh.RegisterCompactType(1, Square{}); err == nil {
+		t.Fatalf("%s: expected error registering an id for 2 types", name)
+	}
+
+	v := T{
+		A: []interface{}{&Circle{2}, Square{3}, nil, "s"},
+		B: Circle{4},
+		C: map[string]interface{}{"c": Square{5}},
+	}
+	v2 := T{
+		A: []interface{}{
+			[]interface{}{uint8(1), Circle{2}},
+			[]interface{}{uint8(2), Square{3}},
+			nil,
+			[]interface{}{uint8(3), "s"},
+		},
+		B: []interface{}{uint8(1), Circle{4}},
+		C: map[string]interface{}{"c": []interface{}{uint8(2), Square{5}}},
+	}
+	b2 := testMarshalErr(v2, h0, t, name+"-tagged-intf")
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		b := testMarshalErr(v, h, t, name+"-tagged-intf")
+		testDeepEqualErr(b, b2, t, name+"-tagged-intf-cmp")
+	}
+
+	// values of unregistered types cannot be tagged
+	var b []byte
+	err := NewEncoderBytes(&b, h).Encode(T{B: 1.5})
+	if err == nil || !strings.Contains(err.Error(), "no compact type registered") {
+		t.Fatalf("%s: expected error encoding unregistered type, got: %v", name, err)
+	}
+}
+
+func doTestBoolAsInt(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(boolAsInt, iterative bool) {
+		bh.BoolAsInt, bh.Iterative = boolAsInt, iterative
+	}(bh.BoolAsInt, bh.Iterative)
+
+	type T struct {
+		A, B bool
+		P    *bool
+		S    []bool
+		M    map[bool]int
+		I    interface{}
+	}
+	type T2 struct {
+		A, B uint
+		P    *uint
+		S    []uint
+		M    map[uint]int
+		I    interface{}
+	}
+	vtrue, utrue := true, uint(1)
+	v := T{A: true, P: &vtrue, S: []bool{false, true}, M: map[bool]int{true: 2}, I: true}
+	b2 := testMarshalErr(T2{A: 1, P: &utrue, S: []uint{0, 1}, M: map[uint]int{1: 2}, I: uint(1)}, h, t, name+"-bool-as-int")
+
+	bh.BoolAsInt = true
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		b := testMarshalErr(v, h, t, name+"-bool-as-int")
+		testDeepEqualErr(b, b2, t, name+"-bool-as-int-cmp")
+		if name == "json" {
+			testDeepEqualErr(testMarshalErr(true, h, t, name+"-bool-as-int"), []byte("1"), t, name+"-bool-as-int-json")
+		}
+
+		// integers 0 and 1 decode as bools
+		var v2 T
+		testUnmarshalErr(&v2, b, h, t, name+"-bool-as-int-dec")
+		v2.I = v.I // decoded as an integer, as there is no bool type to decode into
+		testDeepEqualErr(v2, v, t, name+"-bool-as-int-dec-cmp")
+	}
+
+	var v3 bool
+	if err := testUnmarshal(&v3, testMarshalErr(2, h, t, name+"-bool-as-int"), h); err == nil {
+		t.Fatalf("%s: expected error decoding 2 as a bool", name)
+	}
+}
+
+func doTestEncodeContext(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(mkf func(reflect.Value) bool) {
+		bh.MapKeyFilter = mkf
+	}(bh.MapKeyFilter)
+
+	v := []map[string]int{{"a": 1}, {"b": 2}}
+	b := testMarshalErr(v, h, t, name+"-encode-context")
+
+	// a context which cannot be canceled
+	var b2 []byte
+	testCheckErr(t, NewEncoderBytes(&b2, h).EncodeContext(context.Background(), v))
+	testDeepEqualErr(b2, b, t, name+"-encode-context-background")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := NewEncoderBytes(&b2, h).EncodeContext(ctx, v)
+	if err != context.Canceled {
+		t.Fatalf("%s: expected context.Canceled, got: %v", name, err)
+	}
+
+	// cancel mid-encode (after the array is started, but before the first map is):
+	// the context is checked at the start of each container.
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	var n int
+	bh.MapKeyFilter = func(k reflect.Value) bool {
+		if n++; n == 1 {
+			cancel()
+		}
+		return true
+	}
+	e := NewEncoderBytes(&b2, h)
+	err = e.EncodeContext(ctx, v)
+	if err != context.Canceled {
+		t.Fatalf("%s: expected context.Canceled mid-encode, got: %v", name, err)
+	}
+	if n != 1 {
+		t.Fatalf("%s: expected encode to stop at the first map, but saw %d keys", name, n)
+	}
+
+	// the encoder can be reused after a Reset
+	bh.MapKeyFilter = nil
+	e.ResetBytes(&b2)
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(b2, b, t, name+"-encode-context-reset")
+}
+
+func doTestRegisterDecimal(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	type Dec struct {
+		Exp  int64
+		Mant string
+	}
+	h = testHandleUninited(h)
+	bh := testBasicHandle(h)
+	testCheckErr(t, bh.RegisterDecimal(reflect.TypeOf(&Dec{}), func(v interface{}) (exp int64, m *big.Int, err error) {
+		d := v.(Dec)
+		m, ok := new(big.Int).SetString(d.Mant, 10)
+		if !ok {
+			err = errors.New("invalid mantissa: " + d.Mant)
+		}
+		return d.Exp, m, err
+	}))
+
+	for _, v := range []struct {
+		d    Dec
+		s    string // decimal notation
+		cbor []byte
+	}{
+		{Dec{-2, "27315"}, "273.15", []byte{0xc4, 0x82, 0x21, 0x19, 0x6a, 0xb3}},
+		{Dec{-3, "-5"}, "-0.005", []byte{0xc4, 0x82, 0x22, 0x24}},
+		{Dec{2, "12"}, "1200", []byte{0xc4, 0x82, 0x02, 0x0c}},
+		{Dec{0, "0"}, "0", []byte{0xc4, 0x82, 0x00, 0x00}},
+		{Dec{-2, "0"}, "0.00", []byte{0xc4, 0x82, 0x21, 0x00}},
+		{Dec{-100, "5"}, "5e-100", []byte{0xc4, 0x82, 0x38, 0x63, 0x05}},
+		{Dec{0, "18446744073709551616"}, "18446744073709551616", // 2^64
+			[]byte{0xc4, 0x82, 0x00, 0xc2, 0x49, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{Dec{0, "-18446744073709551617"}, "-18446744073709551617", // -1 - 2^64
+			[]byte{0xc4, 0x82, 0x00, 0xc3, 0x49, 0x01, 0, 0, 0, 0, 0, 0, 0, 0}},
+	} {
+		var b []byte
+		testCheckErr(t, NewEncoderBytes(&b, h).Encode(&v.d))
+		switch name {
+		case "cbor":
+			testDeepEqualErr(b, v.cbor, t, name+"-decimal-"+v.s)
+		case "json":
+			testDeepEqualErr(string(b), v.s, t, name+"-decimal-"+v.s)
+		default:
+			testDeepEqualErr(b, testMarshalErr(v.s, h, t, name+"-decimal"), t, name+"-decimal-"+v.s)
+		}
+	}
+
+	// an error from the DecimalFunc fails the encode
+	var b []byte
+	if err := NewEncoderBytes(&b, h).Encode(Dec{0, "x"}); err == nil || !strings.Contains(err.Error(), "invalid mantissa") {
+		t.Fatalf("%s: expected error from DecimalFunc, got: %v", name, err)
+	}
+}
+
+func doTestEmptyStructHandling(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(esh EmptyStructHandling, iterative, s2a bool) {
+		bh.EmptyStructHandling, bh.Iterative, bh.StructToArray = esh, iterative, s2a
+	}(bh.EmptyStructHandling, bh.Iterative, bh.StructToArray)
+	s2a := bh.StructToArray
+
+	type T struct {
+		E struct{}
+		F struct{} `codec:",omitempty"`
+	}
+	set := map[string]struct{}{"a": {}}
+	var empty interface{} = map[string]int{}
+	if s2a {
+		empty = []int{}
+	}
+	bsSetMap := testMarshalErr(map[string]interface{}{"a": empty}, h, t, name+"-empty-struct")
+	bsSetNil := testMarshalErr(map[string]interface{}{"a": nil}, h, t, name+"-empty-struct")
+	bsNil := testMarshalErr(nil, h, t, name+"-empty-struct")
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+
+		bh.EmptyStructHandling = EmptyStructAsEmptyMap
+		testDeepEqualErr(testMarshalErr(set, h, t, name+"-empty-struct"), bsSetMap, t, name+"-empty-struct-as-map")
+
+		bh.EmptyStructHandling = EmptyStructAsNil
+		testDeepEqualErr(testMarshalErr(set, h, t, name+"-empty-struct"), bsSetNil, t, name+"-empty-struct-as-nil")
+		testDeepEqualErr(testMarshalErr(struct{}{}, h, t, name+"-empty-struct"), bsNil, t, name+"-empty-struct-as-nil-top")
+
+		// a nil decodes into an empty struct
+		var set2 map[string]struct{}
+		testUnmarshalErr(&set2, bsSetNil, h, t, name+"-empty-struct-dec")
+		testDeepEqualErr(set2, set, t, name+"-empty-struct-dec")
+
+		// a field is omitted if omitempty, else encoded as nil
+		var v2 map[string]interface{}
+		bh.StructToArray = false
+		testUnmarshalErr(&v2, testMarshalErr(T{}, h, t, name+"-empty-struct"), h, t, name+"-empty-struct-dec")
+		bh.StructToArray = s2a
+		testDeepEqualErr(v2, map[string]interface{}{"E": nil}, t, name+"-empty-struct-field")
+	}
+}
+
+func doTestJsonNumberFormatter(t *testing.T, h *JsonHandle) {
+	defer testSetup(t, nil)()
+	h = testHandleCopy(h).(*JsonHandle)
+	h.Indent, h.StructToArray, h.Canonical, h.MapKeyAsString = 0, false, false, true
+	sep := func(s string) string { // 1234567 => 1,234,567
+		var b []byte
+		for i := range s {
+			if i != 0 && (len(s)-i)%3 == 0 {
+				b = append(b, ',')
+			}
+			b = append(b, s[i])
+		}
+		return string(b)
+	}
+	h.NumberFormatter = func(f float64) string { return strconv.FormatFloat(f, 'f', 2, 64) }
+	h.IntFormatter = func(i int64) string { return sep(strconv.FormatInt(i, 10)) }
+	h.UintFormatter = func(u uint64) string { return "u" + strconv.FormatUint(u, 10) }
+
+	type T struct {
+		I int
+		U uint
+		F float32
+		M map[int64]float64
+	}
+	b := testMarshalErr(T{1234567, 42, 1.5, map[int64]float64{1000: 0.125}}, h, t, "json-number-formatter")
+	testDeepEqualErr(string(b), `{"I":1,234,567,"U":u42,"F":1.50,"M":{"1,000":0.12}}`, t, "json-number-formatter")
+
+	// nil means standard
+	h.NumberFormatter, h.IntFormatter, h.UintFormatter = nil, nil, nil
+	b = testMarshalErr(T{1234567, 42, 1.5, nil}, h, t, "json-number-formatter")
+	testDeepEqualErr(string(b), `{"I":1234567,"U":42,"F":1.5,"M":null}`, t, "json-number-formatter-nil")
+}
+
+func doTestStructFieldOrder(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(iterative bool) { bh.Iterative = iterative }(bh.Iterative)
+
+	type E struct {
+		N string
+		K int `codec:"k"`
+	}
+	type T struct {
+		R  []int  `codec:",reverse"`
+		A  [3]int `codec:",reverse"`
+		S  []E    `codec:",sortby=k"`
+		SR []*E   `codec:",sortby=k,reverse"`
+		P  *[]E   `codec:",sortby=k"`
+	}
+	type U struct {
+		R  []int
+		A  [3]int
+		S  []E
+		SR []*E
+		P  *[]E
+	}
+	es := []E{{"a", 2}, {"b", 1}, {"c", 2}, {"d", 0}}
+	v := T{
+		R:  []int{1, 2, 3},
+		A:  [3]int{4, 5, 6},
+		S:  es,
+		SR: []*E{&es[0], &es[1], &es[2], &es[3]},
+		P:  &es,
+	}
+	sorted := []E{{"d", 0}, {"b", 1}, {"a", 2}, {"c", 2}}
+	u := U{
+		R:  []int{3, 2, 1},
+		A:  [3]int{6, 5, 4},
+		S:  sorted,
+		SR: []*E{&es[0], &es[2], &es[1], &es[3]}, // stable: a before c
+		P:  &sorted,
+	}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-order"), testMarshalErr(u, h, t, name+"-order"), t, name+"-order")
+		// the value being encoded is not modified
+		testDeepEqualErr(es[0], E{"a", 2}, t, name+"-order-unmodified")
+
+		type X struct {
+			S []string `codec:",sortby=k"`
+		}
+		_, err := testMarshal(X{S: []string{"a"}}, h)
+		if err == nil || !strings.Contains(err.Error(), "expected struct elements") {
+			t.Fatalf("%s: expected error for sortby on non-struct elements, got: %v", name, err)
+		}
+		type Y struct {
+			S []*E `codec:",sortby=k"`
+		}
+		_, err = testMarshal(Y{S: []*E{nil}}, h)
+		if err == nil || !strings.Contains(err.Error(), "nil element") {
+			t.Fatalf("%s: expected error for sortby with nil element, got: %v", name, err)
+		}
+	}
+}
+
+func doTestEncodeMerged(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical bool) { bh.Canonical = canonical }(bh.Canonical)
+
+	type A struct {
+		X int
+		Y string
+	}
+	type B struct {
+		Y string
+		Z int `codec:",omitempty"`
+	}
+	type C struct {
+		X int
+		Y string
+		Z int
+		W []int
+	}
+	fnEnc := func(vs ...interface{}) (bs []byte, err error) {
+		err = NewEncoderBytes(&bs, h).EncodeMerged(vs...)
+		return
+	}
+	bs, err := fnEnc(A{1, "a"}, &B{"b", 0}, (*B)(nil), B{Y: "c", Z: 3})
+	testCheckErr(t, err)
+	var c C
+	testUnmarshalErr(&c, bs, h, t, name+"-merged")
+	testDeepEqualErr(c, C{X: 1, Y: "c", Z: 3}, t, name+"-merged")
+
+	// Canonical sorts the merged keys together
+	bh.Canonical = true
+	bs, err = fnEnc(B{"b", 3}, A{1, "a"})
+	testCheckErr(t, err)
+	testDeepEqualErr(bs, testMarshalErr(map[string]interface{}{"X": 1, "Y": "a", "Z": 3}, h, t, name+"-merged"), t, name+"-merged-canonical")
+
+	// an empty merge is an empty map
+	bs, err = fnEnc()
+	testCheckErr(t, err)
+	testDeepEqualErr(bs, testMarshalErr(map[string]interface{}{}, h, t, name+"-merged"), t, name+"-merged-empty")
+
+	_, err = fnEnc(A{}, 1)
+	if err == nil || !strings.Contains(err.Error(), "expected a struct at index 1") {
+		t.Fatalf("%s: expected error for non-struct value, got: %v", name, err)
+	}
+}
+
+func doTestSchemaVersion(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(ver uint64, key string, s2a, iterative, canonical bool) {
+		bh.SchemaVersion, bh.SchemaVersionKey, bh.StructToArray, bh.Iterative, bh.Canonical = ver, key, s2a, iterative, canonical
+	}(bh.SchemaVersion, bh.SchemaVersionKey, bh.StructToArray, bh.Iterative, bh.Canonical)
+	canonical := bh.Canonical
+
+	type In struct {
+		B int
+	}
+	type T struct {
+		A  string
+		In In
+	}
+	type TV struct {
+		V  uint64 `codec:"_version"`
+		A  string
+		In In
+	}
+	v := T{"a", In{1}}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bh.SchemaVersion = 0
+		bh.StructToArray = false
+		// the version is the first entry, and nested structs are not affected
+		bh.Canonical = false
+		bs0 := testMarshalErr(TV{3, "a", In{1}}, h, t, name+"-version")
+		bh.SchemaVersion = 3
+		testDeepEqualErr(testMarshalErr(&v, h, t, name+"-version"), bs0, t, name+"-version-map")
+		bh.Canonical = canonical
+		bs := testMarshalErr(&v, h, t, name+"-version")
+		var v2 TV
+		testUnmarshalErr(&v2, bs, h, t, name+"-version-map")
+		testDeepEqualErr(v2, TV{3, "a", In{1}}, t, name+"-version-map")
+
+		// as an array, the version is the first element
+		bh.StructToArray = true
+		var v3 []interface{}
+		testUnmarshalErr(&v3, testMarshalErr(v, h, t, name+"-version"), h, t, name+"-version-array")
+		if len(v3) != 3 || len(v3[2].([]interface{})) != 1 {
+			t.Fatalf("%s: expected [version, a, [b]], got: %v", name, v3)
+		}
+		testDeepEqualErr(fmt.Sprint(v3[0]), "3", t, name+"-version-array")
+
+		// a field with the same name is an error
+		bh.StructToArray = false
+		bh.SchemaVersionKey = "A"
+		_, err := testMarshal(v, h)
+		if err == nil || !strings.Contains(err.Error(), "is a field of") {
+			t.Fatalf("%s: expected error for colliding schema version key, got: %v", name, err)
+		}
+		bh.SchemaVersionKey = ""
+	}
+}
+
+func doTestEncodeNoFlush(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(bufsize int) { bh.WriterBufferSize = bufsize }(bh.WriterBufferSize)
+	bh.WriterBufferSize = 256
+
+	v := []interface{}{"a", "aaa", []interface{}{"x", "y"}}
+	bs0 := testMarshalErr(v, h, t, name+"-no-flush")
+
+	// the body stays buffered, so a header can be written ahead of it
+	var buf bytes.Buffer
+	e := NewEncoder(struct{ io.Writer }{&buf}, h)
+	testCheckErr(t, e.EncodeNoFlush(v))
+	testDeepEqualErr(buf.Len(), 0, t, name+"-no-flush-buffered")
+	n := e.NumBytesWritten()
+	testDeepEqualErr(n, len(bs0), t, name+"-no-flush-len")
+	buf.WriteByte(byte(n))
+	testCheckErr(t, e.Flush())
+	testDeepEqualErr(buf.Bytes(), append([]byte{byte(n)}, bs0...), t, name+"-no-flush-framed")
+
+	// Encode still flushes
+	buf.Reset()
+	e.Reset(struct{ io.Writer }{&buf})
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(buf.Bytes(), bs0, t, name+"-flush")
+
+	// into a []byte, the output is updated as usual
+	var bs []byte
+	testCheckErr(t, NewEncoderBytes(&bs, h).EncodeNoFlush(v))
+	testDeepEqualErr(bs, bs0, t, name+"-no-flush-bytes")
+}
+
+func doTestCanonicalIntfKeys(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical bool) { bh.Canonical = canonical }(bh.Canonical)
+	bh.Canonical = true
+
+	nan := math.NaN()
+	v := map[interface{}]interface{}{
+		"b": 1, [2]int{1, 2}: 2, "a": 3, uint8(3): 4, 1.5: 5, int64(-2): 6,
+		true: 7, false: 9, nil: 10, int8(1): 11, uint64(1): 12,
+	}
+	// nil, bools, numbers (by value), strings, then others
+	expect := testMbsT{
+		nil, 10, false, 9, true, 7, int64(-2), 6, nil, nil, nil, nil, 1.5, 5, uint8(3), 4,
+		"a", 3, "b", 1, [2]int{1, 2}, 2,
+	}
+	// int8(1) and uint64(1) are equal by value, so are ordered by their encoded bytes, then type name
+	k1, k2 := testMarshalErr(int8(1), h, t, name+"-intf-keys"), testMarshalErr(uint64(1), h, t, name+"-intf-keys")
+	if bytes.Compare(k1, k2) <= 0 {
+		expect[8], expect[9], expect[10], expect[11] = int8(1), 11, uint64(1), 12
+	} else {
+		expect[8], expect[9], expect[10], expect[11] = uint64(1), 12, int8(1), 11
+	}
+	testDeepEqualErr(testMarshalErr(v, h, t, name+"-intf-keys"), testMarshalErr(expect, h, t, name+"-intf-keys"), t, name+"-intf-keys")
+
+	_, err := testMarshal(map[interface{}]interface{}{"a": 1, nan: 2}, h)
+	if err == nil || !strings.Contains(err.Error(), "NaN map key") {
+		t.Fatalf("%s: expected error for NaN map key, got: %v", name, err)
+	}
+}
+
+func doTestStructUnwrap(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(iterative bool) { bh.Iterative = iterative }(bh.Iterative)
+
+	type ID struct {
+		V    string `codec:",unwrap,omitempty"`
+		note string
+	}
+	type Tags struct {
+		List []string `codec:",unwrap"`
+		Skip int
+	}
+	type T struct {
+		ID   ID
+		PID  *ID
+		Tags Tags
+	}
+	v := T{ID{"a", ""}, &ID{"b", ""}, Tags{List: []string{"x", "y"}, Skip: 1}}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bs := testMarshalErr(v, h, t, name+"-unwrap")
+		bs0 := testMarshalErr(struct {
+			ID   string
+			PID  string
+			Tags []string
+		}{"a", "b", []string{"x", "y"}}, h, t, name+"-unwrap")
+		testDeepEqualErr(bs, bs0, t, name+"-unwrap")
+		testDeepEqualErr(testMarshalErr(ID{}, h, t, name+"-unwrap"), testMarshalErr("", h, t, name+"-unwrap"), t, name+"-unwrap-empty")
+
+		var v2 T
+		testUnmarshalErr(&v2, bs, h, t, name+"-unwrap")
+		testDeepEqualErr(v2, T{ID{"a", ""}, &ID{"b", ""}, Tags{List: []string{"x", "y"}}}, t, name+"-unwrap")
+
+		type X struct {
+			A int `codec:",unwrap"`
+			B int `codec:",unwrap"`
+		}
+		_, err := testMarshal(X{}, h)
+		if err == nil || !strings.Contains(err.Error(), "more than 1 field tagged unwrap") {
+			t.Fatalf("%s: expected error for multiple unwrap fields, got: %v", name, err)
+		}
+	}
+}
+
+type testWriteCloser struct {
+	bytes.Buffer
+	closed int
+}
+
+func (w *testWriteCloser) Close() error {
+	w.closed++
+	return nil
+}
+
+func doTestEncoderClose(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(bufsize int, onRelease bool) {
+		bh.WriterBufferSize, bh.CloseWriterOnRelease = bufsize, onRelease
+	}(bh.WriterBufferSize, bh.CloseWriterOnRelease)
+	bh.WriterBufferSize = 256
+
+	v := []interface{}{"a", uint64(1)}
+	bs0 := testMarshalErr(v, h, t, name+"-close")
+
+	// Close flushes and closes the writer, once
+	var w testWriteCloser
+	e := NewEncoder(&w, h)
+	testCheckErr(t, e.EncodeNoFlush(v))
+	testCheckErr(t, e.Close())
+	testCheckErr(t, e.Close())
+	testDeepEqualErr(w.Bytes(), bs0, t, name+"-close")
+	testDeepEqualErr(w.closed, 1, t, name+"-close-once")
+	if err := e.Encode(v); err == nil {
+		t.Fatalf("%s: expected error encoding after Close", name)
+	}
+
+	// each writer (which is a closer) is closed
+	var w1, w2 testWriteCloser
+	var buf bytes.Buffer
+	e.ResetMulti(&w1, &buf, &w2)
+	testCheckErr(t, e.Encode(v))
+	testCheckErr(t, e.Close())
+	testDeepEqualErr([]int{w1.closed, w2.closed}, []int{1, 1}, t, name+"-close-multi")
+
+	// Release only closes if CloseWriterOnRelease
+	var w3 testWriteCloser
+	e.Reset(&w3)
+	e.Release()
+	testDeepEqualErr(w3.closed, 0, t, name+"-close-release")
+	bh.CloseWriterOnRelease = true
+	e.Release()
+	testDeepEqualErr(w3.closed, 1, t, name+"-close-release")
+
+	// no-op for a []byte
+	var bs []byte
+	e = NewEncoderBytes(&bs, h)
+	testCheckErr(t, e.Encode(v))
+	testCheckErr(t, e.Close())
+	testDeepEqualErr(bs, bs0, t, name+"-close-bytes")
+}
+
+func doTestStringToRawMapKeys(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(raw, canonical bool) { bh.StringToRaw, bh.Canonical = raw, canonical }(bh.StringToRaw, bh.Canonical)
+	bh.StringToRaw = true
+
+	// string map keys are encoded like []byte, so invalid UTF-8 is preserved.
+	// a map[string]T goes through a fast-path, so check the reflection path (map[S]T) also.
+	type S string
+	k := "\xffa"
+	_, isJson := h.(*JsonHandle)
+	for _, canonical := range []bool{false, true} {
+		bh.Canonical = canonical
+		if isJson {
+			// json object keys are strings: an error for invalid UTF-8, else written as-is
+			for _, v := range []interface{}{map[string]int{k: 1}, map[S]int{S(k): 1}} {
+				_, err := testMarshal(v, h)
+				if err == nil || !strings.Contains(err.Error(), "invalid UTF-8") {
+					t.Fatalf("%s: expected an invalid UTF-8 map key error, got: %v", name, err)
+				}
+			}
+			bh.StringToRaw = false
+			bs0 := testMarshalErr(map[string]string{"a": "Yg=="}, h, t, name+"-raw-keys") // base64 of "b"
+			bh.StringToRaw = true
+			bs := testMarshalErr(map[string][]byte{"a": []byte("b")}, h, t, name+"-raw-keys")
+			testDeepEqualErr(bs, bs0, t, name+"-raw-keys")
+			bs = testMarshalErr(map[S]string{"a": "b"}, h, t, name+"-raw-keys-named")
+			testDeepEqualErr(bs, bs0, t, name+"-raw-keys-named")
+			continue
+		}
+		bs := testMarshalErr(map[string]int{k: 1}, h, t, name+"-raw-keys")
+		bs0 := testMarshalErr(testMbsT{[]byte(k), 1}, h, t, name+"-raw-keys")
+		testDeepEqualErr(bs, bs0, t, name+"-raw-keys")
+		testDeepEqualErr(testMarshalErr(map[S]int{S(k): 1}, h, t, name+"-raw-keys"), bs0, t, name+"-raw-keys-named")
+	}
+}
+
+func doTestStructFieldPad(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(iterative bool) { bh.Iterative = iterative }(bh.Iterative)
+
+	type T struct {
+		A int    `codec:",pad=3"`
+		B int8   `codec:",pad=3"`
+		C uint64 `codec:",pad=2"`
+		D *int   `codec:",pad=4"`
+		E *int   `codec:",pad=4"`
+	}
+	type TS struct {
+		A, B, C, D string
+		E          *int
+	}
+	d := 42
+	v := T{7, -7, 12345, &d, nil}
+	_, isJson := h.(*JsonHandle)
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bs := testMarshalErr(v, h, t, name+"-pad")
+		if isJson {
+			// zero-padded (including the sign), and not truncated if wider
+			testDeepEqualErr(bs, testMarshalErr(TS{"007", "-07", "12345", "0042", nil}, h, t, name+"-pad"), t, name+"-pad-json")
+		} else {
+			// other formats are not affected
+			testDeepEqualErr(bs, testMarshalErr(struct {
+				A int
+				B int8
+				C uint64
+				D *int
+				E *int
+			}(v), h, t, name+"-pad"), t, name+"-pad")
+		}
+		var v2 T
+		testUnmarshalErr(&v2, bs, h, t, name+"-pad")
+		testDeepEqualErr(v2, v, t, name+"-pad")
+	}
+	if isJson {
+		type X struct {
+			S string `codec:",pad=3"`
+		}
+		_, err := testMarshal(X{"a"}, h)
+		if err == nil || !strings.Contains(err.Error(), "not an integer") {
+			t.Fatalf("%s: expected error padding a non-integer, got: %v", name, err)
+		}
+	}
+
+	// an invalid width is an error in the struct tag
+	type PadAbc struct {
+		A int `codec:",pad=abc"`
+	}
+	type Pad300 struct {
+		A int `codec:",pad=300"` // overflows a uint8
+	}
+	for _, v := range []interface{}{PadAbc{1}, Pad300{1}} {
+		_, err := testMarshal(v, h)
+		if err == nil || !strings.Contains(err.Error(), "invalid option") || !strings.Contains(err.Error(), "field A") {
+			t.Fatalf("%s: expected error for an invalid pad width in %T, got: %v", name, v, err)
+		}
+	}
+}
+
+func doTestEncodeMapFunc(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical bool) { bh.Canonical = canonical }(bh.Canonical)
+	bh.Canonical = false
+
+	fnEnc := func(length int, fn func(emit func(k, v interface{}) error) error) (bs []byte, err error) {
+		err = NewEncoderBytes(&bs, h).EncodeMapFunc(length, fn)
+		return
+	}
+	entries := func(n int) func(emit func(k, v interface{}) error) error {
+		return func(emit func(k, v interface{}) error) error {
+			for i := 1; i <= n; i++ {
+				if err := emit(uint64(i), []interface{}{"x", uint64(i)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	bs0 := testMarshalErr(testMbsT{uint64(1), []interface{}{"x", uint64(1)}, uint64(2), []interface{}{"x", uint64(2)}}, h, t, name+"-map-func")
+	bs, err := fnEnc(2, entries(2))
+	testCheckErr(t, err)
+	testDeepEqualErr(bs, bs0, t, name+"-map-func")
+
+	// a length of -1 is only supported by json and cbor
+	bs, err = fnEnc(-1, entries(2))
+	switch h.(type) {
+	case *JsonHandle:
+		testCheckErr(t, err)
+		var m map[uint64][]interface{}
+		testUnmarshalErr(&m, bs, h, t, name+"-map-func-indefinite")
+		testDeepEqualErr(len(m), 2, t, name+"-map-func-indefinite")
+	case *CborHandle:
+		testCheckErr(t, err)
+		bs, err = fnEnc(-1, func(emit func(k, v interface{}) error) error { return emit(uint64(1), uint64(2)) })
+		testCheckErr(t, err)
+		testDeepEqualErr(bs, []byte{0xbf, 0x01, 0x02, 0xff}, t, name+"-map-func-indefinite")
+	default:
+		if err == nil || !strings.Contains(err.Error(), "unknown length") {
+			t.Fatalf("%s: expected error for unknown length, got: %v", name, err)
+		}
+	}
+
+	// entries must match the declared length
+	var errEmit error
+	_, err = fnEnc(1, func(emit func(k, v interface{}) error) error {
+		emit(uint64(1), uint64(1))
+		errEmit = emit(uint64(2), uint64(2))
+		return nil
+	})
+	testDeepEqualErr(errEmit, errMapFuncTooManyEntries, t, name+"-map-func-too-many")
+	if _, err = fnEnc(3, entries(2)); err == nil || !strings.Contains(err.Error(), "emitted 2 entries") {
+		t.Fatalf("%s: expected error for too few entries, got: %v", name, err)
+	}
+
+	// the error from fn is returned as-is
+	errFn := errors.New("cursor failed")
+	_, err = fnEnc(2, func(emit func(k, v interface{}) error) error { return errFn })
+	testDeepEqualErr(err, errFn, t, name+"-map-func-fn-error")
+
+	bh.Canonical = true
+	if _, err = fnEnc(2, entries(2)); err == nil || !strings.Contains(err.Error(), "Canonical") {
+		t.Fatalf("%s: expected error when Canonical, got: %v", name, err)
+	}
+}
+
+func doTestJsonNullToken(t *testing.T, h *JsonHandle) {
+	defer testSetup(t, nil)()
+	h = testHandleCopy(h).(*JsonHandle)
+	h.Indent, h.StructToArray, h.Canonical = 0, false, false
+
+	type T struct {
+		P *int
+		S []int
+		M map[string]int
+		I interface{}
+		N int
+	}
+	h.NullToken = []byte(`"NULL"`)
+	bs := testMarshalErr(T{N: 1}, h, t, "json-null-token")
+	testDeepEqualErr(string(bs), `{"P":"NULL","S":"NULL","M":"NULL","I":"NULL","N":1}`, t, "json-null-token")
+	testDeepEqualErr(string(testMarshalErr([]interface{}{nil, math.NaN()}, h, t, "json-null-token")), `["NULL","NULL"]`, t, "json-null-token-array")
+
+	h.NullToken = []byte("null")
+	testDeepEqualErr(string(testMarshalErr(T{N: 1}, h, t, "json-null-token")), `{"P":null,"S":null,"M":null,"I":null,"N":1}`, t, "json-null-token-null")
+
+	for _, v := range []string{"NULL", `"a"b"`, `"a\"`, `"`} {
+		h.NullToken = []byte(v)
+		if _, err := testMarshal(nil, h); err == nil || !strings.Contains(err.Error(), "invalid NullToken") {
+			t.Fatalf("expected error for invalid NullToken %s, got: %v", v, err)
+		}
+	}
+}
+
+type testLazyFunc func() (interface{}, error)
+
+func doTestCallLazyFuncs(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+
+	type T struct {
+		A    int
+		L    func() (interface{}, error)
+		N    testLazyFunc
+		Z    func() (interface{}, error)
+		F    func() int // not a lazy func, so skipped
+		l    func() (interface{}, error)
+		Last string
+	}
+	var calls int
+	v := T{
+		A:    1,
+		L:    func() (interface{}, error) { calls++; return []interface{}{"x", uint64(2)}, nil },
+		N:    func() (interface{}, error) { return "n", nil },
+		F:    func() int { return 0 },
+		Last: "z",
+	}
+	type TS struct {
+		A    int
+		L    []interface{}
+		N    string
+		Z    *int
+		Last string
+	}
+	bs0 := testMarshalErr(TS{1, []interface{}{"x", uint64(2)}, "n", nil, "z"}, h, t, name+"-lazy")
+
+	// by default, func fields are skipped
+	bs := testMarshalErr(v, h, t, name+"-lazy")
+	testDeepEqualErr(calls, 0, t, name+"-lazy-default")
+	testDeepEqualErr(bs, testMarshalErr(struct {
+		A    int
+		Last string
+	}{1, "z"}, h, t, name+"-lazy"), t, name+"-lazy-default")
+
+	h = testHandleUninited(h)
+	bh := testBasicHandle(h)
+	bh.CallLazyFuncs = true
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bs = testMarshalErr(v, h, t, name+"-lazy")
+		testDeepEqualErr(bs, bs0, t, name+"-lazy")
+		// the lazy values are skipped when decoding
+		var v2 T
+		testUnmarshalErr(&v2, bs, h, t, name+"-lazy")
+		testDeepEqualErr([]interface{}{v2.A, v2.L == nil, v2.Last}, []interface{}{1, true, "z"}, t, name+"-lazy-decode")
+	}
+	testDeepEqualErr(calls, 2, t, name+"-lazy-calls")
+
+	// also a lazy func held in an interface
+	testDeepEqualErr(testMarshalErr([]interface{}{v.N}, h, t, name+"-lazy"), testMarshalErr([]interface{}{"n"}, h, t, name+"-lazy"), t, name+"-lazy-intf")
+
+	// an error or panic aborts the encode
+	errLazy := errors.New("lazy failed")
+	_, err := testMarshal(T{L: func() (interface{}, error) { return nil, errLazy }}, h)
+	if err == nil || !strings.Contains(err.Error(), errLazy.Error()) {
+		t.Fatalf("%s: expected error from lazy func, got: %v", name, err)
+	}
+	_, err = testMarshal(T{L: func() (interface{}, error) { panic("boom") }}, h)
+	if err == nil || !strings.Contains(err.Error(), "panicked: boom") {
+		t.Fatalf("%s: expected error from lazy func panic, got: %v", name, err)
+	}
+}
+
+type testEncodeAsArrayT struct {
+	Arr bool
+	A   int
+	O   string `codec:",omitempty"`
+}
+
+func (x testEncodeAsArrayT) CodecEncodeAsArray() bool { return x.Arr }
+
+type testEncodeAsArrayPtrT struct {
+	Arr bool
+	A   int
+}
+
+func (x *testEncodeAsArrayPtrT) CodecEncodeAsArray() bool { return x.Arr }
+
+func doTestStructEncodeAsArray(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(b, i bool) { bh.StructToArray, bh.Iterative = b, i }(bh.StructToArray, bh.Iterative)
+
+	var bs []byte
+	var vi interface{}
+	for _, toArray := range []bool{false, true} {
+		for _, iterative := range []bool{false, true} {
+			bh.StructToArray, bh.Iterative = toArray, iterative
+			for _, arr := range []bool{false, true} {
+				v := testEncodeAsArrayT{Arr: arr, A: 1}
+				bs = testMarshalErr(v, h, t, name+"-asarray")
+				vi = nil
+				testUnmarshalErr(&vi, bs, h, t, name+"-asarray")
+				xs, isArr := vi.([]interface{})
+				testDeepEqualErr(isArr, arr, t, name+"-asarray-kind")
+				if isArr {
+					// omitempty is not honored in array mode
+					testDeepEqualErr(len(xs), 3, t, name+"-asarray-len")
+				} else {
+					testDeepEqualErr(reflect.ValueOf(vi).Len(), 2, t, name+"-asarray-len")
+				}
+				var v2 testEncodeAsArrayT
+				testUnmarshalErr(&v2, bs, h, t, name+"-asarray")
+				testDeepEqualErr(v2, v, t, name+"-asarray")
+
+				vp := testEncodeAsArrayPtrT{Arr: arr, A: 2}
+				for _, x := range []interface{}{vp, &vp, []testEncodeAsArrayPtrT{vp}} {
+					bs = testMarshalErr(x, h, t, name+"-asarray-ptr")
+					vi = nil
+					testUnmarshalErr(&vi, bs, h, t, name+"-asarray-ptr")
+					if xs, ok := vi.([]interface{}); ok && len(xs) == 1 {
+						vi = xs[0]
+					}
+					_, isArr = vi.([]interface{})
+					testDeepEqualErr(isArr, arr, t, name+"-asarray-ptr-kind")
+				}
+			}
+		}
+	}
+}
+
+type testSortableT []struct {
+	A int
+	B string
+}
+
+func (x testSortableT) Len() int           { return len(x) }
+func (x testSortableT) Less(i, j int) bool { return x[i].A < x[j].A }
+func (x testSortableT) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+type testSortablePtrT []string
+
+func (x *testSortablePtrT) Len() int           { return len(*x) }
+func (x *testSortablePtrT) Less(i, j int) bool { return (*x)[i] > (*x)[j] }
+func (x *testSortablePtrT) Swap(i, j int)      { (*x)[i], (*x)[j] = (*x)[j], (*x)[i] }
+
+func doTestSortSortables(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(b, i bool) { bh.SortSortables, bh.Iterative = b, i }(bh.SortSortables, bh.Iterative)
+
+	type T struct {
+		I sort.IntSlice
+		S testSortableT
+		P testSortablePtrT
+		N []int // not sortable
+	}
+	v := T{
+		I: sort.IntSlice{3, 1, 2},
+		S: testSortableT{{2, "b"}, {1, "a"}},
+		P: testSortablePtrT{"x", "z", "y"},
+		N: []int{3, 1, 2},
+	}
+	type TS struct {
+		I []int
+		S []struct {
+			A int
+			B string
+		}
+		P []string
+		N []int
+	}
+	vs := TS{
+		I: []int{1, 2, 3},
+		S: []struct {
+			A int
+			B string
+		}{{1, "a"}, {2, "b"}},
+		P: []string{"z", "y", "x"},
+		N: []int{3, 1, 2},
+	}
+	bsSorted := testMarshalErr(vs, h, t, name+"-sortables")
+	vs.I, vs.S, vs.P = []int(v.I), v.S, []string(v.P)
+	bsUnsorted := testMarshalErr(vs, h, t, name+"-sortables")
+
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bh.SortSortables = false
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-sortables"), bsUnsorted, t, name+"-sortables-off")
+		bh.SortSortables = true
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-sortables"), bsSorted, t, name+"-sortables-on")
+		testDeepEqualErr(testMarshalErr(&v, h, t, name+"-sortables"), bsSorted, t, name+"-sortables-on-ptr")
+		// the caller's slices are not mutated
+		testDeepEqualErr(v.I, sort.IntSlice{3, 1, 2}, t, name+"-sortables-unmutated")
+		testDeepEqualErr(v.S[0].A, 2, t, name+"-sortables-unmutated")
+		testDeepEqualErr(v.P, testSortablePtrT{"x", "z", "y"}, t, name+"-sortables-unmutated")
+	}
+}
+
+func doTestFloatSpecials(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(v FloatSpecialsHandling, optimumSize bool) {
+		bh.FloatSpecials, bh.OptimumSize = v, optimumSize
+	}(bh.FloatSpecials, bh.OptimumSize)
+	bh.OptimumSize = false // so cbor does not write a half float
+
+	// the native encoding of NaN, +Inf and -Inf in each format, as a float64 and a float32.
+	// math.NaN() is 0x7ff8000000000001, and 0x7fc00000 as a float32.
+	// sNaN is a signaling NaN, whose payload is preserved (except by binc).
+	const sNaN64, sNaN32 = 0x7ff0000000000001, 0x7f800001
+	vs := []interface{}{math.NaN(), math.Inf(1), math.Inf(-1), float32(math.NaN()), float32(math.Inf(1)), float32(math.Inf(-1)),
+		math.Float64frombits(sNaN64), math.Float32frombits(sNaN32)}
+	var native [][]byte
+	var isJson bool
+	switch h.(type) {
+	case *JsonHandle:
+		isJson = true
+		for range vs {
+			native = append(native, []byte("null"))
+		}
+	case *CborHandle:
+		native = [][]byte{
+			{0xfb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1}, {0xfb, 0x7f, 0xf0, 0, 0, 0, 0, 0, 0}, {0xfb, 0xff, 0xf0, 0, 0, 0, 0, 0, 0},
+			{0xfa, 0x7f, 0xc0, 0, 0}, {0xfa, 0x7f, 0x80, 0, 0}, {0xfa, 0xff, 0x80, 0, 0},
+			{0xfb, 0x7f, 0xf0, 0, 0, 0, 0, 0, 1}, {0xfa, 0x7f, 0x80, 0, 1},
+		}
+	case *MsgpackHandle:
+		native = [][]byte{
+			{0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1}, {0xcb, 0x7f, 0xf0, 0, 0, 0, 0, 0, 0}, {0xcb, 0xff, 0xf0, 0, 0, 0, 0, 0, 0},
+			{0xca, 0x7f, 0xc0, 0, 0}, {0xca, 0x7f, 0x80, 0, 0}, {0xca, 0xff, 0x80, 0, 0},
+			{0xcb, 0x7f, 0xf0, 0, 0, 0, 0, 0, 1}, {0xca, 0x7f, 0x80, 0, 1},
+		}
+	case *SimpleHandle:
+		native = [][]byte{
+			{5, 0x7f, 0xf8, 0, 0, 0, 0, 0, 1}, {5, 0x7f, 0xf0, 0, 0, 0, 0, 0, 0}, {5, 0xff, 0xf0, 0, 0, 0, 0, 0, 0},
+			{4, 0x7f, 0xc0, 0, 0}, {4, 0x7f, 0x80, 0, 0}, {4, 0xff, 0x80, 0, 0},
+			{5, 0x7f, 0xf0, 0, 0, 0, 0, 0, 1}, {4, 0x7f, 0x80, 0, 1},
+		}
+	case *BincHandle: // a special value each, for NaN, +Inf and -Inf
+		native = [][]byte{{3}, {4}, {5}, {3}, {4}, {5}, {3}, {3}}
+	}
+
+	for i, v := range vs {
+		// FloatSpecialsAsNullJSON (default): null in json, natively otherwise
+		bh.FloatSpecials = FloatSpecialsAsNullJSON
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-floatspecials-null-json"), native[i], t, fmt.Sprintf("%s-floatspecials-null-json-%d", name, i))
+
+		// FloatSpecialsPreserveNative: natively, or an error in json
+		bh.FloatSpecials = FloatSpecialsPreserveNative
+		if isJson {
+			if _, err := testMarshal(v, h); err == nil {
+				t.Fatalf("%s: expected error encoding %v with FloatSpecialsPreserveNative", name, v)
+			}
+		} else {
+			testDeepEqualErr(testMarshalErr(v, h, t, name+"-floatspecials-native"), native[i], t, fmt.Sprintf("%s-floatspecials-native-%d", name, i))
+		}
+
+		// FloatSpecialsError: an error in all formats
+		bh.FloatSpecials = FloatSpecialsError
+		if _, err := testMarshal(v, h); err == nil {
+			t.Fatalf("%s: expected error encoding %v with FloatSpecialsError", name, v)
+		}
+	}
+
+	// regular floats are not affected
+	for _, fs := range []FloatSpecialsHandling{FloatSpecialsAsNullJSON, FloatSpecialsPreserveNative, FloatSpecialsError} {
+		bh.FloatSpecials = fs
+		var f2 float64
+		testUnmarshalErr(&f2, testMarshalErr(-2.5, h, t, name+"-floatspecials-regular"), h, t, name+"-floatspecials-regular")
+		testDeepEqualErr(f2, -2.5, t, name+"-floatspecials-regular")
+	}
+
+	// the payload of a signaling NaN is decoded back, except by binc
+	bh.FloatSpecials = FloatSpecialsPreserveNative
+	switch h.(type) {
+	case *CborHandle, *MsgpackHandle, *SimpleHandle:
+		var f2 float64
+		testUnmarshalErr(&f2, native[6], h, t, name+"-floatspecials-snan")
+		testDeepEqualErr(math.Float64bits(f2), uint64(sNaN64), t, name+"-floatspecials-snan")
+	}
+}
+
+type testMapKVSelfer struct{ N uint64 }
+
+func (x *testMapKVSelfer) CodecEncodeSelf(e *Encoder) {
+	// written as a hand-built map, within an entry of another one
+	for _, err := range []error{e.EncodeMapStart(1), e.EncodeMapKV("n", x.N), e.EncodeMapEnd()} {
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (x *testMapKVSelfer) CodecDecodeSelf(d *Decoder) {
+	var m map[string]uint64
+	d.MustDecode(&m)
+	x.N = m["n"]
+}
+
+func doTestEncodeMapKV(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical bool) { bh.Canonical = canonical }(bh.Canonical)
+	bh.Canonical = false
+
+	bs0 := testMarshalErr(testMbsT{uint64(1), []interface{}{"x", uint64(1)}, uint64(2), []interface{}{"x", uint64(2)}}, h, t, name+"-map-kv")
+	kvEnc := func(length, n int) (bs []byte, err error) {
+		e := NewEncoderBytes(&bs, h)
+		if err = e.EncodeMapStart(length); err != nil {
+			return
+		}
+		for i := 1; i <= n; i++ {
+			if err = e.EncodeMapKV(uint64(i), []interface{}{"x", uint64(i)}); err != nil {
+				return
+			}
+		}
+		err = e.EncodeMapEnd()
+		return
+	}
+	bs, err := kvEnc(2, 2)
+	testCheckErr(t, err)
+	testDeepEqualErr(bs, bs0, t, name+"-map-kv")
+
+	// a length of -1 is only supported by json and cbor
+	bs, err = kvEnc(-1, 2)
+	switch h.(type) {
+	case *JsonHandle, *CborHandle:
+		testCheckErr(t, err)
+		var m map[uint64][]interface{}
+		testUnmarshalErr(&m, bs, h, t, name+"-map-kv-indefinite")
+		testDeepEqualErr(len(m), 2, t, name+"-map-kv-indefinite")
+	default:
+		if err == nil || !strings.Contains(err.Error(), "unknown length") {
+			t.Fatalf("%s: expected error for unknown length, got: %v", name, err)
+		}
+	}
+
+	// entries must match the declared length
+	_, err = kvEnc(1, 2)
+	testDeepEqualErr(err, errMapFuncTooManyEntries, t, name+"-map-kv-too-many")
+	if _, err = kvEnc(3, 2); err == nil || !strings.Contains(err.Error(), "emitted 2 entries") {
+		t.Fatalf("%s: expected error for too few entries, got: %v", name, err)
+	}
+
+	// calls outside a map started by EncodeMapStart are errors
+	e := NewEncoderBytes(&bs, h)
+	testDeepEqualErr(e.EncodeMapKV("a", 1), errNoOpenMap, t, name+"-map-kv-not-open")
+	testDeepEqualErr(e.EncodeMapEnd(), errNoOpenMap, t, name+"-map-kv-not-open")
+	testCheckErr(t, e.EncodeMapStart(0))
+	testDeepEqualErr(e.EncodeMapStart(0), errOpenMapNeedsKey, t, name+"-map-kv-needs-key")
+	testCheckErr(t, e.EncodeMapEnd())
+	testDeepEqualErr(e.EncodeMapEnd(), errNoOpenMap, t, name+"-map-kv-not-open")
+
+	// a hand-built map can be nested within the value of an entry
+	bs = nil
+	e = NewEncoderBytes(&bs, h)
+	testCheckErr(t, e.EncodeMapStart(2))
+	testCheckErr(t, e.EncodeMapKV("A", &testMapKVSelfer{N: 7}))
+	testCheckErr(t, e.EncodeMapKV("B", []interface{}{&testMapKVSelfer{N: 8}}))
+	testCheckErr(t, e.EncodeMapEnd())
+	var v2 struct {
+		A testMapKVSelfer
+		B []testMapKVSelfer
+	}
+	testUnmarshalErr(&v2, bs, h, t, name+"-map-kv-nested")
+	testDeepEqualErr(v2.A.N, uint64(7), t, name+"-map-kv-nested")
+	testDeepEqualErr(v2.B, []testMapKVSelfer{{8}}, t, name+"-map-kv-nested")
+
+	// each map is a single value in the stream
+	bs = nil
+	e = NewEncoderBytes(&bs, h)
+	for i := 0; i < 2; i++ {
+		testCheckErr(t, e.EncodeMapStart(1))
+		testCheckErr(t, e.EncodeMapKV("n", uint64(i)))
+		testCheckErr(t, e.EncodeMapEnd())
+	}
+	d := NewDecoderBytes(bs, h)
+	for i := 0; i < 2; i++ {
+		var m map[string]uint64
+		testCheckErr(t, d.Decode(&m))
+		testDeepEqualErr(m["n"], uint64(i), t, name+"-map-kv-sequence")
+	}
+}
+
+func doTestFrameLengthPrefix(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(v FrameLengthPrefix, fs FloatSpecialsHandling) {
+		bh.FrameLengthPrefix, bh.FloatSpecials = v, fs
+	}(bh.FrameLengthPrefix, bh.FloatSpecials)
+
+	// a Selfer encoding via nested calls is still a single frame
+	vs := []interface{}{[]interface{}{"a", uint64(1)}, &testMapKVSelfer{N: 7}}
+	var bs0 [][]byte
+	for _, v := range vs {
+		bs0 = append(bs0, testMarshalErr(v, h, t, name+"-frame"))
+	}
+	for _, prefix := range []FrameLengthPrefix{FrameVarint, FrameFixed32BE, FrameFixed32LE} {
+		bh.FrameLengthPrefix = prefix
+		var bsBytes []byte
+		var buf bytes.Buffer
+		for _, e := range []*Encoder{NewEncoderBytes(&bsBytes, h), NewEncoder(struct{ io.Writer }{&buf}, h)} {
+			for _, v := range vs {
+				testCheckErr(t, e.Encode(v))
+			}
+		}
+		for _, bs := range [][]byte{bsBytes, buf.Bytes()} {
+			for i := range vs {
+				var n, m int
+				switch prefix {
+				case FrameVarint:
+					var u uint64
+					u, m = DecodeVarint(bs)
+					n = int(u)
+				case FrameFixed32BE:
+					n, m = int(bigen.Uint32([4]byte{bs[0], bs[1], bs[2], bs[3]})), 4
+				case FrameFixed32LE:
+					n, m = int(bs[0])|int(bs[1])<<8|int(bs[2])<<16|int(bs[3])<<24, 4
+				}
+				testDeepEqualErr(bs[m:m+n], bs0[i], t, name+"-frame")
+				bs = bs[m+n:]
+			}
+			testDeepEqualErr(len(bs), 0, t, name+"-frame-end")
+		}
+	}
+
+	// a value which fails to encode is not written, so the stream can continue after ResetState
+	bh.FrameLengthPrefix = FrameNone
+	b1, b2 := testMarshalErr(uint64(1), h, t, name+"-frame"), testMarshalErr(uint64(2), h, t, name+"-frame")
+	bh.FrameLengthPrefix = FrameFixed32BE
+	var bs []byte
+	e := NewEncoderBytes(&bs, h)
+	testCheckErr(t, e.Encode(uint64(1)))
+	bh.FloatSpecials = FloatSpecialsError
+	if err := e.Encode([]interface{}{"a", math.NaN()}); err == nil {
+		t.Fatalf("%s: expected error encoding NaN with FloatSpecialsError", name)
+	}
+	bh.FloatSpecials = FloatSpecialsAsNullJSON
+	e.ResetState()
+	testCheckErr(t, e.Encode(uint64(2)))
+	testDeepEqualErr(bs, append(append(append([]byte{0, 0, 0, byte(len(b1))}, b1...), 0, 0, 0, byte(len(b2))), b2...), t, name+"-frame-error")
+}
+
+func doTestMapKeyHandle(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(kh Handle, canonical, iterative bool) {
+		bh.KeyHandle, bh.Canonical, bh.Iterative = kh, canonical, iterative
+	}(bh.KeyHandle, bh.Canonical, bh.Iterative)
+
+	type K struct {
+		A int
+		B string
+	}
+	kh := &JsonHandle{}
+	kh.Canonical = true
+	v := map[string]interface{}{
+		"a": map[K]int{{1, "x"}: 1, {2, "y"}: 2},
+		"b": map[int]string{1: "one", 10: "ten"},
+	}
+	// expected, with the keys encoded as json
+	var bs0 []byte
+	bh.Canonical = false
+	e := NewEncoderBytes(&bs0, h)
+	testCheckErr(t, e.EncodeMapStart(2))
+	testCheckErr(t, e.EncodeMapKV(`"a"`, testMbsT{`{"A":1,"B":"x"}`, 1, `{"A":2,"B":"y"}`, 2}))
+	testCheckErr(t, e.EncodeMapKV(`"b"`, testMbsT{`1`, "one", `10`, "ten"}))
+	testCheckErr(t, e.EncodeMapEnd())
+
+	bh.KeyHandle = kh
+	bh.Canonical = true
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bs := testMarshalErr(v, h, t, name+"-keyhandle")
+		testDeepEqualErr(bs, bs0, t, name+"-keyhandle")
+
+		var v2 map[string]map[string]interface{}
+		testUnmarshalErr(&v2, bs, h, t, name+"-keyhandle")
+		testDeepEqualErr(len(v2[`"a"`]), 2, t, name+"-keyhandle")
+		testDeepEqualErr(len(v2[`"b"`]), 2, t, name+"-keyhandle")
+	}
+
+	// not Canonical: the entries are in random order, but all the keys are encoded via KeyHandle
+	bh.Canonical = false
+	var v3 map[string]string
+	testUnmarshalErr(&v3, testMarshalErr(map[string]string{"x": "1", "y": "2"}, h, t, name+"-keyhandle"), h, t, name+"-keyhandle")
+	testDeepEqualErr(v3, map[string]string{`"x"`: "1", `"y"`: "2"}, t, name+"-keyhandle")
+
+	// struct field names are not affected
+	var v4 struct{ M map[string]int }
+	testUnmarshalErr(&v4, testMarshalErr(struct{ M map[int]int }{map[int]int{1: 2}}, h, t, name+"-keyhandle"), h, t, name+"-keyhandle")
+	testDeepEqualErr(v4.M, map[string]int{"1": 2}, t, name+"-keyhandle")
+}
+
+func doTestStructFieldRequires(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(a, i bool) { bh.StructToArray, bh.Iterative = a, i }(bh.StructToArray, bh.Iterative)
+	bh.StructToArray = false
+
+	type T struct {
+		Detail string `codec:"detail,requires=code"` // forward reference
+		Code   int    `codec:"code"`
+		Extra  string `codec:"extra,requires=detail"` // chained
+		Hint   string `codec:"hint,requires=code,omitempty"`
+	}
+	type TS struct {
+		Detail string `codec:"detail"`
+		Code   int    `codec:"code"`
+		Extra  string `codec:"extra"`
+		Hint   string `codec:"hint"`
+	}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		for _, v := range []T{
+			{"bad input", 400, "x", "retry"},
+			{"", 400, "x", ""},
+			{"bad input", 0, "x", "retry"},
+			{"", 0, "", ""},
+		} {
+			var vm map[string]interface{}
+			testUnmarshalErr(&vm, testMarshalErr(v, h, t, name+"-requires"), h, t, name+"-requires")
+			var keys []string
+			for k := range vm {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			var want []string
+			if v.Code != 0 {
+				want = append(want, "code", "detail")
+				if v.Detail != "" {
+					want = append(want, "extra")
+				}
+				if v.Hint != "" {
+					want = append(want, "hint")
+				}
+				sort.Strings(want)
+			} else {
+				want = []string{"code"}
+			}
+			testDeepEqualErr(keys, want, t, name+"-requires")
+
+			var v2 TS
+			testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-requires"), h, t, name+"-requires")
+			if v.Code != 0 {
+				testDeepEqualErr(v2.Detail, v.Detail, t, name+"-requires")
+			}
+		}
+	}
+
+	// requires is ignored when encoding as an array
+	bh.StructToArray = true
+	v := T{Detail: "d"}
+	testDeepEqualErr(testMarshalErr(v, h, t, name+"-requires-array"),
+		testMarshalErr(TS{Detail: "d"}, h, t, name+"-requires-array"), t, name+"-requires-array")
+	bh.StructToArray = false
+
+	// an unknown field or a cycle is an error
+	if _, err := testMarshal(struct {
+		A int `codec:"a,requires=b"`
+	}{}, h); err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Fatalf("%s: expected error for requires of an unknown field, got: %v", name, err)
+	}
+	if _, err := testMarshal(struct {
+		A int `codec:"a,requires=b"`
+		B int `codec:"b,requires=a"`
+	}{}, h); err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Fatalf("%s: expected error for a cycle of requires, got: %v", name, err)
+	}
+}
+
+type testSharedT struct {
+	V    int
+	Next *testSharedT
+}
+
+func doTestShareReferences(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(s, i bool) { bh.ShareReferences, bh.Iterative = s, i }(bh.ShareReferences, bh.Iterative)
+
+	x := &testSharedT{V: 1}
+	v := []interface{}{x, x, &testSharedT{V: 1}, x}
+	bh.ShareReferences = false
+	bsFull := testMarshalErr(v, h, t, name+"-share")
+	bsX := testMarshalErr(x, h, t, name+"-share")
+	_, isCbor := h.(*CborHandle)
+
+	bh.ShareReferences = true
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bs := testMarshalErr(v, h, t, name+"-share")
+		if !isCbor {
+			// only cbor supports shared references
+			testDeepEqualErr(bs, bsFull, t, name+"-share-unsupported")
+			continue
+		}
+		// the first is marked shared (0), the identical pointers refer to it,
+		// and an equal (but distinct) pointer is marked shared (1) and encoded in full
+		indefinite := bsFull[0] == 0x9f
+		want := []byte{bsFull[0], 0xd8, 28} // the array header
+		want = append(want, bsX...)
+		want = append(want, 0xd8, 29, 0x00, 0xd8, 28)
+		want = append(want, bsX...)
+		want = append(want, 0xd8, 29, 0x00)
+		if indefinite {
+			want = append(want, 0xff)
+		}
+		testDeepEqualErr(bs, want, t, name+"-share")
+
+		// each top-level value has its own shared values
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-share"), want, t, name+"-share-again")
+
+		// a cycle is encoded as a reference
+		c := &testSharedT{V: 2}
+		c.Next = c
+		bs = testMarshalErr(c, h, t, name+"-share-cycle")
+		testDeepEqualErr(bs[:2], []byte{0xd8, 28}, t, name+"-share-cycle")
+		if !bytes.Contains(bs, []byte{0xd8, 29, 0x00}) {
+			t.Fatalf("%s: expected a reference for the cycle, got: %x", name, bs)
+		}
+	}
+}
+
+func doTestValidateUTF8(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(v UTF8Validation, raw bool) {
+		bh.ValidateUTF8, bh.StringToRaw = v, raw
+	}(bh.ValidateUTF8, bh.StringToRaw)
+	bh.StringToRaw = false
+
+	const bad, fixed, good = "a\xffb\xc0", "a�b�", "héllo, 世界"
+	_, isJson := h.(*JsonHandle)
+
+	// valid strings are not affected
+	for _, v := range []UTF8Validation{UTF8PassThrough, UTF8Replace, UTF8Error} {
+		bh.ValidateUTF8 = v
+		var s string
+		testUnmarshalErr(&s, testMarshalErr(good, h, t, name+"-utf8-good"), h, t, name+"-utf8-good")
+		testDeepEqualErr(s, good, t, name+"-utf8-good")
+	}
+
+	bh.ValidateUTF8 = UTF8PassThrough
+	bs := testMarshalErr(bad, h, t, name+"-utf8-passthrough")
+	if !isJson { // json decoding may itself replace the invalid bytes
+		var s string
+		testUnmarshalErr(&s, bs, h, t, name+"-utf8-passthrough")
+		testDeepEqualErr(s, bad, t, name+"-utf8-passthrough")
+	}
+
+	bh.ValidateUTF8 = UTF8Replace
+	testDeepEqualErr(testMarshalErr(bad, h, t, name+"-utf8-replace"),
+		testMarshalErr(fixed, h, t, name+"-utf8-replace"), t, name+"-utf8-replace")
+	var vs []string
+	testUnmarshalErr(&vs, testMarshalErr([]string{bad, good}, h, t, name+"-utf8-replace"), h, t, name+"-utf8-replace")
+	testDeepEqualErr(vs, []string{fixed, good}, t, name+"-utf8-replace")
+	var vm map[string]string
+	testUnmarshalErr(&vm, testMarshalErr(map[string]string{bad: bad}, h, t, name+"-utf8-replace"), h, t, name+"-utf8-replace")
+	testDeepEqualErr(vm, map[string]string{fixed: fixed}, t, name+"-utf8-replace")
+	var vt struct{ S string }
+	testUnmarshalErr(&vt, testMarshalErr(struct{ S string }{bad}, h, t, name+"-utf8-replace"), h, t, name+"-utf8-replace")
+	testDeepEqualErr(vt.S, fixed, t, name+"-utf8-replace")
+
+	bh.ValidateUTF8 = UTF8Error
+	for _, v := range []interface{}{bad, []string{good, bad}, map[string]int{bad: 1}, struct{ S string }{bad}} {
+		if _, err := testMarshal(v, h); err == nil {
+			t.Fatalf("%s: expected error encoding %q with UTF8Error", name, v)
+		}
+	}
+
+	// strings encoded as bytes are not validated
+	bh.StringToRaw = true
+	testMarshalErr(bad, h, t, name+"-utf8-raw")
+}
+
+type testNilVsEmptyT struct {
+	S   []int
+	M   map[string]int
+	SO  []string       `codec:",omitempty"`
+	MO  map[string]int `codec:",omitempty"`
+	SS  []testNilVsEmptyT
+	Arr [0]int
+}
+
+func doTestPreserveNilVsEmpty(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(emptyAsNull, preserve bool) {
+		bh.EmptyArrayAsNull, bh.PreserveNilVsEmpty = emptyAsNull, preserve
+	}(bh.EmptyArrayAsNull, bh.PreserveNilVsEmpty)
+	bh.EmptyArrayAsNull = true
+	bh.PreserveNilVsEmpty = true
+
+	isNil := func(v interface{}) bool { return reflect.ValueOf(v).IsNil() }
+	check := func(v, v2 testNilVsEmptyT, suffix string) {
+		for i, x := range [][2]interface{}{{v.S, v2.S}, {v.M, v2.M}, {v.SO, v2.SO}, {v.MO, v2.MO}, {v.SS, v2.SS}} {
+			if isNil(x[0]) != isNil(x[1]) {
+				t.Fatalf("%s: field %d: expected nil %v, got nil %v", name+suffix, i, isNil(x[0]), isNil(x[1]))
+			}
+		}
+		testDeepEqualErr(v2, v, t, name+suffix)
+	}
+
+	// all four combinations of nil and empty, for slices and maps (with and without omitempty)
+	for _, sNil := range []bool{true, false} {
+		for _, mNil := range []bool{true, false} {
+			var v testNilVsEmptyT
+			if !sNil {
+				v.S, v.SO, v.SS = []int{}, []string{}, []testNilVsEmptyT{}
+			}
+			if !mNil {
+				v.M, v.MO = map[string]int{}, map[string]int{}
+			}
+			var v2 testNilVsEmptyT
+			testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-nilvsempty"), h, t, name+"-nilvsempty")
+			check(v, v2, fmt.Sprintf("-nilvsempty-%v-%v", sNil, mNil))
+		}
+	}
+
+	// top-level values, including through the fast-path
+	for _, v := range []interface{}{[]int(nil), []int{}, map[string]int(nil), map[string]int{}} {
+		bs := testMarshalErr(v, h, t, name+"-nilvsempty-top")
+		v2 := reflect.New(reflect.TypeOf(v))
+		testUnmarshalErr(v2.Interface(), bs, h, t, name+"-nilvsempty-top")
+		if isNil(v) != isNil(v2.Elem().Interface()) {
+			t.Fatalf("%s: %T: expected nil %v, got nil %v", name, v, isNil(v), isNil(v2.Elem().Interface()))
+		}
+	}
+	if _, ok := h.(*JsonHandle); ok {
+		// the indent options may write whitespace within the empty array
+		testDeepEqualErr(testMarshalErr([]int{}, h, t, name+"-nilvsempty-json")[0], byte('['), t, name+"-nilvsempty-json")
+		testDeepEqualErr(string(testMarshalErr([]int(nil), h, t, name+"-nilvsempty-json")), "null", t, name+"-nilvsempty-json")
+	}
+
+	// without it, EmptyArrayAsNull conflates them
+	bh.PreserveNilVsEmpty = false
+	testDeepEqualErr(testMarshalErr([]int{}, h, t, name+"-nilvsempty-off"),
+		testMarshalErr([]int(nil), h, t, name+"-nilvsempty-off"), t, name+"-nilvsempty-off")
+}
+
+func doTestEncodeWithFieldBytes(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping EncodeWithFieldBytes tests as it is not honored by codecgen")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(s2a, iterative bool, wbs int) {
+		bh.StructToArray, bh.Iterative, bh.WriterBufferSize = s2a, iterative, wbs
+	}(bh.StructToArray, bh.Iterative, bh.WriterBufferSize)
+	bh.StructToArray = false
+	bh.WriterBufferSize = 16 // so some bytes would be flushed before a field is fully encoded
+
+	type T1 struct {
+		A int
+		B string
+	}
+	type T2 struct {
+		I  int64
+		S  string
+		T  T1
+		L  []T1
+		M  map[string]uint
+		E  string `codec:",omitempty"`
+		Pi *int
+	}
+	v := T2{
+		I: -12345,
+		S: "hello",
+		T: T1{1, "one"},
+		L: []T1{{2, "two"}, {3, "three"}},
+		M: map[string]uint{"x": 9},
+	}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bs0 := testMarshalErr(&v, h, t, name+"-field-bytes")
+		var buf bytes.Buffer
+		var b []byte
+		for i, e := range []*Encoder{NewEncoderBytes(&b, h), NewEncoder(&buf, h)} {
+			fields := make(map[string][]byte)
+			err := e.EncodeWithFieldBytes(&v, func(fname string, bs []byte) {
+				fields[fname] = append([]byte(nil), bs...)
+			})
+			testCheckErr(t, err)
+			if i == 1 {
+				b = buf.Bytes()
+			}
+			testDeepEqualErr(b, bs0, t, name+"-field-bytes-output")
+			if len(fields) != 6 {
+				t.Fatalf("%s: expected 6 fields, got: %v", name, fields)
+			}
+			var v2 T2
+			for fname, fv := range map[string]interface{}{
+				"I": &v2.I, "S": &v2.S, "T": &v2.T, "L": &v2.L, "M": &v2.M, "Pi": &v2.Pi,
+			} {
+				fb, ok := fields[fname]
+				if !ok {
+					t.Fatalf("%s: no bytes for field: %s", name, fname)
+				}
+				testUnmarshalErr(fv, fb, h, t, name+"-"+fname)
+				// the bytes are exactly those of the value
+				testDeepEqualErr(bytes.Contains(bs0, fb), true, t, name+"-"+fname)
+			}
+			testDeepEqualErr(v, v2, t, name+"-field-bytes")
+			testDeepEqualErr(fields["I"], testMarshalErr(v.I, h, t, name+"-field-bytes-I"), t, name+"-field-bytes-I")
+		}
+	}
+
+	// only top-level struct fields are captured
+	var b []byte
+	var n int
+	testCheckErr(t, NewEncoderBytes(&b, h).EncodeWithFieldBytes([]T1{{1, "one"}}, func(string, []byte) { n++ }))
+	testDeepEqualErr(n, 0, t, name+"-field-bytes-slice")
+}
+
+func doTestTimeLayout(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping TimeLayout tests as it is not honored by codecgen")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(v string) { bh.TimeLayout = v }(bh.TimeLayout)
+	bh.TimeLayout = "2006-01-02"
+
+	type T struct {
+		D  time.Time
+		P  *time.Time
+		Z  time.Time
+		Ds []time.Time
+	}
+	tm := time.Date(2024, 3, 5, 14, 30, 0, 0, time.UTC)
+	day := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	bs := testMarshalErr(tm, h, t, name+"-timelayout")
+	testDeepEqualErr(bs, testMarshalErr("2024-03-05", h, t, name+"-timelayout"), t, name+"-timelayout")
+
+	v := T{D: tm, P: &tm, Ds: []time.Time{tm, tm.AddDate(0, 0, 1)}}
+	var v2 T
+	testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-timelayout"), h, t, name+"-timelayout")
+	testDeepEqualErr(v2, T{D: day, P: &day, Ds: []time.Time{day, day.AddDate(0, 0, 1)}}, t, name+"-timelayout")
+
+	// the zero time is encoded as nil
+	testDeepEqualErr(testMarshalErr(time.Time{}, h, t, name+"-timelayout-zero"),
+		testMarshalErr(nil, h, t, name+"-timelayout-zero"), t, name+"-timelayout-zero")
+
+	var t2 time.Time
+	if err := testUnmarshal(&t2, testMarshalErr("not a date", h, t, name+"-timelayout-err"), h); err == nil {
+		t.Fatalf("%s: expected error decoding an invalid date", name)
+	}
+
+	// without it, the format's native representation is used
+	bh.TimeLayout = ""
+	testUnmarshalErr(&t2, testMarshalErr(tm, h, t, name+"-timelayout-none"), h, t, name+"-timelayout-none")
+	testDeepEqualErr(t2.Equal(tm), true, t, name+"-timelayout-none")
+}
+
+type testStructSliceInner struct {
+	X int
+	Y string `codec:",omitempty"`
+}
+
+type testStructSliceElem struct {
+	testStructSliceInner
+	A  int
+	S  []string `codec:",omitempty"`
+	P  *testStructSliceInner
+	In testStructSliceInner
+}
+
+func doTestStructSliceFast(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+
+	// a slice (or array) of structs encodes exactly as the generic path (through interface{} elements)
+	v := []testStructSliceElem{
+		{testStructSliceInner{1, "a"}, 2, []string{"s"}, &testStructSliceInner{3, ""}, testStructSliceInner{4, "b"}},
+		{},
+		{A: 5, In: testStructSliceInner{Y: "c"}},
+	}
+	vi := make([]interface{}, len(v))
+	for i := range v {
+		vi[i] = v[i]
+	}
+	bs := testMarshalErr(v, h, t, name+"-struct-slice")
+	testDeepEqualErr(bs, testMarshalErr(vi, h, t, name+"-struct-slice"), t, name+"-struct-slice")
+	va := [3]testStructSliceElem{v[0], v[1], v[2]}
+	testDeepEqualErr(testMarshalErr(va, h, t, name+"-struct-array"), bs, t, name+"-struct-array")
+
+	var v2 []testStructSliceElem
+	testUnmarshalErr(&v2, bs, h, t, name+"-struct-slice")
+	testDeepEqualErr(v2, v, t, name+"-struct-slice")
+
+	// elements with pointer-receiver marshalers still go through the generic path
+	vs := []TestABC{{"a", "b", "c"}, {"d", "e", "f"}}
+	vsi := []interface{}{&vs[0], &vs[1]}
+	testDeepEqualErr(testMarshalErr(vs, h, t, name+"-struct-slice-marshaler"),
+		testMarshalErr(vsi, h, t, name+"-struct-slice-marshaler"), t, name+"-struct-slice-marshaler")
+}
+
+type testRedactT struct {
+	User     string
+	Password string          `codec:",redact"`
+	Token    *string         `codec:"tok,redact"`
+	PIN      int             `codec:",redact"`
+	Keys     map[string]int  `codec:",redact"`
+	Empty    string          `codec:",redact,omitempty"`
+	Inner    testRedactInner `codec:",redact"`
+}
+
+type testRedactInner struct{ K string }
+
+func doTestStructFieldRedact(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping redact tests as it is not honored by codecgen")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(unredact, s2a, iterative bool) {
+		bh.Unredact, bh.StructToArray, bh.Iterative = unredact, s2a, iterative
+	}(bh.Unredact, bh.StructToArray, bh.Iterative)
+
+	tok := "tok123"
+	v := testRedactT{User: "bob", Password: "secret", Token: &tok, PIN: 1234,
+		Keys: map[string]int{"a": 1}, Inner: testRedactInner{"k"}}
+	redacted := "***"
+	for _, s2a := range []bool{false, true} {
+		for _, iterative := range []bool{false, true} {
+			bh.StructToArray, bh.Iterative = s2a, iterative
+			bh.Unredact = false
+			var v2 testRedactT
+			testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-redact"), h, t, name+"-redact")
+			v3 := testRedactT{User: "bob", Password: redacted, Token: &redacted}
+			if s2a { // omitempty is ignored when encoding as an array
+				v3.Empty = redacted
+			}
+			testDeepEqualErr(v2, v3, t, name+"-redact")
+
+			// the real values are encoded with Unredact
+			bh.Unredact = true
+			v2 = testRedactT{}
+			testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-unredact"), h, t, name+"-unredact")
+			testDeepEqualErr(v2, v, t, name+"-unredact")
+		}
+	}
+
+	// omitempty applies to the real value
+	bh.StructToArray, bh.Unredact = false, false
+	var m map[string]interface{}
+	testUnmarshalErr(&m, testMarshalErr(v, h, t, name+"-redact-omitempty"), h, t, name+"-redact-omitempty")
+	if _, ok := m["Empty"]; ok {
+		t.Fatalf("%s: expected empty redacted field to be omitted, got: %v", name, m)
+	}
+	testDeepEqualErr(len(m), 6, t, name+"-redact-omitempty")
+}
+
+type testEstimateCycle struct {
+	N    int
+	Next *testEstimateCycle
+}
+
+type testEstimateTree struct{ L, R *testEstimateTree }
+
+func doTestEstimateSize(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+
+	// the estimate is within a small factor of the actual size, for typical values
+	for i, v := range []interface{}{
+		newTestStrucFlex(testDepth, testNumRepeatString, true, !testSkipIntf, testMapStringKeyOnly),
+		[]string{"a", "bb", strings.Repeat("c", 100)},
+		map[string]int{"one": 1, "two": 2, "three": 3},
+		[]int64{1, -20, 300, 4000, -50000, 600000, 7000000},
+		bytes.Repeat([]byte("x"), 1000),
+	} {
+		n, est := len(testMarshalErr(v, h, t, name+"-estimate")), EstimateSize(h, v)
+		if est < n/2 || est > n*2 {
+			t.Fatalf("%s: %d: estimate %d is not within a factor of 2 of the actual size %d", name, i, est, n)
+		}
+	}
+
+	// a chan cannot be estimated
+	testDeepEqualErr(EstimateSize(h, make(chan int)), estimateDefault, t, name+"-estimate-chan")
+
+	// a cyclic value still terminates
+	c := &testEstimateCycle{N: 1}
+	c.Next = c
+	if est := EstimateSize(h, c); est <= 0 {
+		t.Fatalf("%s: expected a positive estimate for a cyclic value, got: %d", name, est)
+	}
+
+	// a cycle through 2 pointers at each level (2^depth paths) also terminates quickly,
+	// as does a deep graph of shared (non-cyclic) pointers
+	o := &testEstimateTree{}
+	o.L, o.R = o, o
+	if est := EstimateSize(h, o); est <= 0 || est > 1024 {
+		t.Fatalf("%s: expected a small positive estimate for a cyclic tree, got: %d", name, est)
+	}
+	o = &testEstimateTree{}
+	for i := 0; i < 100; i++ {
+		o = &testEstimateTree{L: o, R: o}
+	}
+	if est := EstimateSize(h, o); est <= 0 {
+		t.Fatalf("%s: expected a positive estimate for a graph of shared pointers, got: %d", name, est)
+	}
+}
+
+// BenchmarkEstimateSize encodes into a buffer pre-sized with EstimateSize, against one
+// grown while encoding: the B/op and allocs/op (buffer grows) should be fewer for the former.
+// The estimate is computed once, as it would be for values of a similar shape.
+func BenchmarkEstimateSize(b *testing.B) {
+	testOnce.Do(testInitAll)
+	v := newTestStrucFlex(testDepth, testNumRepeatString, true, !testSkipIntf, testMapStringKeyOnly)
+	for _, h := range []Handle{testJsonH, testCborH, testMsgpackH} {
+		for _, presize := range []bool{false, true} {
+			b.Run(fmt.Sprintf("%s/presize=%v", h.Name(), presize), func(b *testing.B) {
+				var n int
+				if presize {
+					n = EstimateSize(h, v)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				var bs []byte
+				e := NewEncoderBytes(&bs, h)
+				for i := 0; i < b.N; i++ {
+					bs = make([]byte, 0, n)
+					e.ResetBytes(&bs)
+					if err := e.Encode(v); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// testTextAppenderT and testBinaryAppenderT encode differently through their appender,
+// so a test can tell which was used.
+type testTextAppenderT struct{ S string }
+
+func (x testTextAppenderT) MarshalText() ([]byte, error) { return []byte("m:" + x.S), nil }
+func (x testTextAppenderT) AppendText(b []byte) ([]byte, error) {
+	return append(append(b, "a:"...), x.S...), nil
+}
+func (x *testTextAppenderT) UnmarshalText(b []byte) error {
+	x.S = string(b)
+	return nil
+}
+
+type testBinaryAppenderT struct{ S string }
+
+func (x testBinaryAppenderT) MarshalBinary() ([]byte, error) { return []byte("m:" + x.S), nil }
+func (x testBinaryAppenderT) AppendBinary(b []byte) ([]byte, error) {
+	return append(append(b, "a:"...), x.S...), nil
+}
+func (x *testBinaryAppenderT) UnmarshalBinary(b []byte) error {
+	x.S = string(b)
+	return nil
+}
+
+func doTestMarshalAppender(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+
+	// the appender is preferred over the marshaler
+	// (text for json, binary for the binary formats)
+	vs := []testTextAppenderT{{"one"}, {"two"}, {"three"}}
+	var v interface{} = testTextAppenderT{"x"}
+	var vsi interface{} = vs
+	if testBasicHandle(h).isBe() {
+		v = testBinaryAppenderT{"x"}
+		vsi = []testBinaryAppenderT{{"one"}, {"two"}, {"three"}}
+	}
+	bs := testMarshalErr(v, h, t, name+"-appender")
+	var s string
+	testUnmarshalErr(&s, bs, h, t, name+"-appender")
+	testDeepEqualErr(s, "a:x", t, name+"-appender")
+
+	// the buffer is reused across values
+	var vs2 []string
+	testUnmarshalErr(&vs2, testMarshalErr(vsi, h, t, name+"-appender-slice"), h, t, name+"-appender-slice")
+	testDeepEqualErr(vs2, []string{"a:one", "a:two", "a:three"}, t, name+"-appender-slice")
+	if _, ok := h.(*JsonHandle); ok { // text as map keys
+		var m2 map[string]int
+		m := map[testTextAppenderT]int{{"one"}: 1, {"two"}: 2, {"three"}: 3}
+		testUnmarshalErr(&m2, testMarshalErr(m, h, t, name+"-appender-map"), h, t, name+"-appender-map")
+		testDeepEqualErr(m2, map[string]int{"a:one": 1, "a:two": 2, "a:three": 3}, t, name+"-appender-map")
+	}
+}
+
+type testUnionKind uint8
+
+type testUnionA struct{ A int }
+
+type testUnionB struct{ B string }
+
+type testUnionT struct {
+	Kind    testUnionKind `codec:"kind"`
+	Payload interface{}   `codec:"payload"`
+}
+
+func doTestUnionPayload(t *testing.T, h Handle) {
+	if codecgen {
+		t.Skipf("skipping union payload test: not honored by codecgen")
+	}
+	defer testSetup(t, &h)()
+	name := h.Name()
+	h = testHandleUninited(h)
+	bh := testBasicHandle(h)
+	rt := reflect.TypeOf(testUnionT{})
+	testCheckErr(t, bh.RegisterUnion(rt, "kind", "payload", testUnionKind(1), reflect.TypeOf(testUnionA{})))
+	testCheckErr(t, bh.RegisterUnion(rt, "kind", "payload", testUnionKind(2), reflect.TypeOf(&testUnionB{})))
+	testCheckErr(t, bh.RegisterUnion(rt, "kind", "payload", testUnionKind(3), nil))
+	if err := bh.RegisterUnion(rt, "kind", "data", testUnionKind(4), nil); err == nil {
+		t.Fatalf("%s: expected error registering a union with a different payload field", name)
+	}
+	if err := bh.RegisterUnion(reflect.TypeOf(0), "kind", "payload", testUnionKind(4), nil); err == nil {
+		t.Fatalf("%s: expected error registering a union for a non-struct", name)
+	}
+
+	good := []testUnionT{
+		{Kind: 1, Payload: testUnionA{1}},
+		{Kind: 2, Payload: &testUnionB{"b"}},
+		{Kind: 3},
+		{Kind: 1}, // nil payload
+	}
+	bad := []testUnionT{
+		{Kind: 9, Payload: testUnionA{1}},          // unknown kind
+		{Kind: 1, Payload: &testUnionA{1}},         // *T is not T
+		{Kind: 2, Payload: testUnionA{1}},          // mismatched payload
+		{Kind: 3, Payload: testUnionB{"b"}},        // kind carries no payload
+		{Kind: 1, Payload: map[string]int{"a": 1}}, // mismatched payload
+	}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bh.EnforceUnions = true
+		for i, v := range good {
+			testMarshalErr(v, h, t, fmt.Sprintf("%s-union-good-%d", name, i))
+			testMarshalErr([]testUnionT{v}, h, t, fmt.Sprintf("%s-union-good-slice-%d", name, i))
+		}
+		for i, v := range bad {
+			if _, err := testMarshal(v, h); err == nil {
+				t.Fatalf("%s: expected error encoding bad union %d: %v", name, i, v)
+			}
+			if _, err := testMarshal(map[string]testUnionT{"a": v}, h); err == nil {
+				t.Fatalf("%s: expected error encoding bad union in map %d: %v", name, i, v)
+			}
+		}
+		// without the option, unions are not checked
+		bh.EnforceUnions = false
+		for i, v := range bad {
+			testMarshalErr(v, h, t, fmt.Sprintf("%s-union-unenforced-%d", name, i))
+		}
+	}
+}
+
+func doTestMsgpackRawToStringIfUTF8(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	mh := h.(*MsgpackHandle)
+	defer func(writeExt, rawToString bool, maxLen int) {
+		mh.WriteExt, mh.RawToStringIfUTF8, mh.RawToStringIfUTF8MaxLen = writeExt, rawToString, maxLen
+	}(mh.WriteExt, mh.RawToStringIfUTF8, mh.RawToStringIfUTF8MaxLen)
+	mh.WriteExt = true
+	mh.RawToStringIfUTF8 = true
+
+	for i, v := range []struct {
+		maxLen int
+		in     []byte
+		b      []byte
+	}{
+		{0, []byte("abc"), []byte{0xa3, 'a', 'b', 'c'}},
+		{0, []byte{}, []byte{0xa0}},
+		{0, []byte{0xff, 0x01}, []byte{0xc4, 2, 0xff, 0x01}},
+		{0, []byte("héllo"), append([]byte{0xa6}, "héllo"...)},
+		{2, []byte("abc"), []byte{0xc4, 3, 'a', 'b', 'c'}}, // too long to check
+		{3, []byte("abc"), []byte{0xa3, 'a', 'b', 'c'}},
+		{0, nil, []byte{0xc0}},
+	} {
+		name := fmt.Sprintf("msgpack-raw-to-string-if-utf8-%d", i)
+		mh.RawToStringIfUTF8MaxLen = v.maxLen
+		b := testMarshalErr(v.in, h, t, name)
+		testDeepEqualErr(b, v.b, t, name)
+		var v2 []byte
+		testUnmarshalErr(&v2, b, h, t, name)
+		testDeepEqualErr(v2, v.in, t, name)
+	}
+
+	// strings are not affected
+	mh.RawToStringIfUTF8MaxLen = 0
+	testDeepEqualErr(testMarshalErr("abc", h, t, "msgpack-raw-to-string-if-utf8-string"),
+		[]byte{0xa3, 'a', 'b', 'c'}, t, "msgpack-raw-to-string-if-utf8-string")
+
+	// with the old spec, there is no distinct bin type
+	mh.WriteExt = false
+	testDeepEqualErr(testMarshalErr([]byte{0xff}, h, t, "msgpack-raw-to-string-if-utf8-old-spec"),
+		[]byte{0xa1, 0xff}, t, "msgpack-raw-to-string-if-utf8-old-spec")
+}
+
+func doTestJsonTrailingComma(t *testing.T, h *JsonHandle) {
+	defer testSetup(t, nil)()
+	h = testHandleCopy(h).(*JsonHandle)
+	h.Indent, h.StructToArray, h.Canonical = 0, false, false
+	h.TrailingComma = true
+
+	type T struct {
+		A int
+		S []int
+		M map[string]int
+	}
+	v := T{A: 1, S: []int{1, 2}, M: map[string]int{}}
+	testDeepEqualErr(string(testMarshalErr(v, h, t, "json-trailing-comma")),
+		`{"A":1,"S":[1,2,],"M":{},}`, t, "json-trailing-comma")
+	testDeepEqualErr(string(testMarshalErr([]interface{}{[]int{}, map[string]int{"a": 1}}, h, t, "json-trailing-comma")),
+		`[[],{"a":1,},]`, t, "json-trailing-comma-nested")
+	testDeepEqualErr(string(testMarshalErr([]int{}, h, t, "json-trailing-comma")), `[]`, t, "json-trailing-comma-empty")
+
+	h.Indent = 2
+	testDeepEqualErr(string(testMarshalErr(map[string][]int{"a": {1}}, h, t, "json-trailing-comma")),
+		"{\n  \"a\": [\n    1,\n  ],\n}", t, "json-trailing-comma-indent")
+
+	h.Indent = 0
+	h.StructToArray = true
+	testDeepEqualErr(string(testMarshalErr(v, h, t, "json-trailing-comma")),
+		`[1,[1,2,],{},]`, t, "json-trailing-comma-struct-to-array")
+}
+
+func doTestEncodeFields(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical, ignoreUnknown bool) {
+		bh.Canonical, bh.EncodeFieldsIgnoreUnknown = canonical, ignoreUnknown
+	}(bh.Canonical, bh.EncodeFieldsIgnoreUnknown)
+
+	type In struct {
+		B int
+		C string
+	}
+	type T struct {
+		A  int `codec:"a,omitempty"`
+		S  string
+		N  In
+		P  *In
+		Q  *In
+		Xs []int
+	}
+	fnEnc := func(v interface{}, fields ...string) (bs []byte, err error) {
+		err = NewEncoderBytes(&bs, h).EncodeFields(v, fields...)
+		return
+	}
+	v := &T{S: "s", N: In{1, "n"}, P: &In{2, "p"}, Xs: []int{1}}
+
+	// only the named fields are written (ignoring omitempty), in the order named
+	bh.Canonical = false
+	bs, err := fnEnc(v, "S", "a", "N.C", "P", "Q.B", "N.B", "S")
+	testCheckErr(t, err)
+	var m map[string]interface{}
+	testUnmarshalErr(&m, bs, h, t, name+"-fields")
+	testDeepEqualErr(len(m), 5, t, name+"-fields-len")
+	if _, ok := m["Xs"]; ok {
+		t.Fatalf("%s: expected field Xs to be skipped, got: %v", name, m)
+	}
+	var v2 T
+	testUnmarshalErr(&v2, bs, h, t, name+"-fields")
+	testDeepEqualErr(v2, T{S: "s", N: In{1, "n"}, P: &In{2, "p"}}, t, name+"-fields")
+
+	bh.Canonical = true
+	bs, err = fnEnc(v, "S", "N.C", "a")
+	testCheckErr(t, err)
+	testDeepEqualErr(bs, testMarshalErr(map[string]interface{}{"a": 0, "S": "s", "N": map[string]interface{}{"C": "n"}},
+		h, t, name+"-fields"), t, name+"-fields-canonical")
+
+	// a nil nested struct is nil, and no fields is an empty map
+	bs, err = fnEnc(v, "Q.B")
+	testCheckErr(t, err)
+	testDeepEqualErr(bs, testMarshalErr(map[string]interface{}{"Q": nil}, h, t, name+"-fields"), t, name+"-fields-nil")
+	bs, err = fnEnc(v)
+	testCheckErr(t, err)
+	testDeepEqualErr(bs, testMarshalErr(map[string]interface{}{}, h, t, name+"-fields"), t, name+"-fields-empty")
+
+	for _, fs := range [][]string{{"Z"}, {"N.Z"}, {"S.B"}} {
+		_, err = fnEnc(v, fs...)
+		if err == nil || !strings.Contains(err.Error(), "cannot encode fields") {
+			t.Fatalf("%s: expected error for fields %v, got: %v", name, fs, err)
+		}
+	}
+	_, err = fnEnc(1, "A")
+	if err == nil || !strings.Contains(err.Error(), "expected a struct") {
+		t.Fatalf("%s: expected error for non-struct value, got: %v", name, err)
+	}
+
+	bh.EncodeFieldsIgnoreUnknown = true
+	bs, err = fnEnc(v, "Z", "N.Z", "S")
+	testCheckErr(t, err)
+	testDeepEqualErr(bs, testMarshalErr(map[string]interface{}{"N": map[string]interface{}{}, "S": "s"},
+		h, t, name+"-fields"), t, name+"-fields-ignore-unknown")
+}
+
+type TestInlineMixin interface{ Mixin() }
+
+type testInlineA struct {
+	X int
+	Y string `codec:",omitempty"`
+}
+
+func (testInlineA) Mixin() {}
+
+type testInlineB int
+
+func (testInlineB) Mixin() {}
+
+type testInlineT struct {
+	Name            string
+	TestInlineMixin `codec:",inline"`
+}
+
+type testInlineNamedT struct {
+	Name            string
+	TestInlineMixin `codec:",omitempty"`
+}
+
+type testInlineOverrideT struct {
+	X               string
+	TestInlineMixin `codec:",inline"`
+}
+
+func doTestStructFieldInline(t *testing.T, h Handle) {
+	if codecgen {
+		t.Skipf("skipping inline test: not honored by codecgen")
+	}
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(toArray bool) { bh.StructToArray = toArray }(bh.StructToArray)
+	bh.StructToArray = false
+
+	fnMap := func(v interface{}) (m map[string]interface{}) {
+		testUnmarshalErr(&m, testMarshalErr(v, h, t, name+"-inline"), h, t, name+"-inline")
+		return
+	}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		// a struct (or pointer to one) is inlined
+		for _, v := range []TestInlineMixin{testInlineA{X: 1}, &testInlineA{X: 1}} {
+			m := fnMap(testInlineT{"n", v})
+			testDeepEqualErr(len(m), 2, t, name+"-inline-len")
+			if _, ok := m["X"]; !ok {
+				t.Fatalf("%s: expected inlined field X, got: %v", name, m)
+			}
+		}
+		// a nil interface is omitted
+		testDeepEqualErr(len(fnMap(testInlineT{Name: "n"})), 1, t, name+"-inline-nil")
+		// a non-struct is encoded by name
+		m := fnMap(testInlineT{"n", testInlineB(2)})
+		if _, ok := m["TestInlineMixin"]; !ok || len(m) != 2 {
+			t.Fatalf("%s: expected non-struct to be encoded by name, got: %v", name, m)
+		}
+		// a field of the enclosing struct takes precedence
+		v := testInlineOverrideT{"outer", testInlineA{X: 3, Y: "y"}}
+		testDeepEqualErr(len(fnMap(v)), 2, t, name+"-inline-override-len")
+		var v2 struct{ X, Y string }
+		testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-inline"), h, t, name+"-inline")
+		testDeepEqualErr(v2, struct{ X, Y string }{"outer", "y"}, t, name+"-inline-override")
+		// without the option, it is encoded by name
+		m = fnMap(testInlineNamedT{"n", testInlineA{X: 1}})
+		if _, ok := m["TestInlineMixin"]; !ok {
+			t.Fatalf("%s: expected embedded interface to be encoded by name, got: %v", name, m)
+		}
+	}
+	bh.Iterative = false
+
+	// decoding skips the inlined fields, as the interface cannot be set
+	var v2 testInlineT
+	testUnmarshalErr(&v2, testMarshalErr(testInlineT{"n", testInlineA{X: 1}}, h, t, name+"-inline"), h, t, name+"-inline")
+	testDeepEqualErr(v2, testInlineT{Name: "n"}, t, name+"-inline-decode")
+
+	// as an array, it is encoded by position
+	bh.StructToArray = true
+	var vs []interface{}
+	testUnmarshalErr(&vs, testMarshalErr(testInlineT{"n", testInlineA{X: 1}}, h, t, name+"-inline"), h, t, name+"-inline")
+	testDeepEqualErr(len(vs), 2, t, name+"-inline-array")
+}
+
+func doTestNetExt(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	h = testHandleUninited(h)
+	testCheckErr(t, SetNetExts(h, 100))
+
+	type T struct {
+		IP4  net.IP
+		IP16 net.IP
+		IP6  net.IP
+		Nil  net.IP
+		Net  net.IPNet
+		Net6 *net.IPNet
+		Zero net.IPNet
+		IPs  []net.IP
+	}
+	_, n4, _ := net.ParseCIDR("192.0.2.1/24")
+	n4.IP = net.IPv4(192, 0, 2, 1).To4()
+	_, n6, _ := net.ParseCIDR("2001:db8::/32")
+	v := T{
+		IP4:  net.IPv4(192, 0, 2, 1).To4(),
+		IP16: net.IPv4(10, 0, 0, 1), // 16-byte form
+		IP6:  net.ParseIP("2001:db8::1"),
+		Net:  *n4,
+		Net6: n6,
+		IPs:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	b := testMarshalErr(v, h, t, name+"-net-ext")
+	var v2 T
+	testUnmarshalErr(&v2, b, h, t, name+"-net-ext")
+	for i, ip := range [][2]net.IP{{v.IP4, v2.IP4}, {v.IP16, v2.IP16}, {v.IP6, v2.IP6}, {v.IPs[0], v2.IPs[0]}, {v.IPs[1], v2.IPs[1]}} {
+		if !ip[0].Equal(ip[1]) {
+			t.Fatalf("%s: net ext %d: expected %v, got %v", name, i, ip[0], ip[1])
+		}
+	}
+	testDeepEqualErr(v2.Nil, net.IP(nil), t, name+"-net-ext-nil")
+	testDeepEqualErr(v2.Net, v.Net, t, name+"-net-ext-ipnet")
+	testDeepEqualErr(v2.Net6, v.Net6, t, name+"-net-ext-ipnet6")
+	testDeepEqualErr(v2.Zero, net.IPNet{}, t, name+"-net-ext-zero")
+	testReleaseBytes(b)
+
+	if _, ok := h.(*JsonHandle); ok {
+		b = testMarshalErr([]interface{}{v.IP16, *n4, net.IP(nil), net.IPNet{}}, h, t, name+"-net-ext-json")
+		testDeepEqualErr(strings.Join(strings.Fields(string(b)), ""), `["10.0.0.1","192.0.2.1/24",null,""]`, t, name+"-net-ext-json")
+	}
+
+	var ip net.IP
+	if err := testUnmarshal(&ip, testMarshalErr(n4, h, t, name+"-net-ext"), h); err == nil {
+		t.Fatalf("%s: expected error decoding a CIDR into a net.IP", name)
+	}
+}
+
+type testSetKey struct{}
+
+func doTestMapSetAsArray(t *testing.T, h Handle) {
+	if codecgen {
+		t.Skipf("skipping set as array test: not honored by codecgen")
+	}
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(setAsArray, boolSetAsArray bool, filter func(reflect.Value) bool) {
+		bh.SetAsArray, bh.BoolSetAsArray, bh.MapKeyFilter = setAsArray, boolSetAsArray, filter
+	}(bh.SetAsArray, bh.BoolSetAsArray, bh.MapKeyFilter)
+
+	type T struct {
+		S map[string]struct{}
+		I map[int]testSetKey
+		B map[string]bool
+	}
+	v := T{
+		S: map[string]struct{}{"c": {}, "a": {}, "b": {}},
+		I: map[int]testSetKey{3: {}, 1: {}},
+		B: map[string]bool{"x": true, "y": false, "z": true},
+	}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bh.SetAsArray, bh.BoolSetAsArray = true, true
+		var v2 struct {
+			S []string
+			I []int
+			B []string
+		}
+		testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-set-as-array"), h, t, name+"-set-as-array")
+		sort.Strings(v2.S)
+		sort.Ints(v2.I)
+		sort.Strings(v2.B)
+		testDeepEqualErr(v2.S, []string{"a", "b", "c"}, t, name+"-set-as-array-struct")
+		testDeepEqualErr(v2.I, []int{1, 3}, t, name+"-set-as-array-named-struct")
+		testDeepEqualErr(v2.B, []string{"x", "z"}, t, name+"-set-as-array-bool")
+
+		// sorted by their encoded bytes, which for strings of the same length is their natural order
+		testDeepEqualErr(testMarshalErr(v.S, h, t, name+"-set-as-array"),
+			testMarshalErr([]string{"a", "b", "c"}, h, t, name+"-set-as-array"), t, name+"-set-as-array-sorted")
+
+		bh.MapKeyFilter = func(k reflect.Value) bool { return k.Kind() != reflect.String || k.String() != "b" }
+		var s []string
+		testUnmarshalErr(&s, testMarshalErr(v.S, h, t, name+"-set-as-array"), h, t, name+"-set-as-array")
+		sort.Strings(s)
+		testDeepEqualErr(s, []string{"a", "c"}, t, name+"-set-as-array-filter")
+		bh.MapKeyFilter = nil
+
+		// each option applies to its own kind of map
+		bh.SetAsArray, bh.BoolSetAsArray = false, true
+		var m map[string]struct{}
+		testUnmarshalErr(&m, testMarshalErr(v.S, h, t, name+"-set-as-array"), h, t, name+"-set-as-array")
+		testDeepEqualErr(m, v.S, t, name+"-set-as-array-off")
+		bh.SetAsArray, bh.BoolSetAsArray = true, false
+		var mb map[string]bool
+		testUnmarshalErr(&mb, testMarshalErr(v.B, h, t, name+"-set-as-array"), h, t, name+"-set-as-array")
+		testDeepEqualErr(mb, v.B, t, name+"-set-as-array-bool-off")
+	}
+	bh.Iterative = false
+	bh.SetAsArray = true
+	if _, ok := h.(*JsonHandle); ok {
+		testDeepEqualErr(strings.Join(strings.Fields(string(testMarshalErr(v.S, h, t, name+"-set-as-array-json"))), ""),
+			`["a","b","c"]`, t, name+"-set-as-array-json")
+	}
+}
+
+func doTestMaxCollectionElements(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(max int, canonical bool) {
+		bh.MaxCollectionElements, bh.Canonical = max, canonical
+	}(bh.MaxCollectionElements, bh.Canonical)
+	bh.MaxCollectionElements = 2
+
+	type S struct{ A int }
+	str := func(v interface{}) string {
+		switch x := v.(type) {
+		case string:
+			return x
+		case []byte:
+			return string(x)
+		}
+		return ""
+	}
+	var x []interface{}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		// slices and arrays (fastpath or not) keep their first elements, then the marker
+		for i, v := range []interface{}{[]int{1, 2, 3}, [3]int{1, 2, 3}, []S{{1}, {2}, {3}}, []int8{1, 2, 3}} {
+			x = nil
+			testUnmarshalErr(&x, testMarshalErr(v, h, t, name+"-max-elems"), h, t, name+"-max-elems")
+			testDeepEqualErr(len(x), 3, t, fmt.Sprintf("%s-max-elems-len-%d", name, i))
+			testDeepEqualErr(str(x[2]), encTruncatedMarker, t, fmt.Sprintf("%s-max-elems-marker-%d", name, i))
+		}
+		// not truncated at or below the limit
+		var xs []int
+		testUnmarshalErr(&xs, testMarshalErr([]int{1, 2}, h, t, name+"-max-elems"), h, t, name+"-max-elems")
+		testDeepEqualErr(xs, []int{1, 2}, t, name+"-max-elems-under")
+
+		// maps keep their first entries (sorted if Canonical), then the marker
+		for _, canonical := range []bool{false, true} {
+			bh.Canonical = canonical
+			for i, v := range []interface{}{
+				map[string]int{"a": 1, "b": 2, "c": 3},
+				map[string]S{"a": {1}, "b": {2}, "c": {3}},
+				map[int]int{1: 1, 2: 2, 3: 3},
+			} {
+				var m map[interface{}]interface{}
+				testUnmarshalErr(&m, testMarshalErr(v, h, t, name+"-max-elems"), h, t, name+"-max-elems")
+				testDeepEqualErr(len(m), 3, t, fmt.Sprintf("%s-max-elems-map-len-%d", name, i))
+				var found bool
+				for k, mv := range m {
+					if str(k) == encTruncatedKey {
+						found = true
+						testDeepEqualErr(str(mv), encTruncatedMarker, t, name+"-max-elems-map-marker")
+					} else if canonical && (str(k) == "c" || k == int64(3) || k == uint64(3)) {
+						t.Fatalf("%s: expected the first entries in sorted order, got: %v", name, m)
+					}
+				}
+				if !found {
+					t.Fatalf("%s: expected truncation marker in map: %v", name, m)
+				}
+			}
+		}
+		bh.Canonical = false
+	}
+	bh.Iterative = false
+
+	// structs, strings and []byte are not truncated
+	type T struct{ A, B, C int }
+	var t2 T
+	testUnmarshalErr(&t2, testMarshalErr(T{1, 2, 3}, h, t, name+"-max-elems"), h, t, name+"-max-elems")
+	testDeepEqualErr(t2, T{1, 2, 3}, t, name+"-max-elems-struct")
+	var bs []byte
+	testUnmarshalErr(&bs, testMarshalErr([]byte{1, 2, 3}, h, t, name+"-max-elems"), h, t, name+"-max-elems")
+	testDeepEqualErr(bs, []byte{1, 2, 3}, t, name+"-max-elems-bytes")
+
+	if jh, ok := h.(*JsonHandle); ok {
+		defer func(v bool) { jh.HTMLCharsAsIs = v }(jh.HTMLCharsAsIs)
+		jh.HTMLCharsAsIs = true // do not escape < and > in the marker
+		bh.Canonical = true
+		testDeepEqualErr(strings.Join(strings.Fields(string(testMarshalErr(
+			map[string][]int{"a": {1, 2, 3}, "b": nil, "c": {}}, h, t, name+"-max-elems"))), ""),
+			`{"a":[1,2,"<truncated>"],"b":null,"...":"<truncated>"}`, t, name+"-max-elems-json")
+	}
+}
+
+type testEmbedTimeT struct {
+	time.Time
+	Name string
+}
+
+type testEmbedTimeNamedT struct {
+	time.Time `codec:"at"`
+	Name      string
+}
+
+type testEmbedTimePtrT struct {
+	*time.Time
+	Name string
+}
+
+type testEmbedTimeOuterT struct {
+	testEmbedTimeT
+	N int
+}
+
+func doTestEmbeddedTime(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	fnTime := func(v interface{}) time.Time {
+		var t2 time.Time
+		testUnmarshalErr(&t2, testMarshalErr(v, h, t, name+"-embedded-time"), h, t, name+"-embedded-time")
+		return t2
+	}
+	fnMap := func(v interface{}) (m map[string]interface{}) {
+		testUnmarshalErr(&m, testMarshalErr(v, h, t, name+"-embedded-time"), h, t, name+"-embedded-time")
+		return
+	}
+	v := testEmbedTimeT{tm, "n"}
+	var v2 testEmbedTimeT
+	testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-embedded-time"), h, t, name+"-embedded-time")
+	if !v2.Time.Equal(tm) || v2.Name != "n" {
+		t.Fatalf("%s: expected %v, got %v", name, v, v2)
+	}
+
+	vn := testEmbedTimeNamedT{tm, "n"}
+	var vn2 testEmbedTimeNamedT
+	testUnmarshalErr(&vn2, testMarshalErr(vn, h, t, name+"-embedded-time"), h, t, name+"-embedded-time")
+	if !vn2.Time.Equal(tm) || vn2.Name != "n" {
+		t.Fatalf("%s: expected %v, got %v", name, vn, vn2)
+	}
+
+	vp := testEmbedTimePtrT{&tm, "n"}
+	var vp2 testEmbedTimePtrT
+	testUnmarshalErr(&vp2, testMarshalErr(vp, h, t, name+"-embedded-time"), h, t, name+"-embedded-time")
+	if vp2.Time == nil || !vp2.Time.Equal(tm) || vp2.Name != "n" {
+		t.Fatalf("%s: expected %v, got %v", name, vp, vp2)
+	}
+	var vp3 testEmbedTimePtrT
+	testUnmarshalErr(&vp3, testMarshalErr(testEmbedTimePtrT{Name: "n"}, h, t, name+"-embedded-time"), h, t, name+"-embedded-time")
+	testDeepEqualErr(vp3, testEmbedTimePtrT{Name: "n"}, t, name+"-embedded-time-nil")
+
+	// promoted through another embedded struct
+	vo := testEmbedTimeOuterT{v, 1}
+	var vo2 testEmbedTimeOuterT
+	testUnmarshalErr(&vo2, testMarshalErr(vo, h, t, name+"-embedded-time"), h, t, name+"-embedded-time")
+	if !vo2.Time.Equal(tm) || vo2.Name != "n" || vo2.N != 1 {
+		t.Fatalf("%s: expected %v, got %v", name, vo, vo2)
+	}
+
+	// time.Time itself is unchanged
+	if t2 := fnTime(tm); !t2.Equal(tm) {
+		t.Fatalf("%s: expected %v, got %v", name, tm, t2)
+	}
+
+	// the embedded time is a single value keyed by its type name (or tag), not the whole struct
+	if testBasicHandle(h).StructToArray {
+		return
+	}
+	for _, key := range []string{"Time", "at"} {
+		var v interface{} = testEmbedTimeT{tm, "n"}
+		if key == "at" {
+			v = testEmbedTimeNamedT{tm, "n"}
+		}
+		m := fnMap(v)
+		if _, ok := m[key]; !ok || len(m) != 2 {
+			t.Fatalf("%s: expected embedded time under key %s, got: %v", name, key, m)
+		}
+	}
+}
+
+type testPtrCycle *testPtrCycle
+
+func doTestPointerDepthLimit(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(limit int, iterative bool) {
+		bh.PointerDepthLimit, bh.Iterative = limit, iterative
+	}(bh.PointerDepthLimit, bh.Iterative)
+
+	var p testPtrCycle
+	p = &p
+	var i interface{}
+	i = &i
+	n := 7
+	pn := &n
+	ppn := &pn
+	v := map[string]interface{}{"a": &ppn}
+
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bh.PointerDepthLimit = 0
+		for _, x := range []interface{}{p, &i} {
+			var bs []byte
+			err := NewEncoderBytes(&bs, h).Encode(x)
+			if err == nil || !strings.Contains(err.Error(), "PointerDepthLimit") {
+				t.Fatalf("%s: expected a PointerDepthLimit error encoding %T, got: %v", name, x, err)
+			}
+		}
+		// a chain within the limit encodes as its base value
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-ptr-depth"),
+			testMarshalErr(map[string]interface{}{"a": 7}, h, t, name+"-ptr-depth"), t, name+"-ptr-depth")
+
+		// the value in the map is a ***int i.e. 3 dereferences (the interface is not counted)
+		bh.PointerDepthLimit = 3
+		testMarshalErr(v, h, t, name+"-ptr-depth-3")
+		bh.PointerDepthLimit = 2
+		var bs []byte
+		if err := NewEncoderBytes(&bs, h).Encode(v); err == nil {
+			t.Fatalf("%s: expected a PointerDepthLimit error with a limit of 2", name)
+		}
+		bh.PointerDepthLimit = -1
+		testMarshalErr(v, h, t, name+"-ptr-depth-unlimited")
+	}
+}
+
+type testCodecFielderT struct {
+	name  string
+	tags  []string
+	Count int // exported, but not encoded unless returned by CodecFields
+}
+
+func (x *testCodecFielderT) GetName() string { return x.name }
+
+func (x *testCodecFielderT) CodecFields() map[string]interface{} {
+	return map[string]interface{}{"name": x.GetName(), "tags": x.tags, "": "skipped"}
+}
+
+type testCodecFielderDecT struct {
+	Name  string   `codec:"name"`
+	Tags  []string `codec:"tags"`
+	Count int
+}
+
+func doTestCodecFielder(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(iterative, toArray bool) {
+		bh.Iterative, bh.StructToArray = iterative, toArray
+	}(bh.Iterative, bh.StructToArray)
+
+	v := testCodecFielderT{name: "n", tags: []string{"a", "b"}, Count: 3}
+	expect := testCodecFielderDecT{Name: "n", Tags: []string{"a", "b"}}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		for _, toArray := range []bool{false, true} {
+			bh.StructToArray = toArray
+			// decoding a map into a struct is the same, whether StructToArray or not
+			var v2 testCodecFielderDecT
+			bs := testMarshalErr(&v, h, t, name+"-codec-fielder")
+			testUnmarshalErr(&v2, bs, h, t, name+"-codec-fielder")
+			testDeepEqualErr(v2, expect, t, name+"-codec-fielder")
+			// the keys are in a stable order
+			testDeepEqualErr(testMarshalErr(&v, h, t, name+"-codec-fielder"), bs, t, name+"-codec-fielder-stable")
+
+			var m map[string]testCodecFielderDecT
+			bs = testMarshalErr(map[string]*testCodecFielderT{"x": &v}, h, t, name+"-codec-fielder-map")
+			testUnmarshalErr(&m, bs, h, t, name+"-codec-fielder-map")
+			testDeepEqualErr(m, map[string]testCodecFielderDecT{"x": expect}, t, name+"-codec-fielder-map")
+		}
+	}
+}
+
+type testMsgpackExtSelfer struct {
+	data []byte
+}
+
+func (x *testMsgpackExtSelfer) CodecEncodeSelf(e *Encoder) {
+	if err := e.EncodeMsgpackExt(9, x.data); err != nil {
+		panic(err)
+	}
+}
+
+func (x *testMsgpackExtSelfer) CodecDecodeSelf(d *Decoder) {
+	var re RawExt
+	d.MustDecode(&re)
+	x.data = re.Data
+}
+
+func doTestMsgpackEncodeExt(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping as codecgen is enabled")
+	}
+	name := h.Name()
+	for _, x := range []struct {
+		n  int
+		bd byte
+	}{
+		{1, mpFixExt1}, {2, mpFixExt2}, {3, mpExt8}, {4, mpFixExt4}, {8, mpFixExt8},
+		{16, mpFixExt16}, {17, mpExt8}, {255, mpExt8}, {256, mpExt16}, {65536, mpExt32},
+	} {
+		data := make([]byte, x.n)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		bs := testMarshalErr(&testMsgpackExtSelfer{data}, h, t, name+"-msgpack-ext")
+		if bs[0] != x.bd {
+			t.Fatalf("%s: ext of %d bytes: expected descriptor 0x%x, got 0x%x", name, x.n, x.bd, bs[0])
+		}
+		var re RawExt
+		testUnmarshalErr(&re, bs, h, t, name+"-msgpack-ext")
+		testDeepEqualErr(re, RawExt{Tag: 9, Data: data}, t, name+"-msgpack-ext")
+		var v testMsgpackExtSelfer
+		testUnmarshalErr(&v, bs, h, t, name+"-msgpack-ext")
+		testDeepEqualErr(v.data, data, t, name+"-msgpack-ext")
+	}
+
+	// for another handle, and within a map
+	var bs []byte
+	if err := NewEncoderBytes(&bs, testJsonH).EncodeMsgpackExt(9, []byte{1}); err == nil {
+		t.Fatalf("%s: expected an error encoding a msgpack ext with json", name)
+	}
+	v := map[string]*testMsgpackExtSelfer{"a": {[]byte{1, 2}}}
+	var v2 map[string]*testMsgpackExtSelfer
+	testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-msgpack-ext-map"), h, t, name+"-msgpack-ext-map")
+	testDeepEqualErr(v2, v, t, name+"-msgpack-ext-map")
+}
+
+func doTestWrapScalarsKey(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(key string) { bh.WrapScalarsKey = key }(bh.WrapScalarsKey)
+
+	n := 42
+	tm := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	scalars := []interface{}{42, "s", nil, true, 1.5, []byte("b"), tm, &n, (*int)(nil)}
+	others := []interface{}{[]int{1}, [1]int{1}, map[string]int{"a": 1}, struct{ A int }{1}, &struct{ A []int }{[]int{1}}}
+
+	var wrapped, plain [][]byte
+	for _, v := range scalars {
+		wrapped = append(wrapped, testMarshalErr(map[string]interface{}{"value": v}, h, t, name+"-wrap-scalars"))
+	}
+	for _, v := range others {
+		plain = append(plain, testMarshalErr(v, h, t, name+"-wrap-scalars"))
+	}
+
+	bh.WrapScalarsKey = "value"
+	for i, v := range scalars {
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-wrap-scalars"), wrapped[i], t, name+"-wrap-scalars")
+	}
+	// values which are not scalars, and the scalars within them, are not wrapped
+	for i, v := range others {
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-wrap-scalars-others"), plain[i], t, name+"-wrap-scalars-others")
+	}
+
+	var m map[string]int
+	testUnmarshalErr(&m, testMarshalErr(n, h, t, name+"-wrap-scalars"), h, t, name+"-wrap-scalars")
+	testDeepEqualErr(m, map[string]int{"value": 42}, t, name+"-wrap-scalars")
+}
+
+func doTestCanonicalMaxKeyBytes(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical bool, max int) {
+		bh.Canonical, bh.CanonicalMaxKeyBytes = canonical, max
+	}(bh.Canonical, bh.CanonicalMaxKeyBytes)
+	bh.Canonical = true
+
+	type key struct {
+		A int
+		B string
+	}
+	ms := make(map[key]int)
+	mi := make(map[interface{}]int)
+	for i := 0; i < 64; i++ {
+		ms[key{i % 7, strconv.Itoa(i)}] = i
+		mi[strconv.Itoa(i)] = i
+		mi[uint64(i+100)] = i
+	}
+	mi[true] = -1
+	mi[1.5] = -2
+	vs := []interface{}{ms, mi, map[string]map[key]int{"a": ms, "b": {}}}
+
+	for _, v := range vs {
+		bh.CanonicalMaxKeyBytes = 0
+		bs := testMarshalErr(v, h, t, name+"-canonical-max-key-bytes")
+		// keys are sorted on demand once the encoded keys exceed the limit
+		for _, max := range []int{1, 16, 1 << 20} {
+			bh.CanonicalMaxKeyBytes = max
+			testDeepEqualErr(testMarshalErr(v, h, t, name+"-canonical-max-key-bytes"), bs, t,
+				fmt.Sprintf("%s-canonical-max-key-bytes-%d", name, max))
+		}
+	}
+
+	bh.CanonicalMaxKeyBytes = 1
+	var bs []byte
+	if err := NewEncoderBytes(&bs, h).Encode(map[interface{}]int{"a": 1, math.NaN(): 2}); err == nil {
+		t.Fatalf("%s: expected an error encoding a NaN key when Canonical", name)
+	}
+}
+
+func doTestEncodeMapFromKeys(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical bool) { bh.Canonical = canonical }(bh.Canonical)
+
+	strlen := func(k interface{}) (interface{}, error) { return len(k.(string)), nil }
+	square := func(k interface{}) (interface{}, error) { return k.(int) * k.(int), nil }
+	encode := func(keys interface{}, fn func(k interface{}) (interface{}, error)) (bs []byte, err error) {
+		err = NewEncoderBytes(&bs, h).EncodeMapFromKeys(keys, fn)
+		return
+	}
+
+	// entries are written in the order of the keys, unless Canonical
+	bh.Canonical = false
+	bs, err := encode([]string{"bb", "a"}, strlen)
+	testCheckErr(t, err)
+	var bs2 []byte
+	testCheckErr(t, NewEncoderBytes(&bs2, h).EncodeMapFunc(2, func(emit func(k, v interface{}) error) error {
+		testCheckErr(t, emit("bb", 2))
+		return emit("a", 1)
+	}))
+	testDeepEqualErr(bs, bs2, t, name+"-map-from-keys")
+
+	bh.Canonical = true
+	for _, x := range []struct {
+		keys interface{}
+		fn   func(k interface{}) (interface{}, error)
+		m    interface{}
+	}{
+		{[]string{"ccc", "a", "bb"}, strlen, map[string]int{"a": 1, "bb": 2, "ccc": 3}},
+		{[3]int{10, -2, 9}, square, map[int]int{10: 100, -2: 4, 9: 81}},
+	} {
+		bs, err = encode(x.keys, x.fn)
+		testCheckErr(t, err)
+		testDeepEqualErr(bs, testMarshalErr(x.m, h, t, name+"-map-from-keys"), t, name+"-map-from-keys-canonical")
+	}
+
+	// an error from valueFn is returned as is
+	errBad := errors.New("bad key")
+	_, err = encode([]string{"a", "b"}, func(k interface{}) (interface{}, error) {
+		if k == "b" {
+			return nil, errBad
+		}
+		return 1, nil
+	})
+	testDeepEqualErr(err, errBad, t, name+"-map-from-keys-error")
+	if _, err = encode("a", strlen); err == nil {
+		t.Fatalf("%s: expected an error encoding a map from keys which are not a slice", name)
+	}
+}
+
+func doTestJsonSeparators(t *testing.T, h *JsonHandle) {
+	defer testSetup(t, nil)()
+	h = testHandleCopy(h).(*JsonHandle)
+	h.Canonical, h.Indent, h.TrailingComma = true, 0, false
+	h.ItemSeparator, h.KeyValueSeparator = ", ", " : "
+
+	v := map[string]interface{}{"a": []int{1, 2}, "b": map[string]int{}, "c": []int{}}
+	bs := testMarshalErr(v, h, t, "json-separators")
+	testDeepEqualErr(string(bs), `{"a" : [1, 2], "b" : {}, "c" : []}`, t, "json-separators")
+	// still json, so it decodes
+	var v2 map[string]interface{}
+	testUnmarshalErr(&v2, bs, h, t, "json-separators")
+	testDeepEqualErr(len(v2), 3, t, "json-separators")
+
+	h.Indent = 2
+	testDeepEqualErr(string(testMarshalErr(map[string]int{"a": 1, "b": 2}, h, t, "json-separators-indent")),
+		"{\n  \"a\" : 1, \n  \"b\" : 2\n}", t, "json-separators-indent")
+
+	h.Indent = 0
+	h.TrailingComma = true
+	testDeepEqualErr(string(testMarshalErr([]int{1, 2}, h, t, "json-separators-trailing")),
+		`[1, 2, ]`, t, "json-separators-trailing")
+	h.TrailingComma = false
+
+	// a separator which is not json is an error, unless lenient
+	h.ItemSeparator, h.KeyValueSeparator = ";", "="
+	var out []byte
+	if err := NewEncoderBytes(&out, h).Encode(v); err == nil {
+		t.Fatalf("json-separators: expected an error for separators which are not json")
+	}
+	h.LenientSeparators = true
+	testDeepEqualErr(string(testMarshalErr(map[string][]int{"a": {1, 2}, "b": {3}}, h, t, "json-separators-lenient")),
+		`{"a"=[1;2];"b"=[3]}`, t, "json-separators-lenient")
+}
+
+func doTestChecksumTrailer(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(c ChecksumTrailer, f FrameLengthPrefix, canonical bool) {
+		bh.ChecksumTrailer, bh.FrameLengthPrefix, bh.Canonical = c, f, canonical
+	}(bh.ChecksumTrailer, bh.FrameLengthPrefix, bh.Canonical)
+	bh.Canonical = true // the value is compared by its encoded bytes
+
+	// known XXH64 values, including one longer than a 32-byte stripe
+	for s, x := range map[string]uint64{
+		"":    0xef46db3751d8e999,
+		"a":   0xd24ec4f1a98c6e5b,
+		"abc": 0x44bc2cf5ad770999,
+		"Nobody inspects the spammish repetition": 0xfbcea83c8a378bf1,
+	} {
+		testDeepEqualErr(xxHash64([]byte(s)), x, t, name+"-xxhash64")
+	}
+
+	v := map[string]interface{}{"a": 1, "b": []string{"x", "y"}}
+	bh.ChecksumTrailer, bh.FrameLengthPrefix = ChecksumNone, FrameNone
+	bs0 := testMarshalErr(v, h, t, name+"-checksum")
+	crc := bigen.PutUint32(crc32.ChecksumIEEE(bs0))
+	xxh := bigen.PutUint64(xxHash64(bs0))
+
+	for _, x := range []struct {
+		c       ChecksumTrailer
+		trailer []byte
+	}{
+		{ChecksumCRC32, crc[:]},
+		{ChecksumXXHash64, xxh[:]},
+	} {
+		bh.ChecksumTrailer, bh.FrameLengthPrefix = x.c, FrameNone
+		expect := append(append([]byte{}, bs0...), x.trailer...)
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-checksum"), expect, t, name+"-checksum")
+
+		// the same when streaming, and for each of multiple values
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf, h)
+		testCheckErr(t, enc.Encode(v))
+		testCheckErr(t, enc.Encode(v))
+		testDeepEqualErr(buf.Bytes(), append(append([]byte{}, expect...), expect...), t, name+"-checksum-stream")
+
+		// the length prefix covers the value, but not the trailer
+		bh.FrameLengthPrefix = FrameVarint
+		expect = append(AppendVarint(nil, uint64(len(bs0))), expect...)
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-checksum-frame"), expect, t, name+"-checksum-frame")
+
+		// the value decodes, once the trailer is stripped
+		bh.FrameLengthPrefix = FrameNone
+		bs := testMarshalErr(v, h, t, name+"-checksum")
+		var v2 map[string]interface{}
+		testUnmarshalErr(&v2, bs[:len(bs)-len(x.trailer)], h, t, name+"-checksum")
+		testDeepEqualErr(len(v2), 2, t, name+"-checksum")
+	}
+}
+
+type testJsonStringDoc struct {
+	A int               `json:"a"`
+	B []string          `json:"b,omitempty"`
+	M map[string]string `json:"m,omitempty"`
+}
+
+type testJsonStringT struct {
+	ID  int                `codec:"id"`
+	Doc testJsonStringDoc  `codec:"doc,jsonstring"`
+	P   *testJsonStringDoc `codec:"p,jsonstring"`
+	L   []int              `codec:"l,jsonstring"`
+	M   map[string]int     `codec:"m,jsonstring,omitempty"`
+}
+
+func doTestStructFieldJsonString(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping as codecgen is enabled")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(toArray bool) { bh.StructToArray = toArray }(bh.StructToArray)
+	bh.StructToArray = false // the fields are checked by name
+
+	v := testJsonStringT{
+		ID:  1,
+		Doc: testJsonStringDoc{A: 2, B: []string{`x"<y>`}, M: map[string]string{"k": "v\n"}},
+		L:   []int{3, 4},
+	}
+	bs := testMarshalErr(v, h, t, name+"-jsonstring")
+	var m map[string]interface{}
+	testUnmarshalErr(&m, bs, h, t, name+"-jsonstring")
+	// msgpack (without WriteExt) decodes strings in an interface{} as []byte
+	str := func(x interface{}) string {
+		if b, ok := x.([]byte); ok {
+			return string(b)
+		}
+		s, _ := x.(string)
+		return s
+	}
+	testDeepEqualErr(str(m["doc"]), `{"a":2,"b":["x\"<y>"],"m":{"k":"v\n"}}`, t, name+"-jsonstring")
+	testDeepEqualErr(str(m["l"]), `[3,4]`, t, name+"-jsonstring")
+	testDeepEqualErr(m["p"], nil, t, name+"-jsonstring-nil")
+
+	// decoding the string (or the value itself) gives back the value
+	var v2 testJsonStringT
+	testUnmarshalErr(&v2, bs, h, t, name+"-jsonstring")
+	testDeepEqualErr(v2, v, t, name+"-jsonstring")
+
+	type plain struct {
+		ID  int               `codec:"id"`
+		Doc testJsonStringDoc `codec:"doc"`
+	}
+	var v3 testJsonStringT
+	testUnmarshalErr(&v3, testMarshalErr(plain{1, v.Doc}, h, t, name+"-jsonstring-plain"), h, t, name+"-jsonstring-plain")
+	testDeepEqualErr(v3.Doc, v.Doc, t, name+"-jsonstring-plain")
+
+	if jh, ok := h.(*JsonHandle); ok {
+		// the json within the string is escaped as a string
+		jh = testHandleCopy(jh).(*JsonHandle)
+		jh.Indent, jh.Canonical = 0, false
+		p := &testJsonStringDoc{A: 5}
+		testDeepEqualErr(string(testMarshalErr(testJsonStringT{P: p, L: []int{}}, jh, t, name+"-jsonstring-escaped")),
+			`{"id":0,"doc":"{\"a\":0}","p":"{\"a\":5}","l":"[]"}`, t, name+"-jsonstring-escaped")
+	}
+}
+
+type testOmitEmptyDefaultT struct {
+	A int
+	B string
+	C []int
+	D *int
+	K int `codec:",keepempty"`
+	O int `codec:",omitempty"`
+}
+
+func doTestOmitEmptyByDefault(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(omit, iterative, toArray, canonical bool) {
+		bh.OmitEmptyByDefault, bh.Iterative, bh.StructToArray, bh.Canonical = omit, iterative, toArray, canonical
+	}(bh.OmitEmptyByDefault, bh.Iterative, bh.StructToArray, bh.Canonical)
+	bh.Canonical = true
+
+	bh.StructToArray = false
+	v := testOmitEmptyDefaultT{B: "b"}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bh.OmitEmptyByDefault = false
+		var m map[string]interface{}
+		testUnmarshalErr(&m, testMarshalErr(v, h, t, name+"-omitempty-default"), h, t, name+"-omitempty-default")
+		testDeepEqualErr(len(m), 5, t, name+"-omitempty-default-off")
+
+		bh.OmitEmptyByDefault = true
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-omitempty-default"),
+			testMarshalErr(map[string]interface{}{"B": "b", "K": 0}, h, t, name+"-omitempty-default"),
+			t, name+"-omitempty-default")
+		// as a field of another, and for a type without any omitempty tag
+		testDeepEqualErr(testMarshalErr([]interface{}{struct{ A, B int }{0, 1}}, h, t, name+"-omitempty-default-nested"),
+			testMarshalErr([]interface{}{map[string]int{"B": 1}}, h, t, name+"-omitempty-default-nested"),
+			t, name+"-omitempty-default-nested")
+	}
+
+	// ignored when encoding as an array
+	bh.StructToArray = true
+	bh.OmitEmptyByDefault = true
+	var vs []interface{}
+	testUnmarshalErr(&vs, testMarshalErr(v, h, t, name+"-omitempty-default-array"), h, t, name+"-omitempty-default-array")
+	testDeepEqualErr(len(vs), 6, t, name+"-omitempty-default-array")
+}
+
+func doTestEncodeMulti(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+
+	v := map[string]interface{}{"a": []interface{}{1, "x"}}
+	handles := []Handle{h, testJsonH, h}
+	outs, err := EncodeMulti(v, handles...)
+	testCheckErr(t, err)
+	testDeepEqualErr(len(outs), len(handles), t, name+"-encode-multi")
+	for i, hh := range handles {
+		testDeepEqualErr(outs[i], testMarshalErr(v, hh, t, name+"-encode-multi"), t, name+"-encode-multi")
+	}
+	// each output is distinct
+	if &outs[0][0] == &outs[2][0] {
+		t.Fatalf("%s: expected distinct outputs", name)
+	}
+	var p testPtrCycle
+	p = &p
+	if _, err = EncodeMulti(p, h); err == nil {
+		t.Fatalf("%s: expected an error from EncodeMulti", name)
+	}
+	// the pooled Encoders are reused after an error
+	outs, err = EncodeMulti(v, h)
+	testCheckErr(t, err)
+	testDeepEqualErr(outs[0], testMarshalErr(v, h, t, name+"-encode-multi"), t, name+"-encode-multi-after-error")
+	outs, err = EncodeMulti(v)
+	testCheckErr(t, err)
+	testDeepEqualErr(len(outs), 0, t, name+"-encode-multi-none")
+}
+
+type testFieldIndexT struct {
+	_struct struct{} `codec:",toarray"`
+	A       int      `codec:"a,index=2"`
+	B       string   `codec:"b"`
+	C       bool     `codec:"c,index=0"`
+	D       uint     `codec:"d,index=1"`
+	E       string   `codec:"e"`
+}
+
+type testFieldIndexGapT struct {
+	A int `codec:",index=0"`
+	B int `codec:",index=2"`
+}
+
+type testFieldIndexDupT struct {
+	A int `codec:",index=0"`
+	B int `codec:",index=0"`
+}
+
+type testFieldIndexBadT struct {
+	A int `codec:",index=a"`
+}
+
+type testFieldIndexOverflowT struct {
+	A int `codec:",index=65536"` // overflows a uint16
+}
+
+func doTestStructFieldIndex(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping as codecgen is enabled")
+	}
+	name := h.Name()
+
+	v := testFieldIndexT{A: 1, B: "b", C: true, D: 4, E: "e"}
+	bs := testMarshalErr(v, h, t, name+"-field-index")
+	// the indexed fields in order, then the others in declaration order
+	testDeepEqualErr(bs, testMarshalErr([]interface{}{true, uint(4), 1, "b", "e"}, h, t, name+"-field-index"),
+		t, name+"-field-index")
+	var v2 testFieldIndexT
+	testUnmarshalErr(&v2, bs, h, t, name+"-field-index")
+	testDeepEqualErr(v2, v, t, name+"-field-index")
+
+	var out []byte
+	for _, x := range []interface{}{testFieldIndexGapT{}, testFieldIndexDupT{}} {
+		if err := NewEncoderBytes(&out, h).Encode(x); err == nil || !strings.Contains(err.Error(), "index") {
+			t.Fatalf("%s: expected an index error encoding %T, got: %v", name, x, err)
+		}
+	}
+	// a non-numeric or out-of-range index is an error in the struct tag
+	for _, x := range []interface{}{testFieldIndexBadT{}, testFieldIndexOverflowT{}} {
+		if err := NewEncoderBytes(&out, h).Encode(x); err == nil || !strings.Contains(err.Error(), "invalid option") {
+			t.Fatalf("%s: expected an invalid index error encoding %T, got: %v", name, x, err)
+		}
+	}
+}
+
+type testLenOfT struct {
+	Items []string
+	Count int `codec:"count,lenof=Items"`
+	M     map[string]int
+	N     uint8 `codec:"n,lenof=M,omitempty"`
+	P     *[]int
+	PN    int64 `codec:"pn,lenof=P"`
+}
+
+// testLenOfPlainT is testLenOfT without the lenof options.
+type testLenOfPlainT struct {
+	Items []string
+	Count int `codec:"count"`
+	M     map[string]int
+	N     uint8 `codec:"n,omitempty"`
+	P     *[]int
+	PN    int64 `codec:"pn"`
+}
+
+type testLenOfNoLenT struct {
+	A int
+	N int `codec:",lenof=A"`
+}
+
+type testLenOfUnknownT struct {
+	N int `codec:",lenof=A"`
+}
+
+type testLenOfNotIntT struct {
+	A []int
+	N string `codec:",lenof=A"`
+}
+
+func doTestStructFieldLenOf(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping as codecgen is enabled")
+	}
+	name := h.Name()
+
+	p := []int{1, 2, 3}
+	v := testLenOfT{Items: []string{"a", "b"}, Count: 7, N: 9, P: &p, PN: 1}
+	bs := testMarshalErr(v, h, t, name+"-lenof")
+	v0 := testLenOfPlainT{Items: v.Items, Count: 2, P: &p, PN: 3} // M is nil, so N is 0 (and omitted)
+	testDeepEqualErr(bs, testMarshalErr(v0, h, t, name+"-lenof"), t, name+"-lenof")
+	var v2 testLenOfPlainT
+	testUnmarshalErr(&v2, bs, h, t, name+"-lenof")
+	testDeepEqualErr(v2, v0, t, name+"-lenof")
+
+	v = testLenOfT{M: map[string]int{"a": 1}}
+	testDeepEqualErr(testMarshalErr(v, h, t, name+"-lenof-map"),
+		testMarshalErr(testLenOfPlainT{M: v.M, N: 1}, h, t, name+"-lenof-map"), t, name+"-lenof-map")
+
+	var out []byte
+	for _, x := range []interface{}{testLenOfNoLenT{}, testLenOfUnknownT{}, testLenOfNotIntT{}} {
+		if err := NewEncoderBytes(&out, h).Encode(x); err == nil || !strings.Contains(err.Error(), "lenof") {
+			t.Fatalf("%s: expected a lenof error encoding %T, got: %v", name, x, err)
+		}
+	}
+}
+
+func doTestEncodeNoExt(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	h0 := h
+	h = testHandleUninited(h)
+	testCheckErr(t, SetImageExts(h, 100))
+
+	type T struct {
+		P  image.Point
+		Ps []image.Point
+		Rp *image.Rectangle
+		M  map[string]interface{}
+	}
+	// the image types as structs without an extension
+	type point struct{ X, Y int }
+	type rect struct{ Min, Max point }
+	type T0 struct {
+		P  point
+		Ps []point
+		Rp *rect
+		M  map[string]interface{}
+	}
+	v := T{
+		P:  image.Pt(-3, 4),
+		Ps: []image.Point{{1, 2}},
+		Rp: &image.Rectangle{Max: image.Pt(3, 4)},
+		M:  map[string]interface{}{"c": color.RGBA{1, 2, 3, 4}},
+	}
+	v0 := T0{
+		P:  point{-3, 4},
+		Ps: []point{{1, 2}},
+		Rp: &rect{Max: point{3, 4}},
+		M:  map[string]interface{}{"c": struct{ R, G, B, A uint8 }{1, 2, 3, 4}},
+	}
+
+	var bs []byte
+	e := NewEncoderBytes(&bs, h)
+	testCheckErr(t, e.EncodeNoExt(v))
+	testDeepEqualErr(bs, testMarshalErr(v0, h0, t, name+"-noext"), t, name+"-noext")
+
+	// the extensions are used again by the next Encode
+	e.ResetBytes(&bs)
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(bs, testMarshalErr(v, h, t, name+"-noext-ext"), t, name+"-noext-ext")
+}
+
+func doTestSkipMapValueKinds(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(kinds []reflect.Kind, canonical bool) {
+		bh.SkipMapValueKinds, bh.Canonical = kinds, canonical
+	}(bh.SkipMapValueKinds, bh.Canonical)
+	bh.Canonical = true
+
+	fn, ch := func() {}, make(chan int)
+	v := map[string]interface{}{
+		"a": 1, "b": fn, "c": ch, "d": nil,
+		"e": map[string]interface{}{"x": "y", "z": fn},
+	}
+	type T struct {
+		M  map[string]interface{}
+		Fs map[string]func()
+	}
+	tv := T{M: v, Fs: map[string]func(){"f": fn}}
+
+	bh.SkipMapValueKinds = nil
+	v0 := map[string]interface{}{"a": 1, "d": nil, "e": map[string]interface{}{"x": "y"}}
+	bs0 := testMarshalErr(v0, h, t, name+"-skip-kinds")
+	bst0 := testMarshalErr(T{M: v0, Fs: map[string]func(){}}, h, t, name+"-skip-kinds-struct")
+
+	bh.SkipMapValueKinds = []reflect.Kind{reflect.Func, reflect.Chan}
+	testDeepEqualErr(testMarshalErr(v, h, t, name+"-skip-kinds"), bs0, t, name+"-skip-kinds")
+	testDeepEqualErr(testMarshalErr(tv, h, t, name+"-skip-kinds-struct"), bst0, t, name+"-skip-kinds-struct")
+
+	// a nil interface value is of kind Invalid
+	bh.SkipMapValueKinds = []reflect.Kind{reflect.Func, reflect.Chan, reflect.Invalid}
+	delete(v0, "d")
+	testDeepEqualErr(testMarshalErr(v, h, t, name+"-skip-kinds-nil"),
+		testMarshalErr(v0, h, t, name+"-skip-kinds-nil"), t, name+"-skip-kinds-nil")
+}
+
+type testMaxKeysT struct {
+	A int
+	B string `codec:",omitempty"`
+	C bool   `codec:",omitempty"`
+}
+
+func doTestMaxKeysPerMap(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(max int, toArray bool) {
+		bh.MaxKeysPerMap, bh.StructToArray = max, toArray
+	}(bh.MaxKeysPerMap, bh.StructToArray)
+	bh.MaxKeysPerMap = 2
+	bh.StructToArray = false
+
+	var out []byte
+	errs := func(v interface{}) bool {
+		err := NewEncoderBytes(&out, h).Encode(v)
+		return err != nil && strings.Contains(err.Error(), "MaxKeysPerMap")
+	}
+	for i, v := range []interface{}{
+		map[string]int{"a": 1, "b": 2},
+		map[int]interface{}{1: map[string]bool{"x": true}},
+		testMaxKeysT{A: 1, B: "b"}, // C is omitted
+	} {
+		if errs(v) {
+			t.Fatalf("%s: %d: unexpected MaxKeysPerMap error encoding %T", name, i, v)
+		}
+	}
+	for i, v := range []interface{}{
+		map[string]int{"a": 1, "b": 2, "c": 3},
+		[]interface{}{map[int]bool{1: true, 2: true, 3: true}},
+		testMaxKeysT{A: 1, B: "b", C: true},
+	} {
+		if !errs(v) {
+			t.Fatalf("%s: %d: expected a MaxKeysPerMap error encoding %T", name, i, v)
+		}
+	}
+
+	// a struct encoded as an array is not checked
+	bh.StructToArray = true
+	if errs(testMaxKeysT{A: 1, B: "b", C: true}) {
+		t.Fatalf("%s: unexpected MaxKeysPerMap error encoding a struct as an array", name)
+	}
+}
+
+// testReaderMarshalT is encoded from a reader of n bytes (in reads of at most 1000 bytes),
+// returning length as its length e.g. -1 if unknown.
+type testReaderMarshalT struct {
+	n, length int64
+}
+
+func (x testReaderMarshalT) CodecMarshalReader() (io.Reader, int64, error) {
+	return &testPatternReader{n: x.n}, x.length, nil
+}
+
+type testPatternReader struct {
+	i, n int64
+}
+
+func (r *testPatternReader) Read(p []byte) (n int, err error) {
+	if r.i >= r.n {
+		return 0, io.EOF
+	}
+	if len(p) > 1000 {
+		p = p[:1000]
+	}
+	for ; n < len(p) && r.i < r.n; n++ {
+		p[n] = byte(r.i % 251)
+		r.i++
+	}
+	return
+}
+
+func doTestReaderMarshaler(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping as codecgen is enabled")
+	}
+	name := h.Name()
+	const n = 3<<20 + 1
+	bs0, err := ioutil.ReadAll(&testPatternReader{n: n})
+	testCheckErr(t, err)
+
+	for _, length := range []int64{n, -1} {
+		var buf bytes.Buffer
+		testCheckErr(t, NewEncoder(&buf, h).Encode([]interface{}{testReaderMarshalT{n, length}, "x"}))
+		if _, ok := h.(*CborHandle); !ok {
+			testDeepEqualErr(buf.Bytes(), testMarshalErr([]interface{}{bs0, "x"}, h, t, name+"-reader"),
+				t, name+"-reader")
+		}
+		var v2 struct {
+			_struct struct{} `codec:",toarray"`
+			B       []byte
+			S       string
+		}
+		testUnmarshalErr(&v2, buf.Bytes(), h, t, name+"-reader")
+		testDeepEqualErr(v2.B, bs0, t, name+"-reader")
+		testDeepEqualErr(v2.S, "x", t, name+"-reader")
+	}
+
+	var out []byte
+	for _, x := range []testReaderMarshalT{{10, 11}, {10, 9}} {
+		if err := NewEncoderBytes(&out, h).Encode(x); err == nil || !strings.Contains(err.Error(), "reader has") {
+			t.Fatalf("%s: expected a length error encoding %v, got: %v", name, x, err)
+		}
+	}
+}
+
+type testZeroAsNullT struct {
+	A int
+	S string
+	P *int
+	L []int
+	N struct{ X int }
+	B int
+	O int `codec:",omitempty"`
+}
+
+// testZeroAsNullNilT is testZeroAsNullT, with nil for each empty value except B.
+type testZeroAsNullNilT struct {
+	A, S, P, L, N interface{}
+	B             int
+	O             interface{} `codec:",omitempty"`
+}
+
+func doTestZeroAsNull(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping as codecgen is enabled")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(zeroAsNull bool) { bh.ZeroAsNull = zeroAsNull }(bh.ZeroAsNull)
+
+	v := testZeroAsNullT{B: 2}
+	bh.ZeroAsNull = false
+	bs0 := testMarshalErr(testZeroAsNullNilT{B: 2}, h, t, name+"-zero-as-null")
+	testDeepEqualErr(bytes.Equal(testMarshalErr(v, h, t, name+"-zero-as-null"), bs0), false, t, name+"-zero-as-null")
+
+	bh.ZeroAsNull = true
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-zero-as-null"), bs0, t, name+"-zero-as-null")
+	}
+	bh.Iterative = false
+
+	var v2 testZeroAsNullT
+	testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-zero-as-null"), h, t, name+"-zero-as-null")
+	testDeepEqualErr(v2, testZeroAsNullT{B: 2}, t, name+"-zero-as-null")
+}
+
+func doTestFixedInnerSlice(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping as codecgen is enabled")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(fixed, iterative bool) {
+		bh.FixedInnerSlice, bh.Iterative = fixed, iterative
+	}(bh.FixedInnerSlice, bh.Iterative)
+
+	type T struct {
+		M [][]float64
+		S [][]string
+		B [][]byte // not flattened
+	}
+	v := T{
+		M: [][]float64{{1, 2, 3}, {4, 5, 6}},
+		S: [][]string{},
+		B: [][]byte{{1}, {2, 3}},
+	}
+	type T0 struct {
+		M []interface{}
+		S []interface{}
+		B [][]byte
+	}
+	bh.FixedInnerSlice = false
+	bs0 := testMarshalErr(T0{
+		M: []interface{}{2, 3, 1.0, 2.0, 3.0, 4.0, 5.0, 6.0},
+		S: []interface{}{0, 0},
+		B: v.B,
+	}, h, t, name+"-fixed-inner")
+
+	bh.FixedInnerSlice = true
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-fixed-inner"), bs0, t, name+"-fixed-inner")
+	}
+	bh.Iterative = false
+
+	var v2 []float64
+	testUnmarshalErr(&v2, testMarshalErr(v.M, h, t, name+"-fixed-inner"), h, t, name+"-fixed-inner")
+	testDeepEqualErr(v2, []float64{2, 3, 1, 2, 3, 4, 5, 6}, t, name+"-fixed-inner")
+
+	var out []byte
+	err := NewEncoderBytes(&out, h).Encode([][]int{{1, 2}, {3}})
+	if err == nil || !strings.Contains(err.Error(), "row 1 has length 1") {
+		t.Fatalf("%s: expected a jagged row error, got: %v", name, err)
+	}
+}
+
+type testKVArrayT struct {
+	_struct struct{} `codec:",kvarray"`
+	A       int
+	B       string `codec:",omitempty"`
+	C       []int
+	D       *testKVArrayT `codec:",omitempty"`
+}
+
+func doTestStructKVArray(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping as codecgen is enabled")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(toArray, iterative bool) {
+		bh.StructToArray, bh.Iterative = toArray, iterative
+	}(bh.StructToArray, bh.Iterative)
+	bh.StructToArray = false
+
+	v := testKVArrayT{A: 1, C: []int{2, 3}, D: &testKVArrayT{B: "b"}}
+	bs0 := testMarshalErr([]interface{}{"A", 1, "C", []int{2, 3}, "D", []interface{}{"A", 0, "B", "b", "C", nil}},
+		h, t, name+"-kvarray")
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-kvarray"), bs0, t, name+"-kvarray")
+	}
+	bh.Iterative = false
+
+	var v2 testKVArrayT
+	testUnmarshalErr(&v2, bs0, h, t, name+"-kvarray")
+	testDeepEqualErr(v2, v, t, name+"-kvarray")
+
+	// it is still decoded from a map, and an odd number of keys and values is an error
+	v2 = testKVArrayT{}
+	testUnmarshalErr(&v2, testMarshalErr(map[string]interface{}{"B": "x"}, h, t, name+"-kvarray-map"),
+		h, t, name+"-kvarray-map")
+	testDeepEqualErr(v2, testKVArrayT{B: "x"}, t, name+"-kvarray-map")
+	err := NewDecoderBytes(testMarshalErr([]interface{}{"A", 1, "B"}, h, t, name+"-kvarray-odd"), h).Decode(&v2)
+	if err == nil { // a length-prefixed array is reported as of odd length, else the value is missing
+		t.Fatalf("%s: expected an error decoding an odd number of keys and values", name)
+	}
+}
+
+// testTokenRecorder records the tokens it visits as text e.g. "{1 k"a" v1 }".
+type testTokenRecorder struct {
+	b strings.Builder
+}
+
+func (x *testTokenRecorder) EncodeNil()              { x.b.WriteString(" nil") }
+func (x *testTokenRecorder) EncodeBool(b bool)       { fmt.Fprintf(&x.b, " %v", b) }
+func (x *testTokenRecorder) EncodeInt(i int64)       { fmt.Fprintf(&x.b, " %d", i) }
+func (x *testTokenRecorder) EncodeUint(u uint64)     { fmt.Fprintf(&x.b, " %du", u) }
+func (x *testTokenRecorder) EncodeFloat32(f float32) { fmt.Fprintf(&x.b, " %vf", f) }
+func (x *testTokenRecorder) EncodeFloat64(f float64) { fmt.Fprintf(&x.b, " %vd", f) }
+func (x *testTokenRecorder) EncodeString(s string)   { fmt.Fprintf(&x.b, " %q", s) }
+func (x *testTokenRecorder) EncodeBytes(b []byte)    { fmt.Fprintf(&x.b, " 0x%x", b) }
+func (x *testTokenRecorder) EncodeTime(t time.Time)  { fmt.Fprintf(&x.b, " t%d", t.Unix()) }
+func (x *testTokenRecorder) EncodeExt(tag uint64, data []byte) {
+	fmt.Fprintf(&x.b, " ext%d:0x%x", tag, data)
+}
+func (x *testTokenRecorder) WriteArrayStart(length int) { fmt.Fprintf(&x.b, " [%d", length) }
+func (x *testTokenRecorder) WriteArrayElem()            { x.b.WriteString(" e") }
+func (x *testTokenRecorder) WriteArrayEnd()             { x.b.WriteString(" ]") }
+func (x *testTokenRecorder) WriteMapStart(length int)   { fmt.Fprintf(&x.b, " {%d", length) }
+func (x *testTokenRecorder) WriteMapElemKey()           { x.b.WriteString(" k") }
+func (x *testTokenRecorder) WriteMapElemValue()         { x.b.WriteString(" v") }
+func (x *testTokenRecorder) WriteMapEnd()               { x.b.WriteString(" }") }
+
+func doTestTokenVisitor(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping as codecgen is enabled")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(toArray, canonical, iterative bool) {
+		bh.StructToArray, bh.Canonical, bh.Iterative = toArray, canonical, iterative
+	}(bh.StructToArray, bh.Canonical, bh.Iterative)
+	bh.StructToArray, bh.Canonical = false, true
+
+	v := struct {
+		A int
+		B []string
+		M map[string]bool
+		N interface{}
+		P []byte
+		T time.Time
+		U uint8
+	}{1, []string{"x", "y"}, map[string]bool{"k": true, "j": false}, nil, []byte{1, 2}, time.Unix(7, 0), 3}
+	const tokens = ` {7 k "A" v 1 k "B" v [2 e "x" e "y" ] k "M" v {2 k "j" v false k "k" v true }` +
+		` k "N" v nil k "P" v 0x0102 k "T" v t7 k "U" v 3u }`
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		var x testTokenRecorder
+		testCheckErr(t, NewEncoderVisitor(&x, h).Encode(v))
+		testDeepEqualErr(x.b.String(), tokens, t, name+"-token-visitor")
+	}
+	bh.Iterative = false
+
+	// a map of unknown length (which cannot be sorted), and a Raw value (which is not supported)
+	bh.Canonical = false
+	var x testTokenRecorder
+	e := NewEncoderVisitor(&x, h)
+	testCheckErr(t, e.EncodeMapFunc(-1, func(emit func(k, v interface{}) error) error {
+		return emit("a", 1.5)
+	}))
+	testDeepEqualErr(x.b.String(), ` {-1 k "a" v 1.5d }`, t, name+"-token-visitor-map")
+	if err := e.Encode(Raw("1")); err == nil {
+		t.Fatalf("%s: expected an error encoding a Raw value to a TokenVisitor", name)
+	}
+}
+
+type testSchemaInnerT struct {
+	A int
+	B string `codec:"b"`
+}
+
+type testSchemaT struct {
+	I  interface{}
+	N  interface{}
+	M  map[string]interface{}
+	S  []testSchemaInnerT
+	P  *testSchemaInnerT
+	T  time.Time
+	Bs []byte
+}
+
+func doTestEncodeWithSchema(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical bool) { bh.Canonical = canonical }(bh.Canonical)
+	bh.Canonical = true // the map is encoded in the same order each time
+
+	v := testSchemaT{
+		I:  testSchemaInnerT{1, "one"},
+		M:  map[string]interface{}{"y": 2.5, "x": []interface{}{"a", 1}},
+		T:  time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		Bs: []byte("bytes"),
+	}
+	rtInner := reflect.TypeOf(testSchemaInnerT{})
+	inner := Schema{Kind: reflect.Struct, Type: rtInner, Fields: []Schema{
+		{Name: "A", Kind: reflect.Int, Type: reflect.TypeOf(0)},
+		{Name: "b", Kind: reflect.String, Type: reflect.TypeOf("")},
+	}}
+	innerI := inner
+	innerI.Name = "I"
+	schema := Schema{Kind: reflect.Struct, Type: reflect.TypeOf(v), Fields: []Schema{
+		innerI,
+		{Name: "N"},
+		{Name: "M", Kind: reflect.Map, Type: reflect.TypeOf(v.M), Fields: []Schema{
+			{Name: "x", Kind: reflect.Slice, Type: reflect.TypeOf([]interface{}{}),
+				Elem: &Schema{Kind: reflect.String, Type: reflect.TypeOf("")}},
+			{Name: "y", Kind: reflect.Float64, Type: reflect.TypeOf(0.0)},
+		}},
+		{Name: "S", Kind: reflect.Slice, Type: reflect.TypeOf(v.S), Elem: &inner},
+		{Name: "P", Kind: reflect.Ptr, Type: reflect.TypeOf(v.P)},
+		{Name: "T", Kind: reflect.Struct, Type: timeTyp},
+		{Name: "Bs", Kind: reflect.Slice, Type: reflect.TypeOf(v.Bs)},
+	}}
+
+	var b []byte
+	bs, s, err := NewEncoderBytes(&b, h).EncodeWithSchema(&v)
+	testCheckErr(t, err)
+	testDeepEqualErr(s, schema, t, name+"-schema")
+	testDeepEqualErr(bs, b, t, name+"-schema-bytes")
+	testDeepEqualErr(bs, testMarshalErr(v, h, t, name+"-schema"), t, name+"-schema-bytes")
+
+	var buf bytes.Buffer
+	bs, s, err = NewEncoder(&buf, h).EncodeWithSchema(v)
+	testCheckErr(t, err)
+	testDeepEqualErr(s, schema, t, name+"-schema-writer")
+	testDeepEqualErr(bs, buf.Bytes(), t, name+"-schema-writer")
+
+	// a value seen is described over its type e.g. the first element of a slice
+	v.S = []testSchemaInnerT{{2, "two"}}
+	_, s, err = NewEncoderBytes(&b, h).EncodeWithSchema([]interface{}{v.S, nil})
+	testCheckErr(t, err)
+	testDeepEqualErr(s, Schema{Kind: reflect.Slice, Type: reflect.TypeOf([]interface{}{}),
+		Elem: &Schema{Kind: reflect.Slice, Type: reflect.TypeOf(v.S), Elem: &inner}}, t, name+"-schema-slice")
+
+	// no schema is returned if the value cannot be encoded
+	bh.MaxKeysPerMap = 1
+	_, s, err = NewEncoderBytes(&b, h).EncodeWithSchema(v.M)
+	bh.MaxKeysPerMap = 0
+	if err == nil {
+		t.Fatalf("%s: expected an error encoding a map with more than MaxKeysPerMap entries", name)
+	}
+	testDeepEqualErr(s, Schema{}, t, name+"-schema-err")
+}
+
+type testEnumT int
+
+func (x testEnumT) String() string {
+	switch x {
+	case 1:
+		return "Active"
+	case 2:
+		return "Inactive"
+	}
+	return "testEnumT(" + strconv.Itoa(int(x)) + ")"
+}
+
+type testEnumUT uint8
+
+func (x testEnumUT) String() string { return "U" + strconv.Itoa(int(x)) }
+
+type testEnumHolderT struct {
+	E testEnumT
+	U testEnumUT
+	M map[testEnumT]string
+	S []testEnumT
+}
+
+func doTestVerboseEnums(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping VerboseEnums tests as it is not honored by codecgen")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(verbose, toArray, iterative bool) {
+		bh.VerboseEnums, bh.StructToArray, bh.Iterative = verbose, toArray, iterative
+	}(bh.VerboseEnums, bh.StructToArray, bh.Iterative)
+	bh.StructToArray = false // the maps of value and name are compared with structs
+
+	type verbose struct {
+		Value int64  `codec:"value"`
+		Name  string `codec:"name"`
+	}
+	type verboseU struct {
+		Value uint64 `codec:"value"`
+		Name  string `codec:"name"`
+	}
+	v := testEnumHolderT{E: 1, U: 7, M: map[testEnumT]string{2: "two"}, S: []testEnumT{2, 5}}
+	v0 := struct {
+		E verbose
+		U verboseU
+		M map[int64]string
+		S []verbose
+	}{verbose{1, "Active"}, verboseU{7, "U7"}, map[int64]string{2: "two"},
+		[]verbose{{2, "Inactive"}, {5, "testEnumT(5)"}}}
+	vplain := struct {
+		E int64
+		U uint64
+		M map[int64]string
+		S []int64
+	}{1, 7, map[int64]string{2: "two"}, []int64{2, 5}}
+
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bh.VerboseEnums = true
+		// a map key is encoded as the integer
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-verbose"), testMarshalErr(v0, h, t, name+"-verbose"),
+			t, name+"-verbose")
+		testDeepEqualErr(testMarshalErr(testEnumT(1), h, t, name+"-verbose-top"),
+			testMarshalErr(verbose{1, "Active"}, h, t, name+"-verbose-top"), t, name+"-verbose-top")
+
+		bh.VerboseEnums = false
+		testDeepEqualErr(testMarshalErr(v, h, t, name+"-plain"), testMarshalErr(vplain, h, t, name+"-plain"),
+			t, name+"-plain")
+	}
+
+	// without VerboseEnums, the integers are decoded back
+	var v2 testEnumHolderT
+	testUnmarshalErr(&v2, testMarshalErr(v, h, t, name+"-plain"), h, t, name+"-plain")
+	testDeepEqualErr(v2, v, t, name+"-plain")
+}
+
+type testSharedPtrT struct {
+	A, B *testSharedPtrT
+	I    *int
+	Z    *struct{}
+	S    []*int
+	N    int
+}
+
+func doTestErrorOnSharedPointers(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping ErrorOnSharedPointers tests as it is not honored by codecgen")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(check, iterative bool) {
+		bh.ErrorOnSharedPointers, bh.Iterative = check, iterative
+	}(bh.ErrorOnSharedPointers, bh.Iterative)
+
+	i, j := 1, 2
+	str, strs := "s", []string{"t"}
+	z1, z2 := &struct{}{}, &struct{}{}
+	leaf := &testSharedPtrT{N: 3}
+	distinct := &testSharedPtrT{A: leaf, B: &testSharedPtrT{N: 3}, I: &i, Z: z1, S: []*int{&j}}
+	cases := []struct {
+		name string
+		v    interface{}
+	}{
+		{"fields", &testSharedPtrT{A: leaf, B: leaf}},
+		{"nested", &testSharedPtrT{A: &testSharedPtrT{A: leaf}, B: leaf}},
+		{"int", &testSharedPtrT{I: &i, S: []*int{&i}}},
+		{"slice", []*testSharedPtrT{leaf, leaf}},
+		{"map", map[string]*int{"a": &i, "b": &i}},
+		// pointers to builtin types, held in interfaces, are encoded directly (or via fastpath)
+		{"intf-slice", []interface{}{&str, &str}},
+		{"intf-map", map[string]interface{}{"a": &str, "b": &str}},
+		{"intf-fastpath", []interface{}{&strs, &strs}},
+		{"cycle", func() *testSharedPtrT { x := &testSharedPtrT{}; x.A = x; return x }()},
+	}
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		bh.ErrorOnSharedPointers = false
+		for _, c := range cases[:len(cases)-1] { // expanded in full at each occurrence
+			testMarshalErr(c.v, h, t, name+"-shared-"+c.name)
+		}
+
+		bh.ErrorOnSharedPointers = true
+		for _, c := range cases {
+			_, err := testMarshal(c.v, h)
+			if err != nil && c.name == "cycle" && strings.Contains(err.Error(), "circular reference found") {
+				continue // CheckCircularRef may catch it first
+			}
+			if err == nil || !strings.Contains(err.Error(), "shared pointer found") {
+				t.Fatalf("%s: %s: expected a shared pointer error, got: %v", name, c.name, err)
+			}
+		}
+		// distinct pointers (and values of zero size, or reused across top-level values) are fine
+		var b []byte
+		e := NewEncoderBytes(&b, h)
+		for k := 0; k < 2; k++ {
+			testCheckErr(t, e.Encode(distinct))
+		}
+		testMarshalErr([]*struct{}{z1, z2, z1}, h, t, name+"-shared-zero")
+		testMarshalErr([]interface{}{&str, &j, &strs}, h, t, name+"-distinct-intf")
+	}
+}
+
+func doTestTimeEncoding(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	if codecgen {
+		t.Skipf("skipping TimeEncoding tests as it is not honored by codecgen")
+	}
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(v TimeEncoding, layout string) {
+		bh.TimeEncoding, bh.TimeLayout = v, layout
+	}(bh.TimeEncoding, bh.TimeLayout)
+	bh.TimeLayout = "2006-01-02" // TimeEncoding takes precedence
+
+	days := []struct {
+		y, m, d       int
+		week, ordinal string
+	}{
+		{2024, 1, 31, "2024-W05-3", "2024-031"},
+		{2024, 2, 4, "2024-W05-7", "2024-035"},
+		{2023, 12, 31, "2023-W52-7", "2023-365"},
+		// late December in week 1 of the next year, and early January in the last week of the previous one
+		{2024, 12, 30, "2025-W01-1", "2024-365"},
+		{2021, 1, 1, "2020-W53-5", "2021-001"},
+		// the last day of a leap year, and of a year with 53 weeks
+		{2024, 12, 31, "2025-W01-2", "2024-366"},
+		{2020, 12, 31, "2020-W53-4", "2020-366"},
+		{2026, 12, 31, "2026-W53-4", "2026-365"},
+	}
+	for _, te := range []TimeEncoding{TimeISOWeekDate, TimeOrdinalDate} {
+		bh.TimeEncoding = te
+		for _, x := range days {
+			s := x.week
+			if te == TimeOrdinalDate {
+				s = x.ordinal
+			}
+			day := time.Date(x.y, time.Month(x.m), x.d, 0, 0, 0, 0, time.UTC)
+			// the date is that of the time in its location
+			tm := time.Date(x.y, time.Month(x.m), x.d, 23, 30, 0, 0, time.FixedZone("", -5*3600))
+			bs := testMarshalErr(tm, h, t, name+"-timeenc-"+s)
+			testDeepEqualErr(bs, testMarshalErr(s, h, t, name+"-timeenc-"+s), t, name+"-timeenc-"+s)
+			var t2 time.Time
+			testUnmarshalErr(&t2, bs, h, t, name+"-timeenc-"+s)
+			testDeepEqualErr(t2, day, t, name+"-timeenc-"+s)
+		}
+		testDeepEqualErr(testMarshalErr(time.Time{}, h, t, name+"-timeenc-zero"),
+			testMarshalErr(nil, h, t, name+"-timeenc-zero"), t, name+"-timeenc-zero")
+	}
+
+	// invalid dates, including a week 53 or day 366 which the year does not have
+	for _, x := range []struct {
+		te TimeEncoding
+		s  string
+	}{
+		{TimeISOWeekDate, "2023-W53-1"}, {TimeISOWeekDate, "2024-W00-1"}, {TimeISOWeekDate, "2024-W01-8"},
+		{TimeISOWeekDate, "2024-05-3"}, {TimeOrdinalDate, "2023-366"}, {TimeOrdinalDate, "2024-000"},
+		{TimeOrdinalDate, "2024-35"}, {TimeOrdinalDate, "2024-03-05"},
+	} {
+		bh.TimeEncoding = x.te
+		var t2 time.Time
+		if err := testUnmarshal(&t2, testMarshalErr(x.s, h, t, name+"-timeenc-err"), h); err == nil {
+			t.Fatalf("%s: expected error decoding an invalid date: %q", name, x.s)
+		}
+	}
+	bh.TimeEncoding = TimeISOWeekDate
+	if _, err := testMarshal(time.Date(10000, 6, 1, 0, 0, 0, 0, time.UTC), h); err == nil {
+		t.Fatalf("%s: expected error encoding a year with more than 4 digits", name)
+	}
+}
+
+type testNonDefaultInnerT struct {
+	Host string
+	Port int
+	Tags []string
+}
+
+type testNonDefaultT struct {
+	Name   string
+	Debug  bool `codec:",omitempty"`
+	Server testNonDefaultInnerT
+	Backup *testNonDefaultInnerT
+	Limits map[string]int
+	Start  time.Time
+}
+
+func doTestEncodeNonDefault(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical, toArray bool) {
+		bh.Canonical, bh.StructToArray = canonical, toArray
+	}(bh.Canonical, bh.StructToArray)
+	bh.Canonical, bh.StructToArray = true, false // compared with the encoding of structs and maps
+
+	newDefaults := func() testNonDefaultT {
+		return testNonDefaultT{
+			Name:   "app",
+			Server: testNonDefaultInnerT{Host: "localhost", Port: 80, Tags: []string{"a"}},
+			Backup: &testNonDefaultInnerT{Host: "backup", Port: 81},
+			Limits: map[string]int{"x": 1},
+		}
+	}
+	nonDefault := func(v, defaults interface{}) []byte {
+		var b []byte
+		testCheckErr(t, NewEncoderBytes(&b, h).EncodeNonDefault(v, defaults))
+		return b
+	}
+
+	defaults := newDefaults()
+	v := newDefaults()
+	v.Server.Port = 8080
+	v.Backup.Host = "backup2"
+	v.Limits = map[string]int{"x": 1, "y": 2}
+	// only the differing fields, including those of nested structs (through pointers)
+	testDeepEqualErr(nonDefault(&v, &defaults), testMarshalErr(struct {
+		Server struct{ Port int }
+		Backup struct{ Host string }
+		Limits map[string]int
+	}{struct{ Port int }{8080}, struct{ Host string }{"backup2"}, v.Limits}, h, t, name+"-nondefault"),
+		t, name+"-nondefault")
+
+	// decoding into the defaults gives back the value
+	d := newDefaults()
+	testUnmarshalErr(&d, nonDefault(v, defaults), h, t, name+"-nondefault")
+	testDeepEqualErr(d, v, t, name+"-nondefault")
+
+	// equal to the defaults
+	testDeepEqualErr(nonDefault(v, v), testMarshalErr(map[string]int{}, h, t, name+"-nondefault-equal"),
+		t, name+"-nondefault-equal")
+
+	// a nil pointer against a non-nil one, and a struct with a custom encoding, are compared whole
+	v = newDefaults()
+	v.Backup, v.Debug = nil, true
+	v.Start = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	testDeepEqualErr(nonDefault(v, defaults), testMarshalErr(struct {
+		Debug  bool
+		Backup *testNonDefaultInnerT
+		Start  time.Time
+	}{true, nil, v.Start}, h, t, name+"-nondefault-whole"), t, name+"-nondefault-whole")
+
+	// no defaults: the differences from the zero value
+	testDeepEqualErr(nonDefault(testNonDefaultT{Name: "x", Server: testNonDefaultInnerT{Tags: []string{}}}, nil),
+		testMarshalErr(struct {
+			Name   string
+			Server struct{ Tags []string }
+		}{"x", struct{ Tags []string }{[]string{}}}, h, t, name+"-nondefault-nil"), t, name+"-nondefault-nil")
+
+	var b []byte
+	if err := NewEncoderBytes(&b, h).EncodeNonDefault(v, testNonDefaultInnerT{}); err == nil {
+		t.Fatalf("%s: expected error for defaults of a different type", name)
+	}
+	if err := NewEncoderBytes(&b, h).EncodeNonDefault(1, 1); err == nil {
+		t.Fatalf("%s: expected error for a value which is not a struct", name)
+	}
+}
+
+func doTestResetBytesFixed(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	v := []interface{}{"one", 2, map[string]interface{}{"three": 3.5}, []byte("four")}
+	bs0 := testMarshalErr(v, h, t, name+"-fixed")
+
+	var arr [256]byte
+	e := NewEncoderBytes(nil, h)
+	e.ResetBytesFixed(arr[:])
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(arr[:e.NumBytesWritten()], bs0, t, name+"-fixed")
+
+	// it fits exactly
+	buf := make([]byte, len(bs0), len(bs0)+16)
+	e.ResetBytesFixed(buf)
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(buf[:e.NumBytesWritten()], bs0, t, name+"-fixed-exact")
+
+	// it does not fit: the error has the length needed, including values written before
+	var bs2 []byte
+	e2 := NewEncoderBytes(&bs2, h)
+	testCheckErr(t, e2.Encode(v))
+	testCheckErr(t, e2.Encode(v)) // may differ from bs0 e.g. reusing binc symbols
+	e.ResetBytesFixed(arr[:len(bs0)+4])
+	testCheckErr(t, e.Encode(v))
+	err := e.Encode(v)
+	serr, ok := err.(*ShortBufferError)
+	if !ok {
+		t.Fatalf("%s: expected a *ShortBufferError, got: %T: %v", name, err, err)
+	}
+	testDeepEqualErr(serr.N, len(bs2), t, name+"-fixed-short")
+
+	e.ResetBytesFixed(arr[:serr.N])
+	testCheckErr(t, e.Encode(v))
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(arr[:e.NumBytesWritten()], bs2, t, name+"-fixed-retry")
+
+	// ResetBytes grows the output as usual
+	var b []byte
+	e.ResetBytes(&b)
+	testCheckErr(t, e.Encode(v))
+	testDeepEqualErr(b, bs0, t, name+"-fixed-reset")
+}
+
+type testCommentT struct {
+	Name  string `codec:"name,comment=the name, as shown"`
+	Port  int    `codec:"port,omitempty,comment=line one\nline two\n"`
+	Inner struct {
+		A int `codec:"a,comment=nested"`
+	} `codec:"inner"`
+	Plain bool
+}
+
+func doTestJsonAllowComments(t *testing.T, h *JsonHandle) {
+	defer testSetup(t, nil)()
+	if codecgen {
+		t.Skipf("skipping comment tests as it is not honored by codecgen")
+	}
+	h = testHandleCopy(h).(*JsonHandle)
+	h.StructToArray, h.Canonical = false, false
+	name := "json"
+	var v testCommentT
+	v.Name, v.Port, v.Inner.A = "x", 8, 1
+	const want = `{
+  // the name, as shown
+  "name": "x",
+  // line one
+  // line two
+  //
+  "port": 8,
+  "inner": {
+    // nested
+    "a": 1
+  },
+  "Plain": false
+}`
+	for _, iterative := range []bool{false, true} {
+		h.Iterative, h.Indent, h.AllowComments = iterative, 2, true
+		testDeepEqualErr(string(testMarshalErr(&v, h, t, name+"-comments")), want, t, name+"-comments")
+
+		// only when indenting and AllowComments
+		h.AllowComments = false
+		plain := testMarshalErr(&v, h, t, name+"-comments-off")
+		testDeepEqualErr(bytes.Contains(plain, []byte("//")), false, t, name+"-comments-off")
+		h.AllowComments, h.Indent = true, 0
+		testDeepEqualErr(string(testMarshalErr(&v, h, t, name+"-comments-compact")),
+			`{"name":"x","port":8,"inner":{"a":1},"Plain":false}`, t, name+"-comments-compact")
+	}
+
+	// other formats ignore it, and the tag name is unchanged
+	var v2 testCommentT
+	testUnmarshalErr(&v2, testMarshalErr(&v, testCborH, t, name+"-comments-cbor"), testCborH, t, name+"-comments-cbor")
+	testDeepEqualErr(v2, v, t, name+"-comments-cbor")
+}
+
+type testIterOptsE struct {
+	K string
+	V int
+}
+
+// testIterOptsT has a field for each tag option which changes how a value is encoded,
+// and nests itself through slices, maps and interfaces so they are walked iteratively.
+type testIterOptsT struct {
+	Set    []int                  `codec:"set,set"`
+	Rev    []string               `codec:"rev,reverse"`
+	By     []testIterOptsE        `codec:"by,sortby=K"`
+	Pad    int                    `codec:"pad,pad=6"`
+	Secret string                 `codec:"secret,redact"`
+	JS     map[string]int         `codec:"js,jsonstring"`
+	Note   int                    `codec:"note,comment=a note\nover 2 lines"`
+	Code   string                 `codec:"code,omitempty"`
+	Detail string                 `codec:"detail,requires=code"`
+	N      int                    `codec:"n,lenof=rev"`
+	Enum   testEnumT              `codec:"enum"`
+	Time   time.Time              `codec:"time"`
+	Ptr    *string                `codec:"ptr"`
+	Zero   int                    `codec:"zero"`
+	Any    interface{}            `codec:"any"`
+	Kids   []*testIterOptsT       `codec:"kids"`
+	M      map[string]interface{} `codec:"m"`
+}
+
+func doTestIterativeOptions(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	if codecgen {
+		t.Skipf("skipping Iterative tests as it is not honored by codecgen")
+	}
+	newv := func() *testIterOptsT {
+		s := "p"
+		leaf := func(i int) *testIterOptsT {
+			return &testIterOptsT{
+				Set:    []int{3, 1, 3, i},
+				Rev:    []string{"a", "b", "c"},
+				By:     []testIterOptsE{{"z", i}, {"a", 1}, {"m", 2}},
+				Pad:    42 + i,
+				Secret: "hush",
+				JS:     map[string]int{"x": i, "y": 2},
+				Note:   i,
+				Detail: "skipped, as code is empty",
+				Enum:   testEnumT(i % 3),
+				Time:   time.Date(2021, 3, 4+i, 5, 6, 7, 0, time.UTC),
+				Ptr:    &s,
+				Any:    []interface{}{"i", i, map[string]interface{}{"d": time.Duration(i)}},
+				M:      map[string]interface{}{"a": i, "b": []int{1, 2, 3}, "c": nil, "d": ""},
+			}
+		}
+		v := leaf(0)
+		v.Code = "E1"
+		v.Kids = []*testIterOptsT{leaf(1), nil, leaf(2)}
+		v.Kids[2].Kids = []*testIterOptsT{leaf(3)}
+		v.Any = map[string]interface{}{"k": leaf(4), "l": []interface{}{leaf(5), 5}}
+		v.M["kid"] = leaf(6)
+		return v
+	}
+
+	for _, c := range []struct {
+		name string
+		opts func(bh *BasicHandle)
+	}{
+		{"default", func(bh *BasicHandle) {}},
+		{"struct-to-array", func(bh *BasicHandle) { bh.StructToArray = true }},
+		{"key-dictionary", func(bh *BasicHandle) {
+			bh.KeyDictionary = map[string]string{"set": "1", "kids": "2", "a": "3"}
+		}},
+		{"map-key-filter", func(bh *BasicHandle) {
+			bh.MapKeyFilter = func(k reflect.Value) bool { return k.Kind() != reflect.String || k.String() != "b" }
+		}},
+		{"skip-map-value-kinds", func(bh *BasicHandle) { bh.SkipMapValueKinds = []reflect.Kind{reflect.String} }},
+		{"max-collection-elements", func(bh *BasicHandle) { bh.MaxCollectionElements = 2 }},
+		{"string-key-less", func(bh *BasicHandle) { bh.StringKeyLess = func(a, b string) bool { return a > b } }},
+		{"omitempty-by-default", func(bh *BasicHandle) { bh.OmitEmptyByDefault = true }},
+		{"zero-as-null", func(bh *BasicHandle) { bh.ZeroAsNull, bh.RecursiveEmptyCheck = true, true }},
+		{"verbose-enums", func(bh *BasicHandle) { bh.VerboseEnums = true }},
+		{"time-encoding", func(bh *BasicHandle) { bh.TimeEncoding = TimeISOWeekDate }},
+		{"unredact", func(bh *BasicHandle) { bh.Unredact = true }},
+		{"tagged-interfaces", func(bh *BasicHandle) {
+			bh.TaggedInterfaces = true
+			for i, v := range []interface{}{"", 0, []interface{}{}, map[string]interface{}{},
+				time.Duration(0), testIterOptsT{}, []int{}} {
+				testCheckErr(t, bh.RegisterCompactType(uint8(i+1), v))
+			}
+		}},
+		{"check-circular-ref", func(bh *BasicHandle) { bh.CheckCircularRef = true }},
+		{"share-references", func(bh *BasicHandle) { bh.ShareReferences = true }},
+		{"empty-array-as-null", func(bh *BasicHandle) { bh.EmptyArrayAsNull, bh.BoolAsInt = true, true }},
+		{"set-as-array", func(bh *BasicHandle) { bh.SetAsArray = true }},
+		{"wrap-scalars", func(bh *BasicHandle) { bh.WrapScalarsKey = "value" }},
+		{"type-field-name", func(bh *BasicHandle) {
+			bh.TypeFieldName = "type"
+			testCheckErr(t, bh.SetTypeName(reflect.TypeOf(testIterOptsT{}), "opts"))
+		}},
+	} {
+		// a copy of the handle (uninited, so SetTypeName can be called), per case
+		h2 := testHandleUninited(h)
+		bh := testBasicHandle(h2)
+		bh.Canonical = true // so map ordering is deterministic
+		if jh, ok := h2.(*JsonHandle); ok {
+			jh.Indent, jh.AllowComments = 2, true // so comments are written
+		}
+		c.opts(bh)
+		bh.Iterative = false
+		b1 := testMarshalErr(newv(), h2, t, name+"-"+c.name+"-recursive")
+		bh.Iterative = true
+		b2 := testMarshalErr(newv(), h2, t, name+"-"+c.name+"-iterative")
+		if !bytes.Equal(b1, b2) {
+			j := 0
+			for j < len(b1)-1 && j < len(b2)-1 && b1[j] == b2[j] {
+				j++
+			}
+			t.Fatalf("%s: %s: iterative output differs from recursive output at offset %d: %q, %q",
+				name, c.name, j, b1[:j+1], b2[:j+1])
+		}
+	}
+
+	// an error (not an overflow of the work stack) if nested deeper than IterativeMaxDepth
+	bh := testBasicHandle(h)
+	defer func(iterative bool, maxDepth int) {
+		bh.Iterative, bh.IterativeMaxDepth = iterative, maxDepth
+	}(bh.Iterative, bh.IterativeMaxDepth)
+	bh.Iterative, bh.IterativeMaxDepth = true, 100
+	var deep interface{} = "leaf"
+	for i := 0; i < 100; i++ {
+		deep = []interface{}{deep}
+	}
+	testMarshalErr(deep, h, t, name+"-iterative-max-depth")
+	_, err := testMarshal([]interface{}{deep}, h)
+	if err == nil || !strings.Contains(err.Error(), "maximum encoding depth exceeded") {
+		t.Fatalf("%s: expected a maximum encoding depth error, got: %v", name, err)
+	}
+}
+
+// BenchmarkIterative compares the throughput of encoding iteratively against recursively.
+func BenchmarkIterative(b *testing.B) {
+	testOnce.Do(testInitAll)
+	v := newTestStrucFlex(testDepth, testNumRepeatString, true, !testSkipIntf, testMapStringKeyOnly)
+	for _, h := range []Handle{testJsonH, testCborH, testMsgpackH} {
+		for _, iterative := range []bool{false, true} {
+			h2 := testHandleCopy(h)
+			testBasicHandle(h2).Iterative = iterative
+			b.Run(fmt.Sprintf("%s/iterative=%v", h.Name(), iterative), func(b *testing.B) {
+				b.ReportAllocs()
+				var bs []byte
+				e := NewEncoderBytes(&bs, h2)
+				for i := 0; i < b.N; i++ {
+					e.ResetBytes(&bs)
+					if err := e.Encode(v); err != nil {
+						b.Fatal(err)
+					}
+					b.SetBytes(int64(len(bs)))
+					bs = bs[:0]
+				}
+			})
+		}
+	}
+}
+
+func TestMapRangeIndex(t *testing.T) {
+	defer testSetup(t, nil)()
+	// t.Skip()
+	type T struct {
+		I int
+		S string
+		B bool
+		M map[int]T
+	}
+
+	t1 := T{I: 1, B: true, S: "11", M: map[int]T{11: T{I: 11}}}
+	t2 := T{I: 1, B: true, S: "12", M: map[int]T{12: T{I: 12}}}
+
+	// ------
+
+	var m1 = map[string]*T{
+		"11": &t1,
+		"12": &t2,
+	}
+	var m1c = make(map[string]T)
+	for k, v := range m1 {
+		m1c[k] = *v
+	}
+
+	fnrv := func(r1, r2 reflect.Value) reflect.Value {
+		if r1.IsValid() {
+			return r1
+		}
+		return r2
+	}
+
+	// var vx reflect.Value
+
+	mt := reflect.TypeOf(m1)
+	rvk := mapAddrLoopvarRV(mt.Key(), mt.Key().Kind())
+	rvv := mapAddrLoopvarRV(mt.Elem(), mt.Elem().Kind())
+	var it mapIter
+	mapRange(&it, reflect.ValueOf(m1), rvk, rvv, true)
+	for it.Next() {
+		k := fnrv(it.Key(), rvk).Interface().(string)
+		v := fnrv(it.Value(), rvv).Interface().(*T)
+		testDeepEqualErr(m1[k], v, t, "map-key-eq-it-key")
+		if _, ok := m1c[k]; ok {
+			delete(m1c, k)
+		} else {
+			t.Logf("unexpected key in map: %v", k)
+			t.FailNow()
+		}
+	}
+	it.Done()
+	testDeepEqualErr(len(m1c), 0, t, "all-keys-not-consumed")
+
+	// ------
+
+	var m2 = map[*T]T{
+		&t1: t1,
+		&t2: t2,
+	}
+	var m2c = make(map[*T]*T)
+	for k := range m2 {
+		m2c[k] = k
+	}
+
+	mt = reflect.TypeOf(m2)
+	rvk = mapAddrLoopvarRV(mt.Key(), mt.Key().Kind())
+	rvv = mapAddrLoopvarRV(mt.Elem(), mt.Elem().Kind())
+	it = mapIter{} // zero it out first, before calling mapRange
+	mapRange(&it, reflect.ValueOf(m2), rvk, rvv, true)
+	for it.Next() {
+		k := fnrv(it.Key(), rvk).Interface().(*T)
+		v := fnrv(it.Value(), rvv).Interface().(T)
+		testDeepEqualErr(m2[k], v, t, "map-key-eq-it-key")
+		if _, ok := m2c[k]; ok {
+			delete(m2c, k)
+		} else {
+			t.Logf("unexpected key in map: %v", k)
+			t.FailNow()
+		}
+	}
+	it.Done()
+	testDeepEqualErr(len(m2c), 0, t, "all-keys-not-consumed")
+
+	// ---- test mapGet
+
+	fnTestMapIndex := func(mi ...interface{}) {
+		for _, m0 := range mi {
+			m := reflect.ValueOf(m0)
+			mkt := m.Type().Key()
+			mvt := m.Type().Elem()
+			kfast := mapKeyFastKindFor(mkt.Kind())
+			rvv := mapAddrLoopvarRV(mvt, mvt.Kind())
+			visindirect := mapStoresElemIndirect(mvt.Size())
+			visref := refBitset.isset(byte(mvt.Kind()))
+
+			for _, k := range m.MapKeys() {
+				mg := mapGet(m, k, rvv, kfast, visindirect, visref).Interface()
+				testDeepEqualErr(m.MapIndex(k).Interface(), mg, t, "map-index-eq")
+			}
+		}
+	}
+
+	fnTestMapIndex(m1, m1c, m2, m2c)
+
+	// var s string = "hello"
+	// var tt = &T{I: 3}
+	// ttTyp := reflect.TypeOf(tt)
+	// _, _ = tt, ttTyp
+	// mv := reflect.ValueOf(m)
+	// it := mapRange(mv, reflect.ValueOf(&s).Elem(), reflect.ValueOf(&tt).Elem(), true) //ok
+	// it := mapRange(mv, reflect.New(reflect.TypeOf(s)).Elem(), reflect.New(reflect.TypeOf(T{})).Elem(), true) // ok
+	// it := mapRange(mv, reflect.New(reflect.TypeOf(s)).Elem(), reflect.New(ttTyp.Elem()), true) // !ok
+	// it := mapRange(mv, reflect.New(reflect.TypeOf(s)).Elem(), reflect.New(reflect.TypeOf(T{})), true) !ok
+	// it := mapRange(mv, reflect.New(reflect.TypeOf(s)).Elem(), reflect.New(reflect.TypeOf(T{})).Elem(), true) // ok
+
+	// fmt.Printf("key: %#v\n", it.Key())
+	// fmt.Printf("exp: %#v\n", mv.MapIndex(it.Key()))
+	// fmt.Printf("val: %#v\n", it.Value())
+	// testDeepEqualErr(mv.MapIndex(it.Key()), it.Value().Interface()
+}
+
+// ----------
+
+func TestBincCodecsTable(t *testing.T) {
+	doTestCodecTableOne(t, testBincH)
+}
+
+func TestBincCodecsMisc(t *testing.T) {
+	doTestCodecMiscOne(t, testBincH)
+}
+
+func TestBincCodecsEmbeddedPointer(t *testing.T) {
+	doTestCodecEmbeddedPointer(t, testBincH)
+}
+
+func TestBincStdEncIntf(t *testing.T) {
+	doTestStdEncIntf(t, testBincH)
+}
+
+func TestSimpleCodecsTable(t *testing.T) {
+	doTestCodecTableOne(t, testSimpleH)
+}
+
+func TestSimpleCodecsMisc(t *testing.T) {
+	doTestCodecMiscOne(t, testSimpleH)
+}
+
+func TestSimpleCodecsEmbeddedPointer(t *testing.T) {
+	doTestCodecEmbeddedPointer(t, testSimpleH)
+}
+
+func TestSimpleStdEncIntf(t *testing.T) {
+	doTestStdEncIntf(t, testSimpleH)
+}
+
+func TestMsgpackCodecsTable(t *testing.T) {
+	doTestCodecTableOne(t, testMsgpackH)
+}
+
+func TestMsgpackCodecsMisc(t *testing.T) {
+	doTestCodecMiscOne(t, testMsgpackH)
+}
+
+func TestMsgpackCodecsEmbeddedPointer(t *testing.T) {
+	doTestCodecEmbeddedPointer(t, testMsgpackH)
+}
+
+func TestMsgpackStdEncIntf(t *testing.T) {
+	doTestStdEncIntf(t, testMsgpackH)
+}
+
+func TestCborCodecsTable(t *testing.T) {
+	doTestCodecTableOne(t, testCborH)
+}
+
+func TestCborCodecsMisc(t *testing.T) {
+	doTestCodecMiscOne(t, testCborH)
+}
+
+func TestCborCodecsEmbeddedPointer(t *testing.T) {
+	doTestCodecEmbeddedPointer(t, testCborH)
+}
+
+func TestCborCodecChan(t *testing.T) {
+	doTestCodecChan(t, testCborH)
+}
+
+func TestCborStdEncIntf(t *testing.T) {
+	doTestStdEncIntf(t, testCborH)
+}
+
+func TestJsonCodecsTable(t *testing.T) {
+	doTestCodecTableOne(t, testJsonH)
+}
+
+func TestJsonCodecsMisc(t *testing.T) {
+	doTestCodecMiscOne(t, testJsonH)
+}
+
+func TestJsonCodecsEmbeddedPointer(t *testing.T) {
+	doTestCodecEmbeddedPointer(t, testJsonH)
+}
+
+func TestJsonCodecChan(t *testing.T) {
+	doTestCodecChan(t, testJsonH)
+}
+
+func TestJsonStdEncIntf(t *testing.T) {
+	doTestStdEncIntf(t, testJsonH)
+}
+
+// ----- Raw ---------
+func TestJsonRaw(t *testing.T) {
+	doTestRawValue(t, testJsonH)
+}
+func TestBincRaw(t *testing.T) {
+	doTestRawValue(t, testBincH)
+}
+func TestMsgpackRaw(t *testing.T) {
+	doTestRawValue(t, testMsgpackH)
+}
+func TestSimpleRaw(t *testing.T) {
+	doTestRawValue(t, testSimpleH)
+}
+func TestCborRaw(t *testing.T) {
+	doTestRawValue(t, testCborH)
+}
+
+// ----- ALL (framework based) -----
+
+func TestAllEncCircularRef(t *testing.T) {
+	doTestEncCircularRef(t, testCborH)
+}
+
+func TestAllAnonCycle(t *testing.T) {
+	doTestAnonCycle(t, testCborH)
+}
+
+func TestAllErrWriter(t *testing.T) {
+	doTestAllErrWriter(t, testCborH, testJsonH)
+}
+
+// ----- RPC custom -----
+
+func TestMsgpackRpcSpec(t *testing.T) {
+	doTestCodecRpcOne(t, MsgpackSpecRpc, testMsgpackH, true, 0)
+}
+
+// ----- RPC -----
+
+func TestBincRpcGo(t *testing.T) {
+	doTestCodecRpcOne(t, GoRpc, testBincH, true, 0)
+}
+
+func TestSimpleRpcGo(t *testing.T) {
+	doTestCodecRpcOne(t, GoRpc, testSimpleH, true, 0)
+}
+
+func TestMsgpackRpcGo(t *testing.T) {
+	doTestCodecRpcOne(t, GoRpc, testMsgpackH, true, 0)
+}
+
+func TestCborRpcGo(t *testing.T) {
+	doTestCodecRpcOne(t, GoRpc, testCborH, true, 0)
+}
+
+func TestJsonRpcGo(t *testing.T) {
+	doTestCodecRpcOne(t, GoRpc, testJsonH, true, 0)
+}
+
+// ----- OTHERS -----
+
+func TestBincMapEncodeForCanonical(t *testing.T) {
+	t.Skipf("skipping ... needs investigation") // MARKER: testing fails??? Need to research
+	doTestMapEncodeForCanonical(t, testBincH)
+}
+
+func TestSimpleMapEncodeForCanonical(t *testing.T) {
+	doTestMapEncodeForCanonical(t, testSimpleH)
+}
+
+func TestMsgpackMapEncodeForCanonical(t *testing.T) {
+	doTestMapEncodeForCanonical(t, testMsgpackH)
+}
+
+func TestCborMapEncodeForCanonical(t *testing.T) {
+	doTestMapEncodeForCanonical(t, testCborH)
+}
+
+func TestJsonMapEncodeForCanonical(t *testing.T) {
+	doTestMapEncodeForCanonical(t, testJsonH)
+}
+
+func TestBincUnderlyingType(t *testing.T) {
+	testCodecUnderlyingType(t, testBincH)
+}
+
+func TestJsonSwallowAndZero(t *testing.T) {
+	doTestSwallowAndZero(t, testJsonH)
+}
+
+func TestCborSwallowAndZero(t *testing.T) {
+	doTestSwallowAndZero(t, testCborH)
+}
+
+func TestMsgpackSwallowAndZero(t *testing.T) {
+	doTestSwallowAndZero(t, testMsgpackH)
+}
+
+func TestBincSwallowAndZero(t *testing.T) {
+	doTestSwallowAndZero(t, testBincH)
+}
+
+func TestSimpleSwallowAndZero(t *testing.T) {
+	doTestSwallowAndZero(t, testSimpleH)
+}
+
+func TestJsonRawExt(t *testing.T) {
+	doTestRawExt(t, testJsonH)
+}
+
+func TestCborRawExt(t *testing.T) {
+	doTestRawExt(t, testCborH)
+}
+
+func TestMsgpackRawExt(t *testing.T) {
+	doTestRawExt(t, testMsgpackH)
+}
+
+func TestBincRawExt(t *testing.T) {
+	doTestRawExt(t, testBincH)
+}
+
+func TestSimpleRawExt(t *testing.T) {
+	doTestRawExt(t, testSimpleH)
+}
+
+func TestJsonMapStructKey(t *testing.T) {
+	doTestMapStructKey(t, testJsonH)
+}
+
+func TestCborMapStructKey(t *testing.T) {
+	doTestMapStructKey(t, testCborH)
+}
+
+func TestMsgpackMapStructKey(t *testing.T) {
+	doTestMapStructKey(t, testMsgpackH)
+}
+
+func TestBincMapStructKey(t *testing.T) {
+	doTestMapStructKey(t, testBincH)
+}
+
+func TestSimpleMapStructKey(t *testing.T) {
+	doTestMapStructKey(t, testSimpleH)
+}
+
+func TestJsonDecodeNilMapValue(t *testing.T) {
+	doTestDecodeNilMapValue(t, testJsonH)
+}
+
+func TestCborDecodeNilMapValue(t *testing.T) {
+	doTestDecodeNilMapValue(t, testCborH)
+}
+
+func TestMsgpackDecodeNilMapValue(t *testing.T) {
+	doTestDecodeNilMapValue(t, testMsgpackH)
+}
+
+func TestBincDecodeNilMapValue(t *testing.T) {
+	doTestDecodeNilMapValue(t, testBincH)
+}
+
+func TestSimpleDecodeNilMapValue(t *testing.T) {
+	doTestDecodeNilMapValue(t, testSimpleH)
+}
+
+func TestJsonEmbeddedFieldPrecedence(t *testing.T) {
+	doTestEmbeddedFieldPrecedence(t, testJsonH)
+}
+
+func TestCborEmbeddedFieldPrecedence(t *testing.T) {
+	doTestEmbeddedFieldPrecedence(t, testCborH)
+}
+
+func TestMsgpackEmbeddedFieldPrecedence(t *testing.T) {
+	doTestEmbeddedFieldPrecedence(t, testMsgpackH)
+}
+
+func TestBincEmbeddedFieldPrecedence(t *testing.T) {
+	doTestEmbeddedFieldPrecedence(t, testBincH)
+}
+
+func TestSimpleEmbeddedFieldPrecedence(t *testing.T) {
+	doTestEmbeddedFieldPrecedence(t, testSimpleH)
+}
+
+func TestJsonLargeContainerLen(t *testing.T) {
+	doTestLargeContainerLen(t, testJsonH)
+}
+
+func TestCborLargeContainerLen(t *testing.T) {
+	doTestLargeContainerLen(t, testCborH)
+}
+
+func TestMsgpackLargeContainerLen(t *testing.T) {
+	doTestLargeContainerLen(t, testMsgpackH)
+}
+
+func TestBincLargeContainerLen(t *testing.T) {
+	doTestLargeContainerLen(t, testBincH)
+}
+
+func TestSimpleLargeContainerLen(t *testing.T) {
+	doTestLargeContainerLen(t, testSimpleH)
+}
+
+func TestJsonTime(t *testing.T) {
+	doTestTime(t, testJsonH)
+}
+
+func TestCborTime(t *testing.T) {
+	doTestTime(t, testCborH)
+}
+
+func TestMsgpackTime(t *testing.T) {
+	doTestTime(t, testMsgpackH)
+}
+
+func TestBincTime(t *testing.T) {
+	doTestTime(t, testBincH)
+}
+
+func TestSimpleTime(t *testing.T) {
+	doTestTime(t, testSimpleH)
+}
+
+func TestJsonUintToInt(t *testing.T) {
+	doTestUintToInt(t, testJsonH)
+}
+
+func TestCborUintToInt(t *testing.T) {
+	doTestUintToInt(t, testCborH)
+}
+
+func TestMsgpackUintToInt(t *testing.T) {
+	doTestUintToInt(t, testMsgpackH)
+}
+
+func TestBincUintToInt(t *testing.T) {
+	doTestUintToInt(t, testBincH)
+}
+
+func TestSimpleUintToInt(t *testing.T) {
+	doTestUintToInt(t, testSimpleH)
+}
+
+func TestJsonDifferentMapOrSliceType(t *testing.T) {
+	doTestDifferentMapOrSliceType(t, testJsonH)
+}
+
+func TestCborDifferentMapOrSliceType(t *testing.T) {
+	doTestDifferentMapOrSliceType(t, testCborH)
+}
+
+func TestMsgpackDifferentMapOrSliceType(t *testing.T) {
+	doTestDifferentMapOrSliceType(t, testMsgpackH)
+}
+
+func TestBincDifferentMapOrSliceType(t *testing.T) {
+	doTestDifferentMapOrSliceType(t, testBincH)
+}
+
+func TestSimpleDifferentMapOrSliceType(t *testing.T) {
+	doTestDifferentMapOrSliceType(t, testSimpleH)
+}
+
+func TestJsonScalars(t *testing.T) {
+	doTestScalars(t, testJsonH)
+}
+
+func TestCborScalars(t *testing.T) {
+	doTestScalars(t, testCborH)
+}
+
+func TestMsgpackScalars(t *testing.T) {
+	doTestScalars(t, testMsgpackH)
+}
+
+func TestBincScalars(t *testing.T) {
+	doTestScalars(t, testBincH)
+}
+
+func TestSimpleScalars(t *testing.T) {
+	doTestScalars(t, testSimpleH)
+}
+
+func TestJsonOmitempty(t *testing.T) {
+	doTestOmitempty(t, testJsonH)
+}
+
+func TestCborOmitempty(t *testing.T) {
+	doTestOmitempty(t, testCborH)
+}
+
+func TestMsgpackOmitempty(t *testing.T) {
+	doTestOmitempty(t, testMsgpackH)
+}
+
+func TestBincOmitempty(t *testing.T) {
+	doTestOmitempty(t, testBincH)
+}
+
+func TestSimpleOmitempty(t *testing.T) {
+	doTestOmitempty(t, testSimpleH)
+}
+
+func TestJsonIntfMapping(t *testing.T) {
+	doTestIntfMapping(t, testJsonH)
+}
+
+func TestCborIntfMapping(t *testing.T) {
+	doTestIntfMapping(t, testCborH)
+}
+
+func TestMsgpackIntfMapping(t *testing.T) {
+	doTestIntfMapping(t, testMsgpackH)
+}
+
+func TestBincIntfMapping(t *testing.T) {
+	doTestIntfMapping(t, testBincH)
+}
+
+func TestSimpleIntfMapping(t *testing.T) {
+	doTestIntfMapping(t, testSimpleH)
+}
+
+func TestJsonMissingFields(t *testing.T) {
+	doTestMissingFields(t, testJsonH)
+}
+
+func TestCborMissingFields(t *testing.T) {
+	doTestMissingFields(t, testCborH)
+}
+
+func TestMsgpackMissingFields(t *testing.T) {
+	doTestMissingFields(t, testMsgpackH)
+}
+
+func TestBincMissingFields(t *testing.T) {
+	doTestMissingFields(t, testBincH)
+}
+
+func TestSimpleMissingFields(t *testing.T) {
+	doTestMissingFields(t, testSimpleH)
+}
+
+func TestJsonMaxDepth(t *testing.T) {
+	doTestMaxDepth(t, testJsonH)
+}
+
+func TestCborMaxDepth(t *testing.T) {
+	doTestMaxDepth(t, testCborH)
+}
+
+func TestMsgpackMaxDepth(t *testing.T) {
+	doTestMaxDepth(t, testMsgpackH)
+}
+
+func TestBincMaxDepth(t *testing.T) {
+	doTestMaxDepth(t, testBincH)
+}
+
+func TestSimpleMaxDepth(t *testing.T) {
+	doTestMaxDepth(t, testSimpleH)
+}
+
+func TestJsonSelfExt(t *testing.T) {
+	doTestSelfExt(t, testJsonH)
+}
+
+func TestCborSelfExt(t *testing.T) {
+	doTestSelfExt(t, testCborH)
+}
+
+func TestMsgpackSelfExt(t *testing.T) {
+	doTestSelfExt(t, testMsgpackH)
+}
+
+func TestBincSelfExt(t *testing.T) {
+	doTestSelfExt(t, testBincH)
+}
+
+func TestSimpleSelfExt(t *testing.T) {
+	doTestSelfExt(t, testSimpleH)
+}
+
+func TestJsonBytesEncodedAsArray(t *testing.T) {
+	doTestBytesEncodedAsArray(t, testJsonH)
+}
+
+func TestCborBytesEncodedAsArray(t *testing.T) {
+	doTestBytesEncodedAsArray(t, testCborH)
+}
+
+func TestMsgpackBytesEncodedAsArray(t *testing.T) {
+	doTestBytesEncodedAsArray(t, testMsgpackH)
+}
+
+func TestBincBytesEncodedAsArray(t *testing.T) {
+	doTestBytesEncodedAsArray(t, testBincH)
+}
+
+func TestSimpleBytesEncodedAsArray(t *testing.T) {
+	doTestBytesEncodedAsArray(t, testSimpleH)
+}
+
+func TestJsonStrucEncDec(t *testing.T) {
+	doTestStrucEncDec(t, testJsonH)
+}
+
+func TestCborStrucEncDec(t *testing.T) {
+	doTestStrucEncDec(t, testCborH)
+}
+
+func TestMsgpackStrucEncDec(t *testing.T) {
+	doTestStrucEncDec(t, testMsgpackH)
+}
+
+func TestBincStrucEncDec(t *testing.T) {
+	doTestStrucEncDec(t, testBincH)
+}
+
+func TestSimpleStrucEncDec(t *testing.T) {
+	doTestStrucEncDec(t, testSimpleH)
+}
+
+func TestJsonRawToStringToRawEtc(t *testing.T) {
+	doTestRawToStringToRawEtc(t, testJsonH)
+}
+
+func TestCborRawToStringToRawEtc(t *testing.T) {
+	doTestRawToStringToRawEtc(t, testCborH)
+}
+
+func TestMsgpackRawToStringToRawEtc(t *testing.T) {
+	doTestRawToStringToRawEtc(t, testMsgpackH)
+}
+
+func TestBincRawToStringToRawEtc(t *testing.T) {
+	doTestRawToStringToRawEtc(t, testBincH)
+}
+
+func TestSimpleRawToStringToRawEtc(t *testing.T) {
+	doTestRawToStringToRawEtc(t, testSimpleH)
+}
+
+func TestJsonStructKeyType(t *testing.T) {
+	doTestStructKeyType(t, testJsonH)
+}
+
+func TestCborStructKeyType(t *testing.T) {
+	doTestStructKeyType(t, testCborH)
+}
+
+func TestMsgpackStructKeyType(t *testing.T) {
+	doTestStructKeyType(t, testMsgpackH)
+}
+
+func TestBincStructKeyType(t *testing.T) {
+	doTestStructKeyType(t, testBincH)
+}
+
+func TestSimpleStructKeyType(t *testing.T) {
+	doTestStructKeyType(t, testSimpleH)
+}
+
+func TestJsonPreferArrayOverSlice(t *testing.T) {
+	doTestPreferArrayOverSlice(t, testJsonH)
+}
+
+func TestCborPreferArrayOverSlice(t *testing.T) {
+	doTestPreferArrayOverSlice(t, testCborH)
+}
+
+func TestMsgpackPreferArrayOverSlice(t *testing.T) {
+	doTestPreferArrayOverSlice(t, testMsgpackH)
+}
+
+func TestBincPreferArrayOverSlice(t *testing.T) {
+	doTestPreferArrayOverSlice(t, testBincH)
+}
+
+func TestSimplePreferArrayOverSlice(t *testing.T) {
+	doTestPreferArrayOverSlice(t, testSimpleH)
+}
+
+func TestJsonZeroCopyBytes(t *testing.T) {
+	doTestZeroCopyBytes(t, testJsonH)
+}
+
+func TestCborZeroCopyBytes(t *testing.T) {
+	doTestZeroCopyBytes(t, testCborH)
+}
+
+func TestMsgpackZeroCopyBytes(t *testing.T) {
+	doTestZeroCopyBytes(t, testMsgpackH)
+}
+
+func TestBincZeroCopyBytes(t *testing.T) {
+	doTestZeroCopyBytes(t, testBincH)
+}
+
+func TestSimpleZeroCopyBytes(t *testing.T) {
+	doTestZeroCopyBytes(t, testSimpleH)
+}
+
+func TestJsonNextValueBytes(t *testing.T) {
+	doTestNextValueBytes(t, testJsonH)
+}
+
+func TestCborNextValueBytes(t *testing.T) {
+	// x := testCborH.IndefiniteLength
+	// defer func() { testCborH.IndefiniteLength = x }()
+
+	// xdebugf(">>>>> TestCborNextValueBytes: IndefiniteLength = false")
+	// testCborH.IndefiniteLength = false
+	// doTestNextValueBytes(t, testCborH)
+	// xdebugf(">>>>> TestCborNextValueBytes: IndefiniteLength = true")
+	// testCborH.IndefiniteLength = true
+	doTestNextValueBytes(t, testCborH)
+}
+
+func TestMsgpackNextValueBytes(t *testing.T) {
+	doTestNextValueBytes(t, testMsgpackH)
+}
+
+func TestBincNextValueBytes(t *testing.T) {
+	doTestNextValueBytes(t, testBincH)
+}
+
+func TestSimpleNextValueBytes(t *testing.T) {
+	doTestNextValueBytes(t, testSimpleH)
+}
+
+func TestJsonNumbers(t *testing.T) {
+	doTestNumbers(t, testJsonH)
+}
+
+func TestCborNumbers(t *testing.T) {
+	doTestNumbers(t, testCborH)
+}
+
+func TestMsgpackNumbers(t *testing.T) {
+	doTestNumbers(t, testMsgpackH)
+}
+
+func TestBincNumbers(t *testing.T) {
+	doTestNumbers(t, testBincH)
+}
+
+func TestSimpleNumbers(t *testing.T) {
+	doTestNumbers(t, testSimpleH)
+}
+
+func TestJsonDesc(t *testing.T) {
+	doTestDesc(t, testJsonH, map[byte]string{'"': `"`, '{': `{`, '}': `}`, '[': `[`, ']': `]`})
+}
+
+func TestCborDesc(t *testing.T) {
+	m := make(map[byte]string)
+	for k, v := range cbordescMajorNames {
+		// if k == cborMajorSimpleOrFloat { m[k<<5] = "nil" }
+		m[k<<5] = v
+	}
+	for k, v := range cbordescSimpleNames {
+		m[k] = v
+	}
+	delete(m, cborMajorSimpleOrFloat<<5)
+	doTestDesc(t, testCborH, m)
+}
+
+func TestMsgpackDesc(t *testing.T) {
+	m := make(map[byte]string)
+	for k, v := range mpdescNames {
+		m[k] = v
+	}
+	m[mpPosFixNumMin] = "int"
+	m[mpFixStrMin] = "string|bytes"
+	m[mpFixArrayMin] = "array"
+	m[mpFixMapMin] = "map"
+	m[mpFixExt1] = "ext"
+
+	doTestDesc(t, testMsgpackH, m)
+}
+
+func TestBincDesc(t *testing.T) {
+	m := make(map[byte]string)
+	for k, v := range bincdescVdNames {
+		m[k<<4] = v
+	}
+	for k, v := range bincdescSpecialVsNames {
+		m[k] = v
+	}
+	delete(m, bincVdSpecial<<4)
+	doTestDesc(t, testBincH, m)
+}
+
+func TestSimpleDesc(t *testing.T) {
+	doTestDesc(t, testSimpleH, simpledescNames)
+}
+
+func TestJsonStructFieldInfoToArray(t *testing.T) {
+	doTestStructFieldInfoToArray(t, testJsonH)
+}
+
+func TestCborStructFieldInfoToArray(t *testing.T) {
+	doTestStructFieldInfoToArray(t, testCborH)
+}
+
+func TestMsgpackStructFieldInfoToArray(t *testing.T) {
+	doTestStructFieldInfoToArray(t, testMsgpackH)
+}
+
+func TestBincStructFieldInfoToArray(t *testing.T) {
+	doTestStructFieldInfoToArray(t, testBincH)
+}
+
+func TestSimpleStructFieldInfoToArray(t *testing.T) {
+	doTestStructFieldInfoToArray(t, testSimpleH)
+}
+
+// --------
+
+func TestMultipleEncDec(t *testing.T) {
+	doTestMultipleEncDec(t, testJsonH)
+}
+
+func TestJsonEncodeIndent(t *testing.T) {
+	doTestJsonEncodeIndent(t, testJsonH)
+}
+
+func TestJsonDecodeNonStringScalarInStringContext(t *testing.T) {
+	doTestJsonDecodeNonStringScalarInStringContext(t, testJsonH)
+}
+
+func TestJsonLargeInteger(t *testing.T) {
+	doTestJsonLargeInteger(t, testJsonH)
+}
+
+func TestJsonInvalidUnicode(t *testing.T) {
+	doTestJsonInvalidUnicode(t, testJsonH)
+}
+
+func TestJsonNumberParsing(t *testing.T) {
+	doTestJsonNumberParsing(t, testJsonH)
+}
+
+func TestMsgpackDecodeMapAndExtSizeMismatch(t *testing.T) {
+	doTestMsgpackDecodeMapAndExtSizeMismatch(t, testMsgpackH)
+}
+
+func TestJsonFloatAsString(t *testing.T) {
+	doTestJsonFloatAsString(t, testJsonH)
+}
+
+func TestJsonStructTagName(t *testing.T) {
+	doTestStructTagName(t, testJsonH)
+}
+
+func TestCborStructTagName(t *testing.T) {
+	doTestStructTagName(t, testCborH)
+}
+
+func TestMsgpackStructTagName(t *testing.T) {
+	doTestStructTagName(t, testMsgpackH)
+}
+
+func TestBincStructTagName(t *testing.T) {
+	doTestStructTagName(t, testBincH)
+}
+
+func TestSimpleStructTagName(t *testing.T) {
+	doTestStructTagName(t, testSimpleH)
+}
+
+func TestJsonTypeFieldName(t *testing.T) {
+	doTestTypeFieldName(t, testJsonH)
+}
+
+func TestCborTypeFieldName(t *testing.T) {
+	doTestTypeFieldName(t, testCborH)
+}
+
+func TestMsgpackTypeFieldName(t *testing.T) {
+	doTestTypeFieldName(t, testMsgpackH)
+}
+
+func TestBincTypeFieldName(t *testing.T) {
+	doTestTypeFieldName(t, testBincH)
+}
+
+func TestSimpleTypeFieldName(t *testing.T) {
+	doTestTypeFieldName(t, testSimpleH)
+}
+
+func TestJsonMapDecorator(t *testing.T) {
+	doTestMapDecorator(t, testJsonH)
+}
+
+func TestCborMapDecorator(t *testing.T) {
+	doTestMapDecorator(t, testCborH)
+}
+
+func TestMsgpackMapDecorator(t *testing.T) {
+	doTestMapDecorator(t, testMsgpackH)
+}
+
+func TestBincMapDecorator(t *testing.T) {
+	doTestMapDecorator(t, testBincH)
+}
+
+func TestSimpleMapDecorator(t *testing.T) {
+	doTestMapDecorator(t, testSimpleH)
+}
+
+func TestJsonIterative(t *testing.T) {
+	doTestIterative(t, testJsonH)
+}
+
+func TestCborIterative(t *testing.T) {
+	doTestIterative(t, testCborH)
+}
+
+func TestMsgpackIterative(t *testing.T) {
+	doTestIterative(t, testMsgpackH)
+}
+
+func TestBincIterative(t *testing.T) {
+	doTestIterative(t, testBincH)
+}
+
+func TestSimpleIterative(t *testing.T) {
+	doTestIterative(t, testSimpleH)
+}
+
+func TestJsonEncodeWithFieldOffsets(t *testing.T) {
+	doTestEncodeWithFieldOffsets(t, testJsonH)
+}
+
+func TestCborEncodeWithFieldOffsets(t *testing.T) {
+	doTestEncodeWithFieldOffsets(t, testCborH)
+}
+
+func TestMsgpackEncodeWithFieldOffsets(t *testing.T) {
+	doTestEncodeWithFieldOffsets(t, testMsgpackH)
+}
+
+func TestBincEncodeWithFieldOffsets(t *testing.T) {
+	doTestEncodeWithFieldOffsets(t, testBincH)
+}
+
+func TestSimpleEncodeWithFieldOffsets(t *testing.T) {
+	doTestEncodeWithFieldOffsets(t, testSimpleH)
+}
+
+func TestJsonEncodeReflectValue(t *testing.T) {
+	doTestEncodeReflectValue(t, testJsonH)
+}
+
+func TestCborEncodeReflectValue(t *testing.T) {
+	doTestEncodeReflectValue(t, testCborH)
+}
+
+func TestMsgpackEncodeReflectValue(t *testing.T) {
+	doTestEncodeReflectValue(t, testMsgpackH)
+}
+
+func TestBincEncodeReflectValue(t *testing.T) {
+	doTestEncodeReflectValue(t, testBincH)
+}
+
+func TestSimpleEncodeReflectValue(t *testing.T) {
+	doTestEncodeReflectValue(t, testSimpleH)
+}
+
+func TestJsonStringKeyLess(t *testing.T) {
+	doTestStringKeyLess(t, testJsonH)
+}
+
+func TestCborStringKeyLess(t *testing.T) {
+	doTestStringKeyLess(t, testCborH)
+}
+
+func TestMsgpackStringKeyLess(t *testing.T) {
+	doTestStringKeyLess(t, testMsgpackH)
+}
+
+func TestBincStringKeyLess(t *testing.T) {
+	doTestStringKeyLess(t, testBincH)
+}
+
+func TestSimpleStringKeyLess(t *testing.T) {
+	doTestStringKeyLess(t, testSimpleH)
+}
+
+func TestJsonImageExt(t *testing.T) {
+	doTestImageExt(t, testJsonH)
+}
+
+func TestCborImageExt(t *testing.T) {
+	doTestImageExt(t, testCborH)
+}
+
+func TestMsgpackImageExt(t *testing.T) {
+	doTestImageExt(t, testMsgpackH)
+}
+
+func TestBincImageExt(t *testing.T) {
+	doTestImageExt(t, testBincH)
+}
+
+func TestSimpleImageExt(t *testing.T) {
+	doTestImageExt(t, testSimpleH)
+}
+
+func TestJsonWriteBOM(t *testing.T) {
+	doTestJsonWriteBOM(t, testJsonH)
+}
+
+func TestJsonEncodeSliceAsMap(t *testing.T) {
+	doTestEncodeSliceAsMap(t, testJsonH)
+}
+
+func TestCborEncodeSliceAsMap(t *testing.T) {
+	doTestEncodeSliceAsMap(t, testCborH)
+}
+
+func TestMsgpackEncodeSliceAsMap(t *testing.T) {
+	doTestEncodeSliceAsMap(t, testMsgpackH)
+}
+
+func TestBincEncodeSliceAsMap(t *testing.T) {
+	doTestEncodeSliceAsMap(t, testBincH)
+}
+
+func TestSimpleEncodeSliceAsMap(t *testing.T) {
+	doTestEncodeSliceAsMap(t, testSimpleH)
+}
+
+func TestJsonKeyDictionary(t *testing.T) {
+	doTestKeyDictionary(t, testJsonH)
+}
+
+func TestCborKeyDictionary(t *testing.T) {
+	doTestKeyDictionary(t, testCborH)
+}
+
+func TestMsgpackKeyDictionary(t *testing.T) {
+	doTestKeyDictionary(t, testMsgpackH)
+}
+
+func TestBincKeyDictionary(t *testing.T) {
+	doTestKeyDictionary(t, testBincH)
+}
+
+func TestSimpleKeyDictionary(t *testing.T) {
+	doTestKeyDictionary(t, testSimpleH)
+}
+
+func TestJsonTimePrecision(t *testing.T) {
+	doTestTimePrecision(t, testJsonH)
+}
+
+func TestCborTimePrecision(t *testing.T) {
+	doTestTimePrecision(t, testCborH)
+}
+
+func TestMsgpackTimePrecision(t *testing.T) {
+	doTestTimePrecision(t, testMsgpackH)
+}
+
+func TestBincTimePrecision(t *testing.T) {
+	doTestTimePrecision(t, testBincH)
+}
+
+func TestSimpleTimePrecision(t *testing.T) {
+	doTestTimePrecision(t, testSimpleH)
+}
+
+func TestMsgpackTimeExt(t *testing.T) {
+	doTestMsgpackTimeExt(t, testMsgpackH)
+}
+
+func TestJsonStructFieldSet(t *testing.T) {
+	doTestStructFieldSet(t, testJsonH)
+}
+
+func TestCborStructFieldSet(t *testing.T) {
+	doTestStructFieldSet(t, testCborH)
+}
+
+func TestMsgpackStructFieldSet(t *testing.T) {
+	doTestStructFieldSet(t, testMsgpackH)
+}
+
+func TestBincStructFieldSet(t *testing.T) {
+	doTestStructFieldSet(t, testBincH)
+}
+
+func TestSimpleStructFieldSet(t *testing.T) {
+	doTestStructFieldSet(t, testSimpleH)
+}
+
+func TestJsonEmptyArrayAsNull(t *testing.T) {
+	doTestEmptyArrayAsNull(t, testJsonH)
+}
+
+func TestCborEmptyArrayAsNull(t *testing.T) {
+	doTestEmptyArrayAsNull(t, testCborH)
+}
+
+func TestMsgpackEmptyArrayAsNull(t *testing.T) {
+	doTestEmptyArrayAsNull(t, testMsgpackH)
+}
+
+func TestBincEmptyArrayAsNull(t *testing.T) {
+	doTestEmptyArrayAsNull(t, testBincH)
+}
+
+func TestSimpleEmptyArrayAsNull(t *testing.T) {
+	doTestEmptyArrayAsNull(t, testSimpleH)
+}
+
+func TestJsonRecordPrefixSuffix(t *testing.T) {
+	doTestRecordPrefixSuffix(t, testJsonH)
+}
+
+func TestCborRecordPrefixSuffix(t *testing.T) {
+	doTestRecordPrefixSuffix(t, testCborH)
+}
+
+func TestMsgpackRecordPrefixSuffix(t *testing.T) {
+	doTestRecordPrefixSuffix(t, testMsgpackH)
+}
+
+func TestBincRecordPrefixSuffix(t *testing.T) {
+	doTestRecordPrefixSuffix(t, testBincH)
+}
+
+func TestSimpleRecordPrefixSuffix(t *testing.T) {
+	doTestRecordPrefixSuffix(t, testSimpleH)
+}
+
+func TestJsonEncoderResetState(t *testing.T) {
+	doTestEncoderResetState(t, testJsonH)
+}
+
+func TestCborEncoderResetState(t *testing.T) {
+	doTestEncoderResetState(t, testCborH)
+}
+
+func TestMsgpackEncoderResetState(t *testing.T) {
+	doTestEncoderResetState(t, testMsgpackH)
+}
+
+func TestBincEncoderResetState(t *testing.T) {
+	doTestEncoderResetState(t, testBincH)
+}
+
+func TestSimpleEncoderResetState(t *testing.T) {
+	doTestEncoderResetState(t, testSimpleH)
+}
+
+func TestJsonEncodeUintptr(t *testing.T) {
+	doTestEncodeUintptr(t, testJsonH)
+}
+
+func TestCborEncodeUintptr(t *testing.T) {
+	doTestEncodeUintptr(t, testCborH)
+}
+
+func TestMsgpackEncodeUintptr(t *testing.T) {
+	doTestEncodeUintptr(t, testMsgpackH)
+}
+
+func TestBincEncodeUintptr(t *testing.T) {
+	doTestEncodeUintptr(t, testBincH)
+}
+
+func TestSimpleEncodeUintptr(t *testing.T) {
+	doTestEncodeUintptr(t, testSimpleH)
+}
+
+func TestJsonCanonicalKeyBufHint(t *testing.T) {
+	doTestCanonicalKeyBufHint(t, testJsonH)
+}
+
+func TestCborCanonicalKeyBufHint(t *testing.T) {
+	doTestCanonicalKeyBufHint(t, testCborH)
+}
+
+func TestMsgpackCanonicalKeyBufHint(t *testing.T) {
+	doTestCanonicalKeyBufHint(t, testMsgpackH)
+}
+
+func TestBincCanonicalKeyBufHint(t *testing.T) {
+	doTestCanonicalKeyBufHint(t, testBincH)
+}
+
+func TestSimpleCanonicalKeyBufHint(t *testing.T) {
+	doTestCanonicalKeyBufHint(t, testSimpleH)
+}
+
+func TestJsonEncodeToBytesBuffer(t *testing.T) {
+	doTestEncodeToBytesBuffer(t, testJsonH)
+}
+
+func TestCborEncodeToBytesBuffer(t *testing.T) {
+	doTestEncodeToBytesBuffer(t, testCborH)
+}
+
+func TestMsgpackEncodeToBytesBuffer(t *testing.T) {
+	doTestEncodeToBytesBuffer(t, testMsgpackH)
+}
+
+func TestBincEncodeToBytesBuffer(t *testing.T) {
+	doTestEncodeToBytesBuffer(t, testBincH)
+}
+
+func TestSimpleEncodeToBytesBuffer(t *testing.T) {
+	doTestEncodeToBytesBuffer(t, testSimpleH)
+}
+
+func TestJsonMapKeyFilter(t *testing.T) {
+	doTestMapKeyFilter(t, testJsonH)
+}
+
+func TestCborMapKeyFilter(t *testing.T) {
+	doTestMapKeyFilter(t, testCborH)
+}
+
+func TestMsgpackMapKeyFilter(t *testing.T) {
+	doTestMapKeyFilter(t, testMsgpackH)
+}
+
+func TestBincMapKeyFilter(t *testing.T) {
+	doTestMapKeyFilter(t, testBincH)
+}
+
+func TestSimpleMapKeyFilter(t *testing.T) {
+	doTestMapKeyFilter(t, testSimpleH)
+}
+
+func TestJsonOnUnsupported(t *testing.T) {
+	doTestOnUnsupported(t, testJsonH)
+}
+
+func TestCborOnUnsupported(t *testing.T) {
+	doTestOnUnsupported(t, testCborH)
+}
+
+func TestMsgpackOnUnsupported(t *testing.T) {
+	doTestOnUnsupported(t, testMsgpackH)
+}
+
+func TestBincOnUnsupported(t *testing.T) {
+	doTestOnUnsupported(t, testBincH)
+}
+
+func TestSimpleOnUnsupported(t *testing.T) {
+	doTestOnUnsupported(t, testSimpleH)
+}
+
+func TestJsonEncoderResetMulti(t *testing.T) {
+	doTestEncoderResetMulti(t, testJsonH)
+}
+
+func TestCborEncoderResetMulti(t *testing.T) {
+	doTestEncoderResetMulti(t, testCborH)
+}
+
+func TestMsgpackEncoderResetMulti(t *testing.T) {
+	doTestEncoderResetMulti(t, testMsgpackH)
+}
+
+func TestBincEncoderResetMulti(t *testing.T) {
+	doTestEncoderResetMulti(t, testBincH)
+}
+
+func TestSimpleEncoderResetMulti(t *testing.T) {
+	doTestEncoderResetMulti(t, testSimpleH)
+}
+
+func TestJsonStructUnexportedEmbedded(t *testing.T) {
+	doTestStructUnexportedEmbedded(t, testJsonH)
+}
+
+func TestCborStructUnexportedEmbedded(t *testing.T) {
+	doTestStructUnexportedEmbedded(t, testCborH)
+}
+
+func TestMsgpackStructUnexportedEmbedded(t *testing.T) {
+	doTestStructUnexportedEmbedded(t, testMsgpackH)
+}
+
+func TestBincStructUnexportedEmbedded(t *testing.T) {
+	doTestStructUnexportedEmbedded(t, testBincH)
+}
+
+func TestSimpleStructUnexportedEmbedded(t *testing.T) {
+	doTestStructUnexportedEmbedded(t, testSimpleH)
+}
+
+func TestJsonEncodeErrorPath(t *testing.T) {
+	doTestEncodeErrorPath(t, testJsonH)
+}
+
+func TestCborEncodeErrorPath(t *testing.T) {
+	doTestEncodeErrorPath(t, testCborH)
+}
+
+func TestMsgpackEncodeErrorPath(t *testing.T) {
+	doTestEncodeErrorPath(t, testMsgpackH)
+}
+
+func TestBincEncodeErrorPath(t *testing.T) {
+	doTestEncodeErrorPath(t, testBincH)
+}
+
+func TestSimpleEncodeErrorPath(t *testing.T) {
+	doTestEncodeErrorPath(t, testSimpleH)
+}
+
+func TestJsonTaggedInterfaces(t *testing.T) {
+	doTestTaggedInterfaces(t, testJsonH)
+}
+
+func TestCborTaggedInterfaces(t *testing.T) {
+	doTestTaggedInterfaces(t, testCborH)
+}
+
+func TestMsgpackTaggedInterfaces(t *testing.T) {
+	doTestTaggedInterfaces(t, testMsgpackH)
+}
+
+func TestBincTaggedInterfaces(t *testing.T) {
+	doTestTaggedInterfaces(t, testBincH)
+}
+
+func TestSimpleTaggedInterfaces(t *testing.T) {
+	doTestTaggedInterfaces(t, testSimpleH)
+}
+
+func TestJsonBoolAsInt(t *testing.T) {
+	doTestBoolAsInt(t, testJsonH)
+}
+
+func TestCborBoolAsInt(t *testing.T) {
+	doTestBoolAsInt(t, testCborH)
+}
+
+func TestMsgpackBoolAsInt(t *testing.T) {
+	doTestBoolAsInt(t, testMsgpackH)
+}
+
+func TestBincBoolAsInt(t *testing.T) {
+	doTestBoolAsInt(t, testBincH)
+}
+
+func TestSimpleBoolAsInt(t *testing.T) {
+	doTestBoolAsInt(t, testSimpleH)
+}
+
+func TestJsonEncodeContext(t *testing.T) {
+	doTestEncodeContext(t, testJsonH)
+}
+
+func TestCborEncodeContext(t *testing.T) {
+	doTestEncodeContext(t, testCborH)
+}
+
+func TestMsgpackEncodeContext(t *testing.T) {
+	doTestEncodeContext(t, testMsgpackH)
+}
+
+func TestBincEncodeContext(t *testing.T) {
+	doTestEncodeContext(t, testBincH)
+}
+
+func TestSimpleEncodeContext(t *testing.T) {
+	doTestEncodeContext(t, testSimpleH)
+}
+
+func TestJsonRegisterDecimal(t *testing.T) {
+	doTestRegisterDecimal(t, testJsonH)
+}
+
+func TestCborRegisterDecimal(t *testing.T) {
+	doTestRegisterDecimal(t, testCborH)
+}
+
+func TestMsgpackRegisterDecimal(t *testing.T) {
+	doTestRegisterDecimal(t, testMsgpackH)
+}
+
+func TestBincRegisterDecimal(t *testing.T) {
+	doTestRegisterDecimal(t, testBincH)
+}
+
+func TestSimpleRegisterDecimal(t *testing.T) {
+	doTestRegisterDecimal(t, testSimpleH)
+}
+
+func TestJsonEmptyStructHandling(t *testing.T) {
+	doTestEmptyStructHandling(t, testJsonH)
+}
+
+func TestCborEmptyStructHandling(t *testing.T) {
+	doTestEmptyStructHandling(t, testCborH)
+}
+
+func TestMsgpackEmptyStructHandling(t *testing.T) {
+	doTestEmptyStructHandling(t, testMsgpackH)
+}
+
+func TestBincEmptyStructHandling(t *testing.T) {
+	doTestEmptyStructHandling(t, testBincH)
+}
+
+func TestSimpleEmptyStructHandling(t *testing.T) {
+	doTestEmptyStructHandling(t, testSimpleH)
+}
+
+func TestJsonNumberFormatter(t *testing.T) {
+	doTestJsonNumberFormatter(t, testJsonH)
+}
+
+func TestJsonStructFieldOrder(t *testing.T) {
+	doTestStructFieldOrder(t, testJsonH)
+}
+
+func TestCborStructFieldOrder(t *testing.T) {
+	doTestStructFieldOrder(t, testCborH)
+}
+
+func TestMsgpackStructFieldOrder(t *testing.T) {
+	doTestStructFieldOrder(t, testMsgpackH)
+}
+
+func TestBincStructFieldOrder(t *testing.T) {
+	doTestStructFieldOrder(t, testBincH)
+}
+
+func TestSimpleStructFieldOrder(t *testing.T) {
+	doTestStructFieldOrder(t, testSimpleH)
+}
+
+func TestJsonEncodeMerged(t *testing.T) {
+	doTestEncodeMerged(t, testJsonH)
+}
+
+func TestCborEncodeMerged(t *testing.T) {
+	doTestEncodeMerged(t, testCborH)
+}
+
+func TestMsgpackEncodeMerged(t *testing.T) {
+	doTestEncodeMerged(t, testMsgpackH)
+}
+
+func TestBincEncodeMerged(t *testing.T) {
+	doTestEncodeMerged(t, testBincH)
+}
+
+func TestSimpleEncodeMerged(t *testing.T) {
+	doTestEncodeMerged(t, testSimpleH)
+}
+
+func TestJsonSchemaVersion(t *testing.T) {
+	doTestSchemaVersion(t, testJsonH)
+}
+
+func TestCborSchemaVersion(t *testing.T) {
+	doTestSchemaVersion(t, testCborH)
+}
+
+func TestMsgpackSchemaVersion(t *testing.T) {
+	doTestSchemaVersion(t, testMsgpackH)
+}
+
+func TestBincSchemaVersion(t *testing.T) {
+	doTestSchemaVersion(t, testBincH)
+}
+
+func TestSimpleSchemaVersion(t *testing.T) {
+	doTestSchemaVersion(t, testSimpleH)
+}
+
+func TestJsonEncodeNoFlush(t *testing.T) {
+	doTestEncodeNoFlush(t, testJsonH)
+}
+
+func TestCborEncodeNoFlush(t *testing.T) {
+	doTestEncodeNoFlush(t, testCborH)
+}
+
+func TestMsgpackEncodeNoFlush(t *testing.T) {
+	doTestEncodeNoFlush(t, testMsgpackH)
+}
+
+func TestBincEncodeNoFlush(t *testing.T) {
+	doTestEncodeNoFlush(t, testBincH)
+}
+
+func TestSimpleEncodeNoFlush(t *testing.T) {
+	doTestEncodeNoFlush(t, testSimpleH)
+}
+
+func TestCborCanonicalIntfKeys(t *testing.T) {
+	doTestCanonicalIntfKeys(t, testCborH)
+}
+
+func TestMsgpackCanonicalIntfKeys(t *testing.T) {
+	doTestCanonicalIntfKeys(t, testMsgpackH)
+}
+
+func TestBincCanonicalIntfKeys(t *testing.T) {
+	doTestCanonicalIntfKeys(t, testBincH)
+}
+
+func TestSimpleCanonicalIntfKeys(t *testing.T) {
+	doTestCanonicalIntfKeys(t, testSimpleH)
+}
+
+func TestJsonStructUnwrap(t *testing.T) {
+	doTestStructUnwrap(t, testJsonH)
+}
+
+func TestCborStructUnwrap(t *testing.T) {
+	doTestStructUnwrap(t, testCborH)
+}
+
+func TestMsgpackStructUnwrap(t *testing.T) {
+	doTestStructUnwrap(t, testMsgpackH)
+}
+
+func TestBincStructUnwrap(t *testing.T) {
+	doTestStructUnwrap(t, testBincH)
+}
+
+func TestSimpleStructUnwrap(t *testing.T) {
+	doTestStructUnwrap(t, testSimpleH)
+}
+
+func TestJsonEncoderClose(t *testing.T) {
+	doTestEncoderClose(t, testJsonH)
+}
+
+func TestCborEncoderClose(t *testing.T) {
+	doTestEncoderClose(t, testCborH)
+}
+
+func TestMsgpackEncoderClose(t *testing.T) {
+	doTestEncoderClose(t, testMsgpackH)
+}
+
+func TestBincEncoderClose(t *testing.T) {
+	doTestEncoderClose(t, testBincH)
+}
+
+func TestSimpleEncoderClose(t *testing.T) {
+	doTestEncoderClose(t, testSimpleH)
+}
+
+func TestJsonStringToRawMapKeys(t *testing.T) {
+	doTestStringToRawMapKeys(t, testJsonH)
+}
+
+func TestCborStringToRawMapKeys(t *testing.T) {
+	doTestStringToRawMapKeys(t, testCborH)
+}
+
+func TestMsgpackStringToRawMapKeys(t *testing.T) {
+	doTestStringToRawMapKeys(t, testMsgpackH)
+}
+
+func TestBincStringToRawMapKeys(t *testing.T) {
+	doTestStringToRawMapKeys(t, testBincH)
+}
+
+func TestSimpleStringToRawMapKeys(t *testing.T) {
+	doTestStringToRawMapKeys(t, testSimpleH)
+}
+
+func TestJsonStructFieldPad(t *testing.T) {
+	doTestStructFieldPad(t, testJsonH)
+}
+
+func TestCborStructFieldPad(t *testing.T) {
+	doTestStructFieldPad(t, testCborH)
+}
+
+func TestMsgpackStructFieldPad(t *testing.T) {
+	doTestStructFieldPad(t, testMsgpackH)
+}
+
+func TestBincStructFieldPad(t *testing.T) {
+	doTestStructFieldPad(t, testBincH)
+}
+
+func TestSimpleStructFieldPad(t *testing.T) {
+	doTestStructFieldPad(t, testSimpleH)
+}
+
+func TestJsonEncodeMapFunc(t *testing.T) {
+	doTestEncodeMapFunc(t, testJsonH)
+}
+
+func TestCborEncodeMapFunc(t *testing.T) {
+	doTestEncodeMapFunc(t, testCborH)
+}
+
+func TestMsgpackEncodeMapFunc(t *testing.T) {
+	doTestEncodeMapFunc(t, testMsgpackH)
+}
+
+func TestBincEncodeMapFunc(t *testing.T) {
+	doTestEncodeMapFunc(t, testBincH)
+}
+
+func TestSimpleEncodeMapFunc(t *testing.T) {
+	doTestEncodeMapFunc(t, testSimpleH)
+}
+
+func TestJsonNullToken(t *testing.T) {
+	doTestJsonNullToken(t, testJsonH)
+}
+
+func TestJsonCallLazyFuncs(t *testing.T) {
+	doTestCallLazyFuncs(t, testJsonH)
+}
+
+func TestCborCallLazyFuncs(t *testing.T) {
+	doTestCallLazyFuncs(t, testCborH)
+}
+
+func TestMsgpackCallLazyFuncs(t *testing.T) {
+	doTestCallLazyFuncs(t, testMsgpackH)
+}
+
+func TestBincCallLazyFuncs(t *testing.T) {
+	doTestCallLazyFuncs(t, testBincH)
+}
+
+func TestSimpleCallLazyFuncs(t *testing.T) {
+	doTestCallLazyFuncs(t, testSimpleH)
+}
+
+func TestJsonStructEncodeAsArray(t *testing.T) {
+	doTestStructEncodeAsArray(t, testJsonH)
+}
+
+func TestCborStructEncodeAsArray(t *testing.T) {
+	doTestStructEncodeAsArray(t, testCborH)
+}
+
+func TestMsgpackStructEncodeAsArray(t *testing.T) {
+	doTestStructEncodeAsArray(t, testMsgpackH)
+}
+
+func TestBincStructEncodeAsArray(t *testing.T) {
+	doTestStructEncodeAsArray(t, testBincH)
+}
+
+func TestSimpleStructEncodeAsArray(t *testing.T) {
+	doTestStructEncodeAsArray(t, testSimpleH)
+}
+
+func TestJsonSortSortables(t *testing.T) {
+	doTestSortSortables(t, testJsonH)
+}
+
+func TestCborSortSortables(t *testing.T) {
+	doTestSortSortables(t, testCborH)
+}
+
+func TestMsgpackSortSortables(t *testing.T) {
+	doTestSortSortables(t, testMsgpackH)
+}
+
+func TestBincSortSortables(t *testing.T) {
+	doTestSortSortables(t, testBincH)
+}
+
+func TestSimpleSortSortables(t *testing.T) {
+	doTestSortSortables(t, testSimpleH)
+}
+
+func TestJsonFloatSpecials(t *testing.T) {
+	doTestFloatSpecials(t, testJsonH)
 }
 
-func TestCborCodecsMisc(t *testing.T) {
-	doTestCodecMiscOne(t, testCborH)
+func TestCborFloatSpecials(t *testing.T) {
+	doTestFloatSpecials(t, testCborH)
 }
 
-func TestCborCodecsEmbeddedPointer(t *testing.T) {
-	doTestCodecEmbeddedPointer(t, testCborH)
+func TestMsgpackFloatSpecials(t *testing.T) {
+	doTestFloatSpecials(t, testMsgpackH)
 }
 
-func TestCborCodecChan(t *testing.T) {
-	doTestCodecChan(t, testCborH)
+func TestBincFloatSpecials(t *testing.T) {
+	doTestFloatSpecials(t, testBincH)
 }
 
-func TestCborStdEncIntf(t *testing.T) {
-	doTestStdEncIntf(t, testCborH)
+func TestSimpleFloatSpecials(t *testing.T) {
+	doTestFloatSpecials(t, testSimpleH)
 }
 
-func TestJsonCodecsTable(t *testing.T) {
-	doTestCodecTableOne(t, testJsonH)
+func TestJsonEncodeMapKV(t *testing.T) {
+	doTestEncodeMapKV(t, testJsonH)
 }
 
-func TestJsonCodecsMisc(t *testing.T) {
-	doTestCodecMiscOne(t, testJsonH)
+func TestCborEncodeMapKV(t *testing.T) {
+	doTestEncodeMapKV(t, testCborH)
 }
 
-func TestJsonCodecsEmbeddedPointer(t *testing.T) {
-	doTestCodecEmbeddedPointer(t, testJsonH)
+func TestMsgpackEncodeMapKV(t *testing.T) {
+	doTestEncodeMapKV(t, testMsgpackH)
 }
 
-func TestJsonCodecChan(t *testing.T) {
-	doTestCodecChan(t, testJsonH)
+func TestBincEncodeMapKV(t *testing.T) {
+	doTestEncodeMapKV(t, testBincH)
 }
 
-func TestJsonStdEncIntf(t *testing.T) {
-	doTestStdEncIntf(t, testJsonH)
+func TestSimpleEncodeMapKV(t *testing.T) {
+	doTestEncodeMapKV(t, testSimpleH)
 }
 
-// ----- Raw ---------
-func TestJsonRaw(t *testing.T) {
-	doTestRawValue(t, testJsonH)
+func TestJsonFrameLengthPrefix(t *testing.T) {
+	doTestFrameLengthPrefix(t, testJsonH)
 }
-func TestBincRaw(t *testing.T) {
-	doTestRawValue(t, testBincH)
+
+func TestCborFrameLengthPrefix(t *testing.T) {
+	doTestFrameLengthPrefix(t, testCborH)
 }
-func TestMsgpackRaw(t *testing.T) {
-	doTestRawValue(t, testMsgpackH)
+
+func TestMsgpackFrameLengthPrefix(t *testing.T) {
+	doTestFrameLengthPrefix(t, testMsgpackH)
 }
-func TestSimpleRaw(t *testing.T) {
-	doTestRawValue(t, testSimpleH)
+
+func TestBincFrameLengthPrefix(t *testing.T) {
+	doTestFrameLengthPrefix(t, testBincH)
 }
-func TestCborRaw(t *testing.T) {
-	doTestRawValue(t, testCborH)
+
+func TestSimpleFrameLengthPrefix(t *testing.T) {
+	doTestFrameLengthPrefix(t, testSimpleH)
 }
 
-// ----- ALL (framework based) -----
+func TestJsonMapKeyHandle(t *testing.T) {
+	doTestMapKeyHandle(t, testJsonH)
+}
 
-func TestAllEncCircularRef(t *testing.T) {
-	doTestEncCircularRef(t, testCborH)
+func TestCborMapKeyHandle(t *testing.T) {
+	doTestMapKeyHandle(t, testCborH)
 }
 
-func TestAllAnonCycle(t *testing.T) {
-	doTestAnonCycle(t, testCborH)
+func TestMsgpackMapKeyHandle(t *testing.T) {
+	doTestMapKeyHandle(t, testMsgpackH)
 }
 
-func TestAllErrWriter(t *testing.T) {
-	doTestAllErrWriter(t, testCborH, testJsonH)
+func TestBincMapKeyHandle(t *testing.T) {
+	doTestMapKeyHandle(t, testBincH)
 }
 
-// ----- RPC custom -----
+func TestSimpleMapKeyHandle(t *testing.T) {
+	doTestMapKeyHandle(t, testSimpleH)
+}
 
-func TestMsgpackRpcSpec(t *testing.T) {
-	doTestCodecRpcOne(t, MsgpackSpecRpc, testMsgpackH, true, 0)
+func TestJsonStructFieldRequires(t *testing.T) {
+	doTestStructFieldRequires(t, testJsonH)
 }
 
-// ----- RPC -----
+func TestCborStructFieldRequires(t *testing.T) {
+	doTestStructFieldRequires(t, testCborH)
+}
 
-func TestBincRpcGo(t *testing.T) {
-	doTestCodecRpcOne(t, GoRpc, testBincH, true, 0)
+func TestMsgpackStructFieldRequires(t *testing.T) {
+	doTestStructFieldRequires(t, testMsgpackH)
 }
 
-func TestSimpleRpcGo(t *testing.T) {
-	doTestCodecRpcOne(t, GoRpc, testSimpleH, true, 0)
+func TestBincStructFieldRequires(t *testing.T) {
+	doTestStructFieldRequires(t, testBincH)
 }
 
-func TestMsgpackRpcGo(t *testing.T) {
-	doTestCodecRpcOne(t, GoRpc, testMsgpackH, true, 0)
+func TestSimpleStructFieldRequires(t *testing.T) {
+	doTestStructFieldRequires(t, testSimpleH)
 }
 
-func TestCborRpcGo(t *testing.T) {
-	doTestCodecRpcOne(t, GoRpc, testCborH, true, 0)
+func TestCborShareReferences(t *testing.T) {
+	doTestShareReferences(t, testCborH)
 }
 
-func TestJsonRpcGo(t *testing.T) {
-	doTestCodecRpcOne(t, GoRpc, testJsonH, true, 0)
+func TestMsgpackShareReferences(t *testing.T) {
+	doTestShareReferences(t, testMsgpackH)
 }
 
-// ----- OTHERS -----
+func TestJsonShareReferences(t *testing.T) {
+	doTestShareReferences(t, testJsonH)
+}
 
-func TestBincMapEncodeForCanonical(t *testing.T) {
-	t.Skipf("skipping ... needs investigation") // MARKER: testing fails??? Need to research
-	doTestMapEncodeForCanonical(t, testBincH)
+func TestJsonValidateUTF8(t *testing.T) {
+	doTestValidateUTF8(t, testJsonH)
 }
 
-func TestSimpleMapEncodeForCanonical(t *testing.T) {
-	doTestMapEncodeForCanonical(t, testSimpleH)
+func TestCborValidateUTF8(t *testing.T) {
+	doTestValidateUTF8(t, testCborH)
 }
 
-func TestMsgpackMapEncodeForCanonical(t *testing.T) {
-	doTestMapEncodeForCanonical(t, testMsgpackH)
+func TestMsgpackValidateUTF8(t *testing.T) {
+	doTestValidateUTF8(t, testMsgpackH)
 }
 
-func TestCborMapEncodeForCanonical(t *testing.T) {
-	doTestMapEncodeForCanonical(t, testCborH)
+func TestBincValidateUTF8(t *testing.T) {
+	doTestValidateUTF8(t, testBincH)
 }
 
-func TestJsonMapEncodeForCanonical(t *testing.T) {
-	doTestMapEncodeForCanonical(t, testJsonH)
+func TestSimpleValidateUTF8(t *testing.T) {
+	doTestValidateUTF8(t, testSimpleH)
 }
 
-func TestBincUnderlyingType(t *testing.T) {
-	testCodecUnderlyingType(t, testBincH)
+func TestJsonPreserveNilVsEmpty(t *testing.T) {
+	doTestPreserveNilVsEmpty(t, testJsonH)
 }
 
-func TestJsonSwallowAndZero(t *testing.T) {
-	doTestSwallowAndZero(t, testJsonH)
+func TestCborPreserveNilVsEmpty(t *testing.T) {
+	doTestPreserveNilVsEmpty(t, testCborH)
 }
 
-func TestCborSwallowAndZero(t *testing.T) {
-	doTestSwallowAndZero(t, testCborH)
+func TestMsgpackPreserveNilVsEmpty(t *testing.T) {
+	doTestPreserveNilVsEmpty(t, testMsgpackH)
 }
 
-func TestMsgpackSwallowAndZero(t *testing.T) {
-	doTestSwallowAndZero(t, testMsgpackH)
+func TestBincPreserveNilVsEmpty(t *testing.T) {
+	doTestPreserveNilVsEmpty(t, testBincH)
 }
 
-func TestBincSwallowAndZero(t *testing.T) {
-	doTestSwallowAndZero(t, testBincH)
+func TestSimplePreserveNilVsEmpty(t *testing.T) {
+	doTestPreserveNilVsEmpty(t, testSimpleH)
 }
 
-func TestSimpleSwallowAndZero(t *testing.T) {
-	doTestSwallowAndZero(t, testSimpleH)
+func TestJsonEncodeWithFieldBytes(t *testing.T) {
+	doTestEncodeWithFieldBytes(t, testJsonH)
 }
 
-func TestJsonRawExt(t *testing.T) {
-	doTestRawExt(t, testJsonH)
+func TestCborEncodeWithFieldBytes(t *testing.T) {
+	doTestEncodeWithFieldBytes(t, testCborH)
 }
 
-func TestCborRawExt(t *testing.T) {
-	doTestRawExt(t, testCborH)
+func TestMsgpackEncodeWithFieldBytes(t *testing.T) {
+	doTestEncodeWithFieldBytes(t, testMsgpackH)
 }
 
-func TestMsgpackRawExt(t *testing.T) {
-	doTestRawExt(t, testMsgpackH)
+func TestBincEncodeWithFieldBytes(t *testing.T) {
+	doTestEncodeWithFieldBytes(t, testBincH)
 }
 
-func TestBincRawExt(t *testing.T) {
-	doTestRawExt(t, testBincH)
+func TestSimpleEncodeWithFieldBytes(t *testing.T) {
+	doTestEncodeWithFieldBytes(t, testSimpleH)
 }
 
-func TestSimpleRawExt(t *testing.T) {
-	doTestRawExt(t, testSimpleH)
+func TestJsonTimeLayout(t *testing.T) {
+	doTestTimeLayout(t, testJsonH)
 }
 
-func TestJsonMapStructKey(t *testing.T) {
-	doTestMapStructKey(t, testJsonH)
+func TestCborTimeLayout(t *testing.T) {
+	doTestTimeLayout(t, testCborH)
 }
 
-func TestCborMapStructKey(t *testing.T) {
-	doTestMapStructKey(t, testCborH)
+func TestMsgpackTimeLayout(t *testing.T) {
+	doTestTimeLayout(t, testMsgpackH)
 }
 
-func TestMsgpackMapStructKey(t *testing.T) {
-	doTestMapStructKey(t, testMsgpackH)
+func TestBincTimeLayout(t *testing.T) {
+	doTestTimeLayout(t, testBincH)
 }
 
-func TestBincMapStructKey(t *testing.T) {
-	doTestMapStructKey(t, testBincH)
+func TestSimpleTimeLayout(t *testing.T) {
+	doTestTimeLayout(t, testSimpleH)
 }
 
-func TestSimpleMapStructKey(t *testing.T) {
-	doTestMapStructKey(t, testSimpleH)
+func TestJsonStructSliceFast(t *testing.T) {
+	doTestStructSliceFast(t, testJsonH)
 }
 
-func TestJsonDecodeNilMapValue(t *testing.T) {
-	doTestDecodeNilMapValue(t, testJsonH)
+func TestCborStructSliceFast(t *testing.T) {
+	doTestStructSliceFast(t, testCborH)
 }
 
-func TestCborDecodeNilMapValue(t *testing.T) {
-	doTestDecodeNilMapValue(t, testCborH)
+func TestMsgpackStructSliceFast(t *testing.T) {
+	doTestStructSliceFast(t, testMsgpackH)
 }
 
-func TestMsgpackDecodeNilMapValue(t *testing.T) {
-	doTestDecodeNilMapValue(t, testMsgpackH)
+func TestBincStructSliceFast(t *testing.T) {
+	doTestStructSliceFast(t, testBincH)
 }
 
-func TestBincDecodeNilMapValue(t *testing.T) {
-	doTestDecodeNilMapValue(t, testBincH)
+func TestSimpleStructSliceFast(t *testing.T) {
+	doTestStructSliceFast(t, testSimpleH)
 }
 
-func TestSimpleDecodeNilMapValue(t *testing.T) {
-	doTestDecodeNilMapValue(t, testSimpleH)
+func TestJsonStructFieldRedact(t *testing.T) {
+	doTestStructFieldRedact(t, testJsonH)
 }
 
-func TestJsonEmbeddedFieldPrecedence(t *testing.T) {
-	doTestEmbeddedFieldPrecedence(t, testJsonH)
+func TestCborStructFieldRedact(t *testing.T) {
+	doTestStructFieldRedact(t, testCborH)
 }
 
-func TestCborEmbeddedFieldPrecedence(t *testing.T) {
-	doTestEmbeddedFieldPrecedence(t, testCborH)
+func TestMsgpackStructFieldRedact(t *testing.T) {
+	doTestStructFieldRedact(t, testMsgpackH)
 }
 
-func TestMsgpackEmbeddedFieldPrecedence(t *testing.T) {
-	doTestEmbeddedFieldPrecedence(t, testMsgpackH)
+func TestBincStructFieldRedact(t *testing.T) {
+	doTestStructFieldRedact(t, testBincH)
+}
+
+func TestSimpleStructFieldRedact(t *testing.T) {
+	doTestStructFieldRedact(t, testSimpleH)
+}
+
+func TestJsonEstimateSize(t *testing.T) {
+	doTestEstimateSize(t, testJsonH)
+}
+
+func TestCborEstimateSize(t *testing.T) {
+	doTestEstimateSize(t, testCborH)
+}
+
+func TestMsgpackEstimateSize(t *testing.T) {
+	doTestEstimateSize(t, testMsgpackH)
+}
+
+func TestBincEstimateSize(t *testing.T) {
+	doTestEstimateSize(t, testBincH)
+}
+
+func TestSimpleEstimateSize(t *testing.T) {
+	doTestEstimateSize(t, testSimpleH)
+}
+
+func TestJsonMarshalAppender(t *testing.T) {
+	doTestMarshalAppender(t, testJsonH)
+}
+
+func TestCborMarshalAppender(t *testing.T) {
+	doTestMarshalAppender(t, testCborH)
+}
+
+func TestMsgpackMarshalAppender(t *testing.T) {
+	doTestMarshalAppender(t, testMsgpackH)
+}
+
+func TestBincMarshalAppender(t *testing.T) {
+	doTestMarshalAppender(t, testBincH)
+}
+
+func TestSimpleMarshalAppender(t *testing.T) {
+	doTestMarshalAppender(t, testSimpleH)
+}
+
+func TestJsonUnionPayload(t *testing.T) {
+	doTestUnionPayload(t, testJsonH)
+}
+
+func TestCborUnionPayload(t *testing.T) {
+	doTestUnionPayload(t, testCborH)
+}
+
+func TestMsgpackUnionPayload(t *testing.T) {
+	doTestUnionPayload(t, testMsgpackH)
+}
+
+func TestBincUnionPayload(t *testing.T) {
+	doTestUnionPayload(t, testBincH)
+}
+
+func TestSimpleUnionPayload(t *testing.T) {
+	doTestUnionPayload(t, testSimpleH)
+}
+
+func TestMsgpackRawToStringIfUTF8(t *testing.T) {
+	doTestMsgpackRawToStringIfUTF8(t, testMsgpackH)
+}
+
+func TestJsonTrailingComma(t *testing.T) {
+	doTestJsonTrailingComma(t, testJsonH)
+}
+
+func TestJsonEncodeFields(t *testing.T) {
+	doTestEncodeFields(t, testJsonH)
+}
+
+func TestCborEncodeFields(t *testing.T) {
+	doTestEncodeFields(t, testCborH)
+}
+
+func TestMsgpackEncodeFields(t *testing.T) {
+	doTestEncodeFields(t, testMsgpackH)
+}
+
+func TestBincEncodeFields(t *testing.T) {
+	doTestEncodeFields(t, testBincH)
+}
+
+func TestSimpleEncodeFields(t *testing.T) {
+	doTestEncodeFields(t, testSimpleH)
+}
+
+func TestJsonStructFieldInline(t *testing.T) {
+	doTestStructFieldInline(t, testJsonH)
+}
+
+func TestCborStructFieldInline(t *testing.T) {
+	doTestStructFieldInline(t, testCborH)
+}
+
+func TestMsgpackStructFieldInline(t *testing.T) {
+	doTestStructFieldInline(t, testMsgpackH)
+}
+
+func TestBincStructFieldInline(t *testing.T) {
+	doTestStructFieldInline(t, testBincH)
+}
+
+func TestSimpleStructFieldInline(t *testing.T) {
+	doTestStructFieldInline(t, testSimpleH)
+}
+
+func TestJsonNetExt(t *testing.T) {
+	doTestNetExt(t, testJsonH)
+}
+
+func TestCborNetExt(t *testing.T) {
+	doTestNetExt(t, testCborH)
+}
+
+func TestMsgpackNetExt(t *testing.T) {
+	doTestNetExt(t, testMsgpackH)
+}
+
+func TestBincNetExt(t *testing.T) {
+	doTestNetExt(t, testBincH)
+}
+
+func TestSimpleNetExt(t *testing.T) {
+	doTestNetExt(t, testSimpleH)
+}
+
+func TestJsonMapSetAsArray(t *testing.T) {
+	doTestMapSetAsArray(t, testJsonH)
+}
+
+func TestCborMapSetAsArray(t *testing.T) {
+	doTestMapSetAsArray(t, testCborH)
+}
+
+func TestMsgpackMapSetAsArray(t *testing.T) {
+	doTestMapSetAsArray(t, testMsgpackH)
+}
+
+func TestBincMapSetAsArray(t *testing.T) {
+	doTestMapSetAsArray(t, testBincH)
+}
+
+func TestSimpleMapSetAsArray(t *testing.T) {
+	doTestMapSetAsArray(t, testSimpleH)
+}
+
+func TestJsonMaxCollectionElements(t *testing.T) {
+	doTestMaxCollectionElements(t, testJsonH)
+}
+
+func TestCborMaxCollectionElements(t *testing.T) {
+	doTestMaxCollectionElements(t, testCborH)
+}
+
+func TestMsgpackMaxCollectionElements(t *testing.T) {
+	doTestMaxCollectionElements(t, testMsgpackH)
+}
+
+func TestBincMaxCollectionElements(t *testing.T) {
+	doTestMaxCollectionElements(t, testBincH)
+}
+
+func TestSimpleMaxCollectionElements(t *testing.T) {
+	doTestMaxCollectionElements(t, testSimpleH)
+}
+
+func TestJsonEmbeddedTime(t *testing.T) {
+	doTestEmbeddedTime(t, testJsonH)
+}
+
+func TestCborEmbeddedTime(t *testing.T) {
+	doTestEmbeddedTime(t, testCborH)
+}
+
+func TestMsgpackEmbeddedTime(t *testing.T) {
+	doTestEmbeddedTime(t, testMsgpackH)
+}
+
+func TestBincEmbeddedTime(t *testing.T) {
+	doTestEmbeddedTime(t, testBincH)
+}
+
+func TestSimpleEmbeddedTime(t *testing.T) {
+	doTestEmbeddedTime(t, testSimpleH)
+}
+
+func TestJsonPointerDepthLimit(t *testing.T) {
+	doTestPointerDepthLimit(t, testJsonH)
+}
+
+func TestCborPointerDepthLimit(t *testing.T) {
+	doTestPointerDepthLimit(t, testCborH)
+}
+
+func TestMsgpackPointerDepthLimit(t *testing.T) {
+	doTestPointerDepthLimit(t, testMsgpackH)
+}
+
+func TestBincPointerDepthLimit(t *testing.T) {
+	doTestPointerDepthLimit(t, testBincH)
+}
+
+func TestSimplePointerDepthLimit(t *testing.T) {
+	doTestPointerDepthLimit(t, testSimpleH)
+}
+
+func TestJsonCodecFielder(t *testing.T) {
+	doTestCodecFielder(t, testJsonH)
+}
+
+func TestCborCodecFielder(t *testing.T) {
+	doTestCodecFielder(t, testCborH)
+}
+
+func TestMsgpackCodecFielder(t *testing.T) {
+	doTestCodecFielder(t, testMsgpackH)
+}
+
+func TestBincCodecFielder(t *testing.T) {
+	doTestCodecFielder(t, testBincH)
+}
+
+func TestSimpleCodecFielder(t *testing.T) {
+	doTestCodecFielder(t, testSimpleH)
+}
+
+func TestMsgpackEncodeExt(t *testing.T) {
+	doTestMsgpackEncodeExt(t, testMsgpackH)
+}
+
+func TestJsonWrapScalarsKey(t *testing.T) {
+	doTestWrapScalarsKey(t, testJsonH)
+}
+
+func TestCborWrapScalarsKey(t *testing.T) {
+	doTestWrapScalarsKey(t, testCborH)
+}
+
+func TestMsgpackWrapScalarsKey(t *testing.T) {
+	doTestWrapScalarsKey(t, testMsgpackH)
+}
+
+func TestBincWrapScalarsKey(t *testing.T) {
+	doTestWrapScalarsKey(t, testBincH)
+}
+
+func TestSimpleWrapScalarsKey(t *testing.T) {
+	doTestWrapScalarsKey(t, testSimpleH)
+}
+
+func TestJsonCanonicalMaxKeyBytes(t *testing.T) {
+	doTestCanonicalMaxKeyBytes(t, testJsonH)
+}
+
+func TestCborCanonicalMaxKeyBytes(t *testing.T) {
+	doTestCanonicalMaxKeyBytes(t, testCborH)
+}
+
+func TestMsgpackCanonicalMaxKeyBytes(t *testing.T) {
+	doTestCanonicalMaxKeyBytes(t, testMsgpackH)
+}
+
+func TestBincCanonicalMaxKeyBytes(t *testing.T) {
+	doTestCanonicalMaxKeyBytes(t, testBincH)
+}
+
+func TestSimpleCanonicalMaxKeyBytes(t *testing.T) {
+	doTestCanonicalMaxKeyBytes(t, testSimpleH)
 }
 
-func TestBincEmbeddedFieldPrecedence(t *testing.T) {
-	doTestEmbeddedFieldPrecedence(t, testBincH)
+func TestJsonEncodeMapFromKeys(t *testing.T) {
+	doTestEncodeMapFromKeys(t, testJsonH)
 }
 
-func TestSimpleEmbeddedFieldPrecedence(t *testing.T) {
-	doTestEmbeddedFieldPrecedence(t, testSimpleH)
+func TestCborEncodeMapFromKeys(t *testing.T) {
+	doTestEncodeMapFromKeys(t, testCborH)
 }
 
-func TestJsonLargeContainerLen(t *testing.T) {
-	doTestLargeContainerLen(t, testJsonH)
+func TestMsgpackEncodeMapFromKeys(t *testing.T) {
+	doTestEncodeMapFromKeys(t, testMsgpackH)
 }
 
-func TestCborLargeContainerLen(t *testing.T) {
-	doTestLargeContainerLen(t, testCborH)
+func TestBincEncodeMapFromKeys(t *testing.T) {
+	doTestEncodeMapFromKeys(t, testBincH)
 }
 
-func TestMsgpackLargeContainerLen(t *testing.T) {
-	doTestLargeContainerLen(t, testMsgpackH)
+func TestSimpleEncodeMapFromKeys(t *testing.T) {
+	doTestEncodeMapFromKeys(t, testSimpleH)
 }
 
-func TestBincLargeContainerLen(t *testing.T) {
-	doTestLargeContainerLen(t, testBincH)
+func TestJsonSeparators(t *testing.T) {
+	doTestJsonSeparators(t, testJsonH)
 }
 
-func TestSimpleLargeContainerLen(t *testing.T) {
-	doTestLargeContainerLen(t, testSimpleH)
+func TestJsonChecksumTrailer(t *testing.T) {
+	doTestChecksumTrailer(t, testJsonH)
 }
 
-func TestJsonTime(t *testing.T) {
-	doTestTime(t, testJsonH)
+func TestCborChecksumTrailer(t *testing.T) {
+	doTestChecksumTrailer(t, testCborH)
 }
 
-func TestCborTime(t *testing.T) {
-	doTestTime(t, testCborH)
+func TestMsgpackChecksumTrailer(t *testing.T) {
+	doTestChecksumTrailer(t, testMsgpackH)
 }
 
-func TestMsgpackTime(t *testing.T) {
-	doTestTime(t, testMsgpackH)
+func TestBincChecksumTrailer(t *testing.T) {
+	doTestChecksumTrailer(t, testBincH)
 }
 
-func TestBincTime(t *testing.T) {
-	doTestTime(t, testBincH)
+func TestSimpleChecksumTrailer(t *testing.T) {
+	doTestChecksumTrailer(t, testSimpleH)
 }
 
-func TestSimpleTime(t *testing.T) {
-	doTestTime(t, testSimpleH)
+func TestJsonStructFieldJsonString(t *testing.T) {
+	doTestStructFieldJsonString(t, testJsonH)
 }
 
-func TestJsonUintToInt(t *testing.T) {
-	doTestUintToInt(t, testJsonH)
+func TestCborStructFieldJsonString(t *testing.T) {
+	doTestStructFieldJsonString(t, testCborH)
 }
 
-func TestCborUintToInt(t *testing.T) {
-	doTestUintToInt(t, testCborH)
+func TestMsgpackStructFieldJsonString(t *testing.T) {
+	doTestStructFieldJsonString(t, testMsgpackH)
 }
 
-func TestMsgpackUintToInt(t *testing.T) {
-	doTestUintToInt(t, testMsgpackH)
+func TestBincStructFieldJsonString(t *testing.T) {
+	doTestStructFieldJsonString(t, testBincH)
 }
 
-func TestBincUintToInt(t *testing.T) {
-	doTestUintToInt(t, testBincH)
+func TestSimpleStructFieldJsonString(t *testing.T) {
+	doTestStructFieldJsonString(t, testSimpleH)
 }
 
-func TestSimpleUintToInt(t *testing.T) {
-	doTestUintToInt(t, testSimpleH)
+func TestJsonOmitEmptyByDefault(t *testing.T) {
+	doTestOmitEmptyByDefault(t, testJsonH)
 }
 
-func TestJsonDifferentMapOrSliceType(t *testing.T) {
-	doTestDifferentMapOrSliceType(t, testJsonH)
+func TestCborOmitEmptyByDefault(t *testing.T) {
+	doTestOmitEmptyByDefault(t, testCborH)
 }
 
-func TestCborDifferentMapOrSliceType(t *testing.T) {
-	doTestDifferentMapOrSliceType(t, testCborH)
+func TestMsgpackOmitEmptyByDefault(t *testing.T) {
+	doTestOmitEmptyByDefault(t, testMsgpackH)
 }
 
-func TestMsgpackDifferentMapOrSliceType(t *testing.T) {
-	doTestDifferentMapOrSliceType(t, testMsgpackH)
+func TestBincOmitEmptyByDefault(t *testing.T) {
+	doTestOmitEmptyByDefault(t, testBincH)
 }
 
-func TestBincDifferentMapOrSliceType(t *testing.T) {
-	doTestDifferentMapOrSliceType(t, testBincH)
+func TestSimpleOmitEmptyByDefault(t *testing.T) {
+	doTestOmitEmptyByDefault(t, testSimpleH)
 }
 
-func TestSimpleDifferentMapOrSliceType(t *testing.T) {
-	doTestDifferentMapOrSliceType(t, testSimpleH)
+func TestJsonEncodeMulti(t *testing.T) {
+	doTestEncodeMulti(t, testJsonH)
 }
 
-func TestJsonScalars(t *testing.T) {
-	doTestScalars(t, testJsonH)
+func TestCborEncodeMulti(t *testing.T) {
+	doTestEncodeMulti(t, testCborH)
 }
 
-func TestCborScalars(t *testing.T) {
-	doTestScalars(t, testCborH)
+func TestMsgpackEncodeMulti(t *testing.T) {
+	doTestEncodeMulti(t, testMsgpackH)
 }
 
-func TestMsgpackScalars(t *testing.T) {
-	doTestScalars(t, testMsgpackH)
+func TestBincEncodeMulti(t *testing.T) {
+	doTestEncodeMulti(t, testBincH)
 }
 
-func TestBincScalars(t *testing.T) {
-	doTestScalars(t, testBincH)
+func TestSimpleEncodeMulti(t *testing.T) {
+	doTestEncodeMulti(t, testSimpleH)
 }
 
-func TestSimpleScalars(t *testing.T) {
-	doTestScalars(t, testSimpleH)
+func TestJsonStructFieldIndex(t *testing.T) {
+	doTestStructFieldIndex(t, testJsonH)
 }
 
-func TestJsonOmitempty(t *testing.T) {
-	doTestOmitempty(t, testJsonH)
+func TestCborStructFieldIndex(t *testing.T) {
+	doTestStructFieldIndex(t, testCborH)
 }
 
-func TestCborOmitempty(t *testing.T) {
-	doTestOmitempty(t, testCborH)
+func TestMsgpackStructFieldIndex(t *testing.T) {
+	doTestStructFieldIndex(t, testMsgpackH)
 }
 
-func TestMsgpackOmitempty(t *testing.T) {
-	doTestOmitempty(t, testMsgpackH)
+func TestBincStructFieldIndex(t *testing.T) {
+	doTestStructFieldIndex(t, testBincH)
 }
 
-func TestBincOmitempty(t *testing.T) {
-	doTestOmitempty(t, testBincH)
+func TestSimpleStructFieldIndex(t *testing.T) {
+	doTestStructFieldIndex(t, testSimpleH)
 }
 
-func TestSimpleOmitempty(t *testing.T) {
-	doTestOmitempty(t, testSimpleH)
+func TestJsonStructFieldLenOf(t *testing.T) {
+	doTestStructFieldLenOf(t, testJsonH)
 }
 
-func TestJsonIntfMapping(t *testing.T) {
-	doTestIntfMapping(t, testJsonH)
+func TestCborStructFieldLenOf(t *testing.T) {
+	doTestStructFieldLenOf(t, testCborH)
 }
 
-func TestCborIntfMapping(t *testing.T) {
-	doTestIntfMapping(t, testCborH)
+func TestMsgpackStructFieldLenOf(t *testing.T) {
+	doTestStructFieldLenOf(t, testMsgpackH)
 }
 
-func TestMsgpackIntfMapping(t *testing.T) {
-	doTestIntfMapping(t, testMsgpackH)
+func TestBincStructFieldLenOf(t *testing.T) {
+	doTestStructFieldLenOf(t, testBincH)
 }
 
-func TestBincIntfMapping(t *testing.T) {
-	doTestIntfMapping(t, testBincH)
+func TestSimpleStructFieldLenOf(t *testing.T) {
+	doTestStructFieldLenOf(t, testSimpleH)
 }
 
-func TestSimpleIntfMapping(t *testing.T) {
-	doTestIntfMapping(t, testSimpleH)
+func TestJsonEncodeNoExt(t *testing.T) {
+	doTestEncodeNoExt(t, testJsonH)
 }
 
-func TestJsonMissingFields(t *testing.T) {
-	doTestMissingFields(t, testJsonH)
+func TestCborEncodeNoExt(t *testing.T) {
+	doTestEncodeNoExt(t, testCborH)
 }
 
-func TestCborMissingFields(t *testing.T) {
-	doTestMissingFields(t, testCborH)
+func TestMsgpackEncodeNoExt(t *testing.T) {
+	doTestEncodeNoExt(t, testMsgpackH)
 }
 
-func TestMsgpackMissingFields(t *testing.T) {
-	doTestMissingFields(t, testMsgpackH)
+func TestBincEncodeNoExt(t *testing.T) {
+	doTestEncodeNoExt(t, testBincH)
 }
 
-func TestBincMissingFields(t *testing.T) {
-	doTestMissingFields(t, testBincH)
+func TestSimpleEncodeNoExt(t *testing.T) {
+	doTestEncodeNoExt(t, testSimpleH)
 }
 
-func TestSimpleMissingFields(t *testing.T) {
-	doTestMissingFields(t, testSimpleH)
+func TestJsonSkipMapValueKinds(t *testing.T) {
+	doTestSkipMapValueKinds(t, testJsonH)
 }
 
-func TestJsonMaxDepth(t *testing.T) {
-	doTestMaxDepth(t, testJsonH)
+func TestCborSkipMapValueKinds(t *testing.T) {
+	doTestSkipMapValueKinds(t, testCborH)
 }
 
-func TestCborMaxDepth(t *testing.T) {
-	doTestMaxDepth(t, testCborH)
+func TestMsgpackSkipMapValueKinds(t *testing.T) {
+	doTestSkipMapValueKinds(t, testMsgpackH)
 }
 
-func TestMsgpackMaxDepth(t *testing.T) {
-	doTestMaxDepth(t, testMsgpackH)
+func TestBincSkipMapValueKinds(t *testing.T) {
+	doTestSkipMapValueKinds(t, testBincH)
 }
 
-func TestBincMaxDepth(t *testing.T) {
-	doTestMaxDepth(t, testBincH)
+func TestSimpleSkipMapValueKinds(t *testing.T) {
+	doTestSkipMapValueKinds(t, testSimpleH)
 }
 
-func TestSimpleMaxDepth(t *testing.T) {
-	doTestMaxDepth(t, testSimpleH)
+func TestJsonMaxKeysPerMap(t *testing.T) {
+	doTestMaxKeysPerMap(t, testJsonH)
 }
 
-func TestJsonSelfExt(t *testing.T) {
-	doTestSelfExt(t, testJsonH)
+func TestCborMaxKeysPerMap(t *testing.T) {
+	doTestMaxKeysPerMap(t, testCborH)
 }
 
-func TestCborSelfExt(t *testing.T) {
-	doTestSelfExt(t, testCborH)
+func TestMsgpackMaxKeysPerMap(t *testing.T) {
+	doTestMaxKeysPerMap(t, testMsgpackH)
 }
 
-func TestMsgpackSelfExt(t *testing.T) {
-	doTestSelfExt(t, testMsgpackH)
+func TestBincMaxKeysPerMap(t *testing.T) {
+	doTestMaxKeysPerMap(t, testBincH)
 }
 
-func TestBincSelfExt(t *testing.T) {
-	doTestSelfExt(t, testBincH)
+func TestSimpleMaxKeysPerMap(t *testing.T) {
+	doTestMaxKeysPerMap(t, testSimpleH)
 }
 
-func TestSimpleSelfExt(t *testing.T) {
-	doTestSelfExt(t, testSimpleH)
+func TestJsonReaderMarshaler(t *testing.T) {
+	doTestReaderMarshaler(t, testJsonH)
 }
 
-func TestJsonBytesEncodedAsArray(t *testing.T) {
-	doTestBytesEncodedAsArray(t, testJsonH)
+func TestCborReaderMarshaler(t *testing.T) {
+	doTestReaderMarshaler(t, testCborH)
 }
 
-func TestCborBytesEncodedAsArray(t *testing.T) {
-	doTestBytesEncodedAsArray(t, testCborH)
+func TestMsgpackReaderMarshaler(t *testing.T) {
+	doTestReaderMarshaler(t, testMsgpackH)
 }
 
-func TestMsgpackBytesEncodedAsArray(t *testing.T) {
-	doTestBytesEncodedAsArray(t, testMsgpackH)
+func TestBincReaderMarshaler(t *testing.T) {
+	doTestReaderMarshaler(t, testBincH)
 }
 
-func TestBincBytesEncodedAsArray(t *testing.T) {
-	doTestBytesEncodedAsArray(t, testBincH)
+func TestSimpleReaderMarshaler(t *testing.T) {
+	doTestReaderMarshaler(t, testSimpleH)
 }
 
-func TestSimpleBytesEncodedAsArray(t *testing.T) {
-	doTestBytesEncodedAsArray(t, testSimpleH)
+func TestJsonZeroAsNull(t *testing.T) {
+	doTestZeroAsNull(t, testJsonH)
 }
 
-func TestJsonStrucEncDec(t *testing.T) {
-	doTestStrucEncDec(t, testJsonH)
+func TestCborZeroAsNull(t *testing.T) {
+	doTestZeroAsNull(t, testCborH)
 }
 
-func TestCborStrucEncDec(t *testing.T) {
-	doTestStrucEncDec(t, testCborH)
+func TestMsgpackZeroAsNull(t *testing.T) {
+	doTestZeroAsNull(t, testMsgpackH)
 }
 
-func TestMsgpackStrucEncDec(t *testing.T) {
-	doTestStrucEncDec(t, testMsgpackH)
+func TestBincZeroAsNull(t *testing.T) {
+	doTestZeroAsNull(t, testBincH)
 }
 
-func TestBincStrucEncDec(t *testing.T) {
-	doTestStrucEncDec(t, testBincH)
+func TestSimpleZeroAsNull(t *testing.T) {
+	doTestZeroAsNull(t, testSimpleH)
 }
 
-func TestSimpleStrucEncDec(t *testing.T) {
-	doTestStrucEncDec(t, testSimpleH)
+func TestJsonFixedInnerSlice(t *testing.T) {
+	doTestFixedInnerSlice(t, testJsonH)
 }
 
-func TestJsonRawToStringToRawEtc(t *testing.T) {
-	doTestRawToStringToRawEtc(t, testJsonH)
+func TestCborFixedInnerSlice(t *testing.T) {
+	doTestFixedInnerSlice(t, testCborH)
 }
 
-func TestCborRawToStringToRawEtc(t *testing.T) {
-	doTestRawToStringToRawEtc(t, testCborH)
+func TestMsgpackFixedInnerSlice(t *testing.T) {
+	doTestFixedInnerSlice(t, testMsgpackH)
 }
 
-func TestMsgpackRawToStringToRawEtc(t *testing.T) {
-	doTestRawToStringToRawEtc(t, testMsgpackH)
+func TestBincFixedInnerSlice(t *testing.T) {
+	doTestFixedInnerSlice(t, testBincH)
 }
 
-func TestBincRawToStringToRawEtc(t *testing.T) {
-	doTestRawToStringToRawEtc(t, testBincH)
+func TestSimpleFixedInnerSlice(t *testing.T) {
+	doTestFixedInnerSlice(t, testSimpleH)
 }
 
-func TestSimpleRawToStringToRawEtc(t *testing.T) {
-	doTestRawToStringToRawEtc(t, testSimpleH)
+func TestJsonStructKVArray(t *testing.T) {
+	doTestStructKVArray(t, testJsonH)
 }
 
-func TestJsonStructKeyType(t *testing.T) {
-	doTestStructKeyType(t, testJsonH)
+func TestCborStructKVArray(t *testing.T) {
+	doTestStructKVArray(t, testCborH)
 }
 
-func TestCborStructKeyType(t *testing.T) {
-	doTestStructKeyType(t, testCborH)
+func TestMsgpackStructKVArray(t *testing.T) {
+	doTestStructKVArray(t, testMsgpackH)
 }
 
-func TestMsgpackStructKeyType(t *testing.T) {
-	doTestStructKeyType(t, testMsgpackH)
+func TestBincStructKVArray(t *testing.T) {
+	doTestStructKVArray(t, testBincH)
 }
 
-func TestBincStructKeyType(t *testing.T) {
-	doTestStructKeyType(t, testBincH)
+func TestSimpleStructKVArray(t *testing.T) {
+	doTestStructKVArray(t, testSimpleH)
 }
 
-func TestSimpleStructKeyType(t *testing.T) {
-	doTestStructKeyType(t, testSimpleH)
+func TestJsonTokenVisitor(t *testing.T) {
+	doTestTokenVisitor(t, testJsonH)
 }
 
-func TestJsonPreferArrayOverSlice(t *testing.T) {
-	doTestPreferArrayOverSlice(t, testJsonH)
+func TestCborTokenVisitor(t *testing.T) {
+	doTestTokenVisitor(t, testCborH)
 }
 
-func TestCborPreferArrayOverSlice(t *testing.T) {
-	doTestPreferArrayOverSlice(t, testCborH)
+func TestMsgpackTokenVisitor(t *testing.T) {
+	doTestTokenVisitor(t, testMsgpackH)
 }
 
-func TestMsgpackPreferArrayOverSlice(t *testing.T) {
-	doTestPreferArrayOverSlice(t, testMsgpackH)
+func TestBincTokenVisitor(t *testing.T) {
+	doTestTokenVisitor(t, testBincH)
 }
 
-func TestBincPreferArrayOverSlice(t *testing.T) {
-	doTestPreferArrayOverSlice(t, testBincH)
+func TestSimpleTokenVisitor(t *testing.T) {
+	doTestTokenVisitor(t, testSimpleH)
 }
 
-func TestSimplePreferArrayOverSlice(t *testing.T) {
-	doTestPreferArrayOverSlice(t, testSimpleH)
+func TestJsonEncodeWithSchema(t *testing.T) {
+	doTestEncodeWithSchema(t, testJsonH)
 }
 
-func TestJsonZeroCopyBytes(t *testing.T) {
-	doTestZeroCopyBytes(t, testJsonH)
+func TestCborEncodeWithSchema(t *testing.T) {
+	doTestEncodeWithSchema(t, testCborH)
 }
 
-func TestCborZeroCopyBytes(t *testing.T) {
-	doTestZeroCopyBytes(t, testCborH)
+func TestMsgpackEncodeWithSchema(t *testing.T) {
+	doTestEncodeWithSchema(t, testMsgpackH)
 }
 
-func TestMsgpackZeroCopyBytes(t *testing.T) {
-	doTestZeroCopyBytes(t, testMsgpackH)
+func TestBincEncodeWithSchema(t *testing.T) {
+	doTestEncodeWithSchema(t, testBincH)
 }
 
-func TestBincZeroCopyBytes(t *testing.T) {
-	doTestZeroCopyBytes(t, testBincH)
+func TestSimpleEncodeWithSchema(t *testing.T) {
+	doTestEncodeWithSchema(t, testSimpleH)
 }
 
-func TestSimpleZeroCopyBytes(t *testing.T) {
-	doTestZeroCopyBytes(t, testSimpleH)
+func TestJsonVerboseEnums(t *testing.T) {
+	doTestVerboseEnums(t, testJsonH)
 }
 
-func TestJsonNextValueBytes(t *testing.T) {
-	doTestNextValueBytes(t, testJsonH)
+func TestCborVerboseEnums(t *testing.T) {
+	doTestVerboseEnums(t, testCborH)
 }
 
-func TestCborNextValueBytes(t *testing.T) {
-	// x := testCborH.IndefiniteLength
-	// defer func() { testCborH.IndefiniteLength = x }()
+func TestMsgpackVerboseEnums(t *testing.T) {
+	doTestVerboseEnums(t, testMsgpackH)
+}
 
-	// xdebugf(">>>>> TestCborNextValueBytes: IndefiniteLength = false")
-	// testCborH.IndefiniteLength = false
-	// doTestNextValueBytes(t, testCborH)
-	// xdebugf(">>>>> TestCborNextValueBytes: IndefiniteLength = true")
-	// testCborH.IndefiniteLength = true
-	doTestNextValueBytes(t, testCborH)
+func TestBincVerboseEnums(t *testing.T) {
+	doTestVerboseEnums(t, testBincH)
 }
 
-func TestMsgpackNextValueBytes(t *testing.T) {
-	doTestNextValueBytes(t, testMsgpackH)
+func TestSimpleVerboseEnums(t *testing.T) {
+	doTestVerboseEnums(t, testSimpleH)
 }
 
-func TestBincNextValueBytes(t *testing.T) {
-	doTestNextValueBytes(t, testBincH)
+func TestJsonErrorOnSharedPointers(t *testing.T) {
+	doTestErrorOnSharedPointers(t, testJsonH)
 }
 
-func TestSimpleNextValueBytes(t *testing.T) {
-	doTestNextValueBytes(t, testSimpleH)
+func TestCborErrorOnSharedPointers(t *testing.T) {
+	doTestErrorOnSharedPointers(t, testCborH)
 }
 
-func TestJsonNumbers(t *testing.T) {
-	doTestNumbers(t, testJsonH)
+func TestMsgpackErrorOnSharedPointers(t *testing.T) {
+	doTestErrorOnSharedPointers(t, testMsgpackH)
 }
 
-func TestCborNumbers(t *testing.T) {
-	doTestNumbers(t, testCborH)
+func TestBincErrorOnSharedPointers(t *testing.T) {
+	doTestErrorOnSharedPointers(t, testBincH)
 }
 
-func TestMsgpackNumbers(t *testing.T) {
-	doTestNumbers(t, testMsgpackH)
+func TestSimpleErrorOnSharedPointers(t *testing.T) {
+	doTestErrorOnSharedPointers(t, testSimpleH)
 }
 
-func TestBincNumbers(t *testing.T) {
-	doTestNumbers(t, testBincH)
+func TestJsonTimeEncoding(t *testing.T) {
+	doTestTimeEncoding(t, testJsonH)
 }
 
-func TestSimpleNumbers(t *testing.T) {
-	doTestNumbers(t, testSimpleH)
+func TestCborTimeEncoding(t *testing.T) {
+	doTestTimeEncoding(t, testCborH)
 }
 
-func TestJsonDesc(t *testing.T) {
-	doTestDesc(t, testJsonH, map[byte]string{'"': `"`, '{': `{`, '}': `}`, '[': `[`, ']': `]`})
+func TestMsgpackTimeEncoding(t *testing.T) {
+	doTestTimeEncoding(t, testMsgpackH)
 }
 
-func TestCborDesc(t *testing.T) {
-	m := make(map[byte]string)
-	for k, v := range cbordescMajorNames {
-		// if k == cborMajorSimpleOrFloat { m[k<<5] = "nil" }
-		m[k<<5] = v
-	}
-	for k, v := range cbordescSimpleNames {
-		m[k] = v
-	}
-	delete(m, cborMajorSimpleOrFloat<<5)
-	doTestDesc(t, testCborH, m)
+func TestBincTimeEncoding(t *testing.T) {
+	doTestTimeEncoding(t, testBincH)
 }
 
-func TestMsgpackDesc(t *testing.T) {
-	m := make(map[byte]string)
-	for k, v := range mpdescNames {
-		m[k] = v
-	}
-	m[mpPosFixNumMin] = "int"
-	m[mpFixStrMin] = "string|bytes"
-	m[mpFixArrayMin] = "array"
-	m[mpFixMapMin] = "map"
-	m[mpFixExt1] = "ext"
+func TestSimpleTimeEncoding(t *testing.T) {
+	doTestTimeEncoding(t, testSimpleH)
+}
 
-	doTestDesc(t, testMsgpackH, m)
+func TestJsonEncodeNonDefault(t *testing.T) {
+	doTestEncodeNonDefault(t, testJsonH)
 }
 
-func TestBincDesc(t *testing.T) {
-	m := make(map[byte]string)
-	for k, v := range bincdescVdNames {
-		m[k<<4] = v
-	}
-	for k, v := range bincdescSpecialVsNames {
-		m[k] = v
-	}
-	delete(m, bincVdSpecial<<4)
-	doTestDesc(t, testBincH, m)
+func TestCborEncodeNonDefault(t *testing.T) {
+	doTestEncodeNonDefault(t, testCborH)
 }
 
-func TestSimpleDesc(t *testing.T) {
-	doTestDesc(t, testSimpleH, simpledescNames)
+func TestMsgpackEncodeNonDefault(t *testing.T) {
+	doTestEncodeNonDefault(t, testMsgpackH)
 }
 
-func TestJsonStructFieldInfoToArray(t *testing.T) {
-	doTestStructFieldInfoToArray(t, testJsonH)
+func TestBincEncodeNonDefault(t *testing.T) {
+	doTestEncodeNonDefault(t, testBincH)
 }
 
-func TestCborStructFieldInfoToArray(t *testing.T) {
-	doTestStructFieldInfoToArray(t, testCborH)
+func TestSimpleEncodeNonDefault(t *testing.T) {
+	doTestEncodeNonDefault(t, testSimpleH)
 }
 
-func TestMsgpackStructFieldInfoToArray(t *testing.T) {
-	doTestStructFieldInfoToArray(t, testMsgpackH)
+func TestJsonResetBytesFixed(t *testing.T) {
+	doTestResetBytesFixed(t, testJsonH)
 }
 
-func TestBincStructFieldInfoToArray(t *testing.T) {
-	doTestStructFieldInfoToArray(t, testBincH)
+func TestCborResetBytesFixed(t *testing.T) {
+	doTestResetBytesFixed(t, testCborH)
 }
 
-func TestSimpleStructFieldInfoToArray(t *testing.T) {
-	doTestStructFieldInfoToArray(t, testSimpleH)
+func TestMsgpackResetBytesFixed(t *testing.T) {
+	doTestResetBytesFixed(t, testMsgpackH)
 }
 
-// --------
+func TestBincResetBytesFixed(t *testing.T) {
+	doTestResetBytesFixed(t, testBincH)
+}
 
-func TestMultipleEncDec(t *testing.T) {
-	doTestMultipleEncDec(t, testJsonH)
+func TestSimpleResetBytesFixed(t *testing.T) {
+	doTestResetBytesFixed(t, testSimpleH)
 }
 
-func TestJsonEncodeIndent(t *testing.T) {
-	doTestJsonEncodeIndent(t, testJsonH)
+func TestJsonAllowComments(t *testing.T) {
+	doTestJsonAllowComments(t, testJsonH)
 }
 
-func TestJsonDecodeNonStringScalarInStringContext(t *testing.T) {
-	doTestJsonDecodeNonStringScalarInStringContext(t, testJsonH)
+func TestJsonIterativeOptions(t *testing.T) {
+	doTestIterativeOptions(t, testJsonH)
 }
 
-func TestJsonLargeInteger(t *testing.T) {
-	doTestJsonLargeInteger(t, testJsonH)
+func TestCborIterativeOptions(t *testing.T) {
+	doTestIterativeOptions(t, testCborH)
 }
 
-func TestJsonInvalidUnicode(t *testing.T) {
-	doTestJsonInvalidUnicode(t, testJsonH)
+func TestMsgpackIterativeOptions(t *testing.T) {
+	doTestIterativeOptions(t, testMsgpackH)
 }
 
-func TestJsonNumberParsing(t *testing.T) {
-	doTestJsonNumberParsing(t, testJsonH)
+func TestBincIterativeOptions(t *testing.T) {
+	doTestIterativeOptions(t, testBincH)
 }
 
-func TestMsgpackDecodeMapAndExtSizeMismatch(t *testing.T) {
-	doTestMsgpackDecodeMapAndExtSizeMismatch(t, testMsgpackH)
+func TestSimpleIterativeOptions(t *testing.T) {
+	doTestIterativeOptions(t, testSimpleH)
 }
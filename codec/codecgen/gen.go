@@ -311,6 +311,11 @@ func mainGen(tv *mainCfg, infiles ...string) (err error) {
 						if len(td.Name.Name) == 0 {
 							continue
 						}
+						// a generic type cannot be generated for, as it must first be instantiated.
+						// Its instantiations are encoded via reflection like their monomorphized equivalents.
+						if hasTypeParams(td) {
+							continue
+						}
 
 						// only generate for:
 						//   struct: StructType
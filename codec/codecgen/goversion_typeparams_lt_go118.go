@@ -0,0 +1,13 @@
+// Copyright (c) 2012-2020 Ugorji Nwoke. All rights reserved.
+// Use of this source code is governed by a MIT license found in the LICENSE file.
+
+//go:build !go1.18
+// +build !go1.18
+
+package main
+
+import "go/ast"
+
+func hasTypeParams(td *ast.TypeSpec) bool {
+	return false
+}
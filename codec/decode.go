@@ -389,6 +389,15 @@ func (d *Decoder) kErr(f *codecFnInfo, rv reflect.Value) {
 	d.errorf("no decoding function defined for kind %v", rv.Kind())
 }
 
+// kFunc skips the value for a lazy func (see CallLazyFuncs), as it is computed when encoding.
+func (d *Decoder) kFunc(f *codecFnInfo, rv reflect.Value) {
+	if d.h.CallLazyFuncs && isLazyFuncType(f.ti.rt) {
+		d.swallow()
+		return
+	}
+	d.kErr(f, rv)
+}
+
 func (d *Decoder) raw(f *codecFnInfo, rv reflect.Value) {
 	rvSetBytes(rv, d.rawBytes())
 }
@@ -402,7 +411,25 @@ func (d *Decoder) kBool(f *codecFnInfo, rv reflect.Value) {
 }
 
 func (d *Decoder) kTime(f *codecFnInfo, rv reflect.Value) {
-	rvSetTime(rv, d.d.DecodeTime())
+	rvSetTime(rv, d.decodeTime())
+}
+
+// decodeTime decodes a time.Time, parsing it from a string if TimeEncoding or TimeLayout is set.
+func (d *Decoder) decodeTime() (t time.Time) {
+	if d.h.TimeEncoding == TimeNative && d.h.TimeLayout == "" {
+		return d.d.DecodeTime()
+	}
+	if d.d.TryNil() {
+		return
+	}
+	var err error
+	if d.h.TimeEncoding != TimeNative {
+		t, err = isoDateParse(d.h.TimeEncoding, string(d.d.DecodeStringAsBytes()))
+	} else {
+		t, err = time.Parse(d.h.TimeLayout, stringView(d.d.DecodeStringAsBytes()))
+	}
+	d.onerror(err)
+	return
 }
 
 func (d *Decoder) kFloat32(f *codecFnInfo, rv reflect.Value) {
@@ -660,19 +687,67 @@ func decStructFieldKeyNotString(dd decDriver, keyType valueType, b *[decScratchB
 	return
 }
 
+// kStructFieldValue decodes into the value of a struct field, honoring the "jsonstring" option.
+func (d *Decoder) kStructFieldValue(si *structFieldInfo, rv reflect.Value) {
+	if !si.path.jsonString {
+		d.decodeValue(rv, nil)
+		return
+	}
+	if d.d.TryNil() {
+		rvSetZero(rv)
+		return
+	}
+	var bs []byte
+	switch d.d.ContainerType() {
+	case valueTypeString:
+		bs = d.d.DecodeStringAsBytes()
+	case valueTypeBytes:
+		bs = d.d.DecodeBytes(nil)
+	default:
+		d.decodeValue(rv, nil) // the value itself
+		return
+	}
+	d.onerror(NewDecoderBytes(bs, jsonStringH).Decode(rv.Addr().Interface()))
+}
+
+// kStructMapEnd ends a struct decoded from a map, or from a flat array of keys and values (kvarray).
+func (d *Decoder) kStructMapEnd(kva bool) {
+	if kva {
+		d.arrayEnd()
+	} else {
+		d.mapEnd()
+	}
+}
+
 func (d *Decoder) kStruct(f *codecFnInfo, rv reflect.Value) {
-	ctyp := d.d.ContainerType()
 	ti := f.ti
+	if ti.unwrap != nil {
+		d.decodeValue(ti.unwrap.path.fieldAlloc(rv), nil)
+		return
+	}
+	ctyp := d.d.ContainerType()
 	var mf MissingFielder
 	if ti.flagMissingFielder {
 		mf = rv2i(rv).(MissingFielder)
 	} else if ti.flagMissingFielderPtr {
 		mf = rv2i(rvAddr(rv, ti.ptr)).(MissingFielder)
 	}
-	if ctyp == valueTypeMap {
-		containerLen := d.mapStart(d.d.ReadMapStart())
+	if ctyp == valueTypeMap || (ctyp == valueTypeArray && ti.kvArray) {
+		// a flat array of alternating keys and values, if the type has the "kvarray" option
+		kva := ctyp == valueTypeArray
+		var containerLen int
+		if kva {
+			if containerLen = d.arrayStart(d.d.ReadArrayStart()); containerLen > 0 {
+				if containerLen%2 != 0 {
+					d.errorf("cannot decode %v from an array of keys and values of odd length %d", ti.rt, containerLen)
+				}
+				containerLen /= 2
+			}
+		} else {
+			containerLen = d.mapStart(d.d.ReadMapStart())
+		}
 		if containerLen == 0 {
-			d.mapEnd()
+			d.kStructMapEnd(kva)
 			return
 		}
 		hasLen := containerLen >= 0
@@ -683,15 +758,26 @@ func (d *Decoder) kStruct(f *codecFnInfo, rv reflect.Value) {
 		}
 		var rvkencname []byte
 		for j := 0; d.containerNext(j, containerLen, hasLen); j++ {
-			d.mapElemKey()
+			if kva {
+				d.arrayElem()
+			} else {
+				d.mapElemKey()
+			}
 			if ti.keyType == valueTypeString {
 				rvkencname = d.d.DecodeStringAsBytes()
+				if d.h.keyDictInv != nil {
+					rvkencname = d.kKeyDictBytes(rvkencname)
+				}
 			} else {
 				rvkencname = decStructFieldKeyNotString(d.d, ti.keyType, &d.b)
 			}
-			d.mapElemValue()
+			if kva {
+				d.arrayElem()
+			} else {
+				d.mapElemValue()
+			}
 			if si := ti.siForEncName(rvkencname); si != nil {
-				d.decodeValue(si.path.fieldAlloc(rv), nil)
+				d.kStructFieldValue(si, si.path.fieldAlloc(rv))
 			} else if mf != nil {
 				// store rvkencname in new []byte, as it previously shares Decoder.b, which is used in decode
 				name2 = append(name2[:0], rvkencname...)
@@ -704,7 +790,7 @@ func (d *Decoder) kStruct(f *codecFnInfo, rv reflect.Value) {
 				d.structFieldNotFound(-1, stringView(rvkencname))
 			}
 		}
-		d.mapEnd()
+		d.kStructMapEnd(kva)
 	} else if ctyp == valueTypeArray {
 		containerLen := d.arrayStart(d.d.ReadArrayStart())
 		if containerLen == 0 {
@@ -726,7 +812,7 @@ func (d *Decoder) kStruct(f *codecFnInfo, rv reflect.Value) {
 				break
 			}
 			d.arrayElem()
-			d.decodeValue(si.path.fieldAlloc(rv), nil)
+			d.kStructFieldValue(si, si.path.fieldAlloc(rv))
 		}
 		var proceed bool
 		if hasLen {
@@ -1209,6 +1295,9 @@ func (d *Decoder) kMap(f *codecFnInfo, rv reflect.Value) {
 		d.mapElemKey()
 		if ktypeIsString {
 			kstr2bs = d.d.DecodeStringAsBytes()
+			if d.h.keyDictInv != nil {
+				kstr2bs = d.kKeyDictBytes(kstr2bs)
+			}
 			rvSetString(rvk, fnRvk2())
 		} else {
 			d.decByteState = decByteStateNone
@@ -1496,6 +1585,23 @@ func (d *Decoder) naked() *fauxUnion {
 	return &d.n
 }
 
+// boolFromInt decodes the next value, which is not a bool, as an integer 0 or 1 into a bool
+// (as written when EncodeOptions.BoolAsInt is set).
+func (d *Decoder) boolFromInt() bool {
+	n := d.naked()
+	d.d.DecodeNaked()
+	switch {
+	case n.v == valueTypeUint && n.u <= 1:
+		return n.u == 1
+	case n.v == valueTypeInt && (n.i == 0 || n.i == 1):
+		return n.i == 1
+	case n.v == valueTypeFloat && (n.f == 0 || n.f == 1):
+		return n.f == 1
+	}
+	d.errorf("cannot decode bool from non-bool value of type: %v", n.v)
+	return false
+}
+
 // Decode decodes the stream from reader and stores the result in the
 // value pointed to by v. v cannot be a nil pointer. v can also be
 // a reflect.Value of a pointer.
@@ -1770,7 +1876,7 @@ func (d *Decoder) decode(iv interface{}) {
 			copy(v, b)
 		}
 	case *time.Time:
-		*v = d.d.DecodeTime()
+		*v = d.decodeTime()
 	case *Raw:
 		*v = d.rawBytes()
 
@@ -1836,6 +1942,21 @@ PTR:
 	fn.fd(d, &fn.i, rv)
 }
 
+// kKeyDict returns the struct field name or string map key for a KeyDictionary code.
+func (d *Decoder) kKeyDict(k string) string {
+	if v := d.h.keyDictInv[k]; v != "" {
+		return v
+	}
+	return k
+}
+
+func (d *Decoder) kKeyDictBytes(k []byte) []byte {
+	if v := d.h.keyDictInv[string(k)]; v != "" {
+		return bytesView(v)
+	}
+	return k
+}
+
 func (d *Decoder) structFieldNotFound(index int, rvkencname string) {
 	// Note: rvkencname is used only if there is an error, to pass into d.errorf.
 	// Consequently, it is ok to pass in a stringView
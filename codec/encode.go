@@ -4,13 +4,20 @@
 package codec
 
 import (
+	"bytes"
+	"context"
 	"encoding"
 	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // defEncByteBufSize is the default size of []byte used
@@ -19,6 +26,16 @@ const defEncByteBufSize = 1 << 10 // 4:16, 6:64, 8:256, 10:1024
 
 var errEncoderNotInitialized = errors.New("Encoder not initialized")
 
+var errEncoderClosed = errors.New("Encoder closed")
+
+var errEncoderNoWriters = errors.New("Encoder reset with no output streams (see ResetMulti)")
+
+var errMapFuncTooManyEntries = errors.New("cannot emit more entries than the declared map length")
+
+var errNoOpenMap = errors.New("not within a map started by EncodeMapStart")
+
+var errOpenMapNeedsKey = errors.New("cannot start a map without a key, within a map started by EncodeMapStart")
+
 // encDriver abstracts the actual codec (binc vs msgpack, etc)
 type encDriver interface {
 	EncodeNil()
@@ -73,6 +90,7 @@ type encStructFieldObj struct {
 	intf  interface{}
 	ascii bool
 	isRv  bool
+	si    *structFieldInfo // if a struct field, else nil
 }
 
 type encStructFieldObjSlice []encStructFieldObj
@@ -83,6 +101,37 @@ func (p encStructFieldObjSlice) Less(i, j int) bool {
 	return p[uint(i)].key < p[uint(j)].key
 }
 
+// stringKeyLessSlice sorts strings using a StringKeyLess function
+// (falling back to the natural order for keys which it treats as equal).
+type stringKeyLessSlice struct {
+	v    []string
+	less func(a, b string) bool
+}
+
+func (p stringKeyLessSlice) Len() int      { return len(p.v) }
+func (p stringKeyLessSlice) Swap(i, j int) { p.v[uint(i)], p.v[uint(j)] = p.v[uint(j)], p.v[uint(i)] }
+func (p stringKeyLessSlice) Less(i, j int) bool {
+	return stringKeyLess(p.less, p.v[uint(i)], p.v[uint(j)])
+}
+
+type stringRvKeyLessSlice struct {
+	v    []stringRv
+	less func(a, b string) bool
+}
+
+func (p stringRvKeyLessSlice) Len() int      { return len(p.v) }
+func (p stringRvKeyLessSlice) Swap(i, j int) { p.v[uint(i)], p.v[uint(j)] = p.v[uint(j)], p.v[uint(i)] }
+func (p stringRvKeyLessSlice) Less(i, j int) bool {
+	return stringKeyLess(p.less, p.v[uint(i)].v, p.v[uint(j)].v)
+}
+
+func stringKeyLess(less func(a, b string) bool, a, b string) bool {
+	if less(a, b) {
+		return true
+	}
+	return !less(b, a) && a < b
+}
+
 // EncodeOptions captures configuration options during encode.
 type EncodeOptions struct {
 	// WriterBufferSize is the size of the buffer used when writing.
@@ -90,6 +139,12 @@ type EncodeOptions struct {
 	// if > 0, we use a smart buffer internally for performance purposes.
 	WriterBufferSize int
 
+	// CloseWriterOnRelease configures Release to Close the Encoder
+	// i.e. flush the output and close the io.Writer, if it is an io.Closer (e.g. an *os.File).
+	//
+	// Use Close directly to see any error.
+	CloseWriterOnRelease bool
+
 	// ChanRecvTimeout is the timeout used when selecting from a chan.
 	//
 	// Configuring this controls how we receive from a chan during the encoding process.
@@ -98,9 +153,138 @@ type EncodeOptions struct {
 	//   - If  >0, we consume until this timeout.
 	ChanRecvTimeout time.Duration
 
+	// TimePrecision, if > 0, truncates each time.Time to a multiple of it before encoding
+	// e.g. time.Millisecond for consumers which only store milliseconds.
+	//
+	// It applies regardless of how the format writes a time (e.g. RFC3339 string or number).
+	// Truncating to time.Second drops the fractional seconds entirely,
+	// and the zero time is unchanged.
+	//
+	// Note that TimePrecision is not honored by codecgen.
+	TimePrecision time.Duration
+
+	// TimeLayout, if set, encodes each time.Time as a string formatted with it
+	// (see time.Time.Format) e.g. "2006-01-02" for a date-only field,
+	// in place of the format's native representation. The zero time is encoded as nil.
+	//
+	// It is also used when decoding into a time.Time, which then expects such a string
+	// (parsed with time.Parse), so values round-trip with the same handle.
+	// Note that a layout which drops information (e.g. the time of day) loses it on the round-trip.
+	//
+	// Note that TimeLayout is not honored by codecgen.
+	TimeLayout string
+
+	// TimeEncoding, if not TimeNative, encodes the date of each time.Time as a string
+	// in an ISO 8601 date format (see TimeEncoding) e.g. "2024-W05-3" for scheduling systems
+	// which use ISO week dates. It takes precedence over TimeLayout. The zero time is encoded as nil.
+	//
+	// It is also used when decoding into a time.Time, which is then parsed as midnight UTC
+	// of the date. The time of day and the location are lost on the round-trip.
+	//
+	// Note that TimeEncoding is not honored by codecgen.
+	TimeEncoding TimeEncoding
+
+	// RecordPrefix and RecordSuffix, if set, are written before and after
+	// each top-level value encoded e.g. "data: " and "\n\n" for Server-Sent Events.
+	//
+	// The prefix is written after any stream preamble (e.g. the json BOM),
+	// and the suffix after any trailing whitespace (e.g. json TermWhitespace).
+	// They are not written around values encoded within a top-level value e.g. by a Selfer.
+	RecordPrefix []byte
+	RecordSuffix []byte
+
+	// WrapScalarsKey, if set, wraps a top-level value which is a scalar in a map
+	// with a single entry under this key e.g. 42 is encoded as {"value":42} if "value".
+	// This enforces that each top-level value is an object (map) in the stream.
+	//
+	// A scalar is a value which is not a struct, map, slice or array (after dereferencing
+	// pointers and interfaces), and includes nil, a time.Time and a []byte.
+	// A Raw is not wrapped, as it is already encoded. Values within a top-level value are unaffected.
+	WrapScalarsKey string
+
 	// StructToArray specifies to encode a struct as an array, and not as a map
 	StructToArray bool
 
+	// BoolAsInt specifies to encode a bool as an unsigned integer: 1 for true, and 0 for false.
+	//
+	// This is for consumers which read bools as integers. It applies to all formats,
+	// including json (where 1 and 0 are written instead of true and false).
+	//
+	// On decode, an integer 0 or 1 is always accepted as a bool.
+	//
+	// Note that BoolAsInt is not honored by codecgen.
+	BoolAsInt bool
+
+	// EmptyStructHandling configures how a struct with no fields (e.g. struct{}) is encoded:
+	// as an empty map (or array, if StructToArray) by default, or as nil.
+	//
+	// This applies everywhere e.g. to the values of a map[string]struct{} used as a set.
+	// A struct field of such a type can be omitted via the omitempty option.
+	//
+	// Note that EmptyStructHandling is not honored by codecgen.
+	EmptyStructHandling EmptyStructHandling
+
+	// FloatSpecials configures how the special float values NaN, +Inf and -Inf
+	// are encoded, consistently across all formats (see FloatSpecialsHandling).
+	//
+	// Note that FloatSpecials is not honored by codecgen.
+	FloatSpecials FloatSpecialsHandling
+
+	// FrameLengthPrefix configures writing the length (in bytes) of each top-level value
+	// before it in the stream, for protocols which frame each record (see FrameLengthPrefix).
+	//
+	// The length covers all that is written for the value, including RecordPrefix and RecordSuffix.
+	// As the length is only known once the value is encoded, each top-level value is first
+	// buffered in full (reusing an internal buffer), and then written after its prefix.
+	// Consequently, a value which fails to encode is not written at all, and the offsets
+	// from EncodeWithFieldOffsets do not account for the prefix.
+	//
+	// The Decoder does not read the prefix: it must be consumed before decoding each value.
+	//
+	// Note that FrameLengthPrefix is not honored by codecgen.
+	FrameLengthPrefix FrameLengthPrefix
+
+	// ChecksumTrailer configures writing a checksum of each top-level value after it
+	// in the stream e.g. for an on-disk record format which detects corruption.
+	//
+	// The checksum is computed over all that is written for the value (including RecordPrefix
+	// and RecordSuffix), and written as a fixed-width big-endian trailer (see ChecksumTrailer).
+	// As for FrameLengthPrefix, each top-level value is first buffered in full, so a value
+	// which fails to encode is not written at all. If both are set, the length prefix
+	// covers the value but not its trailer.
+	//
+	// The Decoder does not read the trailer: it must be consumed (and verified) after decoding each value.
+	//
+	// Note that ChecksumTrailer is not honored by codecgen.
+	ChecksumTrailer ChecksumTrailer
+
+	// AllowUintptr permits encoding a uintptr (as an unsigned integer).
+	//
+	// By default, encoding a uintptr errors, as it typically holds a memory address,
+	// which is meaningless outside this process (and leaks information about it).
+	// Encoding an unsafe.Pointer always errors.
+	//
+	// Note that AllowUintptr is not honored by codecgen.
+	AllowUintptr bool
+
+	// EmptyArrayAsNull says to encode a zero-length (but non-nil) slice, array or chan
+	// as nil, for systems which do not distinguish an empty array from null.
+	//
+	// Note that a nil slice is always encoded as nil, so they both decode as a nil slice.
+	// A []byte (which is encoded as bytes, not an array) is not affected.
+	EmptyArrayAsNull bool
+
+	// PreserveNilVsEmpty guarantees that a nil slice or map, and a zero-length (but non-nil) one,
+	// are encoded distinctly i.e. as nil and as an empty array or map respectively,
+	// so that the distinction survives a round-trip (e.g. as null vs [] in json).
+	//
+	// It overrides options which conflate them:
+	//   - EmptyArrayAsNull is ignored.
+	//   - omitempty only omits (or, with StructToArray, encodes as nil) a nil slice or map.
+	//
+	// Note that PreserveNilVsEmpty is not honored by codecgen.
+	PreserveNilVsEmpty bool
+
 	// Canonical representation means that encoding a value will always result in the same
 	// sequence of bytes.
 	//
@@ -115,8 +299,227 @@ type EncodeOptions struct {
 	//       encoded into []byte, and then sorted,
 	//       before writing the sorted keys and the corresponding map values to the stream.
 	//
+	// The keys of a map with interface keys (e.g. map[interface{}]interface{}) may have
+	// different types, and are sorted in this order: nil, then bools (false first),
+	// then numbers (by value, regardless of type), then strings, then all other keys
+	// (by their encoded bytes). Keys which are otherwise equal (e.g. int64(1) and uint8(1))
+	// are sorted by their encoded bytes, then by their type name.
+	// It is an error for such a key to be NaN, as it cannot be ordered (or looked up).
 	Canonical bool
 
+	// SortSortables specifies that a slice whose type implements sort.Interface
+	// (e.g. sort.IntSlice) is sorted before it is encoded, for a canonical ordering
+	// driven by the type's own comparison logic.
+	//
+	// A copy of the slice is sorted, so the caller's slice is never mutated.
+	// This costs an allocation and a sort for each such slice encoded.
+	//
+	// Other types which implement sort.Interface (e.g. a struct) are encoded as usual.
+	//
+	// Note that this is not honored by codecgen.
+	SortSortables bool
+
+	// CanonicalKeyBufHint is the estimated number of bytes per encoded key, used to size
+	// the buffer which map keys are encoded into before sorting, when Canonical
+	// and the keys have no natural sort order (e.g. struct keys).
+	//
+	// Set it to the typical size of such encoded keys, to reduce re-allocation
+	// when encoding large maps. If <= 0, a default of 16 is used.
+	CanonicalKeyBufHint int
+
+	// CanonicalMaxKeyBytes bounds the memory used to sort the keys of a map when Canonical
+	// and the keys have no natural sort order (e.g. struct keys), which are otherwise
+	// all encoded into one buffer upfront.
+	//
+	// If the encoded keys exceed this many bytes, the keys are instead sorted by encoding
+	// each pair being compared on demand into small reusable buffers (and encoded again when written).
+	// This uses little memory but much more time, giving the same order as the buffered sort.
+	//
+	// If <= 0, there is no limit.
+	CanonicalMaxKeyBytes int
+
+	// PointerDepthLimit caps the number of chained pointer dereferences (including through
+	// interfaces) when encoding a value e.g. a **T counts 2. Encoding errors if a chain is longer,
+	// which defends against a pointer cycle (e.g. of a type P *P), or a crafted input,
+	// which would otherwise loop forever. It is distinct from CheckCircularRef, which only
+	// checks pointers to structs, across nested values.
+	//
+	// If 0, a default of 100 is used. If < 0, there is no limit.
+	//
+	// Note that PointerDepthLimit is not honored by codecgen.
+	PointerDepthLimit int
+
+	// MapKeyFilter, if set, is called with each key of a map being encoded,
+	// and the entry is skipped (elided) if it returns false e.g. to redact secrets.
+	//
+	// The keys are filtered before the map length is written (and before sorting, if Canonical).
+	// Note that MapKeyFilter is not honored by codecgen, except for maps with fastpath support.
+	MapKeyFilter func(key reflect.Value) bool
+
+	// SkipMapValueKinds, if set, skips (elides) each entry of a map whose value is of one
+	// of the kinds, e.g. reflect.Func and reflect.Chan to drop the values which cannot be
+	// encoded from a map[string]interface{}. The kind of an interface value is the kind of
+	// the value it holds (reflect.Invalid if nil). Struct fields are not affected.
+	//
+	// As with MapKeyFilter, the entries are skipped before the map length is written.
+	// Note that SkipMapValueKinds is not honored by codecgen, except for maps with fastpath support.
+	SkipMapValueKinds []reflect.Kind
+
+	// KeyHandle, if set, is used to encode the keys of maps, for bridge formats
+	// e.g. where the keys are canonical json (for indexing), while the values are msgpack.
+	//
+	// Each key is encoded out of band with KeyHandle, and the encoded bytes are then
+	// written as a string key in the stream. This keeps the container framing consistent:
+	// each key is a single string in the stream, even if it encodes as a container in KeyHandle.
+	// Consequently, a map decodes back as a map with string keys (e.g. map[string]T).
+	//
+	// If Canonical, the keys are sorted by their encoded bytes.
+	// KeyDictionary and StringKeyLess do not apply to such keys,
+	// and struct field names are not affected.
+	//
+	// Nil means the keys are encoded with the same handle, as usual.
+	//
+	// Note that KeyHandle is not honored by codecgen.
+	KeyHandle Handle
+
+	// SetAsArray says to encode a map whose values are empty structs (e.g. map[string]struct{}),
+	// as is typical for a set, as an array of its keys instead. As for the "set" option,
+	// the keys are sorted by their encoded bytes, so the output is deterministic.
+	// MapKeyFilter applies, but KeyHandle does not.
+	//
+	// Note that decoding such an array back into the map is not supported.
+	// SetAsArray is not honored by codecgen.
+	SetAsArray bool
+
+	// BoolSetAsArray is like SetAsArray, for a map whose values are bools (e.g. map[string]bool):
+	// it is encoded as an array of the keys whose value is true.
+	//
+	// Note that BoolSetAsArray is not honored by codecgen, except for maps with fastpath support.
+	BoolSetAsArray bool
+
+	// MaxCollectionElements, if > 0, truncates each slice, array and map with more elements
+	// to its first MaxCollectionElements, followed by a marker, to bound the output e.g. of a log record.
+	// The marker is a final string element "<truncated>" in an array,
+	// and a final entry "...": "<truncated>" in a map. The written length counts the marker.
+	//
+	// The entries of a map are kept in its iteration order, or its sorted order if Canonical.
+	// []byte, strings and structs are not truncated, nor are slices encoded as a set, in another order
+	// (see the "set", "reverse" and "sortby" options) or as a map (see MapBySlice) or flat (see FixedInnerSlice),
+	// nor maps with a KeyHandle. The output is not meant to be decoded back.
+	//
+	// Note that MaxCollectionElements is not honored by codecgen, except for slices and maps with fastpath support.
+	MaxCollectionElements int
+
+	// MaxKeysPerMap, if > 0, is the maximum number of entries in a map,
+	// above which encoding errors before the map is written e.g. to reject absurdly wide objects
+	// from user-supplied data. It applies to each (nested) map, and to each struct encoded as a map,
+	// where the fields encoded (i.e. not omitted) are counted. A struct encoded as an array,
+	// or a map whose length is not known when it starts (e.g. an indefinite-length map), is not checked.
+	//
+	// If 0 (the default), there is no limit.
+	MaxKeysPerMap int
+
+	// FixedInnerSlice says to encode a slice of slices whose rows all have the same length,
+	// such as a matrix e.g. [][]float64, compactly as a single flat array: [rows, cols, data...]
+	// i.e. the number of rows and the (common) length of each row, then the elements row by row.
+	// This saves the framing of each row. It is an error if the rows have different lengths.
+	// An empty slice is encoded as [0, 0].
+	//
+	// It only applies where the elements are of an unnamed slice type e.g. []float64
+	// (so they have no custom encoding), other than []byte. MaxCollectionElements does not apply.
+	// The flat array is not decoded back as a slice of slices: decode it into e.g. []float64.
+	//
+	// Note that FixedInnerSlice is not honored by codecgen.
+	FixedInnerSlice bool
+
+	// VerboseEnums says to encode a named integer type with a String method (e.g. an enum)
+	// as a map of its value and name, instead of as a bare integer e.g. {"value":3,"name":"Active"}
+	// for human-readable output such as logs.
+	// A map key is still encoded as the integer, as it cannot be a map. If Canonical, "name" is first.
+	//
+	// The map is not decoded back as the integer: VerboseEnums is for output which is only read.
+	// Note that VerboseEnums is not honored by codecgen.
+	VerboseEnums bool
+
+	// ShareReferences encodes a pointer to a struct, map, slice or array only once
+	// within a top-level value. Its first occurrence is marked as a shared value, and
+	// subsequent occurrences of the same pointer (by identity, not equality) are written
+	// as a reference to it. This can drastically shrink payloads with shared subtrees,
+	// and also encodes cycles (which would otherwise recurse forever) as references.
+	//
+	// It is only supported by cbor, which uses the shared value tags 28 and 29
+	// (see http://cbor.schmorp.de/value-sharing). Other formats ignore it.
+	// Pointers within values encoded out of band (e.g. for the "set" option,
+	// or Canonical map keys with no natural order) are not shared.
+	//
+	// Note that decoding shared references is not supported:
+	// a stream with references must be decoded by a decoder which resolves them.
+	//
+	// Note that ShareReferences is not honored by codecgen.
+	ShareReferences bool
+
+	// Unredact encodes the real value of struct fields tagged with the "redact" option,
+	// in place of their placeholder e.g. in a secure context (see Encoder.Encode).
+	//
+	// Note that the "redact" option is not honored by codecgen.
+	Unredact bool
+
+	// EnforceUnions checks each struct registered as a tagged union (see BasicHandle.RegisterUnion)
+	// before encoding it, and errors if its payload does not match its kind.
+	//
+	// Note that EnforceUnions is not honored by codecgen.
+	EnforceUnions bool
+
+	// EncodeFieldsIgnoreUnknown says Encoder.EncodeFields skips a field name (or path)
+	// which is not in the struct, instead of returning an error.
+	EncodeFieldsIgnoreUnknown bool
+
+	// ValidateUTF8 configures how a string with invalid UTF-8 is encoded as a text string
+	// in any format (see UTF8Validation). By default, it is written as-is, which may
+	// produce an invalid json or cbor text string e.g. from unchecked user input.
+	//
+	// The strings are only scanned if it is not UTF8PassThrough.
+	// It does not apply to strings encoded as bytes (see StringToRaw).
+	//
+	// Note that ValidateUTF8 is not honored by codecgen.
+	ValidateUTF8 UTF8Validation
+
+	// OnUnsupported, if set, is called with a value which cannot be encoded
+	// (e.g. a func or an unsafe.Pointer), and may return a substitute to encode in its place
+	// e.g. the name of a func.
+	//
+	// If it returns false, the value is handled as if OnUnsupported was not set
+	// i.e. a func is encoded as nil, and other values cause an error.
+	// This is also the case for an unsupported value within a substitute,
+	// so a substitute cannot recursively cause another substitution.
+	//
+	// Note that func fields of a struct are never encoded (so not passed to OnUnsupported).
+	OnUnsupported func(rv reflect.Value) (substitute interface{}, ok bool)
+
+	// StringKeyLess, if set, orders the string keys of maps when Canonical
+	// e.g. for a case-insensitive ordering in human-facing output.
+	//
+	// Keys which it treats as equal are ordered by their natural (byte) order,
+	// so the output is still deterministic.
+	//
+	// If nil, the natural (byte) order is used.
+	StringKeyLess func(a, b string) bool
+
+	// KeyDictionary maps struct field names and string map keys to (shorter) codes,
+	// which are written in their place e.g. {"FirstName": "fn"}.
+	// Keys not in the dictionary are written as-is.
+	//
+	// During decode, the same dictionary is used (in reverse) to map the codes
+	// back to the field names and map keys. Consequently, it is an error to encode
+	// a key which is the same as a code, or whose code is shared with another key.
+	//
+	// If Canonical, keys are sorted by their codes (i.e. as written).
+	//
+	// Note that KeyDictionary is not honored by codecgen, or when decoding into an interface{}.
+	//
+	// DO NOT CHANGE AFTER FIRST USE.
+	KeyDictionary map[string]string
+
 	// CheckCircularRef controls whether we check for circular references
 	// and error fast during an encode.
 	//
@@ -126,6 +529,19 @@ type EncodeOptions struct {
 	// This is opt-in, as there may be a performance hit to checking circular references.
 	CheckCircularRef bool
 
+	// ErrorOnSharedPointers says to error if the same pointer is encoded more than once
+	// within a top-level value e.g. to catch unintended aliasing, which expands the shared value
+	// in full at each occurrence. Unlike CheckCircularRef, it is not limited to cycles
+	// (though it catches them too): any second occurrence of a pointer errors.
+	//
+	// Pointers are the same if they have the same type and address, so a pointer to a struct
+	// and to its first field are not. A pointer to a zero-size value (e.g. &struct{}{}) is not checked,
+	// as distinct values of zero size may have the same address.
+	// Other references (e.g. a map or slice encoded twice) are not checked.
+	//
+	// Note that ErrorOnSharedPointers is not honored by codecgen.
+	ErrorOnSharedPointers bool
+
 	// RecursiveEmptyCheck controls how we determine whether a value is empty.
 	//
 	// If true, we descend into interfaces and pointers to reursively check if value is empty.
@@ -138,6 +554,22 @@ type EncodeOptions struct {
 	// If false, we check if the value is equal to its zero value (newly allocated state).
 	RecursiveEmptyCheck bool
 
+	// OmitEmptyByDefault encodes every struct field as if tagged omitempty (including the fields
+	// from a MissingFielder), except a field tagged with the "keepempty" option.
+	// As with omitempty, it is ignored when encoding a struct as an array.
+	//
+	// Note that OmitEmptyByDefault is not honored by codecgen.
+	OmitEmptyByDefault bool
+
+	// ZeroAsNull says to encode a struct field whose value is empty (as for omitempty)
+	// as nil, instead of its zero value e.g. for an API with an "explicit null" contract
+	// where every field is present. A field which is omitted (e.g. omitempty) is still omitted.
+	// It applies to any empty field, including a scalar (e.g. 0 or ""), which is then
+	// decoded back as its zero value. It also applies when encoding the struct as an array.
+	//
+	// Note that ZeroAsNull is not honored by codecgen.
+	ZeroAsNull bool
+
 	// Raw controls whether we encode Raw values.
 	// This is a "dangerous" option and must be explicitly set.
 	// If set, we blindly encode Raw values as-is, without checking
@@ -153,6 +585,11 @@ type EncodeOptions struct {
 	// By default, strings are encoded as UTF-8.
 	// but can be treated as []byte during an encode.
 	//
+	// This includes string map keys (e.g. of a map[string]T, with or without Canonical),
+	// so keys which are not valid UTF-8 are kept as-is. However, json object keys
+	// must be strings: so json writes them as strings, and errors for a key
+	// which is not valid UTF-8 (instead of writing invalid UTF-8).
+	//
 	// Note that things which we know (by definition) to be UTF-8
 	// are ALWAYS encoded as UTF-8 strings.
 	// These include encoding.TextMarshaler, time.Format calls, struct field names, etc.
@@ -175,6 +612,101 @@ type EncodeOptions struct {
 	// Use it in the very rare occurrence that your types modify a pointer value when calling
 	// an encode callback function e.g. JsonMarshal, TextMarshal, BinaryMarshal or CodecEncodeSelf.
 	NoAddressableReadonly bool
+
+	// TypeFieldName, if set, configures encoding of values held in an interface
+	// as discriminated unions.
+	//
+	// If the concrete type of the value has a name registered via SetTypeName,
+	// it is encoded as a map of 2 entries: the name keyed by TypeFieldName,
+	// and the value itself keyed by TypeValueFieldName e.g.
+	//    {"type": "Circle", "data": {"Radius": 2}}
+	//
+	// The name is always written first (even if Canonical), so a decoder can dispatch on it.
+	//
+	// This applies to interface-typed struct fields, slice or array elements and map values.
+	// Values of unregistered types are encoded as-is.
+	TypeFieldName string
+
+	// TypeValueFieldName is the key for the value, when encoding with TypeFieldName.
+	//
+	// If not set, "data" is used.
+	TypeValueFieldName string
+
+	// TaggedInterfaces configures encoding of values held in an interface
+	// (e.g. the elements of a []interface{}) with a compact type tag.
+	//
+	// Each value is encoded as a 2-element array: the id registered for its concrete type
+	// via RegisterCompactType, and the value itself e.g. [1, {"Radius": 2}].
+	// This is more compact than TypeFieldName, and so suits large polymorphic arrays.
+	//
+	// It is an error to encode a value of an unregistered type, as it could not be told apart
+	// from a tagged value. A nil interface value is encoded as nil.
+	//
+	// If set, TypeFieldName is not used.
+	//
+	// Note that TaggedInterfaces is not honored by codecgen.
+	TaggedInterfaces bool
+
+	// CallLazyFuncs configures the encoder to call each func() (interface{}, error)
+	// (including a named type with that signature) and encode the value it returns,
+	// so a value can be computed lazily, only when encoded.
+	//
+	// A struct field of such a type is then kept (by default, func fields are skipped).
+	// A nil func is encoded as nil. An error returned by the func (or a panic within it)
+	// aborts the encode. When decoding, the value for such a field is skipped.
+	//
+	// Note: DO NOT CHANGE AFTER FIRST USE, as it determines which struct fields are kept.
+	//
+	// Note that CallLazyFuncs is not honored by codecgen.
+	CallLazyFuncs bool
+
+	// MapDecorator, if set, is called for each struct encoded as a map,
+	// and the entries returned are added to the encoded map e.g. {"_version": 2}.
+	//
+	// This is like MissingFielder, but configured on the handle and applied to all types.
+	// Entries whose key collides with a struct field or a missing field are skipped.
+	//
+	// Note that MapDecorator is not honored by codecgen.
+	MapDecorator func(t reflect.Type) map[string]interface{}
+
+	// MapDecoratorMaxDepth limits the structs which MapDecorator is applied to.
+	//
+	// If > 0, MapDecorator is only applied to structs nested within fewer than
+	// MapDecoratorMaxDepth containers e.g. if 1, only to the top-level struct.
+	MapDecoratorMaxDepth int
+
+	// SchemaVersion, if non-zero, is written with the top-level struct (if any) being encoded,
+	// so that a decoder can tell which version of a format it is reading.
+	//
+	// If the struct is encoded as a map, the version is its first entry, keyed by SchemaVersionKey
+	// (even if Canonical, so it can be read before the rest of the map).
+	// If the struct is encoded as an array, the version is its first element.
+	// Nested structs are not affected.
+	//
+	// It is an error if SchemaVersionKey is also a field (or missing field) of the struct.
+	//
+	// Note that SchemaVersion is not honored by codecgen.
+	SchemaVersion uint64
+
+	// SchemaVersionKey is the map key for the SchemaVersion. It defaults to "_version" if empty.
+	SchemaVersionKey string
+
+	// Iterative configures the encoder to walk the value using an explicit (heap-allocated)
+	// work stack, instead of recursing through nested slices, arrays, maps and structs.
+	//
+	// This bounds the (goroutine) stack used when encoding very deep values,
+	// and produces the same output as the default recursive encoding.
+	//
+	// Values with a customized encoding (e.g. extensions, Selfer, marshalers, MissingFielder)
+	// and canonical maps with non-string keys are still encoded recursively.
+	Iterative bool
+
+	// IterativeMaxDepth, if > 0, caps the depth of the work stack when encoding iteratively
+	// (see Iterative) i.e. the number of nested slices, arrays, maps and structs being walked.
+	// Encoding errors if a value is nested deeper, e.g. to bound the memory used for a crafted value.
+	//
+	// Note that IterativeMaxDepth is not honored by codecgen.
+	IterativeMaxDepth int
 }
 
 // ---------------------------------------------
@@ -191,13 +723,87 @@ func (e *Encoder) selferMarshal(f *codecFnInfo, rv reflect.Value) {
 	rv2i(rv).(Selfer).CodecEncodeSelf(e)
 }
 
+// binaryMarshal encodes a BinaryMarshaler, preferring AppendBinary (if also a binaryAppender),
+// which appends into a pooled buffer instead of allocating one per value.
 func (e *Encoder) binaryMarshal(f *codecFnInfo, rv reflect.Value) {
-	bs, fnerr := rv2i(rv).(encoding.BinaryMarshaler).MarshalBinary()
+	v := rv2i(rv)
+	if x, ok := v.(binaryAppender); ok {
+		bs, fnerr := x.AppendBinary(e.blist.get(64))
+		e.marshalRaw(bs, fnerr)
+		e.blist.put(bs)
+		return
+	}
+	bs, fnerr := v.(encoding.BinaryMarshaler).MarshalBinary()
 	e.marshalRaw(bs, fnerr)
 }
 
+// readerMarshalBufLen is the size of the buffer used to copy the bytes of a CodecReaderMarshaler.
+const readerMarshalBufLen = 32 << 10
+
+// readerMarshal encodes a CodecReaderMarshaler as bytes, copying them from its reader
+// into the stream if the format supports it (see encDriverBytesStreamer), else reading them fully.
+func (e *Encoder) readerMarshal(f *codecFnInfo, rv reflect.Value) {
+	r, n, fnerr := rv2i(rv).(CodecReaderMarshaler).CodecMarshalReader()
+	e.onerror(fnerr)
+	if r == nil {
+		e.e.EncodeNil()
+		return
+	}
+	if n < 0 {
+		n = -1
+	}
+	ds, ok := e.e.(encDriverBytesStreamer)
+	if !ok || !ds.WriteBytesStart(n) {
+		var buf bytes.Buffer
+		if n > 0 && n <= readerMarshalBufLen {
+			buf.Grow(int(n))
+		}
+		_, err := buf.ReadFrom(r)
+		e.onerror(err)
+		if n >= 0 && int64(buf.Len()) != n {
+			e.errorf("cannot encode %v: reader has %d bytes, expected %d", f.ti.rt, buf.Len(), n)
+		}
+		bs := buf.Bytes()
+		if bs == nil {
+			bs = []byte{}
+		}
+		e.e.EncodeStringBytesRaw(bs)
+		return
+	}
+	bs := e.blist.get(readerMarshalBufLen)
+	bs = bs[:cap(bs)]
+	var k, written int64
+	for {
+		i, err := r.Read(bs)
+		if k = int64(i); k > 0 {
+			if written += k; n >= 0 && written > n {
+				e.errorf("cannot encode %v: reader has more than %d bytes", f.ti.rt, n)
+			}
+			ds.WriteBytesChunk(bs[:k])
+		}
+		if err == io.EOF {
+			break
+		}
+		e.onerror(err)
+	}
+	e.blist.put(bs)
+	if n >= 0 && written != n {
+		e.errorf("cannot encode %v: reader has %d bytes, expected %d", f.ti.rt, written, n)
+	}
+	ds.WriteBytesEnd()
+}
+
+// textMarshal encodes a TextMarshaler, preferring AppendText (if also a textAppender),
+// as binaryMarshal does.
 func (e *Encoder) textMarshal(f *codecFnInfo, rv reflect.Value) {
-	bs, fnerr := rv2i(rv).(encoding.TextMarshaler).MarshalText()
+	v := rv2i(rv)
+	if x, ok := v.(textAppender); ok {
+		bs, fnerr := x.AppendText(e.blist.get(64))
+		e.marshalUtf8(bs, fnerr)
+		e.blist.put(bs)
+		return
+	}
+	bs, fnerr := v.(encoding.TextMarshaler).MarshalText()
 	e.marshalUtf8(bs, fnerr)
 }
 
@@ -225,11 +831,203 @@ func (e *Encoder) encodeComplex128(v complex128) {
 }
 
 func (e *Encoder) kBool(f *codecFnInfo, rv reflect.Value) {
-	e.e.EncodeBool(rvGetBool(rv))
+	e.encodeBool(rvGetBool(rv))
+}
+
+func (e *Encoder) encodeBool(b bool) {
+	if e.h.BoolAsInt {
+		var v uint64
+		if b {
+			v = 1
+		}
+		e.e.EncodeUint(v)
+		return
+	}
+	e.e.EncodeBool(b)
+}
+
+// EmptyStructHandling configures how a struct with no fields is encoded (see EncodeOptions).
+type EmptyStructHandling uint8
+
+const (
+	// EmptyStructAsEmptyMap encodes a struct with no fields as an empty map (default).
+	EmptyStructAsEmptyMap EmptyStructHandling = iota
+	// EmptyStructAsNil encodes a struct with no fields as nil.
+	EmptyStructAsNil
+)
+
+// FloatSpecialsHandling configures how NaN, +Inf and -Inf are encoded (see EncodeOptions).
+type FloatSpecialsHandling uint8
+
+const (
+	// FloatSpecialsAsNullJSON encodes them as null in json, which has no representation for them
+	// (as suggested by ECMA-262), and natively in the other formats (default).
+	// Note that null decodes into a float as 0, not as the special value.
+	FloatSpecialsAsNullJSON FloatSpecialsHandling = iota
+	// FloatSpecialsPreserveNative encodes them natively in formats which can represent them
+	// i.e. cbor, msgpack, binc and simple, and returns an error for them in json.
+	//
+	// cbor, msgpack and simple preserve the bits of a NaN (e.g. a signaling NaN's payload),
+	// while binc encodes every NaN as a single special value.
+	FloatSpecialsPreserveNative
+	// FloatSpecialsError returns an error when encoding them in any format.
+	FloatSpecialsError
+)
+
+// FrameLengthPrefix configures how the length of each top-level value is written (see EncodeOptions).
+type FrameLengthPrefix uint8
+
+const (
+	// FrameNone writes no length prefix (default).
+	FrameNone FrameLengthPrefix = iota
+	// FrameVarint writes the length as a protobuf-style base-128 varint (see AppendVarint).
+	FrameVarint
+	// FrameFixed32BE writes the length as a 4-byte big-endian unsigned integer.
+	FrameFixed32BE
+	// FrameFixed32LE writes the length as a 4-byte little-endian unsigned integer.
+	FrameFixed32LE
+)
+
+// ChecksumTrailer configures the checksum written after each top-level value (see EncodeOptions).
+type ChecksumTrailer uint8
+
+const (
+	// ChecksumNone writes no checksum (default).
+	ChecksumNone ChecksumTrailer = iota
+	// ChecksumCRC32 writes the CRC-32 (IEEE) checksum as 4 bytes.
+	ChecksumCRC32
+	// ChecksumXXHash64 writes the XXH64 hash (with a seed of 0) as 8 bytes.
+	ChecksumXXHash64
+)
+
+// UTF8Validation configures how a string with invalid UTF-8 is encoded (see EncodeOptions).
+type UTF8Validation uint8
+
+const (
+	// UTF8PassThrough writes the string as-is, without validating it (default).
+	UTF8PassThrough UTF8Validation = iota
+	// UTF8Replace replaces each invalid byte with the Unicode replacement character U+FFFD
+	// (as encoding/json does).
+	UTF8Replace
+	// UTF8Error returns an error.
+	UTF8Error
+)
+
+// encodeUTF8 is called by the drivers before encoding a text string,
+// and returns the string to encode per ValidateUTF8.
+func (e *Encoder) encodeUTF8(s string) string {
+	if e.h.ValidateUTF8 == UTF8PassThrough {
+		return s
+	}
+	return e.validateUTF8(s)
+}
+
+// validateUTF8 returns s if valid UTF-8, else errors or repairs it (see encodeUTF8).
+func (e *Encoder) validateUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	if e.h.ValidateUTF8 == UTF8Error {
+		e.errorf("cannot encode string with invalid UTF-8: %q", s)
+	}
+	b := make([]byte, 0, len(s)+8)
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, string(utf8.RuneError)...)
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	return stringView(b)
+}
+
+// checkFloatSpecial is called by the drivers before encoding a float value,
+// and errors if it is a special value (NaN, +Inf or -Inf) which FloatSpecials does not allow.
+//
+// Otherwise, the driver encodes the value itself: natively, or as null in json.
+func (e *Encoder) checkFloatSpecial(f float64) {
+	if e.h.FloatSpecials == FloatSpecialsAsNullJSON || !(math.IsNaN(f) || math.IsInf(f, 0)) {
+		return
+	}
+	if e.h.FloatSpecials == FloatSpecialsError {
+		e.errorf("cannot encode float special value: %v", f)
+	}
+	if e.js { // FloatSpecialsPreserveNative
+		e.errorf("cannot encode float special value in json, which cannot represent it: %v", f)
+	}
+}
+
+// encDriverDecimal is implemented by drivers which can encode a decimal as a number
+// (see RegisterDecimal).
+type encDriverDecimal interface {
+	EncodeDecimal(exp int64, mantissa *big.Int)
+}
+
+// encDriverSharedRef is implemented by drivers which can encode shared values
+// and references to them (see ShareReferences).
+type encDriverSharedRef interface {
+	// EncodeSharedValue marks the value which follows as shared.
+	EncodeSharedValue()
+	// EncodeSharedRef writes a reference to the shared value with that id
+	// i.e. the index of the shared value in the stream, starting from 0.
+	EncodeSharedRef(id uint64)
+}
+
+// encDriverIndefiniteMap is implemented by drivers which can write a map
+// whose length is not known upfront (see EncodeMapFunc).
+type encDriverIndefiniteMap interface {
+	WriteMapStartIndefinite()
+	WriteMapEndIndefinite()
+}
+
+// encDriverBytesStreamer is implemented by drivers which can write a byte string in pieces
+// (see CodecReaderMarshaler): WriteBytesStart writes its start, for the length (-1 if unknown),
+// then WriteBytesChunk writes each piece of its bytes, and WriteBytesEnd writes its end.
+// WriteBytesStart writes nothing, and returns false, if it cannot stream one of the length.
+type encDriverBytesStreamer interface {
+	WriteBytesStart(length int64) bool
+	WriteBytesChunk(v []byte)
+	WriteBytesEnd()
+}
+
+func (e *Encoder) kDecimal(f *codecFnInfo, rv reflect.Value) {
+	exp, mantissa, err := e.h.decimalFn(f.ti.rtid)(rv2i(rv))
+	e.onerror(err)
+	if mantissa == nil {
+		mantissa = new(big.Int)
+	}
+	if ed, ok := e.e.(encDriverDecimal); ok {
+		ed.EncodeDecimal(exp, mantissa)
+	} else {
+		e.e.EncodeString(decimalString(exp, mantissa))
+	}
 }
 
 func (e *Encoder) kTime(f *codecFnInfo, rv reflect.Value) {
-	e.e.EncodeTime(rvGetTime(rv))
+	e.encodeTime(rvGetTime(rv))
+}
+
+func (e *Encoder) encodeTime(t time.Time) {
+	if e.h.TimePrecision > 0 {
+		t = t.Truncate(e.h.TimePrecision)
+	}
+	if e.h.TimeEncoding == TimeNative && e.h.TimeLayout == "" {
+		e.e.EncodeTime(t)
+	} else if t.IsZero() {
+		e.e.EncodeNil()
+	} else if e.h.TimeEncoding != TimeNative {
+		s, err := isoDateFormat(e.h.TimeEncoding, t)
+		e.onerror(err)
+		e.e.EncodeString(s)
+	} else {
+		e.e.EncodeString(t.Format(e.h.TimeLayout))
+	}
+}
+
+func (e *Encoder) kReflectValue(f *codecFnInfo, rv reflect.Value) {
+	e.encodeValue(rv2i(rv).(reflect.Value), nil)
 }
 
 func (e *Encoder) kString(f *codecFnInfo, rv reflect.Value) {
@@ -292,14 +1090,79 @@ func (e *Encoder) kUint64(f *codecFnInfo, rv reflect.Value) {
 	e.e.EncodeUint(uint64(rvGetUint64(rv)))
 }
 
+// kEnum encodes a named integer with a String method as its value and name (if VerboseEnums),
+// or else as the integer.
+func (e *Encoder) kEnum(f *codecFnInfo, rv reflect.Value) {
+	if !e.h.VerboseEnums || e.c == containerMapKey {
+		e.kEnumValue(rv)
+		return
+	}
+	e.mapStart(2)
+	if e.h.Canonical { // the keys in sorted order
+		e.kEnumName(rv)
+	}
+	e.mapElemKey()
+	e.e.EncodeString("value")
+	e.mapElemValue()
+	e.kEnumValue(rv)
+	if !e.h.Canonical {
+		e.kEnumName(rv)
+	}
+	e.mapEnd()
+}
+
+func (e *Encoder) kEnumName(rv reflect.Value) {
+	e.mapElemKey()
+	e.e.EncodeString("name")
+	e.mapElemValue()
+	e.e.EncodeString(rv2i(rv).(fmt.Stringer).String())
+}
+
+func (e *Encoder) kEnumValue(rv reflect.Value) {
+	if rv.Kind() <= reflect.Int64 {
+		e.e.EncodeInt(rv.Int())
+	} else {
+		e.e.EncodeUint(rv.Uint())
+	}
+}
+
 func (e *Encoder) kUintptr(f *codecFnInfo, rv reflect.Value) {
-	e.e.EncodeUint(uint64(rvGetUintptr(rv)))
+	e.encodeUintptr(rvGetUintptr(rv))
+}
+
+func (e *Encoder) encodeUintptr(v uintptr) {
+	if !e.h.AllowUintptr {
+		e.errorf("cannot encode uintptr (a memory address) unless AllowUintptr")
+	}
+	e.e.EncodeUint(uint64(v))
 }
 
 func (e *Encoder) kErr(f *codecFnInfo, rv reflect.Value) {
+	if e.kUnsupported(rv) {
+		return
+	}
 	e.errorf("unsupported kind %s, for %#v", rv.Kind(), rv)
 }
 
+// kUnsupported encodes the substitute returned by OnUnsupported (if set)
+// for a value which cannot otherwise be encoded.
+//
+// It returns false if nothing was encoded. This is also the case while a substitute is
+// being encoded, so an unsupported substitute cannot cause an infinite recursion.
+func (e *Encoder) kUnsupported(rv reflect.Value) bool {
+	if e.h.OnUnsupported == nil || e.unsup {
+		return false
+	}
+	v, ok := e.h.OnUnsupported(rv)
+	if !ok {
+		return false
+	}
+	e.unsup = true
+	e.encode(v)
+	e.unsup = false
+	return true
+}
+
 func chanToSlice(rv reflect.Value, rtslice reflect.Type, timeout time.Duration) (rvcs reflect.Value) {
 	rvcs = rvZeroK(rtslice, reflect.Slice)
 	if timeout < 0 { // consume until close
@@ -337,7 +1200,7 @@ func (e *Encoder) kSeqFn(rtelem reflect.Type) (fn *codecFn) {
 	// if kind is reflect.Interface, do not pre-determine the encoding type,
 	// because preEncodeValue may break it down to a concrete type and kInterface will bomb.
 	if rtelem.Kind() != reflect.Interface {
-		fn = e.h.fn(rtelem)
+		fn = e.fn(rtelem)
 	}
 	return
 }
@@ -350,7 +1213,9 @@ func (e *Encoder) kSliceWMbs(rv reflect.Value, ti *typeInfo) {
 		e.haltOnMbsOddLen(l)
 		e.mapStart(l >> 1) // e.mapStart(l / 2)
 		fn := e.kSeqFn(ti.elem)
-		for j := 0; j < l; j++ {
+		var j int
+		defer e.pathIndex(&j)
+		for j = 0; j < l; j++ {
 			if j&1 == 0 { // j%2 == 0 {
 				e.mapElemKey()
 			} else {
@@ -364,17 +1229,48 @@ func (e *Encoder) kSliceWMbs(rv reflect.Value, ti *typeInfo) {
 
 func (e *Encoder) kSliceW(rv reflect.Value, ti *typeInfo) {
 	var l = rvLenSlice(rv)
-	e.arrayStart(l)
-	if l > 0 {
+	if l == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	truncated := e.kTruncates(l)
+	if truncated {
+		l = e.h.MaxCollectionElements
+		e.arrayStart(l + 1)
+	} else {
+		e.arrayStart(l)
+	}
+	if l > 0 {
 		fn := e.kSeqFn(ti.elem)
-		for j := 0; j < l; j++ {
-			e.arrayElem()
-			e.encodeValue(rvSliceIndex(rv, j, ti), fn)
+		var j int
+		defer e.pathIndex(&j)
+		if e.kSeqStructFast(ti, fn) {
+			for j = 0; j < l; j++ {
+				e.arrayElem()
+				fn.fe(e, &fn.i, rvSliceIndex(rv, j, ti))
+			}
+		} else {
+			for j = 0; j < l; j++ {
+				e.arrayElem()
+				e.encodeValue(rvSliceIndex(rv, j, ti), fn)
+			}
 		}
 	}
+	if truncated {
+		e.kSeqTruncated()
+	}
 	e.arrayEnd()
 }
 
+// kSeqStructFast reports whether the struct elements of a slice or array can be encoded
+// by calling fn directly, bypassing the per-element checks of encodeValue.
+//
+// This holds for a (non-pointer) struct element whose encode function does not need its address:
+// it is never nil, and a circular reference is only checked through a pointer.
+func (e *Encoder) kSeqStructFast(ti *typeInfo, fn *codecFn) bool {
+	return ti.elemkind == uint8(reflect.Struct) && fn != nil && !fn.i.addrE
+}
+
 func (e *Encoder) kArrayWMbs(rv reflect.Value, ti *typeInfo) {
 	var l = rv.Len()
 	if l == 0 {
@@ -383,7 +1279,9 @@ func (e *Encoder) kArrayWMbs(rv reflect.Value, ti *typeInfo) {
 		e.haltOnMbsOddLen(l)
 		e.mapStart(l >> 1) // e.mapStart(l / 2)
 		fn := e.kSeqFn(ti.elem)
-		for j := 0; j < l; j++ {
+		var j int
+		defer e.pathIndex(&j)
+		for j = 0; j < l; j++ {
 			if j&1 == 0 { // j%2 == 0 {
 				e.mapElemKey()
 			} else {
@@ -397,17 +1295,71 @@ func (e *Encoder) kArrayWMbs(rv reflect.Value, ti *typeInfo) {
 
 func (e *Encoder) kArrayW(rv reflect.Value, ti *typeInfo) {
 	var l = rv.Len()
-	e.arrayStart(l)
+	if l == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	truncated := e.kTruncates(l)
+	if truncated {
+		l = e.h.MaxCollectionElements
+		e.arrayStart(l + 1)
+	} else {
+		e.arrayStart(l)
+	}
 	if l > 0 {
 		fn := e.kSeqFn(ti.elem)
-		for j := 0; j < l; j++ {
-			e.arrayElem()
-			e.encodeValue(rv.Index(j), fn)
+		var j int
+		defer e.pathIndex(&j)
+		if e.kSeqStructFast(ti, fn) {
+			for j = 0; j < l; j++ {
+				e.arrayElem()
+				fn.fe(e, &fn.i, rv.Index(j))
+			}
+		} else {
+			for j = 0; j < l; j++ {
+				e.arrayElem()
+				e.encodeValue(rv.Index(j), fn)
+			}
 		}
 	}
+	if truncated {
+		e.kSeqTruncated()
+	}
 	e.arrayEnd()
 }
 
+// encTruncatedKey and encTruncatedMarker mark a collection truncated per MaxCollectionElements.
+const (
+	encTruncatedKey    = "..."
+	encTruncatedMarker = "<truncated>"
+)
+
+// kTruncates reports whether a collection of length l is truncated, per MaxCollectionElements.
+func (e *Encoder) kTruncates(l int) bool {
+	return e.h.MaxCollectionElements > 0 && l > e.h.MaxCollectionElements
+}
+
+// kSeqTruncated writes the marker of a truncated slice or array, as its final element.
+func (e *Encoder) kSeqTruncated() {
+	e.arrayElem()
+	e.e.EncodeString(encTruncatedMarker)
+}
+
+// kMapTruncated writes the marker of a truncated map, as its final entry.
+func (e *Encoder) kMapTruncated() {
+	e.mapElemKey()
+	e.e.EncodeString(encTruncatedKey)
+	e.mapElemValue()
+	e.e.EncodeString(encTruncatedMarker)
+}
+
+// kSliceTruncated encodes a slice via reflection, honoring MaxCollectionElements.
+// It is used by the fastpath functions for slices.
+func (e *Encoder) kSliceTruncated(rv reflect.Value) {
+	fn := e.fn(rvType(rv))
+	e.kSliceW(rv, fn.i.ti)
+}
+
 func (e *Encoder) kChan(f *codecFnInfo, rv reflect.Value) {
 	if f.ti.chandir&uint8(reflect.RecvDir) == 0 {
 		e.errorf("send-only channel cannot be encoded")
@@ -427,15 +1379,57 @@ func (e *Encoder) kChan(f *codecFnInfo, rv reflect.Value) {
 }
 
 func (e *Encoder) kSlice(f *codecFnInfo, rv reflect.Value) {
+	rv = e.kSorted(rv, f.ti)
 	if f.ti.mbs {
 		e.kSliceWMbs(rv, f.ti)
 	} else if f.ti.rtid == uint8SliceTypId || uint8TypId == rt2id(f.ti.elem) {
 		e.e.EncodeStringBytesRaw(rvGetBytes(rv))
+	} else if e.kSliceFlat(f.ti) {
+		e.kSliceWFlat(rv, f.ti)
 	} else {
 		e.kSliceW(rv, f.ti)
 	}
 }
 
+// kSliceFlat reports whether a slice of the type is encoded as a flat array, per FixedInnerSlice.
+func (e *Encoder) kSliceFlat(ti *typeInfo) bool {
+	return e.h.FixedInnerSlice && ti.elemkind == uint8(reflect.Slice) && ti.elem.Name() == "" &&
+		ti.elem.Elem().Kind() != reflect.Uint8
+}
+
+// kSliceWFlat encodes a slice of slices as [rows, cols, data...] (see FixedInnerSlice).
+func (e *Encoder) kSliceWFlat(rv reflect.Value, ti *typeInfo) {
+	rows := rvLenSlice(rv)
+	var cols int
+	for j := 0; j < rows; j++ {
+		if n := rvLenSlice(rvSliceIndex(rv, j, ti)); j == 0 {
+			cols = n
+		} else if n != cols {
+			e.errorf("cannot encode %v with FixedInnerSlice: row %d has length %d, expected %d", ti.rt, j, n, cols)
+		}
+	}
+	e.arrayStart(2 + rows*cols)
+	e.arrayElem()
+	e.e.EncodeInt(int64(rows))
+	e.arrayElem()
+	e.e.EncodeInt(int64(cols))
+	if rows*cols > 0 {
+		tirow := e.h.getTypeInfo(rt2id(ti.elem), ti.elem)
+		fn := e.kSeqFn(tirow.elem)
+		var j, k int
+		defer e.pathIndex(&j)
+		defer e.pathIndex(&k) // runs first, as the inner index
+		for j = 0; j < rows; j++ {
+			rvrow := rvSliceIndex(rv, j, ti)
+			for k = 0; k < cols; k++ {
+				e.arrayElem()
+				e.encodeValue(rvSliceIndex(rvrow, k, tirow), fn)
+			}
+		}
+	}
+	e.arrayEnd()
+}
+
 func (e *Encoder) kArray(f *codecFnInfo, rv reflect.Value) {
 	if f.ti.mbs {
 		e.kArrayWMbs(rv, f.ti)
@@ -446,6 +1440,278 @@ func (e *Encoder) kArray(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 
+// kSorted returns a sorted copy of the slice if SortSortables is set
+// and its type implements sort.Interface, else it returns the slice as is.
+func (e *Encoder) kSorted(rv reflect.Value, ti *typeInfo) reflect.Value {
+	if !e.h.SortSortables || !(ti.flagSortable || ti.flagSortablePtr) {
+		return rv
+	}
+	n := rvLenSlice(rv)
+	if n < 2 {
+		return rv
+	}
+	rv2 := reflect.New(ti.rt).Elem()
+	rv2.Set(reflect.MakeSlice(ti.rt, n, n))
+	reflect.Copy(rv2, rv)
+	if ti.flagSortable {
+		sort.Sort(rv2i(rv2).(sort.Interface))
+	} else {
+		sort.Sort(rv2i(rv2.Addr()).(sort.Interface))
+	}
+	return rv2
+}
+
+// kSet encodes a slice or array as a set, for a struct field tagged with the "set" option.
+//
+// Each element is encoded out-of-band, and the elements are then sorted and
+// de-duplicated by their encoded bytes, before being written as an array.
+// Consequently, the elements must be of a comparable type.
+func (e *Encoder) kSet(rv reflect.Value) {
+	for rv.Kind() == reflect.Ptr {
+		if rvIsNil(rv) {
+			e.e.EncodeNil()
+			return
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Invalid:
+		e.e.EncodeNil()
+		return
+	case reflect.Slice:
+		if rvIsNil(rv) {
+			e.e.EncodeNil()
+			return
+		}
+	case reflect.Array:
+	default:
+		e.errorf("cannot encode %v as a set: not a slice or array", rvType(rv))
+	}
+	rt := rvType(rv)
+	ti := e.h.getTypeInfo(rt2id(rt), rt)
+	if !ti.elem.Comparable() {
+		e.errorf("cannot encode %v as a set: elements are not comparable", rt)
+	}
+
+	l := rv.Len()
+	bs0 := e.blist.get(e.canonicalBufLen(l))
+	vsv := bs0
+	vsbv := e.brlist.get(l)[:l]
+
+	func() {
+		// replicate sideEncode logic
+		defer func(wb bytesEncAppender, bytes bool, c containerState, state interface{}, noShare bool) {
+			e.wb = wb
+			e.bytes = bytes
+			e.c = c
+			e.e.restoreState(state)
+			e.noShare = noShare
+		}(e.wb, e.bytes, e.c, e.e.captureState(), e.noShare)
+
+		e.wb = bytesEncAppender{vsv[:0], &vsv}
+		e.bytes = true
+		e.c = 0
+		e.e.resetState()
+		e.noShare = true
+
+		fn := e.kSeqFn(ti.elem)
+		for j := 0; j < l; j++ {
+			v := &vsbv[j]
+			n := len(vsv)
+			if ti.kind == uint8(reflect.Array) {
+				v.r = rv.Index(j)
+			} else {
+				v.r = rvSliceIndex(rv, j, ti)
+			}
+			e.encodeValue(v.r, fn)
+			e.atEndOfEncode()
+			e.w().end()
+			v.v = vsv[n:]
+		}
+	}()
+
+	sort.Sort(bytesRvSlice(vsbv))
+	var n int
+	for j := range vsbv {
+		if n == 0 || !bytes.Equal(vsbv[n-1].v, vsbv[j].v) {
+			vsbv[n] = vsbv[j]
+			n++
+		}
+	}
+	if n == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+	} else {
+		e.arrayStart(n)
+		for j := 0; j < n; j++ {
+			e.arrayElem()
+			e.encWr.writeb(vsbv[j].v)
+		}
+		e.arrayEnd()
+	}
+	e.blist.put(vsv)
+	if !byteSliceSameData(bs0, vsv) {
+		e.blist.put(bs0)
+	}
+	e.brlist.put(vsbv)
+}
+
+// kSeqOrdered encodes a slice or array in a different order, for a struct field
+// tagged with the "sortby=Name" or "reverse" options.
+//
+// If sortBy is set, the elements (which must be structs) are sorted stably by the value
+// of their field with that name, in descending order if reverse is also set.
+// Otherwise, the elements are encoded in reverse order.
+func (e *Encoder) kSeqOrdered(rv reflect.Value, sortBy string, reverse bool) {
+	for rv.Kind() == reflect.Ptr {
+		if rvIsNil(rv) {
+			e.e.EncodeNil()
+			return
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Invalid:
+		e.e.EncodeNil()
+		return
+	case reflect.Slice:
+		if rvIsNil(rv) {
+			e.e.EncodeNil()
+			return
+		}
+	case reflect.Array:
+	default:
+		e.errorf("cannot encode %v in order: not a slice or array", rvType(rv))
+	}
+	l := rv.Len()
+	kvs := make(encSliceAsMapEntrySlice, l)
+	var si *structFieldInfo
+	if sortBy != "" {
+		rtelem := rvType(rv).Elem()
+		for rtelem.Kind() == reflect.Ptr {
+			rtelem = rtelem.Elem()
+		}
+		if rtelem.Kind() != reflect.Struct {
+			e.errorf("cannot encode sorted by %s: expected struct elements, got: %v", sortBy, rtelem)
+		}
+		if si = e.h.getTypeInfo(rt2id(rtelem), rtelem).sfi4Name[sortBy]; si == nil {
+			e.errorf("cannot encode sorted by %s: no such field in %v", sortBy, rtelem)
+		}
+		switch si.path.typ.Kind() {
+		case reflect.Bool, reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64:
+		default:
+			e.errorf("cannot encode sorted by %s: unsupported field type: %v", sortBy, si.path.typ)
+		}
+	}
+	for i := 0; i < l; i++ {
+		rvi := rv.Index(i)
+		kvs[i].v = rv2i(rvi)
+		if si != nil {
+			for rvi.Kind() == reflect.Ptr {
+				if rvIsNil(rvi) {
+					e.errorf("cannot encode sorted by %s: nil element at index %d", sortBy, i)
+				}
+				rvi = rvi.Elem()
+			}
+			kvs[i].k = e.kField(si, rvi)
+		}
+	}
+	if si != nil && reverse {
+		sort.Stable(sort.Reverse(kvs)) // descending, but equal elements keep their order
+	} else if si != nil {
+		sort.Stable(kvs)
+	} else if reverse {
+		for i, j := 0, l-1; i < j; i, j = i+1, j-1 {
+			kvs[i], kvs[j] = kvs[j], kvs[i]
+		}
+	}
+	if l == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	e.arrayStart(l)
+	var i int
+	defer e.pathIndex(&i)
+	for i = range kvs {
+		e.arrayElem()
+		e.encode(kvs[i].v)
+	}
+	e.arrayEnd()
+}
+
+// kLazyFunc calls a func() (interface{}, error) and encodes the value it returns (see CallLazyFuncs).
+func (e *Encoder) kLazyFunc(rv reflect.Value) {
+	if rvIsNil(rv) {
+		e.e.EncodeNil()
+		return
+	}
+	var v interface{}
+	var err error
+	func() {
+		defer func() {
+			if x := recover(); x != nil {
+				e.errorf("lazy func of type %v panicked: %v", rvType(rv), x)
+			}
+		}()
+		if fn, ok := rv2i(rv).(func() (interface{}, error)); ok {
+			v, err = fn()
+		} else {
+			out := rv.Call(nil)
+			v = out[0].Interface()
+			err, _ = out[1].Interface().(error)
+		}
+	}()
+	e.onerror(err)
+	e.encode(v)
+}
+
+// kPadInt encodes an integer as a string, zero-padded to width digits (including any sign)
+// e.g. "007" or "-07" for a width of 3. A wider value is written in full.
+//
+// It is only used for json (for a struct field tagged with the "pad=N" option),
+// which has no other way to represent such lexically-sortable numbers.
+func (e *Encoder) kPadInt(rv reflect.Value, width int) {
+	for rv.Kind() == reflect.Ptr {
+		if rvIsNil(rv) {
+			e.e.EncodeNil()
+			return
+		}
+		rv = rv.Elem()
+	}
+	var bs []byte
+	var b [24]byte
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		bs = strconv.AppendInt(b[:0], rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		bs = strconv.AppendUint(b[:0], rv.Uint(), 10)
+	case reflect.Invalid:
+		e.e.EncodeNil()
+		return
+	default:
+		e.errorf("cannot zero-pad %v: not an integer", rvType(rv))
+	}
+	if n := width - len(bs); n > 0 {
+		var sign int
+		if bs[0] == '-' {
+			sign = 1
+		}
+		bs2 := make([]byte, width)
+		copy(bs2, bs[:sign])
+		for i := sign; i < sign+n; i++ {
+			bs2[i] = '0'
+		}
+		copy(bs2[sign+n:], bs[sign:])
+		bs = bs2
+	}
+	// written directly (as only digits and a sign need no escaping), so StringToRaw does not apply
+	e.w().writen1('"')
+	e.w().writeb(bs)
+	e.w().writen1('"')
+}
+
 func (e *Encoder) kSliceBytesChan(rv reflect.Value) {
 	// do not use range, so that the number of elements encoded
 	// does not change, and encoding does not hang waiting on someone to close chan.
@@ -494,30 +1760,95 @@ L1:
 	}
 }
 
-func (e *Encoder) kStructSfi(f *codecFnInfo) []*structFieldInfo {
+func (e *Encoder) kStructSfi(ti *typeInfo) []*structFieldInfo {
 	if e.h.Canonical {
-		return f.ti.sfi.sorted()
+		if e.h.KeyDictionary != nil {
+			return e.kStructSfiDict(ti)
+		}
+		return ti.sfi.sorted()
+	}
+	return ti.sfi.source()
+}
+
+// kStructSfiDict returns the fields sorted by their KeyDictionary codes (when Canonical).
+func (e *Encoder) kStructSfiDict(ti *typeInfo) []*structFieldInfo {
+	tisfi := append([]*structFieldInfo(nil), ti.sfi.source()...)
+	sort.Sort(sfiKeyDictSlice{tisfi, e})
+	return tisfi
+}
+
+type sfiKeyDictSlice struct {
+	v []*structFieldInfo
+	e *Encoder
+}
+
+func (p sfiKeyDictSlice) Len() int      { return len(p.v) }
+func (p sfiKeyDictSlice) Swap(i, j int) { p.v[uint(i)], p.v[uint(j)] = p.v[uint(j)], p.v[uint(i)] }
+func (p sfiKeyDictSlice) Less(i, j int) bool {
+	return p.e.kKeyDict(p.v[uint(i)].encName) < p.e.kKeyDict(p.v[uint(j)].encName)
+}
+
+type encStructFieldObjKeyDictSlice struct {
+	v []encStructFieldObj
+	e *Encoder
+}
+
+func (p encStructFieldObjKeyDictSlice) Len() int { return len(p.v) }
+func (p encStructFieldObjKeyDictSlice) Swap(i, j int) {
+	p.v[uint(i)], p.v[uint(j)] = p.v[uint(j)], p.v[uint(i)]
+}
+func (p encStructFieldObjKeyDictSlice) Less(i, j int) bool {
+	return p.e.kKeyDict(p.v[uint(i)].key) < p.e.kKeyDict(p.v[uint(j)].key)
+}
+
+// kKeyDict returns the code for a struct field name or string map key (if KeyDictionary).
+func (e *Encoder) kKeyDict(k string) string {
+	if v, ok := e.h.KeyDictionary[k]; ok {
+		if e.h.keyDictInv[v] == "" {
+			e.errorf("KeyDictionary: code %q is used for multiple keys", v)
+		}
+		return v
+	}
+	if _, ok := e.h.keyDictInv[k]; ok {
+		e.errorf("KeyDictionary: key %q is the same as the code for another key", k)
+	}
+	return k
+}
+
+// kMapKeyString encodes a string map key, substituting its KeyDictionary code if configured.
+func (e *Encoder) kMapKeyString(k string) {
+	if e.h.KeyDictionary != nil {
+		k = e.kKeyDict(k)
 	}
-	return f.ti.sfi.source()
+	e.e.EncodeString(k)
 }
 
 func (e *Encoder) kStructNoOmitempty(f *codecFnInfo, rv reflect.Value) {
+	if e.sfull {
+		e.kStruct(f, rv)
+		return
+	}
 	var tisfi []*structFieldInfo
 	if f.ti.toArray || e.h.StructToArray { // toArray
 		tisfi = f.ti.sfi.source()
 		e.arrayStart(len(tisfi))
-		for _, si := range tisfi {
+		var si *structFieldInfo
+		defer e.pathField(&si)
+		for _, si = range tisfi {
 			e.arrayElem()
 			e.encodeValue(si.path.field(rv), nil)
 		}
 		e.arrayEnd()
 	} else {
-		tisfi = e.kStructSfi(f)
+		tisfi = e.kStructSfi(f.ti)
 		e.mapStart(len(tisfi))
 		keytyp := f.ti.keyType
-		for _, si := range tisfi {
+		var si *structFieldInfo
+		defer e.pathField(&si)
+		for _, si = range tisfi {
 			e.mapElemKey()
-			e.kStructFieldKey(keytyp, si.path.encNameAsciiAlphaNum, si.encName)
+			// not kStructFieldKey, as kStruct handles KeyDictionary (see kStructFull)
+			encStructFieldKey(si.encName, e.e, e.w(), keytyp, si.path.encNameAsciiAlphaNum, e.js)
 			e.mapElemValue()
 			e.encodeValue(si.path.field(rv), nil)
 		}
@@ -525,124 +1856,500 @@ func (e *Encoder) kStructNoOmitempty(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 
-func (e *Encoder) kStructFieldKey(keyType valueType, encNameAsciiAlphaNum bool, encName string) {
-	encStructFieldKey(encName, e.e, e.w(), keyType, encNameAsciiAlphaNum, e.js)
+// kShared handles a non-nil pointer when ShareReferences.
+//
+// If the pointer was already encoded, it writes a reference to it and returns true.
+// Else it marks the value as shared, before the caller encodes it in full.
+func (e *Encoder) kShared(rvp reflect.Value) (done bool) {
+	switch rvp.Elem().Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+	default:
+		return
+	}
+	d, ok := e.e.(encDriverSharedRef)
+	if !ok {
+		return
+	}
+	k := rv2i(rvp)
+	if id, ok := e.sr[k]; ok {
+		d.EncodeSharedRef(id)
+		return true
+	}
+	if e.sr == nil {
+		e.sr = make(map[interface{}]uint64)
+	}
+	e.sr[k] = uint64(len(e.sr))
+	d.EncodeSharedValue()
+	return
 }
 
-func (e *Encoder) kStruct(f *codecFnInfo, rv reflect.Value) {
-	var newlen int
-	ti := f.ti
-	toMap := !(ti.toArray || e.h.StructToArray)
-	var mf map[string]interface{}
-	if ti.flagMissingFielder {
-		mf = rv2i(rv).(MissingFielder).CodecMissingFields()
-		toMap = true
-		newlen += len(mf)
-	} else if ti.flagMissingFielderPtr {
-		rv2 := e.addrRV(rv, ti.rt, ti.ptr)
-		mf = rv2i(rv2).(MissingFielder).CodecMissingFields()
-		toMap = true
-		newlen += len(mf)
+// kSharedPointerCheck errors if the non-nil pointer rvp was already encoded (if ErrorOnSharedPointers).
+func (e *Encoder) kSharedPointerCheck(rvp reflect.Value) {
+	if rvType(rvp).Elem().Size() == 0 {
+		return
 	}
-	tisfi := ti.sfi.source()
-	newlen += len(tisfi)
-
-	var fkvs = e.slist.get(newlen)[:newlen]
+	k := rv2i(rvp)
+	if _, ok := e.sp[k]; ok {
+		e.errorf("shared pointer found: %p, %T", k, k)
+	}
+	if e.sp == nil {
+		e.sp = make(map[interface{}]struct{})
+	}
+	e.sp[k] = struct{}{}
+}
 
-	recur := e.h.RecursiveEmptyCheck
+// iterInterface is the iterative kInterface, for the concrete value rv of the interface
+// reached from rv0, after checking the pointers up to it (if ErrorOnSharedPointers).
+// It returns false if nothing was encoded (or pushed onto the work stack).
+func (e *Encoder) iterInterface(rv0, rv reflect.Value) bool {
+	e.iterSharedPointerCheck(rv0)
+	if e.h.TaggedInterfaces {
+		e.arrayStart(2)
+		e.arrayElem()
+		e.e.EncodeUint(uint64(e.kTaggedID(rv)))
+		e.iterPush(encIterFrame{rv: rv, k: encIterTagged, n: 1})
+		return true
+	}
+	return e.h.TypeFieldName != "" && e.iterTypeNamed(rv)
+}
 
-	var kv sfiRv
-	var j int
-	if toMap {
-		newlen = 0
-		for _, si := range e.kStructSfi(f) {
-			kv.r = si.path.field(rv)
-			if si.path.omitEmpty && isEmptyValue(kv.r, e.h.TypeInfos, recur) {
-				continue
-			}
-			kv.v = si
-			fkvs[newlen] = kv
-			newlen++
+// iterSharedPointerCheck checks each pointer from rv to the value it points to (if ErrorOnSharedPointers).
+// iterValue checks them once it is not deferring to encodeValue, which checks them itself.
+func (e *Encoder) iterSharedPointerCheck(rv reflect.Value) {
+	if e.h.ErrorOnSharedPointers && !e.noShare {
+		for ; rv.Kind() == reflect.Ptr; rv = rv.Elem() {
+			e.kSharedPointerCheck(rv)
 		}
+	}
+}
 
-		var mf2s []stringIntf
-		if len(mf) > 0 {
-			mf2s = make([]stringIntf, 0, len(mf))
-			for k, v := range mf {
-				if k == "" {
-					continue
-				}
-				if ti.infoFieldOmitempty && isEmptyValue(reflect.ValueOf(v), e.h.TypeInfos, recur) {
-					continue
-				}
-				mf2s = append(mf2s, stringIntf{k, v})
-			}
+// kStructFieldOmitted reports whether a field (with value rvf) of the struct rv is omitted
+// when encoding it as a map: if it is tagged omitempty and is empty, or it is tagged
+// requires=Name and the field Name is empty (or is omitted for its own requires).
+func (e *Encoder) kStructFieldOmitted(si *structFieldInfo, rvf, rv reflect.Value, recur bool) bool {
+	if e.kOmitEmpty(si) && e.kStructFieldIsEmpty(rvf, recur) {
+		return true
+	}
+	for r := si.requires; r != nil; r = r.requires {
+		if isEmptyValue(e.kField(r, rv), e.h.typeInfos(), recur) {
+			return true
 		}
+	}
+	return false
+}
 
-		e.mapStart(newlen + len(mf2s))
+// kField returns the value of the field si of the struct rv or, if it is tagged "lenof=Name",
+// the length of the field Name as a value of its (integer) type (0 if nil).
+func (e *Encoder) kField(si *structFieldInfo, rv reflect.Value) reflect.Value {
+	if si.lenof == nil {
+		return si.path.field(rv)
+	}
+	rvl := si.lenof.path.field(rv)
+	for rvl.Kind() == reflect.Ptr && !rvIsNil(rvl) {
+		rvl = rvl.Elem()
+	}
+	var n int
+	if k := rvl.Kind(); k != reflect.Invalid && k != reflect.Ptr {
+		n = rvl.Len()
+	}
+	rvn := reflect.New(si.path.typ).Elem()
+	switch rvn.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		rvn.SetUint(uint64(n))
+	default:
+		rvn.SetInt(int64(n))
+	}
+	return rvn
+}
 
-		// When there are missing fields, and Canonical flag is set,
-		// we cannot have the missing fields and struct fields sorted independently.
-		// We have to capture them together and sort as a unit.
+// kZeroAsNull reports whether a field value is encoded as nil, as it is empty (see ZeroAsNull).
+func (e *Encoder) kZeroAsNull(rvf reflect.Value, recur bool) bool {
+	return e.h.ZeroAsNull && e.kStructFieldIsEmpty(rvf, recur)
+}
 
-		if len(mf2s) > 0 && e.h.Canonical {
-			mf2w := make([]encStructFieldObj, newlen+len(mf2s))
-			for j = 0; j < newlen; j++ {
-				kv = fkvs[j]
-				mf2w[j] = encStructFieldObj{kv.v.encName, kv.r, nil, kv.v.path.encNameAsciiAlphaNum, true}
-			}
-			for _, v := range mf2s {
-				mf2w[j] = encStructFieldObj{v.v, reflect.Value{}, v.i, false, false}
+// kOmitEmpty reports whether the field is omitted if empty: if tagged omitempty,
+// or if OmitEmptyByDefault and not tagged keepempty.
+func (e *Encoder) kOmitEmpty(si *structFieldInfo) bool {
+	return si.path.omitEmpty || (e.h.OmitEmptyByDefault && !si.path.keepEmpty)
+}
+
+// kStructFieldIsEmpty reports whether the field value is empty, for the omitempty option.
+// With PreserveNilVsEmpty, a non-nil slice or map is never empty.
+func (e *Encoder) kStructFieldIsEmpty(rvf reflect.Value, recur bool) bool {
+	if e.h.PreserveNilVsEmpty {
+		switch rvf.Kind() {
+		case reflect.Map, reflect.Slice:
+			return rvIsNil(rvf)
+		}
+	}
+	return isEmptyValue(rvf, e.h.typeInfos(), recur)
+}
+
+// emptyArrayAsNull reports whether a zero-length array is encoded as nil (see EmptyArrayAsNull).
+func (e *Encoder) emptyArrayAsNull() bool {
+	return e.h.EmptyArrayAsNull && !e.h.PreserveNilVsEmpty
+}
+
+// kUnionCheck errors if the struct is registered as a tagged union (see BasicHandle.RegisterUnion)
+// and its payload does not match its kind.
+func (e *Encoder) kUnionCheck(ti *typeInfo, rv reflect.Value) {
+	u := e.h.union(ti.rtid)
+	if u == nil {
+		return
+	}
+	sik, sip := ti.siForEncName([]byte(u.kindField)), ti.siForEncName([]byte(u.payloadField))
+	if sik == nil || sip == nil {
+		e.errorf("union %v: no kind field %s or payload field %s", ti.rt, u.kindField, u.payloadField)
+	}
+	var kind interface{}
+	if rvk := sik.path.field(rv); rvk.IsValid() {
+		kind = rv2i(rvk)
+	}
+	var uk *unionKind
+	for i := range u.kinds {
+		if u.kinds[i].kind == kind {
+			uk = &u.kinds[i]
+			break
+		}
+	}
+	if uk == nil {
+		e.errorf("union %v: unknown kind: %v", ti.rt, kind)
+	}
+	rvp := sip.path.field(rv)
+	if !rvp.IsValid() || rvp.Kind() != reflect.Interface || rvIsNil(rvp) {
+		return // a nil payload is accepted for any kind
+	}
+	rtp := rvType(rvp.Elem())
+	if uk.payload == nil ||
+		!(rtp == uk.payload || uk.payload.Kind() == reflect.Interface && rtp.Implements(uk.payload)) {
+		e.errorf("union %v: kind %v expects payload of type %v, got: %v", ti.rt, kind, uk.payload, rtp)
+	}
+}
+
+// kStructIsEmpty reports whether the struct type has no fields to encode e.g. struct{}.
+func (e *Encoder) kStructIsEmpty(ti *typeInfo) bool {
+	return len(ti.sfi.source()) == 0 && !(ti.flagMissingFielder || ti.flagMissingFielderPtr ||
+		ti.flagCodecFielder || ti.flagCodecFielderPtr)
+}
+
+// kStructFull reports whether each struct must be encoded by kStruct in this encode,
+// as a per-field hook is on (json comments if AllowComments, EncodeWithFieldOffsets
+// or EncodeWithFieldBytes), or an option which changes how each struct is encoded.
+// It is evaluated once, at the start of each top-level encode.
+//
+// Options of the type itself (e.g. inline, kvarray or a field's value option)
+// are instead decided when its fn is made (see fnLoad).
+func (e *Encoder) kStructFull() bool {
+	return (e.js && e.jsondriver().h.AllowComments) || e.fo != nil || e.fb != nil ||
+		e.h.MapDecorator != nil || e.h.SchemaVersion != 0 || e.h.OmitEmptyByDefault ||
+		e.h.ZeroAsNull || e.h.EnforceUnions || e.h.EmptyStructHandling == EmptyStructAsNil ||
+		e.h.KeyDictionary != nil
+}
+
+// kStructFieldComment writes the comment of the field si (if any and json), before its key.
+func (e *Encoder) kStructFieldComment(si *structFieldInfo) {
+	if e.js && si != nil && si.comment != nil {
+		e.jsondriver().writeComment(si.comment)
+	}
+}
+
+func (e *Encoder) kStructFieldKey(keyType valueType, encNameAsciiAlphaNum bool, encName string) {
+	if e.h.KeyDictionary != nil {
+		encName, encNameAsciiAlphaNum = e.kKeyDict(encName), false
+	}
+	encStructFieldKey(encName, e.e, e.w(), keyType, encNameAsciiAlphaNum, e.js)
+}
+
+// kStructCheckUnsafe errors if any field of the struct is an unsafe.Pointer,
+// or a uintptr (unless AllowUintptr), as memory addresses are meaningless outside this process.
+func (e *Encoder) kStructCheckUnsafe(ti *typeInfo) {
+	for _, si := range ti.sfi.source() {
+		rt := si.path.typ
+		for rt.Kind() == reflect.Ptr {
+			rt = rt.Elem()
+		}
+		switch rt.Kind() {
+		case reflect.UnsafePointer:
+			if e.h.OnUnsupported == nil { // else, the field is passed to it when encoded
+				e.errorf("cannot encode unsafe.Pointer field %s of %v", si.encName, ti.rt)
+			}
+		case reflect.Uintptr:
+			if !e.h.AllowUintptr {
+				e.errorf("cannot encode uintptr field %s of %v (a memory address) unless AllowUintptr", si.encName, ti.rt)
+			}
+		}
+	}
+}
+
+// kStructFieldValue encodes the value of a struct field,
+// honoring the "set", "reverse", "sortby", "pad" and "redact" options in its tag.
+func (e *Encoder) kStructFieldValue(si *structFieldInfo, rv reflect.Value) {
+	if !rv.IsValid() { // e.g. an empty field, per ZeroAsNull
+		e.e.EncodeNil()
+		return
+	}
+	if si.path.redact && !e.h.Unredact {
+		e.kRedacted(rv)
+	} else if si.path.jsonString {
+		e.kJsonString(rv)
+	} else if si.path.set {
+		e.kSet(rv)
+	} else if si.path.reverse || si.sortBy != "" {
+		e.kSeqOrdered(rv, si.sortBy, si.path.reverse)
+	} else if si.pad != 0 && e.js {
+		e.kPadInt(rv, int(si.pad))
+	} else {
+		e.encodeValue(rv, nil)
+	}
+}
+
+// jsonStringH and jsonStringCanonicalH encode (and decode) the value of a field tagged "jsonstring".
+// HTML characters are not escaped, as the json is data which is escaped (if needed) as a string.
+var (
+	jsonStringH          = &JsonHandle{HTMLCharsAsIs: true}
+	jsonStringCanonicalH = &JsonHandle{HTMLCharsAsIs: true, BasicHandle: BasicHandle{EncodeOptions: EncodeOptions{Canonical: true}}}
+)
+
+// kJsonString encodes the value of a field tagged with the "jsonstring" option
+// as a string holding its (compact) json encoding, or nil if a nil pointer or interface.
+func (e *Encoder) kJsonString(rv reflect.Value) {
+	if k := rv.Kind(); (k == reflect.Ptr || k == reflect.Interface) && rvIsNil(rv) {
+		e.e.EncodeNil()
+		return
+	}
+	h := jsonStringH
+	if e.h.Canonical {
+		h = jsonStringCanonicalH
+	}
+	if e.je == nil || e.je.hh != h {
+		e.je = NewEncoderBytes(&e.jeb, h)
+	}
+	e.je.ResetBytes(&e.jeb)
+	e.onerror(e.je.Encode(rv))
+	e.e.EncodeString(stringView(e.jeb))
+}
+
+// redactedString is the placeholder encoded for a string field tagged with the "redact" option.
+const redactedString = "***"
+
+// kRedacted encodes the placeholder for a field tagged with the "redact" option:
+// redactedString for a string (or non-nil pointer to one), so the type still matches, else nil.
+func (e *Encoder) kRedacted(rv reflect.Value) {
+	for rv.Kind() == reflect.Ptr && !rvIsNil(rv) {
+		rv = rv.Elem()
+	}
+	if rv.Kind() == reflect.String {
+		e.e.EncodeString(redactedString)
+	} else {
+		e.e.EncodeNil()
+	}
+}
+
+// kStructFieldOffset records the offset of the value of a top-level struct field
+// (if EncodeWithFieldOffsets).
+func (e *Encoder) kStructFieldOffset(name string) {
+	if e.fo != nil && e.depth == 1 {
+		e.fo[name] = e.w().numwritten()
+	}
+	if e.fb != nil && e.depth == 1 {
+		e.fbStart = len(e.wb.b)
+	}
+}
+
+// kStructFieldBytes passes the encoded value of a top-level struct field
+// to the callback (if EncodeWithFieldBytes). It is called after the value is encoded.
+func (e *Encoder) kStructFieldBytes(name string) {
+	if e.fb != nil && e.depth == 1 {
+		e.fb(name, e.wb.b[e.fbStart:])
+	}
+}
+
+func (e *Encoder) kStruct(f *codecFnInfo, rv reflect.Value) {
+	var newlen int
+	ti := f.ti
+	if si := ti.unwrap; si != nil {
+		e.kStructFieldValue(si, e.kField(si, rv))
+		return
+	}
+	if ti.flagCodecFielder || ti.flagCodecFielderPtr {
+		e.kStructCodecFields(ti, rv)
+		return
+	}
+	if e.h.EmptyStructHandling == EmptyStructAsNil && e.kStructIsEmpty(ti) {
+		e.e.EncodeNil()
+		return
+	}
+	if ti.anyUnsafe {
+		e.kStructCheckUnsafe(ti)
+	}
+	if e.h.EnforceUnions {
+		e.kUnionCheck(ti, rv)
+	}
+	toMap := !(ti.toArray || e.h.StructToArray)
+	if ti.flagEncodeAsArrayer {
+		toMap = !rv2i(rv).(EncodeAsArrayer).CodecEncodeAsArray()
+	} else if ti.flagEncodeAsArrayerPtr {
+		toMap = !rv2i(e.addrRV(rv, ti.rt, ti.ptr)).(EncodeAsArrayer).CodecEncodeAsArray()
+	}
+	if ti.anyInline && (toMap || ti.flagMissingFielder || ti.flagMissingFielderPtr) &&
+		e.h.MapDecorator == nil && !e.kSchemaVersion() && !ti.kvArray {
+		e.kStructInline(ti, rv)
+		return
+	}
+	var mf map[string]interface{}
+	if ti.flagMissingFielder {
+		mf = rv2i(rv).(MissingFielder).CodecMissingFields()
+		toMap = true
+		newlen += len(mf)
+	} else if ti.flagMissingFielderPtr {
+		rv2 := e.addrRV(rv, ti.rt, ti.ptr)
+		mf = rv2i(rv2).(MissingFielder).CodecMissingFields()
+		toMap = true
+		newlen += len(mf)
+	}
+	tisfi := ti.sfi.source()
+	newlen += len(tisfi)
+
+	var fkvs = e.slist.get(newlen)[:newlen]
+
+	recur := e.h.RecursiveEmptyCheck
+	ver := e.kSchemaVersion()
+
+	var kv sfiRv
+	var j int
+	if toMap {
+		newlen = 0
+		for _, si := range e.kStructSfi(ti) {
+			kv.r = e.kField(si, rv)
+			if e.kStructFieldOmitted(si, kv.r, rv, recur) {
+				continue
+			}
+			if e.kZeroAsNull(kv.r, recur) {
+				kv.r = reflect.Value{}
+			}
+			kv.v = si
+			fkvs[newlen] = kv
+			newlen++
+		}
+
+		var mf2s []stringIntf
+		if len(mf) > 0 {
+			mf2s = make([]stringIntf, 0, len(mf))
+			for k, v := range mf {
+				if k == "" {
+					continue
+				}
+				if (ti.infoFieldOmitempty || e.h.OmitEmptyByDefault) && isEmptyValue(reflect.ValueOf(v), e.h.typeInfos(), recur) {
+					continue
+				}
+				mf2s = append(mf2s, stringIntf{k, v})
+			}
+		}
+
+		if e.h.MapDecorator != nil {
+			mf2s = e.kStructDecorate(ti, mf, mf2s)
+		}
+
+		if ver {
+			e.kStructMapStartVersioned(ti, mf, newlen+len(mf2s))
+		} else {
+			e.kStructMapStart(ti, newlen+len(mf2s))
+		}
+
+		var name string
+		defer e.pathName(&name)
+
+		// When there are missing fields, and Canonical flag is set,
+		// we cannot have the missing fields and struct fields sorted independently.
+		// We have to capture them together and sort as a unit.
+
+		if len(mf2s) > 0 && e.h.Canonical {
+			mf2w := make([]encStructFieldObj, newlen+len(mf2s))
+			for j = 0; j < newlen; j++ {
+				kv = fkvs[j]
+				mf2w[j] = encStructFieldObj{kv.v.encName, kv.r, nil, kv.v.path.encNameAsciiAlphaNum, true, kv.v}
+			}
+			for _, v := range mf2s {
+				mf2w[j] = encStructFieldObj{v.v, reflect.Value{}, v.i, false, false, nil}
 				j++
 			}
-			sort.Sort((encStructFieldObjSlice)(mf2w))
+			if e.h.KeyDictionary != nil {
+				sort.Sort(encStructFieldObjKeyDictSlice{mf2w, e})
+			} else {
+				sort.Sort((encStructFieldObjSlice)(mf2w))
+			}
 			for _, v := range mf2w {
-				e.mapElemKey()
+				name = v.key
+				e.kStructMapElemKey(ti)
+				e.kStructFieldComment(v.si)
 				e.kStructFieldKey(ti.keyType, v.ascii, v.key)
-				e.mapElemValue()
-				if v.isRv {
+				e.kStructMapElemValue(ti)
+				e.kStructFieldOffset(v.key)
+				if v.si != nil {
+					e.kStructFieldValue(v.si, v.rv)
+				} else if v.isRv {
 					e.encodeValue(v.rv, nil)
 				} else {
 					e.encode(v.intf)
 				}
+				e.kStructFieldBytes(v.key)
 			}
 		} else {
 			keytyp := ti.keyType
 			for j = 0; j < newlen; j++ {
 				kv = fkvs[j]
-				e.mapElemKey()
+				name = kv.v.encName
+				e.kStructMapElemKey(ti)
+				e.kStructFieldComment(kv.v)
 				e.kStructFieldKey(keytyp, kv.v.path.encNameAsciiAlphaNum, kv.v.encName)
-				e.mapElemValue()
-				e.encodeValue(kv.r, nil)
+				e.kStructMapElemValue(ti)
+				e.kStructFieldOffset(kv.v.encName)
+				e.kStructFieldValue(kv.v, kv.r)
+				e.kStructFieldBytes(kv.v.encName)
 			}
 			for _, v := range mf2s {
-				e.mapElemKey()
+				name = v.v
+				e.kStructMapElemKey(ti)
 				e.kStructFieldKey(keytyp, false, v.v)
-				e.mapElemValue()
+				e.kStructMapElemValue(ti)
+				e.kStructFieldOffset(v.v)
 				e.encode(v.i)
+				e.kStructFieldBytes(v.v)
 			}
 		}
 
-		e.mapEnd()
+		e.kStructMapEnd(ti)
 	} else {
 		newlen = len(tisfi)
 		for i, si := range tisfi { // use unsorted array (to match sequence in struct)
-			kv.r = si.path.field(rv)
+			kv.r = e.kField(si, rv)
 			// use the zero value.
 			// if a reference or struct, set to nil (so you do not output too much)
-			if si.path.omitEmpty && isEmptyValue(kv.r, e.h.TypeInfos, recur) {
+			if e.kZeroAsNull(kv.r, recur) {
+				kv.r = reflect.Value{}
+			} else if e.kOmitEmpty(si) && e.kStructFieldIsEmpty(kv.r, recur) {
 				switch kv.r.Kind() {
 				case reflect.Struct, reflect.Interface, reflect.Ptr, reflect.Array, reflect.Map, reflect.Slice:
 					kv.r = reflect.Value{} //encode as nil
 				}
 			}
+			kv.v = si
 			fkvs[i] = kv
 		}
 		// encode it all
-		e.arrayStart(newlen)
+		if ver {
+			e.arrayStart(newlen + 1)
+			e.arrayElem()
+			e.e.EncodeUint(e.h.SchemaVersion)
+		} else {
+			e.arrayStart(newlen)
+		}
+		var si *structFieldInfo
+		defer e.pathField(&si)
 		for j = 0; j < newlen; j++ {
 			e.arrayElem()
-			e.encodeValue(fkvs[j].r, nil)
+			si = fkvs[j].v
+			e.kStructFieldValue(si, fkvs[j].r)
 		}
 		e.arrayEnd()
 	}
@@ -653,9 +2360,117 @@ func (e *Encoder) kStruct(f *codecFnInfo, rv reflect.Value) {
 	e.slist.put(fkvs)
 }
 
+// kSchemaVersion reports whether the SchemaVersion is written with the struct being encoded
+// i.e. if it is set, and the struct is at the top level.
+func (e *Encoder) kSchemaVersion() bool {
+	return e.h.SchemaVersion != 0 && e.depth == 0
+}
+
+// kStructMapStartVersioned starts the map for a top-level struct (see kStruct),
+// and writes the SchemaVersion as its first entry.
+func (e *Encoder) kStructMapStartVersioned(ti *typeInfo, mf map[string]interface{}, l int) {
+	k := e.h.SchemaVersionKey
+	if k == "" {
+		k = "_version"
+	}
+	if ti.sfi4Name[k] != nil {
+		e.errorf("cannot write schema version: key %s is a field of %v", k, ti.rt)
+	}
+	if _, ok := mf[k]; ok {
+		e.errorf("cannot write schema version: key %s is a missing field of %v", k, ti.rt)
+	}
+	e.kStructMapStart(ti, l+1)
+	e.kStructMapElemKey(ti)
+	e.kStructFieldKey(valueTypeString, false, k)
+	e.kStructMapElemValue(ti)
+	e.e.EncodeUint(e.h.SchemaVersion)
+}
+
+// kStructMapStart, kStructMapElemKey, kStructMapElemValue and kStructMapEnd write
+// the framing of a struct encoded as a map of n entries: as a flat array
+// of alternating keys and values if the type has the "kvarray" option.
+func (e *Encoder) kStructMapStart(ti *typeInfo, n int) {
+	if ti.kvArray {
+		e.arrayStart(2 * n)
+	} else {
+		e.mapStart(n)
+	}
+}
+
+func (e *Encoder) kStructMapElemKey(ti *typeInfo) {
+	if ti.kvArray {
+		e.arrayElem()
+	} else {
+		e.mapElemKey()
+	}
+}
+
+func (e *Encoder) kStructMapElemValue(ti *typeInfo) {
+	if ti.kvArray {
+		e.arrayElem()
+	} else {
+		e.mapElemValue()
+	}
+}
+
+func (e *Encoder) kStructMapEnd(ti *typeInfo) {
+	if ti.kvArray {
+		e.arrayEnd()
+	} else {
+		e.mapEnd()
+	}
+}
+
+// kStructDecorate appends the entries from the MapDecorator to mf2s,
+// skipping those which collide with a struct field or missing field.
+//
+// The entries are sorted, so the output is deterministic.
+func (e *Encoder) kStructDecorate(ti *typeInfo, mf map[string]interface{}, mf2s []stringIntf) []stringIntf {
+	if d := e.h.MapDecoratorMaxDepth; d > 0 && int(e.depth) >= d {
+		return mf2s
+	}
+	dm := e.h.MapDecorator(ti.rt)
+	if len(dm) == 0 {
+		return mf2s
+	}
+	j := len(mf2s)
+	for k, v := range dm {
+		if k == "" || ti.sfi4Name[k] != nil {
+			continue
+		}
+		if _, ok := mf[k]; ok {
+			continue
+		}
+		mf2s = append(mf2s, stringIntf{k, v})
+	}
+	sort.Sort(stringIntfSlice(mf2s[j:]))
+	return mf2s
+}
+
 func (e *Encoder) kMap(f *codecFnInfo, rv reflect.Value) {
+	if e.kMapIsSet(f.ti) {
+		e.kMapSet(f.ti, rv)
+		return
+	}
 	l := rvLenMap(rv)
-	e.mapStart(l)
+	// if filtering, get the keys first, so the length is known before writing the map
+	var mks []reflect.Value
+	if l != 0 && e.kMapFilters(f.ti) {
+		mks = e.kMapFilterKeys(rv)
+		l = len(mks)
+	}
+	if e.h.KeyHandle != nil {
+		e.kMapKeyHandle(f.ti, rv, mks)
+		return
+	}
+	n := l // number of entries to write
+	truncated := e.kTruncates(l)
+	if truncated {
+		n = e.h.MaxCollectionElements
+		e.mapStart(n + 1)
+	} else {
+		e.mapStart(l)
+	}
 	if l == 0 {
 		e.mapEnd()
 		return
@@ -681,13 +2496,16 @@ func (e *Encoder) kMap(f *codecFnInfo, rv reflect.Value) {
 		rtvalkind = rtval.Kind()
 	}
 	if rtvalkind != reflect.Interface {
-		valFn = e.h.fn(rtval)
+		valFn = e.fn(rtval)
 	}
 
 	var rvv = mapAddrLoopvarRV(f.ti.elem, vtypeKind)
 
 	if e.h.Canonical {
-		e.kMapCanonical(f.ti, rv, rvv, valFn)
+		e.kMapCanonical(f.ti, rv, mks, rvv, valFn, n)
+		if truncated {
+			e.kMapTruncated()
+		}
 		e.mapEnd()
 		return
 	}
@@ -699,8 +2517,29 @@ func (e *Encoder) kMap(f *codecFnInfo, rv reflect.Value) {
 			rtkey = rtkey.Elem()
 		}
 		if rtkey.Kind() != reflect.Interface {
-			keyFn = e.h.fn(rtkey)
+			keyFn = e.fn(rtkey)
+		}
+	}
+
+	var k reflect.Value
+	defer e.pathKey(&k)
+
+	if mks != nil {
+		for _, k = range mks[:n] {
+			e.mapElemKey()
+			if keyTypeIsString {
+				e.kMapKeyString(k.String())
+			} else {
+				e.encodeValue(k, keyFn)
+			}
+			e.mapElemValue()
+			e.encodeValue(rv.MapIndex(k), valFn)
+		}
+		if truncated {
+			e.kMapTruncated()
 		}
+		e.mapEnd()
+		return
 	}
 
 	var rvk = mapAddrLoopvarRV(f.ti.key, ktypeKind)
@@ -708,62 +2547,231 @@ func (e *Encoder) kMap(f *codecFnInfo, rv reflect.Value) {
 	var it mapIter
 	mapRange(&it, rv, rvk, rvv, true)
 
-	for it.Next() {
+	for j := 0; j < n && it.Next(); j++ {
+		k = it.Key()
 		e.mapElemKey()
 		if keyTypeIsString {
-			e.e.EncodeString(it.Key().String())
+			e.kMapKeyString(k.String())
 		} else {
-			e.encodeValue(it.Key(), keyFn)
+			e.encodeValue(k, keyFn)
 		}
 		e.mapElemValue()
 		e.encodeValue(it.Value(), valFn)
 	}
 	it.Done()
 
+	if truncated {
+		e.kMapTruncated()
+	}
 	e.mapEnd()
 }
 
-func (e *Encoder) kMapCanonical(ti *typeInfo, rv, rvv reflect.Value, valFn *codecFn) {
-	// we previously did out-of-band if an extension was registered.
-	// This is not necessary, as the natural kind is sufficient for ordering.
-
-	rtkey := ti.key
-	mks := rv.MapKeys()
-	rtkeyKind := rtkey.Kind()
-	kfast := mapKeyFastKindFor(rtkeyKind)
-	visindirect := mapStoresElemIndirect(uintptr(ti.elemsize))
-	visref := refBitset.isset(ti.elemkind)
+// kMapFilters reports whether the entries of a map of the type may be skipped,
+// per MapKeyFilter or SkipMapValueKinds.
+func (e *Encoder) kMapFilters(ti *typeInfo) bool {
+	if e.h.MapKeyFilter != nil {
+		return true
+	}
+	if len(e.h.SkipMapValueKinds) == 0 {
+		return false
+	}
+	k := reflect.Kind(ti.elemkind)
+	return k == reflect.Interface || e.kSkipsValueKind(k)
+}
 
-	switch rtkeyKind {
-	case reflect.Bool:
-		mksv := make([]boolRv, len(mks))
-		for i, k := range mks {
-			v := &mksv[i]
-			v.r = k
-			v.v = k.Bool()
-		}
-		sort.Sort(boolRvSlice(mksv))
-		for i := range mksv {
-			e.mapElemKey()
-			e.e.EncodeBool(mksv[i].v)
-			e.mapElemValue()
-			e.encodeValue(mapGet(rv, mksv[i].r, rvv, kfast, visindirect, visref), valFn)
+// kSkipsValueKind reports whether a map value of kind k is skipped, per SkipMapValueKinds.
+func (e *Encoder) kSkipsValueKind(k reflect.Kind) bool {
+	for _, k2 := range e.h.SkipMapValueKinds {
+		if k == k2 {
+			return true
 		}
-	case reflect.String:
-		mksv := make([]stringRv, len(mks))
-		for i, k := range mks {
-			v := &mksv[i]
-			v.r = k
-			v.v = k.String()
+	}
+	return false
+}
+
+// kMapFilterKeys returns the keys of the map for which MapKeyFilter returns true,
+// and whose values are not of a kind in SkipMapValueKinds.
+func (e *Encoder) kMapFilterKeys(rv reflect.Value) (mks []reflect.Value) {
+	mks = rv.MapKeys()
+	skipKinds := len(e.h.SkipMapValueKinds) != 0
+	var n int
+	for _, k := range mks {
+		if e.h.MapKeyFilter != nil && !e.h.MapKeyFilter(k) {
+			continue
 		}
-		sort.Sort(stringRvSlice(mksv))
-		for i := range mksv {
-			e.mapElemKey()
-			e.e.EncodeString(mksv[i].v)
-			e.mapElemValue()
-			e.encodeValue(mapGet(rv, mksv[i].r, rvv, kfast, visindirect, visref), valFn)
+		if skipKinds {
+			rvv := rv.MapIndex(k)
+			if rvv.Kind() == reflect.Interface {
+				rvv = rvv.Elem()
+			}
+			if e.kSkipsValueKind(rvv.Kind()) {
+				continue
+			}
+		}
+		mks[n] = k
+		n++
+	}
+	return mks[:n]
+}
+
+// kMapIsSet reports whether a map of the type is encoded as an array of its keys,
+// per SetAsArray or BoolSetAsArray.
+func (e *Encoder) kMapIsSet(ti *typeInfo) bool {
+	switch reflect.Kind(ti.elemkind) {
+	case reflect.Struct:
+		return e.h.SetAsArray && ti.elem.NumField() == 0
+	case reflect.Bool:
+		return e.h.BoolSetAsArray
+	}
+	return false
+}
+
+// kMapSet encodes the keys of a map as a set (see kSet), skipping those whose value is false
+// (for a map of bools) or which are filtered out by MapKeyFilter or SkipMapValueKinds.
+func (e *Encoder) kMapSet(ti *typeInfo, rv reflect.Value) {
+	var mks []reflect.Value
+	if e.kMapFilters(ti) {
+		mks = e.kMapFilterKeys(rv)
+	} else {
+		mks = rv.MapKeys()
+	}
+	isBool := ti.elemkind == uint8(reflect.Bool)
+	rvs := reflect.MakeSlice(reflect.SliceOf(ti.key), 0, len(mks))
+	for _, k := range mks {
+		if isBool && !rv.MapIndex(k).Bool() {
+			continue
+		}
+		rvs = reflect.Append(rvs, k)
+	}
+	e.kSet(rvs)
+}
+
+// kMapFiltered encodes a map via reflection, honoring MapKeyFilter, SkipMapValueKinds and KeyHandle.
+// It is used by the fastpath functions for maps.
+func (e *Encoder) kMapFiltered(rv reflect.Value) {
+	fn := e.fn(rvType(rv))
+	e.kMap(&fn.i, rv)
+}
+
+// kMapKeyHandle encodes a map whose keys are encoded with KeyHandle, and written as strings.
+// If mks is nil, all the keys of the map are encoded.
+func (e *Encoder) kMapKeyHandle(ti *typeInfo, rv reflect.Value, mks []reflect.Value) {
+	if mks == nil {
+		mks = rv.MapKeys()
+	}
+	if e.ke == nil || e.ke.hh != e.h.KeyHandle {
+		e.ke = NewEncoderBytes(&e.keb, e.h.KeyHandle)
+	}
+	// the keys are appended to bs, which is only released after the values
+	// (which may themselves be maps with keys to encode) are written.
+	bs := e.blist.get(e.canonicalBufLen(len(mks)))[:0]
+	kvs := e.brlist.get(len(mks))[:len(mks)]
+	for i, k := range mks {
+		e.ke.ResetBytes(&e.keb)
+		e.onerror(e.ke.Encode(k))
+		j := len(bs)
+		bs = append(bs, e.keb...)
+		kvs[i] = bytesRv{v: bs[j:], r: k}
+	}
+	if e.h.Canonical {
+		sort.Sort(bytesRvSlice(kvs))
+	}
+	var valFn *codecFn
+	if rtval := ti.elem; rtval.Kind() != reflect.Interface && rtval.Kind() != reflect.Ptr {
+		valFn = e.fn(rtval)
+	}
+	e.mapStart(len(kvs))
+	var k string
+	defer e.pathName(&k)
+	for _, kv := range kvs {
+		e.mapElemKey()
+		k = stringView(kv.v)
+		e.e.EncodeString(k)
+		e.mapElemValue()
+		e.encodeValue(rv.MapIndex(kv.r), valFn)
+	}
+	e.mapEnd()
+	e.brlist.put(kvs)
+	e.blist.put(bs)
+}
+
+// kMapSortStrings sorts the string keys of a map (when Canonical).
+func (e *Encoder) kMapSortStrings(v []string) {
+	if e.h.KeyDictionary != nil {
+		sort.Sort(stringKeyLessSlice{v, func(a, b string) bool {
+			a, b = e.kKeyDict(a), e.kKeyDict(b)
+			if e.h.StringKeyLess != nil {
+				return stringKeyLess(e.h.StringKeyLess, a, b)
+			}
+			return a < b
+		}})
+	} else if e.h.StringKeyLess != nil {
+		sort.Sort(stringKeyLessSlice{v, e.h.StringKeyLess})
+	} else {
+		sort.Sort(stringSlice(v))
+	}
+}
+
+// kMapCanonical encodes the entries of a map, sorted by key.
+// If mks is nil, all the keys of the map are encoded.
+// Only the first n entries (in sorted order) are written.
+func (e *Encoder) kMapCanonical(ti *typeInfo, rv reflect.Value, mks []reflect.Value, rvv reflect.Value, valFn *codecFn, n int) {
+	// we previously did out-of-band if an extension was registered.
+	// This is not necessary, as the natural kind is sufficient for ordering.
+
+	rtkey := ti.key
+	if mks == nil {
+		mks = rv.MapKeys()
+	}
+	var k reflect.Value
+	defer e.pathKey(&k)
+	rtkeyKind := rtkey.Kind()
+	kfast := mapKeyFastKindFor(rtkeyKind)
+	visindirect := mapStoresElemIndirect(uintptr(ti.elemsize))
+	visref := refBitset.isset(ti.elemkind)
+
+	switch rtkeyKind {
+	case reflect.Bool:
+		mksv := make([]boolRv, len(mks))
+		for i, k := range mks {
+			v := &mksv[i]
+			v.r = k
+			v.v = k.Bool()
+		}
+		sort.Sort(boolRvSlice(mksv))
+		for i := range mksv[:n] {
+			k = mksv[i].r
+			e.mapElemKey()
+			e.encodeBool(mksv[i].v)
+			e.mapElemValue()
+			e.encodeValue(mapGet(rv, mksv[i].r, rvv, kfast, visindirect, visref), valFn)
+		}
+	case reflect.String:
+		mksv := make([]stringRv, len(mks))
+		for i, k := range mks {
+			v := &mksv[i]
+			v.r = k
+			v.v = k.String()
+			if e.h.KeyDictionary != nil && rtkey == stringTyp {
+				v.v = e.kKeyDict(v.v)
+			}
+		}
+		if e.h.StringKeyLess != nil {
+			sort.Sort(stringRvKeyLessSlice{mksv, e.h.StringKeyLess})
+		} else {
+			sort.Sort(stringRvSlice(mksv))
+		}
+		for i := range mksv[:n] {
+			k = mksv[i].r
+			e.mapElemKey()
+			e.e.EncodeString(mksv[i].v)
+			e.mapElemValue()
+			e.encodeValue(mapGet(rv, mksv[i].r, rvv, kfast, visindirect, visref), valFn)
+		}
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint, reflect.Uintptr:
+		if rtkeyKind == reflect.Uintptr && !e.h.AllowUintptr {
+			e.errorf("cannot encode uintptr (a memory address) unless AllowUintptr")
 		}
-	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint, reflect.Uintptr:
 		mksv := make([]uint64Rv, len(mks))
 		for i, k := range mks {
 			v := &mksv[i]
@@ -771,7 +2779,8 @@ func (e *Encoder) kMapCanonical(ti *typeInfo, rv, rvv reflect.Value, valFn *code
 			v.v = k.Uint()
 		}
 		sort.Sort(uint64RvSlice(mksv))
-		for i := range mksv {
+		for i := range mksv[:n] {
+			k = mksv[i].r
 			e.mapElemKey()
 			e.e.EncodeUint(mksv[i].v)
 			e.mapElemValue()
@@ -785,7 +2794,8 @@ func (e *Encoder) kMapCanonical(ti *typeInfo, rv, rvv reflect.Value, valFn *code
 			v.v = k.Int()
 		}
 		sort.Sort(int64RvSlice(mksv))
-		for i := range mksv {
+		for i := range mksv[:n] {
+			k = mksv[i].r
 			e.mapElemKey()
 			e.e.EncodeInt(mksv[i].v)
 			e.mapElemValue()
@@ -799,7 +2809,8 @@ func (e *Encoder) kMapCanonical(ti *typeInfo, rv, rvv reflect.Value, valFn *code
 			v.v = k.Float()
 		}
 		sort.Sort(float64RvSlice(mksv))
-		for i := range mksv {
+		for i := range mksv[:n] {
+			k = mksv[i].r
 			e.mapElemKey()
 			e.e.EncodeFloat32(float32(mksv[i].v))
 			e.mapElemValue()
@@ -813,7 +2824,8 @@ func (e *Encoder) kMapCanonical(ti *typeInfo, rv, rvv reflect.Value, valFn *code
 			v.v = k.Float()
 		}
 		sort.Sort(float64RvSlice(mksv))
-		for i := range mksv {
+		for i := range mksv[:n] {
+			k = mksv[i].r
 			e.mapElemKey()
 			e.e.EncodeFloat64(mksv[i].v)
 			e.mapElemValue()
@@ -828,9 +2840,10 @@ func (e *Encoder) kMapCanonical(ti *typeInfo, rv, rvv reflect.Value, valFn *code
 				v.v = rv2i(k).(time.Time)
 			}
 			sort.Sort(timeRvSlice(mksv))
-			for i := range mksv {
+			for i := range mksv[:n] {
+				k = mksv[i].r
 				e.mapElemKey()
-				e.e.EncodeTime(mksv[i].v)
+				e.encodeTime(mksv[i].v)
 				e.mapElemValue()
 				e.encodeValue(mapGet(rv, mksv[i].r, rvv, kfast, visindirect, visref), valFn)
 			}
@@ -840,28 +2853,36 @@ func (e *Encoder) kMapCanonical(ti *typeInfo, rv, rvv reflect.Value, valFn *code
 	default:
 		// out-of-band
 		// first encode each key to a []byte first, then sort them, then record
-		bs0 := e.blist.get(len(mks) * 16)
+		bs0 := e.blist.get(e.canonicalBufLen(len(mks)))
 		mksv := bs0
-		mksbv := make([]bytesRv, len(mks))
+		mksbv := e.brlist.get(len(mks))[:len(mks)]
+		var bounded bool // CanonicalMaxKeyBytes exceeded
 
 		func() {
 			// replicate sideEncode logic
-			defer func(wb bytesEncAppender, bytes bool, c containerState, state interface{}) {
+			defer func(wb bytesEncAppender, bytes bool, c containerState, state interface{}, noShare bool) {
 				e.wb = wb
 				e.bytes = bytes
 				e.c = c
 				e.e.restoreState(state)
-			}(e.wb, e.bytes, e.c, e.e.captureState())
+				e.noShare = noShare
+			}(e.wb, e.bytes, e.c, e.e.captureState(), e.noShare)
 
 			// e2 := NewEncoderBytes(&mksv, e.hh)
 			e.wb = bytesEncAppender{mksv[:0], &mksv}
 			e.bytes = true
 			e.c = 0
 			e.e.resetState()
+			e.noShare = true
 
 			for i, k := range mks {
 				v := &mksbv[i]
 				l := len(mksv)
+				if rtkeyKind == reflect.Interface {
+					if ke := k.Elem(); (ke.Kind() == reflect.Float32 || ke.Kind() == reflect.Float64) && math.IsNaN(ke.Float()) {
+						e.errorf("cannot encode NaN map key when Canonical")
+					}
+				}
 
 				e.encodeValue(k, nil)
 				e.atEndOfEncode()
@@ -869,11 +2890,29 @@ func (e *Encoder) kMapCanonical(ti *typeInfo, rv, rvv reflect.Value, valFn *code
 
 				v.r = k
 				v.v = mksv[l:]
+				if e.h.CanonicalMaxKeyBytes > 0 && len(mksv) > e.h.CanonicalMaxKeyBytes {
+					bounded = true
+					break
+				}
 			}
 		}()
 
-		sort.Sort(bytesRvSlice(mksbv))
-		for j := range mksbv {
+		if bounded {
+			e.blist.put(mksv)
+			if !byteSliceSameData(bs0, mksv) {
+				e.blist.put(bs0)
+			}
+			e.brlist.put(mksbv)
+			e.kMapCanonicalBounded(rv, mks, rtkeyKind == reflect.Interface, rvv, valFn, n, kfast, visindirect, visref)
+			return
+		}
+		if rtkeyKind == reflect.Interface {
+			sort.Sort(encIntfKeySlice(mksbv))
+		} else {
+			sort.Sort(bytesRvSlice(mksbv))
+		}
+		for j := range mksbv[:n] {
+			k = mksbv[j].r
 			e.mapElemKey()
 			e.encWr.writeb(mksbv[j].v)
 			e.mapElemValue()
@@ -883,7 +2922,239 @@ func (e *Encoder) kMapCanonical(ti *typeInfo, rv, rvv reflect.Value, valFn *code
 		if !byteSliceSameData(bs0, mksv) {
 			e.blist.put(bs0)
 		}
+		e.brlist.put(mksbv)
+	}
+}
+
+// kMapCanonicalBounded encodes the entries of a map in the order of the encoded keys
+// (see CanonicalMaxKeyBytes), without holding all the keys encoded at once.
+func (e *Encoder) kMapCanonicalBounded(rv reflect.Value, mks []reflect.Value, intf bool,
+	rvv reflect.Value, valFn *codecFn, n int, kfast mapKeyFastKind, visindirect, visref bool) {
+	if intf {
+		for _, k := range mks {
+			if ke := k.Elem(); (ke.Kind() == reflect.Float32 || ke.Kind() == reflect.Float64) && math.IsNaN(ke.Float()) {
+				e.errorf("cannot encode NaN map key when Canonical")
+			}
+		}
+	}
+	x := encCanonicalKeys{e: e, mks: mks, intf: intf}
+	sort.Sort(&x)
+	var k reflect.Value
+	defer e.pathKey(&k)
+	for _, k = range mks[:n] {
+		x.a = e.kMapKeyEncode(k, x.a[:0])
+		e.mapElemKey()
+		e.encWr.writeb(x.a)
+		e.mapElemValue()
+		e.encodeValue(mapGet(rv, k, rvv, kfast, visindirect, visref), valFn)
+	}
+}
+
+// kMapKeyEncode appends the encoding of the map key k to bs, out-of-band (as for Canonical).
+func (e *Encoder) kMapKeyEncode(k reflect.Value, bs []byte) []byte {
+	defer func(wb bytesEncAppender, bytes bool, c containerState, state interface{}, noShare bool) {
+		e.wb = wb
+		e.bytes = bytes
+		e.c = c
+		e.e.restoreState(state)
+		e.noShare = noShare
+	}(e.wb, e.bytes, e.c, e.e.captureState(), e.noShare)
+
+	e.wb = bytesEncAppender{bs, &bs}
+	e.bytes = true
+	e.c = 0
+	e.e.resetState()
+	e.noShare = true
+
+	e.encodeValue(k, nil)
+	e.atEndOfEncode()
+	e.w().end()
+	return bs
+}
+
+// encCanonicalKeys sorts the keys of a map by their encoding, which is done on demand
+// for each comparison, reusing the buffers a and b.
+type encCanonicalKeys struct {
+	e    *Encoder
+	mks  []reflect.Value
+	intf bool // keys are compared as for encIntfKeySlice
+	a, b []byte
+}
+
+func (p *encCanonicalKeys) Len() int      { return len(p.mks) }
+func (p *encCanonicalKeys) Swap(i, j int) { p.mks[i], p.mks[j] = p.mks[j], p.mks[i] }
+func (p *encCanonicalKeys) Less(i, j int) bool {
+	p.a = p.e.kMapKeyEncode(p.mks[i], p.a[:0])
+	p.b = p.e.kMapKeyEncode(p.mks[j], p.b[:0])
+	if p.intf {
+		x := [2]bytesRv{{v: p.a, r: p.mks[i]}, {v: p.b, r: p.mks[j]}}
+		return encIntfKeySlice(x[:]).Less(0, 1)
+	}
+	return bytes.Compare(p.a, p.b) == -1
+}
+
+// encIntfKeySlice sorts the (encoded) keys of a map with interface keys, which may
+// have different types, when Canonical: by rank of their type, then by value, then by encoded bytes.
+type encIntfKeySlice []bytesRv
+
+func (p encIntfKeySlice) Len() int      { return len(p) }
+func (p encIntfKeySlice) Swap(i, j int) { p[uint(i)], p[uint(j)] = p[uint(j)], p[uint(i)] }
+func (p encIntfKeySlice) Less(i, j int) bool {
+	a, b := p[uint(i)].r.Elem(), p[uint(j)].r.Elem()
+	ra, rb := encIntfKeyRank(a), encIntfKeyRank(b)
+	if ra != rb {
+		return ra < rb
+	}
+	switch ra {
+	case 1:
+		if a.Bool() != b.Bool() {
+			return b.Bool()
+		}
+	case 2:
+		if c := encIntfKeyCmpNum(a, b); c != 0 {
+			return c < 0
+		}
+	case 3:
+		if a.String() != b.String() {
+			return a.String() < b.String()
+		}
+	}
+	if c := bytes.Compare(p[uint(i)].v, p[uint(j)].v); c != 0 {
+		return c < 0
+	}
+	return ra != 0 && a.Type().String() < b.Type().String()
+}
+
+// encIntfKeyRank returns the rank of the type of a map key (in an interface),
+// for ordering keys of different types: nil, bool, number, string, then all others.
+func encIntfKeyRank(rv reflect.Value) uint8 {
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return 0
+	case reflect.Bool:
+		return 1
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return 2
+	case reflect.String:
+		return 3
+	}
+	return 4
+}
+
+// encIntfKeyCmpNum compares 2 numbers (not NaN) of possibly different types by value,
+// returning -1, 0 or 1.
+func encIntfKeyCmpNum(a, b reflect.Value) int {
+	af, bf := a.Kind() == reflect.Float32 || a.Kind() == reflect.Float64,
+		b.Kind() == reflect.Float32 || b.Kind() == reflect.Float64
+	if af || bf {
+		x, y := encIntfKeyFloat(a), encIntfKeyFloat(b)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	}
+	x, xneg := encIntfKeyInt(a)
+	y, yneg := encIntfKeyInt(b)
+	if xneg != yneg {
+		if xneg {
+			return -1
+		}
+		return 1
+	}
+	// if both negative, their 2's complement (as uint64) has the same order
+	if x < y {
+		return -1
+	} else if x > y {
+		return 1
 	}
+	return 0
+}
+
+func encIntfKeyInt(rv reflect.Value) (v uint64, neg bool) {
+	switch rv.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return rv.Uint(), false
+	}
+	return uint64(rv.Int()), rv.Int() < 0
+}
+
+func encIntfKeyFloat(rv reflect.Value) float64 {
+	switch rv.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint())
+	}
+	return float64(rv.Int())
+}
+
+// encPointerDepthLimitDefault is the PointerDepthLimit used if it is 0.
+const encPointerDepthLimitDefault = 100
+
+// kPointerDepth errors if derefs (the number of chained pointer dereferences
+// seen encoding rv) exceeds PointerDepthLimit.
+func (e *Encoder) kPointerDepth(derefs int, rv reflect.Value) {
+	limit := e.h.PointerDepthLimit
+	if limit == 0 {
+		limit = encPointerDepthLimitDefault
+	}
+	if limit > 0 && derefs > limit {
+		e.errorf("cannot encode %v: more than %d chained pointer dereferences (see PointerDepthLimit)", rvType(rv), limit)
+	}
+}
+
+// kPointerLimit returns the ptrLimit of an encode: 0 if ErrorOnSharedPointers, ShareReferences,
+// TaggedInterfaces or TypeFieldName is on, else the PointerDepthLimit (if any).
+// It is evaluated once, at the start of each top-level encode.
+func (e *Encoder) kPointerLimit() int {
+	if e.h.ErrorOnSharedPointers || e.h.ShareReferences || e.h.TaggedInterfaces || e.h.TypeFieldName != "" {
+		return 0
+	}
+	limit := e.h.PointerDepthLimit
+	if limit == 0 {
+		limit = encPointerDepthLimitDefault
+	} else if limit < 0 {
+		limit = int(^uint(0) >> 1)
+	}
+	return limit
+}
+
+// kPointer checks the pointer rv, at derefs chained pointer dereferences, against
+// PointerDepthLimit and ErrorOnSharedPointers. It returns true if rv was encoded
+// as a reference to a value already encoded (see ShareReferences).
+func (e *Encoder) kPointer(derefs int, rv reflect.Value) bool {
+	e.kPointerDepth(derefs, rv)
+	if e.noShare {
+		return false
+	}
+	if e.h.ErrorOnSharedPointers {
+		e.kSharedPointerCheck(rv)
+	}
+	return e.h.ShareReferences && e.kShared(rv)
+}
+
+// kInterface encodes the concrete value rv of an interface if TaggedInterfaces,
+// or if TypeFieldName and a name is registered for its type.
+// It returns false if nothing was encoded.
+func (e *Encoder) kInterface(rv reflect.Value) bool {
+	if e.h.TaggedInterfaces {
+		e.kTagged(rv)
+		return true
+	}
+	return e.h.TypeFieldName != "" && e.kTypeNamed(rv)
+}
+
+// canonicalBufLen returns the initial size of the buffer which n values
+// are encoded into, out-of-band, before sorting (see CanonicalKeyBufHint).
+func (e *Encoder) canonicalBufLen(n int) int {
+	if e.h.CanonicalKeyBufHint > 0 {
+		return n * e.h.CanonicalKeyBufHint
+	}
+	return n * 16
 }
 
 // Encoder writes an object to an output stream in a supported format.
@@ -925,13 +3196,97 @@ type Encoder struct {
 
 	perType encPerType
 
-	slist sfiRvFreelist
+	slist  sfiRvFreelist
+	brlist bytesRvFreelist
+
+	// depth is the number of containers (maps, arrays) currently being written.
+	depth int16
+
+	// path collects the element being written in each container, innermost first,
+	// as an error (i.e. a panic) unwinds through them (see pathIndex and errPath).
+	path []interface{}
+
+	// unsup is true while encoding a substitute from OnUnsupported
+	unsup bool
+
+	// ptrLimit is the number of chained pointer dereferences which encodeValue (and iterValue)
+	// follow before checking PointerDepthLimit and the pointer options. It is 0 if a pointer or
+	// interface option is on in this encode (see kPointerLimit), so each pointer and interface is checked.
+	ptrLimit int
+
+	// sfull is true if each struct is encoded by kStruct, as an option or per-field hook
+	// which kStructNoOmitempty does not handle is on in this encode (see kStructFull).
+	sfull bool
+
+	// is is the work stack used when encoding iteratively (if Iterative=true)
+	is []encIterFrame
+
+	// fo holds the offsets of the top-level struct fields (if EncodeWithFieldOffsets)
+	fo map[string]int
+
+	// fb is called with the encoded value of each top-level struct field (if EncodeWithFieldBytes).
+	// fbStart is the offset where the value of the current field begins.
+	fb      func(name string, value []byte)
+	fbStart int
+
+	// ctx is the context checked at the start of each container (if EncodeContext).
+	// ctxDone is nil if ctx cannot be canceled, so there is nothing to check.
+	ctx     context.Context
+	ctxDone <-chan struct{}
+
+	// noExt is true if registered extensions are not used, for any value (if EncodeNoExt).
+	noExt bool
+
+	// sch is true if the value is buffered, so its bytes are returned (if EncodeWithSchema).
+	sch bool
+
+	// noFlush is true if the buffered output is not flushed at the end of encoding
+	// (if EncodeNoFlush). It is left for an explicit call to Flush.
+	noFlush bool
+
+	// om is the stack of maps started by EncodeMapStart, which are not yet ended.
+	om []encOpenMap
+
+	// fr holds the output stream while a top-level value is buffered (if FrameLengthPrefix).
+	fr encFrame
+
+	// ke encodes each map key into keb (if KeyHandle).
+	ke  *Encoder
+	keb []byte
+
+	// je encodes the value of a field into jeb (if tagged "jsonstring").
+	je  *Encoder
+	jeb []byte
+
+	// ct is the driver, if it tracks the elements of containers e.g. json, or the driver of a TokenVisitor.
+	ct encDriverContainerTracker
+
+	// sr maps each pointer already encoded to its shared value id (if ShareReferences).
+	// noShare is true while encoding out of band (e.g. to sort by the encoded bytes),
+	// where the order of the shared values in the stream is not yet known.
+	sr      map[interface{}]uint64
+	noShare bool
+
+	// sp holds each pointer already encoded (if ErrorOnSharedPointers).
+	sp map[interface{}]struct{}
+}
+
+// encFrame holds the output stream while a top-level value is buffered in b,
+// so its length can be written before it.
+type encFrame struct {
+	on    bool
+	bytes bool
+	wb    bytesEncAppender
+	b     []byte
 }
 
 // NewEncoder returns an Encoder for encoding into an io.Writer.
 //
 // For efficiency, Users are encouraged to configure WriterBufferSize on the handle
 // OR pass in a memory buffered writer (eg bufio.Writer, bytes.Buffer).
+//
+// A *bytes.Buffer is written to directly, bypassing the internal buffer
+// (so WriterBufferSize does not apply).
 func NewEncoder(w io.Writer, h Handle) *Encoder {
 	e := h.newEncDriver().encoder()
 	if w != nil {
@@ -953,6 +3308,45 @@ func NewEncoderBytes(out *[]byte, h Handle) *Encoder {
 	return e
 }
 
+// EncodeMulti encodes v with each of the handles e.g. as both json and msgpack,
+// returning the encoded bytes for each (in the order of the handles).
+// It is a convenience e.g. to compare a value across formats in a test.
+//
+// Each output is a distinct slice (which the caller owns), sized from the previous output.
+// An Encoder is bound to its format, so each handle keeps a pool of Encoders which
+// EncodeMulti reuses across calls (and goroutines). It stops at the first error, which is returned.
+//
+// v is encoded once per handle, so it must not be consumed by encoding:
+// a chan (which is drained) or a lazy value (e.g. computed on demand) is not supported.
+func EncodeMulti(v interface{}, handles ...Handle) (out [][]byte, err error) {
+	out = make([][]byte, len(handles))
+	var n int
+	for i, h := range handles {
+		bs := make([]byte, 0, n)
+		if err = encodeMultiOne(&bs, h, v); err != nil {
+			return nil, err
+		}
+		out[i], n = bs, len(bs)
+	}
+	return
+}
+
+// encodeMultiOne encodes v into out, with an Encoder from the pool of the handle h.
+func encodeMultiOne(out *[]byte, h Handle, v interface{}) (err error) {
+	initHandle(h)
+	p := &h.getBasicHandle().encPool
+	e, _ := p.Get().(*Encoder)
+	if e == nil {
+		e = NewEncoderBytes(out, h)
+	} else {
+		e.ResetBytes(out)
+	}
+	err = e.Encode(v)
+	e.wb.reset(nil, nil) // so the pooled Encoder does not keep out alive
+	p.Put(e)
+	return
+}
+
 func (e *Encoder) init(h Handle) {
 	initHandle(h)
 	e.err = errEncoderNotInitialized
@@ -960,6 +3354,7 @@ func (e *Encoder) init(h Handle) {
 	e.hh = h
 	e.h = h.getBasicHandle()
 	e.be = e.hh.isBinary()
+	e.ct, _ = e.e.(encDriverContainerTracker)
 }
 
 func (e *Encoder) w() *encWr {
@@ -974,6 +3369,17 @@ func (e *Encoder) resetCommon() {
 	e.c = 0
 	e.calls = 0
 	e.seq = 0
+	e.depth = 0
+	e.path = e.path[:0]
+	e.unsup = false
+	for i := range e.is {
+		e.is[i] = encIterFrame{}
+	}
+	e.is = e.is[:0]
+	e.om = e.om[:0]
+	e.sr = nil
+	e.noShare = false
+	e.sp = nil
 	e.err = nil
 }
 
@@ -982,7 +3388,8 @@ func (e *Encoder) resetCommon() {
 // This accommodates using the state of the Encoder,
 // where it has "cached" information about sub-engines.
 func (e *Encoder) Reset(w io.Writer) {
-	e.bytes = false
+	e.frameRestore()
+	e.bytes, e.wbFixed = false, false
 	if e.wf == nil {
 		e.wf = new(bufioEncWriter)
 	}
@@ -990,20 +3397,90 @@ func (e *Encoder) Reset(w io.Writer) {
 	e.resetCommon()
 }
 
+// ResetMulti resets the Encoder with multiple output streams e.g. a network connection
+// and a log file.
+//
+// The output is encoded and buffered once, and each flush writes it to all the streams
+// (in order). If a write to any of them fails or is short, the encode fails with that error,
+// and the subsequent streams do not receive that chunk of the output.
+//
+// If no streams are passed, each subsequent Encode fails (until the Encoder is Reset),
+// rather than discarding the output.
+func (e *Encoder) ResetMulti(ws ...io.Writer) {
+	switch len(ws) {
+	case 0:
+		e.Reset(encMultiWriter(nil))
+		e.err = errEncoderNoWriters
+	case 1:
+		e.Reset(ws[0])
+	default:
+		e.Reset(append(encMultiWriter(nil), ws...))
+	}
+}
+
 // ResetBytes resets the Encoder with a new destination output []byte.
 func (e *Encoder) ResetBytes(out *[]byte) {
-	e.bytes = true
+	e.frameRestore()
+	e.bytes, e.wbFixed = true, false
 	e.wb.reset(encInBytes(out), out)
 	e.resetCommon()
 }
 
+// ResetBytesFixed resets the Encoder to write into buf (from its start) without growing it
+// e.g. into a pre-sized array on a hot path where allocating is not allowed.
+// The output is buf[:NumBytesWritten()].
+//
+// If the output does not fit in len(buf) bytes, Encode returns a *ShortBufferError
+// with the length it needs. To find it, the rest of the output is written to a temporary buffer,
+// which allocates: only an encode which fits is free of allocations for its output.
+// The content of buf is then undefined, and, as after any error, the Encoder must be reset.
+func (e *Encoder) ResetBytesFixed(buf []byte) {
+	e.frameRestore()
+	e.bytes = true
+	e.wbFixed, e.wbCap = true, len(buf)
+	e.wb.reset(buf[:0:len(buf)], nil)
+	e.resetCommon()
+}
+
+// ShortBufferError is returned when the output does not fit in the buffer
+// passed to ResetBytesFixed, with N the length the buffer must have.
+type ShortBufferError struct {
+	N int
+}
+
+func (e *ShortBufferError) Error() string {
+	return fmt.Sprintf("codec: short buffer: the output needs %d bytes", e.N)
+}
+
+// ResetState resets the state of the Encoder (e.g. binc symbol tables,
+// the circular reference checks and any error seen), but keeps the output stream.
+//
+// Unlike Reset and ResetBytes, the output stream is not reset or re-buffered,
+// so subsequent values are written continuously after those already written.
+// This is useful for writing a sequence of independent self-describing documents
+// to the same stream.
+//
+// A stream preamble (e.g. the json BOM) is only written at the start of the stream.
+func (e *Encoder) ResetState() {
+	e.frameRestore()
+	e.resetCommon()
+	if e.js && e.w().numwritten() != 0 {
+		e.jsondriver().bm = false
+	}
+}
+
 // Encode writes an object into a stream.
 //
+// Encoding stops at the first error. The returned error includes the location
+// of the value which could not be encoded e.g. items[3].meta.ts, with struct fields
+// and string map keys by name, and other map entries or array elements by index.
+//
 // Encoding can be configured via the struct tag for the fields.
 // The key (in the struct tags) that we look at is configurable.
 //
 // By default, we look up the "codec" key in the struct field's tags,
 // and fall bak to the "json" key if "codec" is absent.
+// A single replacement key can be configured via the StructTagName handle option.
 // That key in struct field's tag value is the key name,
 // followed by an optional comma and options.
 //
@@ -1012,6 +3489,7 @@ func (e *Encoder) ResetBytes(out *[]byte) {
 // which can be set on _struct are:
 //    - omitempty: so all fields are omitted if empty
 //    - toarray: so struct is encoded as an array
+//    - kvarray: so struct is encoded as a flat array of keys and values, instead of a map
 //    - int: so struct key names are encoded as signed integers (instead of strings)
 //    - uint: so struct key names are encoded as unsigned integers (instead of strings)
 //    - float: so struct key names are encoded as floats (instead of strings)
@@ -1034,17 +3512,103 @@ func (e *Encoder) ResetBytes(out *[]byte) {
 // However, struct values may encode as arrays. This happens when:
 //    - StructToArray Encode option is set, OR
 //    - the tag on the _struct field sets the "toarray" option
+// A struct which implements EncodeAsArrayer chooses per value, overriding both of these.
 // Note that omitempty is ignored when encoding struct values as arrays,
 // as an entry must be encoded for each field, to maintain its position.
 //
+// A struct whose _struct field sets the "kvarray" option is encoded, where it would be a map,
+// as a flat array of alternating keys and values instead e.g. ["a", 1, "b", 2],
+// for protocols which avoid maps. It is otherwise encoded as a map would be: omitempty skips
+// both the key and value, and the entries are sorted by key if Canonical. It is decoded back
+// into the struct. Note that the "inline" option does not apply to its fields,
+// and that the "kvarray" option is not honored by codecgen.
+//
 // Values with types that implement MapBySlice are encoded as stream maps.
 //
 // The empty values (for omitempty option) are false, 0, any nil pointer
 // or interface value, and any array, slice, map, or string of length zero.
+// With the OmitEmptyByDefault Encode option, every field is omitted if empty,
+// except one whose tag specifies the "keepempty" option.
+//
+// A slice or array field whose tag specifies the "set" option is encoded as a set:
+// its elements are sorted, and duplicates removed, by their encoded bytes.
+// This gives a canonical representation of set-like fields e.g. for hashing.
+// It is an error if the elements are not comparable.
+// Note that the "set" option is not honored by codecgen.
+//
+// A slice or array field whose tag specifies the "reverse" option is encoded in reverse order.
+// One whose tag specifies the "sortby=Name" option (where its elements are structs)
+// is encoded sorted stably by the field with encoded name Name; adding "reverse" sorts descending.
+// Note that the "reverse" and "sortby" options are not honored by codecgen.
+//
+// An integer field whose tag specifies the "pad=N" option is encoded in json as a string,
+// zero-padded to N characters (including any sign) e.g. "007", so it sorts lexically.
+// It has no effect on other formats. Note that the "pad" option is not honored by codecgen.
+//
+// A field whose tag specifies the "requires=Name" option is omitted unless the field
+// with encoded name Name is non-empty (and not itself omitted for its own "requires")
+// e.g. an error detail only encoded when the error code is set. The fields can be
+// in any order, and the map length only counts the fields encoded. As with omitempty,
+// it is ignored when encoding the struct as an array. It is an error if Name is not a field,
+// or if the fields form a cycle. Note that the "requires" option is not honored by codecgen.
+//
+// An integer field whose tag specifies the "lenof=Name" option is encoded as the length of
+// the field with encoded name Name (a string, slice, array, map or chan, or a pointer to one;
+// 0 if nil) instead of its own value e.g. a count kept in sync with a slice. omitempty applies
+// to the length. It is an error if Name is not a field, or has no length, or the field tagged
+// is not an integer. Note that the "lenof" option is not honored by codecgen.
+//
+// A field whose tag specifies the "comment=text" option has the text written in json
+// as // lines before its key, if JsonHandle.AllowComments (and indenting) e.g. for a config file.
+// It must be the last option in the tag, as the text runs to the end of it (including any commas).
+// Other formats ignore it. Note that the "comment" option is not honored by codecgen.
+//
+// A field whose tag specifies the "redact" option is encoded as a placeholder,
+// unless the Unredact Encode option is set e.g. to keep secrets out of logs by default.
+// The placeholder is "***" for a string field (or non-nil pointer to one), and nil otherwise.
+// omitempty still applies to the real value, so an empty secret is omitted (when encoding as a map).
+// Note that the "redact" option is not honored by codecgen, which encodes the real value.
+//
+// A field whose tag specifies the "jsonstring" option is encoded as a string holding its
+// json encoding e.g. {"doc":"{\"a\":1}"}, for a column which stores a json sub-document as text.
+// The json is compact, and sorted if Canonical, but does not use the other options of the handle.
+// A nil pointer or interface is encoded as nil. Decoding accepts the string (decoding the json
+// within it), or the value itself. Note that the "jsonstring" option is not honored by codecgen.
+//
+// A field whose tag specifies the "index=N" option is at position N (from 0) when its struct
+// is encoded (and decoded) as an array, independent of its position in the struct declaration
+// e.g. to evolve a positional format without reordering the Go struct. The indexed fields come first,
+// followed by the others in declaration order. It is an error if the indices are not 0 to k-1
+// for the k indexed fields of a struct. The fields are also in this order when encoding a map
+// (unless Canonical). Note that the "index" option is not honored by codecgen.
+//
+// A struct with a field whose tag specifies the "unwrap" option is encoded (and decoded)
+// as the value of that field alone, like a transparent wrapper; its other fields are ignored.
+// It is an error for more than one field to specify it. omitempty does not apply to the field,
+// as there is no entry to omit. Note that the "unwrap" option is not honored by codecgen.
 //
 // Anonymous fields are encoded inline except:
 //    - the struct tag specifies a replacement name (first value)
 //    - the field is of an interface type
+//    - the field is a time.Time (or pointer to one), which is encoded as a time value
+//      under its type name (Time), unless renamed
+//
+// A struct which embeds a time.Time (directly, or within another embedded struct) gets its
+// marshaling methods (e.g. MarshalJSON, MarshalBinary) by promotion. These are ignored,
+// so the struct is encoded with all its fields, not as just the time.
+// Implement Selfer (or register an extension) to customize its encoding.
+//
+// An interface field (typically an anonymous one e.g. an embedded io.Reader) whose tag specifies
+// the "inline" option is encoded inline if its value is a struct (or pointer to one):
+// the fields of that struct are written in place of it (after those of the enclosing struct,
+// which take precedence on a name conflict). If nil, it is omitted; else it is encoded by name.
+// This only applies when the struct is encoded as a map, and not with a MapDecorator or SchemaVersion.
+// Decoding does not set the interface (its concrete type is unknown), so the inlined fields
+// are decoded as missing fields. Note that the "inline" option is not honored by codecgen.
+//
+// As in encoding/json, the exported fields of an anonymous field of an unexported
+// struct type (or pointer to one) are promoted and encoded inline.
+// Decoding into such a field through a nil pointer is an error, as the pointer cannot be set.
 //
 // Examples:
 //
@@ -1055,6 +3619,7 @@ func (e *Encoder) ResetBytes(out *[]byte) {
 //          Field2 int      `codec:"myName"`       //Use key "myName" in encode stream
 //          Field3 int32    `codec:",omitempty"`   //use key "Field3". Omit if empty.
 //          Field4 bool     `codec:"f4,omitempty"` //use key "f4". Omit if empty.
+//          Field5 []string `codec:",set"`         //sort and de-duplicate elements
 //          io.Reader                              //use key "Reader".
 //          MyStruct        `codec:"my1"           //use key "my1".
 //          MyStruct                               //inline it
@@ -1075,8 +3640,12 @@ func (e *Encoder) ResetBytes(out *[]byte) {
 //   - If a Selfer, call its CodecEncodeSelf method
 //   - If an extension is registered for it, call that extension function
 //   - If implements encoding.(Binary|Text|JSON)Marshaler, call Marshal(Binary|Text|JSON) method
+//     (or Append(Binary|Text), if it also implements encoding.(Binary|Text)Appender)
 //   - Else encode it based on its reflect.Kind
 //
+// A reflect.Value (passed directly, or as a field or element) is encoded as the value it holds.
+// An invalid (zero) reflect.Value, or one holding a nil pointer, is encoded as nil.
+//
 // Note that struct field names and keys in map[string]XXX will be treated as symbols.
 // Some formats support symbols (e.g. binc) and will properly encode the string
 // only once in the stream, and use a tag to refer to it thereafter.
@@ -1109,12 +3678,999 @@ func (e *Encoder) MustEncode(v interface{}) {
 	}
 
 	e.calls++
+	if e.calls == 1 {
+		e.sfull = e.kStructFull()
+		e.ptrLimit = e.kPointerLimit()
+		if e.h.FrameLengthPrefix != FrameNone || e.h.ChecksumTrailer != ChecksumNone || e.sch || (e.fb != nil && !e.bytes) {
+			e.frameStart()
+		}
+		e.sr, e.sp = nil, nil
+		e.atStartOfEncode()
+		if len(e.h.RecordPrefix) != 0 {
+			e.encWr.writeb(e.h.RecordPrefix)
+		}
+		if e.h.WrapScalarsKey != "" && encIsScalar(v) {
+			v = &encMerged{keyType: valueTypeString,
+				fs: []encStructFieldObj{{e.h.WrapScalarsKey, reflect.Value{}, v, false, false, nil}}}
+		}
+	}
 	e.encode(v)
 	e.calls--
 	if e.calls == 0 {
 		e.atEndOfEncode()
-		e.w().end()
+		if len(e.h.RecordSuffix) != 0 {
+			e.encWr.writeb(e.h.RecordSuffix)
+		}
+		if e.fr.on {
+			e.frameEnd()
+		}
+		if !e.noFlush || e.bytes {
+			e.w().end()
+		}
+	}
+}
+
+// encIsScalar reports whether v is a scalar for WrapScalarsKey.
+func encIsScalar(v interface{}) bool {
+	rv, ok := v.(reflect.Value)
+	if !ok {
+		rv = reflect.ValueOf(v)
+	}
+	for k := rv.Kind(); (k == reflect.Ptr || k == reflect.Interface) && !rvIsNil(rv); k = rv.Kind() {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		return rvType(rv) == timeTyp
+	case reflect.Map, reflect.Array:
+		return false
+	case reflect.Slice:
+		rt := rvType(rv)
+		return rt.Elem().Kind() == reflect.Uint8 && rt != rawTyp
+	}
+	return true
+}
+
+// EncodeContext is like Encode, but aborts with ctx.Err() if ctx is done.
+//
+// The context is checked at the start of each map or array, so a cancellation is seen
+// promptly while encoding a large value. If the context cannot be canceled
+// (e.g. context.Background()), there is no extra cost.
+//
+// On cancellation, the output is partial: what was written before stays in the stream,
+// and buffered output is not flushed. As after any error, Reset the Encoder before reusing it.
+func (e *Encoder) EncodeContext(ctx context.Context, v interface{}) (err error) {
+	e.ctx, e.ctxDone = ctx, ctx.Done()
+	err = e.Encode(v)
+	if x, ok := err.(*codecError); ok && e.ctxDone != nil && x.err == ctx.Err() {
+		err = x.err
+	}
+	e.ctx, e.ctxDone = nil, nil
+	return
+}
+
+// EncodeWithFieldOffsets is like Encode, but also returns the offset in the output
+// (since the last Reset) where the value of each top-level struct field begins.
+//
+// This allows a later partial decode of a field, by seeking directly to its value.
+//
+// Only the fields of a top-level struct encoded as a map are captured (including
+// missing fields). If v is (or is encoded as) an array, a map or a scalar,
+// the returned map is empty.
+//
+// Note that the offsets are not captured for types with generated (codecgen) encoders.
+func (e *Encoder) EncodeWithFieldOffsets(v interface{}) (offsets map[string]int, err error) {
+	offsets = make(map[string]int)
+	e.fo = offsets
+	err = e.Encode(v)
+	e.fo = nil
+	return
+}
+
+// EncodeWithFieldBytes is like Encode, but also calls fn with the encoded value
+// of each top-level struct field, once it is fully encoded e.g. to cache it by field.
+//
+// As with EncodeWithFieldOffsets, only the fields of a top-level struct encoded as a map
+// are captured (including missing fields). The bytes are only those of the value,
+// not of its key or of any separator.
+//
+// The bytes alias the output buffer (or, when encoding to an io.Writer, an internal buffer
+// which holds the whole value until it is written), and are only valid until fn returns.
+// Copy them to retain them.
+//
+// Note that the bytes are not captured for types with generated (codecgen) encoders.
+func (e *Encoder) EncodeWithFieldBytes(v interface{}, fn func(fieldName string, encodedBytes []byte)) (err error) {
+	e.fb = fn
+	err = e.Encode(v)
+	e.fb = nil
+	return
+}
+
+// EncodeNoExt is like Encode, but ignores the extensions registered on the handle,
+// encoding the Go structure of each value instead e.g. to inspect what an extension hides.
+// This applies all the way down i.e. to the values nested within v, not just to v.
+//
+// Other custom encodings (Selfer, BinaryMarshaler, etc) are still used.
+func (e *Encoder) EncodeNoExt(v interface{}) (err error) {
+	e.noExt = true
+	err = e.Encode(v)
+	e.noExt = false
+	return
+}
+
+// EncodeWithSchema is like Encode, but also returns the bytes v encodes to
+// and a Schema describing the shape of v (see Schema) e.g. to drive a columnar writer.
+//
+// The bytes are those of v alone, as also written to the output
+// i.e. without any FrameLengthPrefix or ChecksumTrailer.
+func (e *Encoder) EncodeWithSchema(v interface{}) (bs []byte, s Schema, err error) {
+	e.sch = true
+	err = e.Encode(v)
+	e.sch = false
+	if err == nil {
+		bs = append([]byte(nil), e.fr.b...)
+		s = schemaBuilder{h: e.h}.of(v)
+	}
+	return
+}
+
+// EncodeSliceAsMap encodes a slice (or array) of structs as a map,
+// keyed by the value of the keyField field of each element e.g. {id: item}.
+//
+// keyField is the name of the field as encoded (i.e. the name in the struct tag, if renamed).
+// An error is returned if an element is not a struct or a non-nil pointer to a struct,
+// or if 2 elements have the same key.
+//
+// If Canonical, the entries are sorted by the key, which must be a bool, number or string.
+func (e *Encoder) EncodeSliceAsMap(slice interface{}, keyField string) (err error) {
+	if !debugging {
+		defer func() {
+			if x := recover(); x != nil {
+				panicValToErr(e, x, &e.err)
+				err = e.err
+			}
+		}()
+	}
+	e.MustEncode(e.sliceAsMap(slice, keyField))
+	return
+}
+
+// encMapBySlice is a slice of alternating keys and values, encoded as a map.
+type encMapBySlice []interface{}
+
+func (encMapBySlice) MapBySlice() {}
+
+type encSliceAsMapEntry struct {
+	k reflect.Value
+	v interface{}
+}
+
+type encSliceAsMapEntrySlice []encSliceAsMapEntry
+
+func (p encSliceAsMapEntrySlice) Len() int      { return len(p) }
+func (p encSliceAsMapEntrySlice) Swap(i, j int) { p[uint(i)], p[uint(j)] = p[uint(j)], p[uint(i)] }
+func (p encSliceAsMapEntrySlice) Less(i, j int) bool {
+	a, b := p[uint(i)].k, p[uint(j)].k
+	switch a.Kind() {
+	case reflect.Bool:
+		return !a.Bool() && b.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	}
+	return a.String() < b.String()
+}
+
+func (e *Encoder) sliceAsMap(slice interface{}, keyField string) encMapBySlice {
+	rv := baseRV(slice)
+	if k := rv.Kind(); k != reflect.Slice && k != reflect.Array {
+		e.errorf("cannot encode as map: expected a slice or array, got: %T", slice)
+	}
+	rtelem := rv.Type().Elem()
+	for rtelem.Kind() == reflect.Ptr {
+		rtelem = rtelem.Elem()
+	}
+	if rtelem.Kind() != reflect.Struct {
+		e.errorf("cannot encode as map: expected struct elements, got: %v", rtelem)
+	}
+	si := e.h.getTypeInfo(rt2id(rtelem), rtelem).sfi4Name[keyField]
+	if si == nil {
+		e.errorf("cannot encode as map: no field %s in %v", keyField, rtelem)
+	}
+	var kt reflect.Type
+	l := rv.Len()
+	kvs := make(encSliceAsMapEntrySlice, l)
+	seen := make(map[interface{}]struct{}, l)
+	for i := 0; i < l; i++ {
+		rvi := rv.Index(i)
+		for rvi.Kind() == reflect.Ptr {
+			if rvIsNil(rvi) {
+				e.errorf("cannot encode as map: nil element at index %d", i)
+			}
+			rvi = rvi.Elem()
+		}
+		rvk := si.path.field(rvi)
+		if !rvk.IsValid() {
+			e.errorf("cannot encode as map: no key at index %d", i)
+		}
+		if kt == nil {
+			kt = rvk.Type()
+			if !kt.Comparable() {
+				e.errorf("cannot encode as map: key type is not comparable: %v", kt)
+			}
+		}
+		k := rv2i(rvk)
+		if _, ok := seen[k]; ok {
+			e.errorf("cannot encode as map: duplicate key at index %d: %v", i, k)
+		}
+		seen[k] = struct{}{}
+		kvs[i] = encSliceAsMapEntry{rvk, rv2i(rvi)}
+	}
+	if e.h.Canonical && l > 0 {
+		switch kt.Kind() {
+		case reflect.Bool, reflect.String,
+			reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+			reflect.Float32, reflect.Float64:
+		default:
+			e.errorf("cannot encode as map: unsupported key type for Canonical: %v", kt)
+		}
+		sort.Sort(kvs)
+	}
+	v := make(encMapBySlice, 0, 2*l)
+	for _, kv := range kvs {
+		v = append(v, rv2i(kv.k), kv.v)
+	}
+	return v
+}
+
+// EncodeMerged encodes the fields of multiple structs as a single map,
+// as if they were all fields of one struct.
+//
+// Each value must be a struct or a pointer to one; a nil pointer contributes no fields.
+// A key found in more than one value takes the value from the last one,
+// at the position of the first. Fields from a MissingFielder are included,
+// and omitempty is honored, as when encoding each struct on its own.
+//
+// The map is encoded even if StructToArray is set or a struct has the toarray option.
+// If Canonical, the merged keys are sorted together.
+// It is an error if the structs have different key types (see the _struct field).
+func (e *Encoder) EncodeMerged(vs ...interface{}) (err error) {
+	if !debugging {
+		defer func() {
+			if x := recover(); x != nil {
+				panicValToErr(e, x, &e.err)
+				err = e.err
+			}
+		}()
+	}
+	e.MustEncode(e.merged(vs))
+	return
+}
+
+// encMerged holds the fields of the structs passed to EncodeMerged.
+type encMerged struct {
+	keyType valueType
+	fs      []encStructFieldObj
+}
+
+func (e *Encoder) merged(vs []interface{}) *encMerged {
+	x := &encMerged{keyType: valueTypeString}
+	idx := make(map[string]int)
+	add := func(f encStructFieldObj) {
+		if i, ok := idx[f.key]; ok {
+			x.fs[i] = f
+		} else {
+			idx[f.key] = len(x.fs)
+			x.fs = append(x.fs, f)
+		}
+	}
+	recur := e.h.RecursiveEmptyCheck
+	var keyTypeSet bool
+	for i, v := range vs {
+		rv := reflect.ValueOf(v)
+		for rv.Kind() == reflect.Ptr && !rvIsNil(rv) {
+			rv = rv.Elem()
+		}
+		if rv.Kind() == reflect.Ptr && rv.Type().Elem().Kind() == reflect.Struct {
+			continue // nil pointer to a struct
+		}
+		if rv.Kind() != reflect.Struct {
+			e.errorf("cannot encode merged: expected a struct at index %d, got: %T", i, v)
+		}
+		rt := rvType(rv)
+		ti := e.h.getTypeInfo(rt2id(rt), rt)
+		if ti.anyUnsafe {
+			e.kStructCheckUnsafe(ti)
+		}
+		if e.h.EnforceUnions {
+			e.kUnionCheck(ti, rv)
+		}
+		if !keyTypeSet {
+			x.keyType, keyTypeSet = ti.keyType, true
+		} else if ti.keyType != x.keyType {
+			e.errorf("cannot encode merged: key type of %v at index %d differs from earlier values", rt, i)
+		}
+		for _, si := range ti.sfi.source() {
+			rvf := e.kField(si, rv)
+			if e.kStructFieldOmitted(si, rvf, rv, recur) {
+				continue
+			}
+			if e.kZeroAsNull(rvf, recur) {
+				rvf = reflect.Value{}
+			}
+			add(encStructFieldObj{si.encName, rvf, nil, si.path.encNameAsciiAlphaNum, true, si})
+		}
+		e.kMissingFields(ti, rv, recur, add)
+	}
+	e.kMergedSort(x)
+	return x
+}
+
+// kMissingFields calls add for each (non-omitted) missing field of the struct, if a MissingFielder.
+func (e *Encoder) kMissingFields(ti *typeInfo, rv reflect.Value, recur bool, add func(f encStructFieldObj)) {
+	var mf map[string]interface{}
+	if ti.flagMissingFielder {
+		mf = rv2i(rv).(MissingFielder).CodecMissingFields()
+	} else if ti.flagMissingFielderPtr {
+		mf = rv2i(e.addrRV(rv, ti.rt, ti.ptr)).(MissingFielder).CodecMissingFields()
+	}
+	if len(mf) == 0 {
+		return
+	}
+	mfk := make([]string, 0, len(mf))
+	for k := range mf {
+		if k != "" {
+			mfk = append(mfk, k)
+		}
+	}
+	sort.Strings(mfk) // a map has no order, so add them in a stable order
+	for _, k := range mfk {
+		if (ti.infoFieldOmitempty || e.h.OmitEmptyByDefault) && isEmptyValue(reflect.ValueOf(mf[k]), e.h.typeInfos(), recur) {
+			continue
+		}
+		add(encStructFieldObj{k, reflect.Value{}, mf[k], false, false, nil})
+	}
+}
+
+// kStructCodecFields encodes a CodecFielder as a map of the fields it returns, sorted by key.
+func (e *Encoder) kStructCodecFields(ti *typeInfo, rv reflect.Value) {
+	var fs map[string]interface{}
+	if ti.flagCodecFielder {
+		fs = rv2i(rv).(CodecFielder).CodecFields()
+	} else {
+		fs = rv2i(e.addrRV(rv, ti.rt, ti.ptr)).(CodecFielder).CodecFields()
+	}
+	x := &encMerged{keyType: ti.keyType, fs: make([]encStructFieldObj, 0, len(fs))}
+	for k, v := range fs {
+		if k != "" {
+			x.fs = append(x.fs, encStructFieldObj{k, reflect.Value{}, v, false, false, nil})
+		}
+	}
+	sort.Sort((encStructFieldObjSlice)(x.fs)) // a map has no order, so encode them in a stable order
+	if e.h.KeyDictionary != nil {
+		e.kMergedSort(x)
+	}
+	e.kMerged(x)
+}
+
+// kStructInline encodes a struct with a field tagged "inline" as a map, where the fields of a struct
+// in an inline (interface) field are written in place of it, after those of the enclosing struct.
+// A field of the enclosing struct takes precedence over an inlined field of the same name.
+func (e *Encoder) kStructInline(ti *typeInfo, rv reflect.Value) {
+	x := &encMerged{keyType: ti.keyType}
+	seen := make(map[string]struct{})
+	e.kStructInlineFields(x, seen, ti, rv)
+	e.kMergedSort(x)
+	e.kMerged(x)
+}
+
+func (e *Encoder) kStructInlineFields(x *encMerged, seen map[string]struct{}, ti *typeInfo, rv reflect.Value) {
+	add := func(f encStructFieldObj) {
+		if _, ok := seen[f.key]; !ok {
+			seen[f.key] = struct{}{}
+			x.fs = append(x.fs, f)
+		}
+	}
+	recur := e.h.RecursiveEmptyCheck
+	var inline []reflect.Value
+	for _, si := range ti.sfi.source() {
+		rvf := e.kField(si, rv)
+		if si.path.inline && rvf.IsValid() {
+			rvi := rvf
+			for k := rvi.Kind(); (k == reflect.Ptr || k == reflect.Interface) && !rvIsNil(rvi); k = rvi.Kind() {
+				rvi = rvi.Elem()
+			}
+			if k := rvi.Kind(); k == reflect.Struct {
+				inline = append(inline, rvi)
+				continue
+			} else if k == reflect.Ptr || k == reflect.Interface {
+				continue // a nil value has no fields to inline
+			}
+		}
+		if e.kStructFieldOmitted(si, rvf, rv, recur) {
+			continue
+		}
+		if e.kZeroAsNull(rvf, recur) {
+			rvf = reflect.Value{}
+		}
+		add(encStructFieldObj{si.encName, rvf, nil, si.path.encNameAsciiAlphaNum, true, si})
+	}
+	e.kMissingFields(ti, rv, recur, add)
+	for _, rvi := range inline {
+		rt := rvType(rvi)
+		ti2 := e.h.getTypeInfo(rt2id(rt), rt)
+		if ti2.anyUnsafe {
+			e.kStructCheckUnsafe(ti2)
+		}
+		e.kStructInlineFields(x, seen, ti2, rvi)
+	}
+}
+
+// kMergedSort sorts the keys of x if Canonical.
+func (e *Encoder) kMergedSort(x *encMerged) {
+	if e.h.Canonical {
+		if e.h.KeyDictionary != nil {
+			sort.Sort(encStructFieldObjKeyDictSlice{x.fs, e})
+		} else {
+			sort.Sort((encStructFieldObjSlice)(x.fs))
+		}
+	}
+}
+
+// kMerged encodes the fields collected by EncodeMerged as a map.
+func (e *Encoder) kMerged(x *encMerged) {
+	e.mapStart(len(x.fs))
+	var name string
+	defer e.pathName(&name)
+	for _, v := range x.fs {
+		name = v.key
+		e.mapElemKey()
+		e.kStructFieldComment(v.si)
+		e.kStructFieldKey(x.keyType, v.ascii, v.key)
+		e.mapElemValue()
+		if v.si != nil {
+			e.kStructFieldValue(v.si, v.rv)
+		} else {
+			e.encode(v.intf)
+		}
+	}
+	e.mapEnd()
+}
+
+// EncodeFields encodes only the named fields of a struct as a map, skipping all others
+// e.g. for the body of a PATCH request.
+//
+// Each name is the name of the field as encoded (i.e. the name in the struct tag, if renamed),
+// or a path of them separated by '.' for a field of a nested struct e.g. "a.b",
+// which is encoded within a map of just the named fields of that struct e.g. {"a":{"b":1}}.
+// A nil pointer (or interface) to a nested struct is encoded as nil, and naming a nested struct
+// includes all of its fields (so a path within it is redundant).
+//
+// The named fields are always encoded (ignoring omitempty) in the order first named,
+// or sorted if Canonical. The map is encoded even if StructToArray is set
+// or a struct has the toarray option.
+// It is an error if a name is not a field of the struct, unless EncodeFieldsIgnoreUnknown.
+func (e *Encoder) EncodeFields(v interface{}, fields ...string) (err error) {
+	if !debugging {
+		defer func() {
+			if x := recover(); x != nil {
+				panicValToErr(e, x, &e.err)
+				err = e.err
+			}
+		}()
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rvIsNil(rv) {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		e.errorf("cannot encode fields: expected a struct, got: %T", v)
+	}
+	e.MustEncode(e.fields(rv, "", fields))
+	return
+}
+
+// fields collects the named fields of the struct rv for EncodeFields,
+// where prefix is the path to rv (for errors).
+func (e *Encoder) fields(rv reflect.Value, prefix string, fields []string) *encMerged {
+	rt := rvType(rv)
+	ti := e.h.getTypeInfo(rt2id(rt), rt)
+	if ti.anyUnsafe {
+		e.kStructCheckUnsafe(ti)
+	}
+	var names []string
+	var whole map[string]bool
+	var sub map[string][]string
+	for _, f := range fields {
+		name, rest := f, ""
+		if i := strings.IndexByte(f, '.'); i >= 0 {
+			name, rest = f[:i], f[i+1:]
+		}
+		if _, ok := whole[name]; !ok {
+			if _, ok = sub[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		if rest == "" {
+			if whole == nil {
+				whole = make(map[string]bool)
+			}
+			whole[name] = true
+		} else {
+			if sub == nil {
+				sub = make(map[string][]string)
+			}
+			sub[name] = append(sub[name], rest)
+		}
+	}
+	x := &encMerged{keyType: ti.keyType, fs: make([]encStructFieldObj, 0, len(names))}
+	for _, name := range names {
+		si := ti.sfi4Name[name]
+		if si == nil {
+			if e.h.EncodeFieldsIgnoreUnknown {
+				continue
+			}
+			e.errorf("cannot encode fields: no field %s%s in %v", prefix, name, rt)
+		}
+		rvf := e.kField(si, rv)
+		if whole[name] {
+			x.fs = append(x.fs, encStructFieldObj{si.encName, rvf, nil, si.path.encNameAsciiAlphaNum, true, si})
+			continue
+		}
+		for k := rvf.Kind(); (k == reflect.Ptr || k == reflect.Interface) && !rvIsNil(rvf); k = rvf.Kind() {
+			rvf = rvf.Elem()
+		}
+		var intf interface{} // nil, if a nil pointer to the nested struct
+		if k := rvf.Kind(); k == reflect.Struct {
+			intf = e.fields(rvf, prefix+name+".", sub[name])
+		} else if rvf.IsValid() && k != reflect.Ptr && k != reflect.Interface {
+			e.errorf("cannot encode fields: field %s%s of %v is not a struct", prefix, name, rt)
+		}
+		x.fs = append(x.fs, encStructFieldObj{si.encName, reflect.Value{}, intf, si.path.encNameAsciiAlphaNum, false, nil})
+	}
+	e.kMergedSort(x)
+	return x
+}
+
+// EncodeNonDefault encodes a struct as a map of only the fields which differ from those of defaults,
+// a value of the same type e.g. for a minimal config file which only shows the overrides.
+//
+// A field which is a nested struct (or a non-nil pointer to one, whose default is also non-nil)
+// is compared field by field, and encoded as a map of just its fields which differ,
+// or skipped if none do. Other fields are compared whole (per reflect.DeepEqual)
+// and encoded in full if they differ e.g. a slice, a map, a nil pointer against a non-nil one,
+// or a struct with a custom encoding (time.Time, extension, Selfer, Marshaler, etc).
+//
+// A field which differs is encoded even if it is tagged omitempty, and fields from a MissingFielder
+// are not included. The map is encoded even if StructToArray is set or a struct has the toarray option,
+// and is sorted if Canonical. If defaults is nil (or a nil pointer), the zero value is used.
+func (e *Encoder) EncodeNonDefault(v, defaults interface{}) (err error) {
+	if !debugging {
+		defer func() {
+			if x := recover(); x != nil {
+				panicValToErr(e, x, &e.err)
+				err = e.err
+			}
+		}()
+	}
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr && !rvIsNil(rv) {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		e.errorf("cannot encode non-default: expected a struct, got: %T", v)
+	}
+	rvd := reflect.ValueOf(defaults)
+	for rvd.Kind() == reflect.Ptr && !rvIsNil(rvd) {
+		rvd = rvd.Elem()
+	}
+	if !rvd.IsValid() || (rvd.Kind() == reflect.Ptr && rvType(rvd).Elem() == rvType(rv)) {
+		rvd = reflect.Zero(rvType(rv))
+	} else if rvType(rvd) != rvType(rv) {
+		e.errorf("cannot encode non-default: defaults is a %v, expected a %v", rvType(rvd), rvType(rv))
+	}
+	e.MustEncode(e.nonDefault(rv, rvd))
+	return
+}
+
+// nonDefault collects the fields of the struct rv which differ from those of rvd
+// (of the same type) for EncodeNonDefault.
+func (e *Encoder) nonDefault(rv, rvd reflect.Value) *encMerged {
+	rt := rvType(rv)
+	ti := e.h.getTypeInfo(rt2id(rt), rt)
+	if ti.anyUnsafe {
+		e.kStructCheckUnsafe(ti)
+	}
+	x := &encMerged{keyType: ti.keyType}
+	for _, si := range ti.sfi.source() {
+		rvf, rvfd := e.kField(si, rv), e.kField(si, rvd)
+		if !rvf.IsValid() || !rvfd.IsValid() { // within a nil embedded pointer
+			if rvf.IsValid() == rvfd.IsValid() {
+				continue
+			}
+		} else {
+			rvs, rvsd := rvf, rvfd
+			for rvs.Kind() == reflect.Ptr && rvsd.Kind() == reflect.Ptr && !rvIsNil(rvs) && !rvIsNil(rvsd) {
+				rvs, rvsd = rvs.Elem(), rvsd.Elem()
+			}
+			if rvs.Kind() == reflect.Struct && e.kNonDefaultNested(rvType(rvs)) {
+				if y := e.nonDefault(rvs, rvsd); len(y.fs) != 0 {
+					x.fs = append(x.fs, encStructFieldObj{si.encName, reflect.Value{}, y, si.path.encNameAsciiAlphaNum, false, nil})
+				}
+				continue
+			}
+			if reflect.DeepEqual(rv2i(rvf), rv2i(rvfd)) {
+				continue
+			}
+		}
+		x.fs = append(x.fs, encStructFieldObj{si.encName, rvf, nil, si.path.encNameAsciiAlphaNum, true, si})
+	}
+	e.kMergedSort(x)
+	return x
+}
+
+// kNonDefaultNested reports whether EncodeNonDefault compares a nested struct of type rt field by field
+// i.e. it is encoded as a map (or array) of its fields, not with a custom encoding.
+func (e *Encoder) kNonDefaultNested(rt reflect.Type) bool {
+	fn := e.fn(rt)
+	ti := fn.i.ti
+	return rt != timeTyp && fn.i.xfFn == nil && ti.unwrap == nil &&
+		!(ti.flagSelfer || ti.flagSelferPtr ||
+			ti.flagBinaryMarshaler || ti.flagBinaryMarshalerPtr ||
+			ti.flagTextMarshaler || ti.flagTextMarshalerPtr ||
+			ti.flagJsonMarshaler || ti.flagJsonMarshalerPtr ||
+			ti.flagCodecFielder || ti.flagCodecFielderPtr ||
+			ti.flagReaderMarshaler || ti.flagReaderMarshalerPtr)
+}
+
+// EncodeMapFunc encodes a map whose entries are streamed from fn, instead of read from a Go map
+// e.g. from a database cursor, for a dataset too large to hold in memory.
+//
+// fn calls emit for each entry, in the order they are to be written.
+// length is the number of entries fn will emit. It is an error if fn emits a different number;
+// emit returns an error without writing an entry beyond length.
+//
+// If length is -1, the length is not written upfront (e.g. an indefinite-length map in cbor).
+// This is only supported by formats which can do so i.e. json and cbor.
+//
+// If fn returns an error, encoding stops and that error is returned.
+// An error while encoding an entry aborts fn (by panicking through it) and is returned.
+//
+// As the entries are written as they are emitted, they cannot be sorted:
+// it is an error to call EncodeMapFunc if Canonical. Keys are also not checked for duplicates.
+func (e *Encoder) EncodeMapFunc(length int, fn func(emit func(k, v interface{}) error) error) (err error) {
+	x := &encMapFunc{length: length, fn: fn}
+	err = e.Encode(x)
+	if cerr, ok := err.(*codecError); ok && x.err != nil && cerr.err == x.err {
+		err = x.err
+	}
+	return
+}
+
+// encMapFunc holds the arguments to EncodeMapFunc, and the error returned by its fn.
+type encMapFunc struct {
+	length int
+	fn     func(emit func(k, v interface{}) error) error
+	err    error
+}
+
+func (e *Encoder) kMapFunc(x *encMapFunc) {
+	if e.h.Canonical {
+		e.errorf("cannot encode a map from a func when Canonical, as the entries cannot be sorted")
+	}
+	indefinite := e.mapStartLen(x.length)
+	var n int
+	var rk reflect.Value
+	defer e.pathKey(&rk)
+	x.err = x.fn(func(k, v interface{}) error {
+		if x.length >= 0 && n >= x.length {
+			return errMapFuncTooManyEntries
+		}
+		n++
+		rk = reflect.ValueOf(k)
+		e.mapElemKey()
+		e.encode(k)
+		e.mapElemValue()
+		e.encode(v)
+		return nil
+	})
+	e.onerror(x.err)
+	if x.length >= 0 && n != x.length {
+		e.errorf("map from a func emitted %d entries, but the declared length is %d", n, x.length)
+	}
+	e.mapEndLen(indefinite)
+}
+
+// EncodeMapFromKeys encodes a map whose keys are the elements of the slice (or array) keys,
+// and whose values are computed from each key by valueFn, without building the map
+// e.g. when the values are cheap to derive.
+//
+// The entries are written in the order of keys, or sorted by key (as for a map with keys
+// of that type) if Canonical. Keys are not checked for duplicates.
+//
+// If valueFn returns an error, encoding stops and that error is returned.
+func (e *Encoder) EncodeMapFromKeys(keys interface{}, valueFn func(k interface{}) (interface{}, error)) (err error) {
+	x := &encMapFromKeys{keys: keys, fn: valueFn}
+	err = e.Encode(x)
+	if cerr, ok := err.(*codecError); ok && x.err != nil && cerr.err == x.err {
+		err = x.err
+	}
+	return
+}
+
+// encMapFromKeys holds the arguments to EncodeMapFromKeys, and the error returned by its fn.
+type encMapFromKeys struct {
+	keys interface{}
+	fn   func(k interface{}) (interface{}, error)
+	err  error
+}
+
+func (e *Encoder) kMapFromKeys(x *encMapFromKeys) {
+	rv := reflect.ValueOf(x.keys)
+	if k := rv.Kind(); k != reflect.Slice && k != reflect.Array {
+		e.errorf("cannot encode a map from keys: expected a slice or array, got: %T", x.keys)
+	}
+	ks := make([]reflect.Value, rv.Len())
+	for i := range ks {
+		ks[i] = rv.Index(i)
+	}
+	rtkey := rvType(rv).Elem()
+	if e.h.Canonical {
+		e.kSortKeys(rtkey, ks)
+	}
+	e.mapStart(len(ks))
+	var k reflect.Value
+	defer e.pathKey(&k)
+	for _, k = range ks {
+		e.mapElemKey()
+		if rtkey == stringTyp {
+			e.kMapKeyString(k.String())
+		} else {
+			e.encodeValue(k, nil)
+		}
+		e.mapElemValue()
+		v, err := x.fn(rv2i(k))
+		if err != nil {
+			x.err = err
+			e.onerror(err)
+		}
+		e.encode(v)
+	}
+	e.mapEnd()
+}
+
+// kSortKeys sorts the keys of type rtkey, as the keys of a map are sorted when Canonical:
+// naturally if a bool, number, string or time.Time, else by their encoding.
+func (e *Encoder) kSortKeys(rtkey reflect.Type, ks []reflect.Value) {
+	var less func(a, b reflect.Value) bool
+	switch rtkey.Kind() {
+	case reflect.Bool:
+		less = func(a, b reflect.Value) bool { return !a.Bool() && b.Bool() }
+	case reflect.String:
+		dict := e.h.KeyDictionary != nil && rtkey == stringTyp
+		less = func(a, b reflect.Value) bool {
+			x, y := a.String(), b.String()
+			if dict {
+				x, y = e.kKeyDict(x), e.kKeyDict(y)
+			}
+			if e.h.StringKeyLess != nil {
+				return e.h.StringKeyLess(x, y)
+			}
+			return x < y
+		}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Int:
+		less = func(a, b reflect.Value) bool { return a.Int() < b.Int() }
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uint, reflect.Uintptr:
+		less = func(a, b reflect.Value) bool { return a.Uint() < b.Uint() }
+	case reflect.Float32, reflect.Float64:
+		less = func(a, b reflect.Value) bool {
+			x, y := a.Float(), b.Float()
+			return x < y || isNaN64(x) && !isNaN64(y)
+		}
+	default:
+		if rtkey == timeTyp {
+			less = func(a, b reflect.Value) bool { return rv2i(a).(time.Time).Before(rv2i(b).(time.Time)) }
+			break
+		}
+		x := encCanonicalKeys{e: e, mks: ks, intf: rtkey.Kind() == reflect.Interface}
+		sort.Sort(&x)
+		return
+	}
+	sort.Sort(encKeysLess{ks, less})
+}
+
+// encKeysLess sorts keys using a less function.
+type encKeysLess struct {
+	v    []reflect.Value
+	less func(a, b reflect.Value) bool
+}
+
+func (p encKeysLess) Len() int           { return len(p.v) }
+func (p encKeysLess) Swap(i, j int)      { p.v[i], p.v[j] = p.v[j], p.v[i] }
+func (p encKeysLess) Less(i, j int) bool { return p.less(p.v[i], p.v[j]) }
+
+// mapStartLen writes the start of a map, where a length of -1 means the length is unknown
+// i.e. an indefinite-length map, if supported by the format.
+func (e *Encoder) mapStartLen(length int) (indefinite bool) {
+	if length >= 0 {
+		e.mapStart(length)
+		return
+	}
+	ind, ok := e.e.(encDriverIndefiniteMap)
+	if !ok {
+		e.errorf("cannot encode a map of unknown length in %s", e.hh.Name())
+	}
+	if e.ctxDone != nil {
+		e.checkContext()
+	}
+	ind.WriteMapStartIndefinite()
+	e.mapStarted()
+	return true
+}
+
+// mapEndLen writes the end of a map started by mapStartLen.
+func (e *Encoder) mapEndLen(indefinite bool) {
+	if indefinite {
+		e.e.(encDriverIndefiniteMap).WriteMapEndIndefinite()
+		e.mapEnded()
+	} else {
+		e.mapEnd()
+	}
+}
+
+// EncodeMapStart starts writing a map, whose entries are then written one at a time
+// via EncodeMapKV, before it is ended via EncodeMapEnd.
+// This allows hand-built streaming maps, while each key and value is encoded as in Encode.
+//
+// length is the number of entries which will be written. It is an error at EncodeMapEnd
+// if a different number was written. If length is -1, the length is not written upfront
+// (e.g. an indefinite-length map in cbor). This is only supported by json and cbor.
+//
+// The entries are written as given: they are not sorted (even if Canonical),
+// nor checked for duplicates.
+//
+// The map is a single value in the stream: e.g. RecordPrefix is written at EncodeMapStart,
+// and RecordSuffix (and the flush of the buffered output) happens at EncodeMapEnd.
+// A map may also be started while encoding a value for an entry (e.g. from a Selfer),
+// as long as it is ended before that value is done.
+func (e *Encoder) EncodeMapStart(length int) (err error) {
+	if e.inOpenMap() {
+		return errOpenMapNeedsKey
+	}
+	return e.Encode(&encOpenMap{length: length})
+}
+
+// EncodeMapKV writes one entry of the map started by EncodeMapStart.
+//
+// It is an error to call it when not directly within such a map
+// e.g. before EncodeMapStart, after EncodeMapEnd, or within a nested container.
+func (e *Encoder) EncodeMapKV(k, v interface{}) (err error) {
+	if !e.inOpenMap() {
+		return errNoOpenMap
+	}
+	x := &e.om[len(e.om)-1]
+	if x.length >= 0 && x.n >= x.length {
+		return errMapFuncTooManyEntries
+	}
+	x.n++
+	return e.Encode(&encMapKV{k, v})
+}
+
+// EncodeMapEnd ends the map started by EncodeMapStart.
+func (e *Encoder) EncodeMapEnd() (err error) {
+	if !e.inOpenMap() {
+		return errNoOpenMap
+	}
+	return e.Encode(encCloseMap{})
+}
+
+// encOpenMap tracks a map started by EncodeMapStart.
+type encOpenMap struct {
+	length     int
+	n          int
+	depth      int16
+	indefinite bool
+	inKV       bool // an entry is being written
+}
+
+// encMapKV is an entry written via EncodeMapKV.
+type encMapKV struct {
+	k, v interface{}
+}
+
+// encCloseMap is the request to end the map started by EncodeMapStart.
+type encCloseMap struct{}
+
+// inOpenMap reports whether the next value is written directly within a map
+// started by EncodeMapStart.
+func (e *Encoder) inOpenMap() bool {
+	if len(e.om) == 0 || e.err != nil {
+		return false
+	}
+	x := &e.om[len(e.om)-1]
+	return x.depth == e.depth && !x.inKV
+}
+
+func (e *Encoder) kOpenMap(x *encOpenMap) {
+	x.indefinite = e.mapStartLen(x.length)
+	x.depth = e.depth
+	e.om = append(e.om, *x)
+	// keep the map open across calls, so it is started and ended as a single value
+	e.calls++
+}
+
+func (e *Encoder) kMapKV(x *encMapKV) {
+	i := len(e.om) - 1
+	e.om[i].inKV = true
+	k := reflect.ValueOf(x.k)
+	defer e.pathKey(&k)
+	e.mapElemKey()
+	e.encode(x.k)
+	e.mapElemValue()
+	e.encode(x.v)
+	e.om[i].inKV = false
+}
+
+func (e *Encoder) kCloseMap() {
+	x := e.om[len(e.om)-1]
+	e.om = e.om[:len(e.om)-1]
+	e.calls--
+	if x.length >= 0 && x.n != x.length {
+		e.errorf("map emitted %d entries, but the declared length is %d", x.n, x.length)
+	}
+	e.mapEndLen(x.indefinite)
+}
+
+// EncodeNoFlush is like Encode, but does not flush the buffered output at the end.
+//
+// This allows the length of the encoded value to be inspected (see NumBytesWritten)
+// while it is still buffered e.g. to first write a frame header directly to the io.Writer.
+// Call Flush when done. Buffered output exceeding WriterBufferSize is still written as needed.
+//
+// When encoding into a []byte, there is nothing to flush, and the output is updated as in Encode.
+// A call nested within another (e.g. from a Selfer) is not flushed anyway.
+func (e *Encoder) EncodeNoFlush(v interface{}) (err error) {
+	noFlush := e.noFlush
+	e.noFlush = true
+	err = e.Encode(v)
+	e.noFlush = noFlush
+	return
+}
+
+// Flush writes any buffered output to the underlying io.Writer.
+//
+// It is only needed after EncodeNoFlush, as Encode flushes at the end.
+func (e *Encoder) Flush() error {
+	return e.w().endErr()
+}
+
+// NumBytesWritten returns the number of bytes written (since the last Reset),
+// including those still buffered.
+func (e *Encoder) NumBytesWritten() int {
+	return e.w().numwritten()
+}
+
+// Close flushes any buffered output, and closes the io.Writer passed to NewEncoder or Reset
+// if it is an io.Closer (with ResetMulti, each of the writers which is an io.Closer).
+//
+// It is a no-op when encoding into a []byte, or if already closed.
+// After Close, the Encoder must be Reset before it is used again.
+func (e *Encoder) Close() (err error) {
+	if e.bytes || e.wf == nil || e.err == errEncoderClosed {
+		return
+	}
+	err = e.wf.endErr()
+	if c, ok := e.wf.w.(io.Closer); ok {
+		if err2 := c.Close(); err == nil {
+			err = err2
+		}
 	}
+	e.err = errEncoderClosed
+	return
 }
 
 // Release releases shared (pooled) resources.
@@ -1122,9 +4678,14 @@ func (e *Encoder) MustEncode(v interface{}) {
 // It is important to call Release() when done with an Encoder, so those resources
 // are released instantly for use by subsequently created Encoders.
 //
-// Deprecated: Release is a no-op as pooled resources are not used with an Encoder.
-// This method is kept for compatibility reasons only.
+// If CloseWriterOnRelease, it also closes the Encoder (see Close), ignoring any error.
+//
+// Deprecated: Release is a no-op (unless CloseWriterOnRelease) as pooled resources
+// are not used with an Encoder. This method is kept for compatibility reasons only.
 func (e *Encoder) Release() {
+	if e.h != nil && e.h.CloseWriterOnRelease {
+		e.Close()
+	}
 }
 
 func (e *Encoder) encode(iv interface{}) {
@@ -1142,18 +4703,44 @@ func (e *Encoder) encode(iv interface{}) {
 		return
 	}
 
+	if e.ptrLimit == 0 && e.h.ErrorOnSharedPointers && !e.noShare {
+		// these pointers are encoded directly below, bypassing the check in encodeValue
+		switch iv.(type) {
+		case *Raw, *string, *bool, *int, *int8, *int16, *int32, *int64,
+			*uint, *uint8, *uint16, *uint32, *uint64, *uintptr,
+			*float32, *float64, *complex64, *complex128, *time.Time, *[]byte:
+			e.kSharedPointerCheck(rv)
+		}
+	}
+
 	switch v := iv.(type) {
 	// case nil:
 	// case Selfer:
 	case Raw:
 		e.rawBytes(v)
+	case *encMerged:
+		e.kMerged(v)
+	case *encMapFunc:
+		e.kMapFunc(v)
+	case *encMapFromKeys:
+		e.kMapFromKeys(v)
+	case *encOpenMap:
+		e.kOpenMap(v)
+	case *encMapKV:
+		e.kMapKV(v)
+	case encCloseMap:
+		e.kCloseMap()
 	case reflect.Value:
-		e.encodeValue(v, nil)
+		if e.h.Iterative {
+			e.encodeIter(v)
+		} else {
+			e.encodeValue(v, nil)
+		}
 
 	case string:
 		e.e.EncodeString(v)
 	case bool:
-		e.e.EncodeBool(v)
+		e.encodeBool(v)
 	case int:
 		e.e.EncodeInt(int64(v))
 	case int8:
@@ -1175,7 +4762,7 @@ func (e *Encoder) encode(iv interface{}) {
 	case uint64:
 		e.e.EncodeUint(v)
 	case uintptr:
-		e.e.EncodeUint(uint64(v))
+		e.encodeUintptr(v)
 	case float32:
 		e.e.EncodeFloat32(v)
 	case float64:
@@ -1185,7 +4772,7 @@ func (e *Encoder) encode(iv interface{}) {
 	case complex128:
 		e.encodeComplex128(v)
 	case time.Time:
-		e.e.EncodeTime(v)
+		e.encodeTime(v)
 	case []byte:
 		e.e.EncodeStringBytesRaw(v)
 	case *Raw:
@@ -1193,7 +4780,7 @@ func (e *Encoder) encode(iv interface{}) {
 	case *string:
 		e.e.EncodeString(*v)
 	case *bool:
-		e.e.EncodeBool(*v)
+		e.encodeBool(*v)
 	case *int:
 		e.e.EncodeInt(int64(*v))
 	case *int8:
@@ -1215,7 +4802,7 @@ func (e *Encoder) encode(iv interface{}) {
 	case *uint64:
 		e.e.EncodeUint(*v)
 	case *uintptr:
-		e.e.EncodeUint(uint64(*v))
+		e.encodeUintptr(*v)
 	case *float32:
 		e.e.EncodeFloat32(*v)
 	case *float64:
@@ -1225,7 +4812,7 @@ func (e *Encoder) encode(iv interface{}) {
 	case *complex128:
 		e.encodeComplex128(*v)
 	case *time.Time:
-		e.e.EncodeTime(*v)
+		e.encodeTime(*v)
 	case *[]byte:
 		if *v == nil {
 			e.e.EncodeNil()
@@ -1234,12 +4821,26 @@ func (e *Encoder) encode(iv interface{}) {
 		}
 	default:
 		// we can't check non-predefined types, as they might be a Selfer or extension.
-		if skipFastpathTypeSwitchInDirectCall || !fastpathEncodeTypeSwitch(iv, e) {
+		// a pointer (e.g. *[]string) is not encoded via the fastpath type switch if ErrorOnSharedPointers,
+		// so encodeValue checks it.
+		if e.h.Iterative {
+			e.encodeIter(rv)
+		} else if skipFastpathTypeSwitchInDirectCall || (e.ptrLimit == 0 && e.h.ErrorOnSharedPointers && rv.Kind() == reflect.Ptr) ||
+			!fastpathEncodeTypeSwitch(iv, e) {
 			e.encodeValue(rv, nil)
 		}
 	}
 }
 
+// fn returns the function to encode a value of type rt,
+// ignoring any extension registered for it if EncodeNoExt.
+func (e *Encoder) fn(rt reflect.Type) *codecFn {
+	if e.noExt {
+		return e.h.fnNoExt(rt)
+	}
+	return e.h.fn(rt)
+}
+
 // encodeValue will encode a value.
 //
 // Note that encodeValue will handle nil in the stream early, so that the
@@ -1252,6 +4853,7 @@ func (e *Encoder) encodeValue(rv reflect.Value, fn *codecFn) {
 	var sptr interface{}
 	var rvp reflect.Value
 	var rvpValid bool
+	var derefs int
 TOP:
 	switch rv.Kind() {
 	case reflect.Ptr:
@@ -1259,6 +4861,9 @@ TOP:
 			e.e.EncodeNil()
 			return
 		}
+		if derefs++; derefs > e.ptrLimit && e.kPointer(derefs, rv) {
+			return
+		}
 		rvpValid = true
 		rvp = rv
 		rv = rv.Elem()
@@ -1271,6 +4876,9 @@ TOP:
 		rvpValid = false
 		rvp = reflect.Value{}
 		rv = rv.Elem()
+		if e.ptrLimit == 0 && e.kInterface(rv) {
+			return
+		}
 		goto TOP
 	case reflect.Struct:
 		if rvpValid && e.h.CheckCircularRef {
@@ -1287,13 +4895,20 @@ TOP:
 			e.e.EncodeNil()
 			return
 		}
-	case reflect.Invalid, reflect.Func:
+	case reflect.Func:
+		if e.h.CallLazyFuncs && isLazyFuncType(rvType(rv)) {
+			e.kLazyFunc(rv)
+		} else if !e.kUnsupported(rv) {
+			e.e.EncodeNil()
+		}
+		return
+	case reflect.Invalid:
 		e.e.EncodeNil()
 		return
 	}
 
 	if fn == nil {
-		fn = e.h.fn(rvType(rv))
+		fn = e.fn(rvType(rv))
 	}
 
 	if !fn.i.addrE { // typically, addrE = false, so check it first
@@ -1310,6 +4925,488 @@ TOP:
 	}
 }
 
+// kTypeNamed encodes the concrete value of an interface wrapped with its registered type name.
+//
+// It returns false if no name is registered for the type (so nothing was encoded).
+func (e *Encoder) kTypeNamed(rv reflect.Value) bool {
+	rt := rvType(rv)
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	name := e.h.typeName(rt2id(rt))
+	if name == "" {
+		return false
+	}
+	vkey := e.h.TypeValueFieldName
+	if vkey == "" {
+		vkey = "data"
+	}
+	e.mapStart(2)
+	e.mapElemKey()
+	e.e.EncodeString(e.h.TypeFieldName)
+	e.mapElemValue()
+	e.e.EncodeString(name)
+	e.mapElemKey()
+	e.e.EncodeString(vkey)
+	e.mapElemValue()
+	e.encodeValue(rv, nil)
+	e.mapEnd()
+	return true
+}
+
+// kTagged encodes the concrete value of an interface with its compact type tag
+// i.e. [id, value] (if TaggedInterfaces).
+func (e *Encoder) kTagged(rv reflect.Value) {
+	e.arrayStart(2)
+	e.arrayElem()
+	e.e.EncodeUint(uint64(e.kTaggedID(rv)))
+	e.arrayElem()
+	e.encodeValue(rv, nil)
+	e.arrayEnd()
+}
+
+func (e *Encoder) kTaggedID(rv reflect.Value) uint8 {
+	rt := rvType(rv)
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	id, ok := e.h.compactTypeID(rt2id(rt))
+	if !ok {
+		e.errorf("TaggedInterfaces: no compact type registered for %v", rt)
+	}
+	return id
+}
+
+// encodeIntf encodes a value held in an interface e.g. an element of a []interface{}.
+// It is used by the fastpath functions, honoring TaggedInterfaces and TypeFieldName
+// as encodeValue does for a reflect.Interface.
+func (e *Encoder) encodeIntf(v interface{}) {
+	if v != nil && e.ptrLimit == 0 && e.kInterface(reflect.ValueOf(v)) {
+		return
+	}
+	e.encode(v)
+}
+
+// encIterKind is the kind of container being walked by an encIterFrame.
+type encIterKind uint8
+
+const (
+	encIterArray encIterKind = iota
+	encIterArrayMbs
+	encIterStructArray
+	encIterStructMap
+	encIterMap
+	encIterTypeNamed
+	encIterTagged
+)
+
+// encIterFrame is a container on the work stack of the iterative encoder.
+//
+// It tracks the next element (i) of the n elements to be encoded.
+type encIterFrame struct {
+	rv   reflect.Value
+	ti   *typeInfo
+	fn   *codecFn // for the elements (or map values), if not an interface
+	kfn  *codecFn // for the map keys, if not a string or an interface
+	kvs  []sfiRv
+	mks  []reflect.Value // sorted keys (if Canonical)
+	it   *mapIter
+	sptr interface{}
+	i    int
+	n    int
+	k    encIterKind
+	ks   bool // map key type is string
+}
+
+// encodeIter encodes rv like encodeValue, but walks the nested slices, arrays, maps
+// and structs using the work stack (e.is) instead of recursing.
+func (e *Encoder) encodeIter(rv reflect.Value) {
+	base := len(e.is)
+	defer e.pathIter(base)
+	e.iterValue(rv, nil)
+	var x *encIterFrame
+	for len(e.is) > base {
+		x = &e.is[len(e.is)-1]
+		if x.k == encIterStructMap && x.i > 0 {
+			// the value of the previous field is fully encoded
+			e.kStructFieldBytes(x.kvs[x.i-1].v.encName)
+		}
+		if x.i < x.n {
+			// increment before encoding, as e.is may be grown (invalidating x)
+			// if a key or value is encoded by a nested call to encodeIter.
+			x.i++
+			fn := x.fn
+			// a field with a set, reverse, sortby or pad option is encoded out-of-band (not iteratively)
+			if x.kvs != nil && x.kvs[x.i-1].v.hasValueOption() {
+				si := x.kvs[x.i-1].v
+				e.kStructFieldValue(si, e.iterElem(x, x.i-1))
+			} else {
+				e.iterValue(e.iterElem(x, x.i-1), fn)
+			}
+			continue
+		}
+		switch x.k {
+		case encIterArray, encIterStructArray, encIterTagged:
+			e.arrayEnd()
+		default:
+			e.mapEnd()
+		}
+		if x.kvs != nil {
+			e.slist.put(x.kvs)
+		}
+		if x.it != nil {
+			x.it.Done()
+		}
+		if x.sptr != nil {
+			e.ci = e.ci[:len(e.ci)-1]
+		}
+		*x = encIterFrame{}
+		e.is = e.is[:len(e.is)-1]
+	}
+}
+
+// pathIter is deferred by encodeIter. If an error (i.e. a panic) unwinds through it,
+// it records the element being written in each of its containers (on e.is above base)
+// in e.path, innermost first, and pops them (see pathIndex).
+func (e *Encoder) pathIter(base int) {
+	x := recover()
+	if x == nil {
+		return
+	}
+	for i := len(e.is) - 1; i >= base; i-- {
+		f := &e.is[i]
+		if f.i > 0 { // else before the first element
+			switch f.k {
+			case encIterArray, encIterArrayMbs:
+				e.path = append(e.path, f.i-1)
+			case encIterStructArray, encIterStructMap:
+				e.path = append(e.path, f.kvs[f.i-1].v.encName)
+			case encIterMap:
+				if f.it == nil {
+					e.path = append(e.path, f.mks[f.i-1])
+				} else {
+					e.path = append(e.path, f.it.Key())
+				}
+			} // an encIterTypeNamed or encIterTagged frame only wraps a value
+		}
+		*f = encIterFrame{}
+	}
+	e.is = e.is[:base]
+	panic(x)
+}
+
+// iterElem writes the separators (and key, if a map) for the element i of x,
+// and returns the element value.
+func (e *Encoder) iterElem(x *encIterFrame, i int) (rv reflect.Value) {
+	switch x.k {
+	case encIterArray:
+		e.arrayElem()
+		if x.ti.kind == uint8(reflect.Array) {
+			return x.rv.Index(i)
+		}
+		return rvSliceIndex(x.rv, i, x.ti)
+	case encIterArrayMbs:
+		if i&1 == 0 {
+			e.mapElemKey()
+		} else {
+			e.mapElemValue()
+		}
+		if x.ti.kind == uint8(reflect.Array) {
+			return x.rv.Index(i)
+		}
+		return rvSliceIndex(x.rv, i, x.ti)
+	case encIterStructArray:
+		e.arrayElem()
+		return x.kvs[i].r
+	case encIterTagged:
+		e.arrayElem()
+		return x.rv
+	case encIterStructMap:
+		e.mapElemKey()
+		e.kStructFieldComment(x.kvs[i].v)
+		e.kStructFieldKey(x.ti.keyType, x.kvs[i].v.path.encNameAsciiAlphaNum, x.kvs[i].v.encName)
+		e.mapElemValue()
+		e.kStructFieldOffset(x.kvs[i].v.encName)
+		return x.kvs[i].r
+	case encIterMap:
+		var rvk reflect.Value
+		if x.it == nil {
+			rvk = x.mks[i]
+			rv = x.rv.MapIndex(rvk)
+		} else if x.it.Next() {
+			rvk, rv = x.it.Key(), x.it.Value()
+		} else { // map was modified during encoding
+			e.errorf("map modified during encoding")
+		}
+		e.mapElemKey()
+		if x.ks && x.ti.key == stringTyp {
+			e.kMapKeyString(rvk.String())
+		} else if x.ks {
+			e.e.EncodeString(rvk.String())
+		} else {
+			e.encodeValue(rvk, x.kfn)
+		}
+		e.mapElemValue()
+		return
+	default: // encIterTypeNamed
+		e.mapElemKey()
+		vkey := e.h.TypeValueFieldName
+		if vkey == "" {
+			vkey = "data"
+		}
+		e.e.EncodeString(vkey)
+		e.mapElemValue()
+		return x.rv
+	}
+}
+
+// iterValue encodes rv, if it is not a container which can be walked iteratively.
+// Else, it writes the start of the container and pushes it onto the work stack.
+func (e *Encoder) iterValue(rv reflect.Value, fn *codecFn) {
+	rv0 := rv
+	var rvp reflect.Value
+	var rvpValid bool
+	var derefs int
+TOP:
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rvIsNil(rv) {
+			e.e.EncodeNil()
+			return
+		}
+		if derefs++; derefs > e.ptrLimit {
+			e.kPointerDepth(derefs, rv)
+			if e.h.ShareReferences && !e.noShare && e.kShared(rv) {
+				return
+			}
+		}
+		rvpValid = true
+		rvp = rv
+		rv = rv.Elem()
+		goto TOP
+	case reflect.Interface:
+		if rvIsNil(rv) {
+			e.e.EncodeNil()
+			return
+		}
+		rvpValid = false
+		rvp = reflect.Value{}
+		rv = rv.Elem()
+		if e.ptrLimit == 0 && e.iterInterface(rv0, rv) {
+			return
+		}
+		rv0, fn = rv, nil
+		goto TOP
+	case reflect.Slice, reflect.Map:
+		if rvIsNil(rv) {
+			e.e.EncodeNil()
+			return
+		}
+	case reflect.Func:
+		if e.h.CallLazyFuncs && isLazyFuncType(rvType(rv)) {
+			e.kLazyFunc(rv)
+		} else if !e.kUnsupported(rv) {
+			e.e.EncodeNil()
+		}
+		return
+	case reflect.Invalid:
+		e.e.EncodeNil()
+		return
+	}
+
+	if fn == nil {
+		fn = e.fn(rvType(rv))
+	}
+	ti := fn.i.ti
+	if !fn.i.iterE {
+		e.encodeValue(rv0, fn)
+		return
+	}
+
+	var x encIterFrame
+	x.rv, x.ti = rv, ti
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice {
+			rv = e.kSorted(rv, ti)
+			x.rv = rv
+			x.n = rvLenSlice(rv)
+		} else {
+			x.n = rv.Len()
+		}
+		if ti.mbs {
+			x.k = encIterArrayMbs
+			if x.n != 0 {
+				e.haltOnMbsOddLen(x.n)
+			}
+			e.mapStart(x.n >> 1)
+		} else if uint8TypId == rt2id(ti.elem) &&
+			(rv.Kind() == reflect.Slice || handleBytesWithinKArray) ||
+			rv.Kind() == reflect.Slice && e.kSliceFlat(ti) {
+			e.encodeValue(rv0, fn)
+			return
+		} else if x.n == 0 && e.emptyArrayAsNull() {
+			e.e.EncodeNil()
+			return
+		} else if e.kTruncates(x.n) {
+			e.encodeValue(rv0, fn)
+			return
+		} else {
+			x.k = encIterArray
+			e.arrayStart(x.n)
+		}
+		if x.n != 0 {
+			x.fn = e.kSeqFn(ti.elem)
+		}
+	case reflect.Struct:
+		if e.h.EmptyStructHandling == EmptyStructAsNil && e.kStructIsEmpty(ti) {
+			e.e.EncodeNil()
+			return
+		}
+		toMap := !(ti.toArray || e.h.StructToArray)
+		if (toMap && (e.h.MapDecorator != nil || ti.kvArray)) || e.kSchemaVersion() || ti.unwrap != nil || ti.anyInline {
+			e.encodeValue(rv0, fn)
+			return
+		}
+		if ti.anyUnsafe {
+			e.kStructCheckUnsafe(ti)
+		}
+		if e.h.EnforceUnions {
+			e.kUnionCheck(ti, rv)
+		}
+		if rvpValid && e.h.CheckCircularRef {
+			x.sptr = rv2i(rvp)
+			for _, vv := range e.ci {
+				if eq4i(x.sptr, vv) { // error if sptr already seen
+					e.errorf("circular reference found: %p, %T", x.sptr, x.sptr)
+				}
+			}
+			e.ci = append(e.ci, x.sptr)
+		}
+		x.kvs = e.iterStructFields(ti, rv, toMap)
+		x.n = len(x.kvs)
+		if toMap {
+			x.k = encIterStructMap
+			e.mapStart(x.n)
+		} else {
+			x.k = encIterStructArray
+			e.arrayStart(x.n)
+		}
+	case reflect.Map:
+		if (e.h.Canonical && ti.keykind != uint8(reflect.String)) || e.h.KeyHandle != nil || e.kMapIsSet(ti) ||
+			e.kTruncates(rvLenMap(rv)) {
+			e.encodeValue(rv0, fn)
+			return
+		}
+		x.k = encIterMap
+		x.n = rvLenMap(rv)
+		if x.n != 0 && e.kMapFilters(ti) {
+			x.mks = e.kMapFilterKeys(rv)
+			x.n = len(x.mks)
+		}
+		e.mapStart(x.n)
+		if x.n != 0 {
+			x.fn = e.kSeqFn(ti.elem)
+			x.ks = e.h.Canonical || stringTypId == rt2id(ti.key)
+			if !x.ks {
+				x.kfn = e.kSeqFn(ti.key)
+			}
+			if e.h.Canonical {
+				if x.mks == nil {
+					x.mks = rv.MapKeys()
+				}
+				e.iterSortStringKeys(x.mks, ti.key == stringTyp)
+			} else if x.mks == nil {
+				x.it = new(mapIter)
+				mapRange(x.it, rv, mapAddrLoopvarRV(ti.key, reflect.Kind(ti.keykind)),
+					mapAddrLoopvarRV(ti.elem, reflect.Kind(ti.elemkind)), true)
+			}
+		}
+	default:
+		e.encodeValue(rv0, fn)
+		return
+	}
+	e.iterSharedPointerCheck(rv0)
+	e.iterPush(x)
+}
+
+// iterStructFields returns the fields of a struct to encode, in order,
+// eliding the empty omitempty fields if encoding as a map (see kStruct).
+func (e *Encoder) iterStructFields(ti *typeInfo, rv reflect.Value, toMap bool) (kvs []sfiRv) {
+	var tisfi []*structFieldInfo
+	if toMap {
+		tisfi = e.kStructSfi(ti)
+	} else {
+		tisfi = ti.sfi.source()
+	}
+	kvs = e.slist.get(len(tisfi))[:0]
+	recur := e.h.RecursiveEmptyCheck
+	var kv sfiRv
+	for _, si := range tisfi {
+		kv.v = si
+		kv.r = e.kField(si, rv)
+		if toMap && e.kStructFieldOmitted(si, kv.r, rv, recur) {
+			continue
+		}
+		if e.kZeroAsNull(kv.r, recur) {
+			kv.r = reflect.Value{}
+		} else if e.kOmitEmpty(si) && e.kStructFieldIsEmpty(kv.r, recur) {
+			switch kv.r.Kind() {
+			case reflect.Struct, reflect.Interface, reflect.Ptr, reflect.Array, reflect.Map, reflect.Slice:
+				kv.r = reflect.Value{} //encode as nil
+			}
+		}
+		kvs = append(kvs, kv)
+	}
+	return
+}
+
+// iterSortStringKeys sorts the keys of a map whose key kind is string (see kMapCanonical).
+func (e *Encoder) iterSortStringKeys(mks []reflect.Value, keyDict bool) {
+	mksv := make([]stringRv, len(mks))
+	for i, k := range mks {
+		mksv[i] = stringRv{k.String(), k}
+		if keyDict && e.h.KeyDictionary != nil {
+			mksv[i].v = e.kKeyDict(mksv[i].v)
+		}
+	}
+	if e.h.StringKeyLess != nil {
+		sort.Sort(stringRvKeyLessSlice{mksv, e.h.StringKeyLess})
+	} else {
+		sort.Sort(stringRvSlice(mksv))
+	}
+	for i := range mksv {
+		mks[i] = mksv[i].r
+	}
+}
+
+// iterPush pushes x onto the work stack, erroring if it would exceed IterativeMaxDepth.
+func (e *Encoder) iterPush(x encIterFrame) {
+	if e.h.IterativeMaxDepth > 0 && len(e.is) >= e.h.IterativeMaxDepth {
+		e.errorf("maximum encoding depth exceeded: %d", e.h.IterativeMaxDepth)
+	}
+	e.is = append(e.is, x)
+}
+
+// iterTypeNamed is the iterative version of kTypeNamed.
+func (e *Encoder) iterTypeNamed(rv reflect.Value) bool {
+	rt := rvType(rv)
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	name := e.h.typeName(rt2id(rt))
+	if name == "" {
+		return false
+	}
+	e.mapStart(2)
+	e.mapElemKey()
+	e.e.EncodeString(e.h.TypeFieldName)
+	e.mapElemValue()
+	e.e.EncodeString(name)
+	e.iterPush(encIterFrame{rv: rv, k: encIterTypeNamed, n: 1})
+	return true
+}
+
 // addrRV returns a addressable value which may be readonly
 func (e *Encoder) addrRV(rv reflect.Value, typ, ptrType reflect.Type) (rva reflect.Value) {
 	if rv.CanAddr() {
@@ -1355,11 +5452,106 @@ func (e *Encoder) rawBytes(vv Raw) {
 	if !e.h.Raw {
 		e.errorf("Raw values cannot be encoded: %v", v)
 	}
+	if _, ok := e.e.(*visitorEncDriver); ok {
+		e.errorf("Raw values cannot be encoded to a TokenVisitor: %v", v)
+	}
 	e.encWr.writeb(v)
 }
 
 func (e *Encoder) wrapErr(v error, err *error) {
 	*err = wrapCodecErr(v, e.hh.Name(), 0, true)
+	if x, ok := (*err).(*codecError); ok && x.path == "" {
+		x.path = e.errPath()
+	}
+	e.path = e.path[:0]
+}
+
+// errPath returns the location of the value being written when an error occurred,
+// e.g. items[3].meta.ts, built from e.path (see pathIndex).
+func (e *Encoder) errPath() string {
+	var b []byte
+	for i := len(e.path) - 1; i >= 0; i-- {
+		switch x := e.path[i].(type) {
+		case int:
+			b = append(b, '[')
+			b = strconv.AppendInt(b, int64(x), 10)
+			b = append(b, ']')
+		case string:
+			if len(b) != 0 {
+				b = append(b, '.')
+			}
+			b = append(b, x...)
+		case reflect.Value:
+			if x.Kind() == reflect.String {
+				if len(b) != 0 {
+					b = append(b, '.')
+				}
+				b = append(b, x.String()...)
+			} else {
+				b = append(b, fmt.Sprintf("[%v]", x)...)
+			}
+		default:
+			b = append(b, fmt.Sprintf("[%v]", x)...)
+		}
+	}
+	return string(b)
+}
+
+// pathIndex, pathName, pathField and pathKey are deferred by the functions which write
+// the elements of a container, with a pointer to the element being written
+// (its index, field or map key).
+//
+// If an error (i.e. a panic) unwinds through the container, they record that element
+// in e.path and continue the panic. The location of the failing value is thus only
+// built on error: the success path just makes the deferred call.
+
+func (e *Encoder) pathIndex(i *int) {
+	if x := recover(); x != nil {
+		e.pathUnwind(x, *i)
+	}
+}
+
+func (e *Encoder) pathName(name *string) {
+	if x := recover(); x != nil {
+		if *name == "" { // before the first field or entry
+			panic(x)
+		}
+		e.pathUnwind(x, *name)
+	}
+}
+
+func (e *Encoder) pathField(si **structFieldInfo) {
+	if x := recover(); x != nil {
+		if *si == nil { // before the first field
+			panic(x)
+		}
+		e.pathUnwind(x, (*si).encName)
+	}
+}
+
+func (e *Encoder) pathKey(k *reflect.Value) {
+	if x := recover(); x != nil {
+		if !k.IsValid() { // before the first entry
+			panic(x)
+		}
+		e.pathUnwind(x, *k)
+	}
+}
+
+// pathUnwind records the element k (an index, name or map key) in e.path,
+// and continues the panic x.
+func (e *Encoder) pathUnwind(x, k interface{}) {
+	e.path = append(e.path, k)
+	panic(x)
+}
+
+// checkContext aborts the encode if the context (from EncodeContext) is done.
+func (e *Encoder) checkContext() {
+	select {
+	case <-e.ctxDone:
+		halt.onerror(e.ctx.Err())
+	default:
+	}
 }
 
 // ---- container tracker methods
@@ -1367,37 +5559,59 @@ func (e *Encoder) wrapErr(v error, err *error) {
 // This way, the callback can know what the last status was.
 
 func (e *Encoder) mapStart(length int) {
+	if e.ctxDone != nil {
+		e.checkContext()
+	}
+	if e.h.MaxKeysPerMap > 0 && length > e.h.MaxKeysPerMap {
+		e.errorf("cannot encode map with %d entries: more than MaxKeysPerMap (%d)", length, e.h.MaxKeysPerMap)
+	}
 	e.e.WriteMapStart(length)
+	e.mapStarted()
+}
+
+// mapStarted updates the state after the start of a map is written.
+func (e *Encoder) mapStarted() {
 	e.c = containerMapStart
+	e.depth++
 }
 
 func (e *Encoder) mapElemKey() {
-	if e.js {
-		e.jsondriver().WriteMapElemKey()
+	if e.ct != nil {
+		e.ct.WriteMapElemKey()
 	}
 	e.c = containerMapKey
 }
 
 func (e *Encoder) mapElemValue() {
-	if e.js {
-		e.jsondriver().WriteMapElemValue()
+	if e.ct != nil {
+		e.ct.WriteMapElemValue()
 	}
 	e.c = containerMapValue
 }
 
 func (e *Encoder) mapEnd() {
 	e.e.WriteMapEnd()
+	e.mapEnded()
+}
+
+// mapEnded updates the state after the end of a map is written.
+func (e *Encoder) mapEnded() {
 	e.c = 0
+	e.depth--
 }
 
 func (e *Encoder) arrayStart(length int) {
+	if e.ctxDone != nil {
+		e.checkContext()
+	}
 	e.e.WriteArrayStart(length)
 	e.c = containerArrayStart
+	e.depth++
 }
 
 func (e *Encoder) arrayElem() {
-	if e.js {
-		e.jsondriver().WriteArrayElem()
+	if e.ct != nil {
+		e.ct.WriteArrayElem()
 	}
 	e.c = containerArrayElem
 }
@@ -1405,6 +5619,7 @@ func (e *Encoder) arrayElem() {
 func (e *Encoder) arrayEnd() {
 	e.e.WriteArrayEnd()
 	e.c = 0
+	e.depth--
 }
 
 // ----------
@@ -1415,6 +5630,56 @@ func (e *Encoder) haltOnMbsOddLen(length int) {
 	}
 }
 
+// frameStart redirects the output to the frame buffer, at the start of a top-level value
+// (if FrameLengthPrefix or ChecksumTrailer, or if EncodeWithFieldBytes while encoding to an io.Writer).
+func (e *Encoder) frameStart() {
+	e.fr.on, e.fr.bytes, e.fr.wb = true, e.bytes, e.wb
+	e.wb = bytesEncAppender{e.fr.b[:0], &e.fr.b}
+	e.bytes = true
+}
+
+// frameEnd restores the output stream, and writes the length of the buffered value
+// followed by the value itself, and its checksum.
+func (e *Encoder) frameEnd() {
+	e.wb.endErr()
+	e.frameRestore()
+	n := len(e.fr.b)
+	if e.h.FrameLengthPrefix != FrameNone && e.h.FrameLengthPrefix != FrameVarint && uint64(n) > math.MaxUint32 {
+		e.errorf("cannot write a length of %d bytes as a 4-byte frame prefix", n)
+	}
+	switch e.h.FrameLengthPrefix {
+	case FrameNone: // buffered for ChecksumTrailer or EncodeWithFieldBytes
+	case FrameVarint:
+		var b [10]byte
+		e.encWr.writeb(AppendVarint(b[:0], uint64(n)))
+	case FrameFixed32BE:
+		e.encWr.writen4(bigen.PutUint32(uint32(n)))
+	case FrameFixed32LE:
+		e.encWr.writen4([4]byte{byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)})
+	default:
+		e.errorf("unknown FrameLengthPrefix: %d", e.h.FrameLengthPrefix)
+	}
+	e.encWr.writeb(e.fr.b)
+	if e.h.ChecksumTrailer != ChecksumNone {
+		var b [8]byte
+		e.encWr.writeb(appendChecksum(b[:0], e.h.ChecksumTrailer, e.fr.b))
+	}
+}
+
+// frameRestore restores the output stream redirected by frameStart.
+func (e *Encoder) frameRestore() {
+	if e.fr.on {
+		e.wb, e.bytes = e.fr.wb, e.fr.bytes
+		e.fr.on, e.fr.wb = false, bytesEncAppender{}
+	}
+}
+
+func (e *Encoder) atStartOfEncode() {
+	if e.js {
+		e.jsondriver().atStartOfEncode()
+	}
+}
+
 func (e *Encoder) atEndOfEncode() {
 	// e.e.atEndOfEncode()
 	if e.js {
@@ -1429,17 +5694,19 @@ func (e *Encoder) sideEncode(v interface{}, basetype reflect.Type, bs *[]byte) {
 	// e2.atEndOfEncode()
 	// e2.w().end()
 
-	defer func(wb bytesEncAppender, bytes bool, c containerState, state interface{}) {
+	defer func(wb bytesEncAppender, bytes bool, c containerState, state interface{}, noShare bool) {
 		e.wb = wb
 		e.bytes = bytes
 		e.c = c
 		e.e.restoreState(state)
-	}(e.wb, e.bytes, e.c, e.e.captureState())
+		e.noShare = noShare
+	}(e.wb, e.bytes, e.c, e.e.captureState(), e.noShare)
 
 	e.wb = bytesEncAppender{encInBytes(bs)[:0], bs}
 	e.bytes = true
 	e.c = 0
 	e.e.resetState()
+	e.noShare = true
 
 	// must call using fnNoExt
 	rv := baseRV(v)
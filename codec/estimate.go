@@ -0,0 +1,211 @@
+// Copyright (c) 2012-2020 Ugorji Nwoke. All rights reserved.
+// Use of this source code is governed by a MIT license found in the LICENSE file.
+
+package codec
+
+import (
+	"reflect"
+)
+
+const (
+	// estimateDefault is the estimate for a value whose size cannot be known without
+	// encoding it e.g. a chan, a func, or one with a custom encoding (Selfer, extension, etc).
+	estimateDefault = 16
+
+	// estimateMaxNodes bounds the number of values walked, so a value with many shared
+	// pointers (whose paths grow exponentially with its depth) still terminates quickly.
+	estimateMaxNodes = 1 << 16
+)
+
+// EstimateSize returns a cheap estimate of the number of bytes v encodes to with h,
+// to pre-size the output buffer and reduce its growth while encoding e.g.
+//
+//	b := make([]byte, 0, EstimateSize(h, v))
+//	err := NewEncoderBytes(&b, h).Encode(v)
+//
+// It walks v structurally (counting struct fields, lengths of strings, slices and maps)
+// without encoding it, and with fixed estimates for scalars. It is a heuristic, not exact:
+//   - a value with a custom encoding (Selfer, extension, Marshaler, etc) is estimated
+//     from its structure, which may differ from what it encodes to.
+//   - a chan, func or lazy value cannot be estimated, and counts a small default.
+//   - omitempty and other encode options are not considered.
+//   - a pointer to a value being walked (i.e. a cycle) counts a small default,
+//     and the walk stops after a bounded number of values.
+func EstimateSize(h Handle, v interface{}) int {
+	z := sizeEstimator{bh: h.getBasicHandle()}
+	if jh, ok := h.(*JsonHandle); ok {
+		z.js = true
+		if z.indent = int(jh.Indent); z.indent < 0 {
+			z.indent = -z.indent // tabs
+		}
+	}
+	return z.estimate(reflect.ValueOf(v), 0)
+}
+
+type sizeEstimator struct {
+	bh     *BasicHandle
+	js     bool
+	indent int // json indent per level (if any)
+	nodes  int // number of values walked
+
+	// ci holds the pointers being walked, to detect a cycle (see CheckCircularRef)
+	ci map[uintptr]struct{}
+}
+
+// str estimates a string (or []byte) of length n: a length prefix, or quotes in json.
+func (z *sizeEstimator) str(n int) int {
+	if z.js {
+		return n + 2
+	}
+	if n < 24 {
+		return n + 1
+	}
+	return n + 5
+}
+
+// scalar estimates the number of bytes for a scalar of the kind.
+func (z *sizeEstimator) scalar(k reflect.Kind) int {
+	switch k {
+	case reflect.Bool:
+		if z.js {
+			return 5
+		}
+		return 1
+	case reflect.Int8, reflect.Uint8:
+		return 2
+	case reflect.Int16, reflect.Uint16:
+		if z.js {
+			return 4
+		}
+		return 3
+	case reflect.Float32:
+		if z.js {
+			return 10
+		}
+		return 5
+	case reflect.Float64, reflect.Complex64, reflect.Complex128:
+		if z.js {
+			return 18
+		}
+		return 9
+	}
+	// other integers, which are typically small
+	if z.js {
+		return 5
+	}
+	return 3
+}
+
+func (z *sizeEstimator) estimate(rv reflect.Value, depth int) (n int) {
+	if z.nodes++; z.nodes > estimateMaxNodes {
+		return estimateDefault
+	}
+	depth++
+	switch rv.Kind() {
+	case reflect.Invalid:
+		return z.scalar(reflect.Bool) // nil or null
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return z.scalar(reflect.Bool)
+		}
+		p := rv.Pointer()
+		if _, ok := z.ci[p]; ok {
+			return estimateDefault
+		}
+		if z.ci == nil {
+			z.ci = make(map[uintptr]struct{})
+		}
+		z.ci[p] = struct{}{}
+		n = z.estimate(rv.Elem(), depth)
+		delete(z.ci, p)
+		return
+	case reflect.Interface:
+		if rv.IsNil() {
+			return z.scalar(reflect.Bool)
+		}
+		return z.estimate(rv.Elem(), depth)
+	case reflect.String:
+		return z.str(rv.Len())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return z.scalar(reflect.Bool)
+		}
+		l := rv.Len()
+		rtelem := rv.Type().Elem()
+		if rtelem.Kind() == reflect.Uint8 { // encoded as bytes
+			if z.js { // base64
+				return z.str((l + 2) / 3 * 4)
+			}
+			return z.str(l)
+		}
+		n = z.str(0)
+		if k := rtelem.Kind(); k <= reflect.Complex128 { // bool or number: no need to walk it
+			return n + l*(z.scalar(k)+z.sep(depth))
+		}
+		for j := 0; j < l; j++ {
+			n += z.estimate(rv.Index(j), depth) + z.sep(depth)
+		}
+		return
+	case reflect.Map:
+		if rv.IsNil() {
+			return z.scalar(reflect.Bool)
+		}
+		n = z.str(0)
+		rt := rv.Type()
+		rtkey, rtval := rt.Key(), rt.Elem()
+		if kk, vk := rtkey.Kind(), rtval.Kind(); kk <= reflect.Complex128 && vk <= reflect.Complex128 {
+			return n + rv.Len()*(z.scalar(kk)+z.scalar(vk)+z.sep(depth)+z.kv())
+		}
+		var it mapIter
+		mapRange(&it, rv, mapAddrLoopvarRV(rtkey, rtkey.Kind()), mapAddrLoopvarRV(rtval, rtval.Kind()), true)
+		for it.Next() {
+			n += z.estimate(it.Key(), depth) + z.estimate(it.Value(), depth) + z.sep(depth) + z.kv()
+		}
+		it.Done()
+		return
+	case reflect.Struct:
+		rt := rv.Type()
+		if rt == timeTyp {
+			if z.js {
+				return 32 // RFC3339 with nanoseconds
+			}
+			return 15
+		}
+		ti := z.bh.getTypeInfo(rt2id(rt), rt)
+		toArray := ti.toArray || z.bh.StructToArray
+		n = z.str(0)
+		for _, si := range ti.sfi.source() {
+			if !toArray {
+				n += z.str(len(si.encName)) + z.kv()
+			}
+			n += z.estimate(si.path.field(rv), depth) + z.sep(depth)
+		}
+		return
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return estimateDefault
+	}
+	return z.scalar(rv.Kind())
+}
+
+// sep estimates the separator written before an element (or key) at depth,
+// including a newline and the indentation if the json is indented.
+func (z *sizeEstimator) sep(depth int) int {
+	if !z.js {
+		return 0
+	}
+	if z.indent != 0 {
+		return 2 + z.indent*depth
+	}
+	return 1
+}
+
+// kv estimates the separator written between a key and its value.
+func (z *sizeEstimator) kv() int {
+	if !z.js {
+		return 0
+	}
+	if z.indent != 0 {
+		return 2
+	}
+	return 1
+}
@@ -637,23 +637,35 @@ func (e *Encoder) fastpathEncSliceIntfR(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 func (fastpathT) EncSliceIntfV(v []interface{}, e *Encoder) {
+	if len(v) == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	if e.kTruncates(len(v)) {
+		e.kSliceTruncated(reflect.ValueOf(v))
+		return
+	}
 	e.arrayStart(len(v))
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		e.arrayElem()
-		e.encode(v[j])
+		e.encodeIntf(v[j])
 	}
 	e.arrayEnd()
 }
 func (fastpathT) EncAsMapSliceIntfV(v []interface{}, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
 			e.mapElemValue()
 		}
-		e.encode(v[j])
+		e.encodeIntf(v[j])
 	}
 	e.mapEnd()
 }
@@ -671,8 +683,18 @@ func (e *Encoder) fastpathEncSliceStringR(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 func (fastpathT) EncSliceStringV(v []string, e *Encoder) {
+	if len(v) == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	if e.kTruncates(len(v)) {
+		e.kSliceTruncated(reflect.ValueOf(v))
+		return
+	}
 	e.arrayStart(len(v))
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		e.arrayElem()
 		e.e.EncodeString(v[j])
 	}
@@ -681,7 +703,9 @@ func (fastpathT) EncSliceStringV(v []string, e *Encoder) {
 func (fastpathT) EncAsMapSliceStringV(v []string, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
@@ -705,8 +729,18 @@ func (e *Encoder) fastpathEncSliceBytesR(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 func (fastpathT) EncSliceBytesV(v [][]byte, e *Encoder) {
+	if len(v) == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	if e.kTruncates(len(v)) {
+		e.kSliceTruncated(reflect.ValueOf(v))
+		return
+	}
 	e.arrayStart(len(v))
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		e.arrayElem()
 		e.e.EncodeStringBytesRaw(v[j])
 	}
@@ -715,7 +749,9 @@ func (fastpathT) EncSliceBytesV(v [][]byte, e *Encoder) {
 func (fastpathT) EncAsMapSliceBytesV(v [][]byte, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
@@ -739,8 +775,18 @@ func (e *Encoder) fastpathEncSliceFloat32R(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 func (fastpathT) EncSliceFloat32V(v []float32, e *Encoder) {
+	if len(v) == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	if e.kTruncates(len(v)) {
+		e.kSliceTruncated(reflect.ValueOf(v))
+		return
+	}
 	e.arrayStart(len(v))
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		e.arrayElem()
 		e.e.EncodeFloat32(v[j])
 	}
@@ -749,7 +795,9 @@ func (fastpathT) EncSliceFloat32V(v []float32, e *Encoder) {
 func (fastpathT) EncAsMapSliceFloat32V(v []float32, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
@@ -773,8 +821,18 @@ func (e *Encoder) fastpathEncSliceFloat64R(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 func (fastpathT) EncSliceFloat64V(v []float64, e *Encoder) {
+	if len(v) == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	if e.kTruncates(len(v)) {
+		e.kSliceTruncated(reflect.ValueOf(v))
+		return
+	}
 	e.arrayStart(len(v))
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		e.arrayElem()
 		e.e.EncodeFloat64(v[j])
 	}
@@ -783,7 +841,9 @@ func (fastpathT) EncSliceFloat64V(v []float64, e *Encoder) {
 func (fastpathT) EncAsMapSliceFloat64V(v []float64, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
@@ -812,7 +872,9 @@ func (fastpathT) EncSliceUint8V(v []uint8, e *Encoder) {
 func (fastpathT) EncAsMapSliceUint8V(v []uint8, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
@@ -836,8 +898,18 @@ func (e *Encoder) fastpathEncSliceUint64R(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 func (fastpathT) EncSliceUint64V(v []uint64, e *Encoder) {
+	if len(v) == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	if e.kTruncates(len(v)) {
+		e.kSliceTruncated(reflect.ValueOf(v))
+		return
+	}
 	e.arrayStart(len(v))
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		e.arrayElem()
 		e.e.EncodeUint(v[j])
 	}
@@ -846,7 +918,9 @@ func (fastpathT) EncSliceUint64V(v []uint64, e *Encoder) {
 func (fastpathT) EncAsMapSliceUint64V(v []uint64, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
@@ -870,8 +944,18 @@ func (e *Encoder) fastpathEncSliceIntR(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 func (fastpathT) EncSliceIntV(v []int, e *Encoder) {
+	if len(v) == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	if e.kTruncates(len(v)) {
+		e.kSliceTruncated(reflect.ValueOf(v))
+		return
+	}
 	e.arrayStart(len(v))
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		e.arrayElem()
 		e.e.EncodeInt(int64(v[j]))
 	}
@@ -880,7 +964,9 @@ func (fastpathT) EncSliceIntV(v []int, e *Encoder) {
 func (fastpathT) EncAsMapSliceIntV(v []int, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
@@ -904,8 +990,18 @@ func (e *Encoder) fastpathEncSliceInt32R(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 func (fastpathT) EncSliceInt32V(v []int32, e *Encoder) {
+	if len(v) == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	if e.kTruncates(len(v)) {
+		e.kSliceTruncated(reflect.ValueOf(v))
+		return
+	}
 	e.arrayStart(len(v))
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		e.arrayElem()
 		e.e.EncodeInt(int64(v[j]))
 	}
@@ -914,7 +1010,9 @@ func (fastpathT) EncSliceInt32V(v []int32, e *Encoder) {
 func (fastpathT) EncAsMapSliceInt32V(v []int32, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
@@ -938,8 +1036,18 @@ func (e *Encoder) fastpathEncSliceInt64R(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 func (fastpathT) EncSliceInt64V(v []int64, e *Encoder) {
+	if len(v) == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	if e.kTruncates(len(v)) {
+		e.kSliceTruncated(reflect.ValueOf(v))
+		return
+	}
 	e.arrayStart(len(v))
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		e.arrayElem()
 		e.e.EncodeInt(v[j])
 	}
@@ -948,7 +1056,9 @@ func (fastpathT) EncSliceInt64V(v []int64, e *Encoder) {
 func (fastpathT) EncAsMapSliceInt64V(v []int64, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
@@ -972,23 +1082,35 @@ func (e *Encoder) fastpathEncSliceBoolR(f *codecFnInfo, rv reflect.Value) {
 	}
 }
 func (fastpathT) EncSliceBoolV(v []bool, e *Encoder) {
+	if len(v) == 0 && e.emptyArrayAsNull() {
+		e.e.EncodeNil()
+		return
+	}
+	if e.kTruncates(len(v)) {
+		e.kSliceTruncated(reflect.ValueOf(v))
+		return
+	}
 	e.arrayStart(len(v))
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		e.arrayElem()
-		e.e.EncodeBool(v[j])
+		e.encodeBool(v[j])
 	}
 	e.arrayEnd()
 }
 func (fastpathT) EncAsMapSliceBoolV(v []bool, e *Encoder) {
 	e.haltOnMbsOddLen(len(v))
 	e.mapStart(len(v) >> 1) // e.mapStart(len(v) / 2)
-	for j := range v {
+	var j int
+	defer e.pathIndex(&j)
+	for j = range v {
 		if j&1 == 0 { // if j%2 == 0 {
 			e.mapElemKey()
 		} else {
 			e.mapElemValue()
 		}
-		e.e.EncodeBool(v[j])
+		e.encodeBool(v[j])
 	}
 	e.mapEnd()
 }
@@ -996,6 +1118,10 @@ func (e *Encoder) fastpathEncMapStringIntfR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapStringIntfV(rv2i(rv).(map[string]interface{}), e)
 }
 func (fastpathT) EncMapStringIntfV(v map[string]interface{}, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]string, len(v))
@@ -1004,19 +1130,24 @@ func (fastpathT) EncMapStringIntfV(v map[string]interface{}, e *Encoder) {
 			v2[i] = k
 			i++
 		}
-		sort.Sort(stringSlice(v2))
-		for _, k2 := range v2 {
+		e.kMapSortStrings(v2)
+		var k2 string
+		defer e.pathName(&k2)
+		for _, k2 = range v2 {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
-			e.encode(v[k2])
+			e.encodeIntf(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 string
+		var v2 interface{}
+		defer e.pathName(&k2)
+		for k2, v2 = range v {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
-			e.encode(v2)
+			e.encodeIntf(v2)
 		}
 	}
 	e.mapEnd()
@@ -1025,6 +1156,10 @@ func (e *Encoder) fastpathEncMapStringStringR(f *codecFnInfo, rv reflect.Value)
 	fastpathTV.EncMapStringStringV(rv2i(rv).(map[string]string), e)
 }
 func (fastpathT) EncMapStringStringV(v map[string]string, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]string, len(v))
@@ -1033,17 +1168,22 @@ func (fastpathT) EncMapStringStringV(v map[string]string, e *Encoder) {
 			v2[i] = k
 			i++
 		}
-		sort.Sort(stringSlice(v2))
-		for _, k2 := range v2 {
+		e.kMapSortStrings(v2)
+		var k2 string
+		defer e.pathName(&k2)
+		for _, k2 = range v2 {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeString(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 string
+		var v2 string
+		defer e.pathName(&k2)
+		for k2, v2 = range v {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeString(v2)
 		}
@@ -1054,6 +1194,10 @@ func (e *Encoder) fastpathEncMapStringBytesR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapStringBytesV(rv2i(rv).(map[string][]byte), e)
 }
 func (fastpathT) EncMapStringBytesV(v map[string][]byte, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]string, len(v))
@@ -1062,17 +1206,22 @@ func (fastpathT) EncMapStringBytesV(v map[string][]byte, e *Encoder) {
 			v2[i] = k
 			i++
 		}
-		sort.Sort(stringSlice(v2))
-		for _, k2 := range v2 {
+		e.kMapSortStrings(v2)
+		var k2 string
+		defer e.pathName(&k2)
+		for _, k2 = range v2 {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeStringBytesRaw(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 string
+		var v2 []byte
+		defer e.pathName(&k2)
+		for k2, v2 = range v {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeStringBytesRaw(v2)
 		}
@@ -1083,6 +1232,10 @@ func (e *Encoder) fastpathEncMapStringUint8R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapStringUint8V(rv2i(rv).(map[string]uint8), e)
 }
 func (fastpathT) EncMapStringUint8V(v map[string]uint8, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]string, len(v))
@@ -1091,17 +1244,22 @@ func (fastpathT) EncMapStringUint8V(v map[string]uint8, e *Encoder) {
 			v2[i] = k
 			i++
 		}
-		sort.Sort(stringSlice(v2))
-		for _, k2 := range v2 {
+		e.kMapSortStrings(v2)
+		var k2 string
+		defer e.pathName(&k2)
+		for _, k2 = range v2 {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeUint(uint64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 string
+		var v2 uint8
+		defer e.pathName(&k2)
+		for k2, v2 = range v {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeUint(uint64(v2))
 		}
@@ -1112,6 +1270,10 @@ func (e *Encoder) fastpathEncMapStringUint64R(f *codecFnInfo, rv reflect.Value)
 	fastpathTV.EncMapStringUint64V(rv2i(rv).(map[string]uint64), e)
 }
 func (fastpathT) EncMapStringUint64V(v map[string]uint64, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]string, len(v))
@@ -1120,17 +1282,22 @@ func (fastpathT) EncMapStringUint64V(v map[string]uint64, e *Encoder) {
 			v2[i] = k
 			i++
 		}
-		sort.Sort(stringSlice(v2))
-		for _, k2 := range v2 {
+		e.kMapSortStrings(v2)
+		var k2 string
+		defer e.pathName(&k2)
+		for _, k2 = range v2 {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeUint(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 string
+		var v2 uint64
+		defer e.pathName(&k2)
+		for k2, v2 = range v {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeUint(v2)
 		}
@@ -1141,6 +1308,10 @@ func (e *Encoder) fastpathEncMapStringIntR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapStringIntV(rv2i(rv).(map[string]int), e)
 }
 func (fastpathT) EncMapStringIntV(v map[string]int, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]string, len(v))
@@ -1149,17 +1320,22 @@ func (fastpathT) EncMapStringIntV(v map[string]int, e *Encoder) {
 			v2[i] = k
 			i++
 		}
-		sort.Sort(stringSlice(v2))
-		for _, k2 := range v2 {
+		e.kMapSortStrings(v2)
+		var k2 string
+		defer e.pathName(&k2)
+		for _, k2 = range v2 {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 string
+		var v2 int
+		defer e.pathName(&k2)
+		for k2, v2 = range v {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v2))
 		}
@@ -1170,6 +1346,10 @@ func (e *Encoder) fastpathEncMapStringInt32R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapStringInt32V(rv2i(rv).(map[string]int32), e)
 }
 func (fastpathT) EncMapStringInt32V(v map[string]int32, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]string, len(v))
@@ -1178,17 +1358,22 @@ func (fastpathT) EncMapStringInt32V(v map[string]int32, e *Encoder) {
 			v2[i] = k
 			i++
 		}
-		sort.Sort(stringSlice(v2))
-		for _, k2 := range v2 {
+		e.kMapSortStrings(v2)
+		var k2 string
+		defer e.pathName(&k2)
+		for _, k2 = range v2 {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 string
+		var v2 int32
+		defer e.pathName(&k2)
+		for k2, v2 = range v {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v2))
 		}
@@ -1199,6 +1384,10 @@ func (e *Encoder) fastpathEncMapStringFloat64R(f *codecFnInfo, rv reflect.Value)
 	fastpathTV.EncMapStringFloat64V(rv2i(rv).(map[string]float64), e)
 }
 func (fastpathT) EncMapStringFloat64V(v map[string]float64, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]string, len(v))
@@ -1207,17 +1396,22 @@ func (fastpathT) EncMapStringFloat64V(v map[string]float64, e *Encoder) {
 			v2[i] = k
 			i++
 		}
-		sort.Sort(stringSlice(v2))
-		for _, k2 := range v2 {
+		e.kMapSortStrings(v2)
+		var k2 string
+		defer e.pathName(&k2)
+		for _, k2 = range v2 {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeFloat64(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 string
+		var v2 float64
+		defer e.pathName(&k2)
+		for k2, v2 = range v {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
 			e.e.EncodeFloat64(v2)
 		}
@@ -1228,6 +1422,10 @@ func (e *Encoder) fastpathEncMapStringBoolR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapStringBoolV(rv2i(rv).(map[string]bool), e)
 }
 func (fastpathT) EncMapStringBoolV(v map[string]bool, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) || e.h.BoolSetAsArray {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]string, len(v))
@@ -1236,19 +1434,24 @@ func (fastpathT) EncMapStringBoolV(v map[string]bool, e *Encoder) {
 			v2[i] = k
 			i++
 		}
-		sort.Sort(stringSlice(v2))
-		for _, k2 := range v2 {
+		e.kMapSortStrings(v2)
+		var k2 string
+		defer e.pathName(&k2)
+		for _, k2 = range v2 {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
-			e.e.EncodeBool(v[k2])
+			e.encodeBool(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 string
+		var v2 bool
+		defer e.pathName(&k2)
+		for k2, v2 = range v {
 			e.mapElemKey()
-			e.e.EncodeString(k2)
+			e.kMapKeyString(k2)
 			e.mapElemValue()
-			e.e.EncodeBool(v2)
+			e.encodeBool(v2)
 		}
 	}
 	e.mapEnd()
@@ -1257,6 +1460,10 @@ func (e *Encoder) fastpathEncMapUint8IntfR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint8IntfV(rv2i(rv).(map[uint8]interface{}), e)
 }
 func (fastpathT) EncMapUint8IntfV(v map[uint8]interface{}, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint8, len(v))
@@ -1266,18 +1473,31 @@ func (fastpathT) EncMapUint8IntfV(v map[uint8]interface{}, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint8Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
-			e.encode(v[k2])
+			e.encodeIntf(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint8
+		var v2 interface{}
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
-			e.encode(v2)
+			e.encodeIntf(v2)
 		}
 	}
 	e.mapEnd()
@@ -1286,6 +1506,10 @@ func (e *Encoder) fastpathEncMapUint8StringR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint8StringV(rv2i(rv).(map[uint8]string), e)
 }
 func (fastpathT) EncMapUint8StringV(v map[uint8]string, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint8, len(v))
@@ -1295,14 +1519,27 @@ func (fastpathT) EncMapUint8StringV(v map[uint8]string, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint8Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
 			e.e.EncodeString(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint8
+		var v2 string
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
@@ -1315,6 +1552,10 @@ func (e *Encoder) fastpathEncMapUint8BytesR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint8BytesV(rv2i(rv).(map[uint8][]byte), e)
 }
 func (fastpathT) EncMapUint8BytesV(v map[uint8][]byte, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint8, len(v))
@@ -1324,14 +1565,27 @@ func (fastpathT) EncMapUint8BytesV(v map[uint8][]byte, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint8Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
 			e.e.EncodeStringBytesRaw(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint8
+		var v2 []byte
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
@@ -1344,6 +1598,10 @@ func (e *Encoder) fastpathEncMapUint8Uint8R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint8Uint8V(rv2i(rv).(map[uint8]uint8), e)
 }
 func (fastpathT) EncMapUint8Uint8V(v map[uint8]uint8, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint8, len(v))
@@ -1353,14 +1611,27 @@ func (fastpathT) EncMapUint8Uint8V(v map[uint8]uint8, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint8Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
 			e.e.EncodeUint(uint64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint8
+		var v2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
@@ -1373,6 +1644,10 @@ func (e *Encoder) fastpathEncMapUint8Uint64R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint8Uint64V(rv2i(rv).(map[uint8]uint64), e)
 }
 func (fastpathT) EncMapUint8Uint64V(v map[uint8]uint64, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint8, len(v))
@@ -1382,14 +1657,27 @@ func (fastpathT) EncMapUint8Uint64V(v map[uint8]uint64, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint8Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
 			e.e.EncodeUint(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint8
+		var v2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
@@ -1402,6 +1690,10 @@ func (e *Encoder) fastpathEncMapUint8IntR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint8IntV(rv2i(rv).(map[uint8]int), e)
 }
 func (fastpathT) EncMapUint8IntV(v map[uint8]int, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint8, len(v))
@@ -1411,14 +1703,27 @@ func (fastpathT) EncMapUint8IntV(v map[uint8]int, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint8Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint8
+		var v2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
@@ -1431,6 +1736,10 @@ func (e *Encoder) fastpathEncMapUint8Int32R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint8Int32V(rv2i(rv).(map[uint8]int32), e)
 }
 func (fastpathT) EncMapUint8Int32V(v map[uint8]int32, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint8, len(v))
@@ -1440,14 +1749,27 @@ func (fastpathT) EncMapUint8Int32V(v map[uint8]int32, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint8Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint8
+		var v2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
@@ -1460,6 +1782,10 @@ func (e *Encoder) fastpathEncMapUint8Float64R(f *codecFnInfo, rv reflect.Value)
 	fastpathTV.EncMapUint8Float64V(rv2i(rv).(map[uint8]float64), e)
 }
 func (fastpathT) EncMapUint8Float64V(v map[uint8]float64, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint8, len(v))
@@ -1469,14 +1795,27 @@ func (fastpathT) EncMapUint8Float64V(v map[uint8]float64, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint8Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
 			e.e.EncodeFloat64(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint8
+		var v2 float64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
@@ -1489,6 +1828,10 @@ func (e *Encoder) fastpathEncMapUint8BoolR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint8BoolV(rv2i(rv).(map[uint8]bool), e)
 }
 func (fastpathT) EncMapUint8BoolV(v map[uint8]bool, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) || e.h.BoolSetAsArray {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint8, len(v))
@@ -1498,18 +1841,31 @@ func (fastpathT) EncMapUint8BoolV(v map[uint8]bool, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint8Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
-			e.e.EncodeBool(v[k2])
+			e.encodeBool(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint8
+		var v2 bool
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(uint64(k2))
 			e.mapElemValue()
-			e.e.EncodeBool(v2)
+			e.encodeBool(v2)
 		}
 	}
 	e.mapEnd()
@@ -1518,6 +1874,10 @@ func (e *Encoder) fastpathEncMapUint64IntfR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint64IntfV(rv2i(rv).(map[uint64]interface{}), e)
 }
 func (fastpathT) EncMapUint64IntfV(v map[uint64]interface{}, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint64, len(v))
@@ -1527,18 +1887,31 @@ func (fastpathT) EncMapUint64IntfV(v map[uint64]interface{}, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint64Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
-			e.encode(v[k2])
+			e.encodeIntf(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint64
+		var v2 interface{}
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
-			e.encode(v2)
+			e.encodeIntf(v2)
 		}
 	}
 	e.mapEnd()
@@ -1547,6 +1920,10 @@ func (e *Encoder) fastpathEncMapUint64StringR(f *codecFnInfo, rv reflect.Value)
 	fastpathTV.EncMapUint64StringV(rv2i(rv).(map[uint64]string), e)
 }
 func (fastpathT) EncMapUint64StringV(v map[uint64]string, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint64, len(v))
@@ -1556,14 +1933,27 @@ func (fastpathT) EncMapUint64StringV(v map[uint64]string, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint64Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
 			e.e.EncodeString(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint64
+		var v2 string
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
@@ -1576,6 +1966,10 @@ func (e *Encoder) fastpathEncMapUint64BytesR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint64BytesV(rv2i(rv).(map[uint64][]byte), e)
 }
 func (fastpathT) EncMapUint64BytesV(v map[uint64][]byte, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint64, len(v))
@@ -1585,14 +1979,27 @@ func (fastpathT) EncMapUint64BytesV(v map[uint64][]byte, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint64Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
 			e.e.EncodeStringBytesRaw(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint64
+		var v2 []byte
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
@@ -1605,6 +2012,10 @@ func (e *Encoder) fastpathEncMapUint64Uint8R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint64Uint8V(rv2i(rv).(map[uint64]uint8), e)
 }
 func (fastpathT) EncMapUint64Uint8V(v map[uint64]uint8, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint64, len(v))
@@ -1614,14 +2025,27 @@ func (fastpathT) EncMapUint64Uint8V(v map[uint64]uint8, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint64Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
 			e.e.EncodeUint(uint64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint64
+		var v2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
@@ -1634,6 +2058,10 @@ func (e *Encoder) fastpathEncMapUint64Uint64R(f *codecFnInfo, rv reflect.Value)
 	fastpathTV.EncMapUint64Uint64V(rv2i(rv).(map[uint64]uint64), e)
 }
 func (fastpathT) EncMapUint64Uint64V(v map[uint64]uint64, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint64, len(v))
@@ -1643,14 +2071,27 @@ func (fastpathT) EncMapUint64Uint64V(v map[uint64]uint64, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint64Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
 			e.e.EncodeUint(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint64
+		var v2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
@@ -1663,6 +2104,10 @@ func (e *Encoder) fastpathEncMapUint64IntR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint64IntV(rv2i(rv).(map[uint64]int), e)
 }
 func (fastpathT) EncMapUint64IntV(v map[uint64]int, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint64, len(v))
@@ -1672,14 +2117,27 @@ func (fastpathT) EncMapUint64IntV(v map[uint64]int, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint64Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint64
+		var v2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
@@ -1692,6 +2150,10 @@ func (e *Encoder) fastpathEncMapUint64Int32R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint64Int32V(rv2i(rv).(map[uint64]int32), e)
 }
 func (fastpathT) EncMapUint64Int32V(v map[uint64]int32, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint64, len(v))
@@ -1701,14 +2163,27 @@ func (fastpathT) EncMapUint64Int32V(v map[uint64]int32, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint64Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint64
+		var v2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
@@ -1721,6 +2196,10 @@ func (e *Encoder) fastpathEncMapUint64Float64R(f *codecFnInfo, rv reflect.Value)
 	fastpathTV.EncMapUint64Float64V(rv2i(rv).(map[uint64]float64), e)
 }
 func (fastpathT) EncMapUint64Float64V(v map[uint64]float64, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint64, len(v))
@@ -1730,14 +2209,27 @@ func (fastpathT) EncMapUint64Float64V(v map[uint64]float64, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint64Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
 			e.e.EncodeFloat64(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint64
+		var v2 float64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
@@ -1750,6 +2242,10 @@ func (e *Encoder) fastpathEncMapUint64BoolR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapUint64BoolV(rv2i(rv).(map[uint64]bool), e)
 }
 func (fastpathT) EncMapUint64BoolV(v map[uint64]bool, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) || e.h.BoolSetAsArray {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]uint64, len(v))
@@ -1759,18 +2255,31 @@ func (fastpathT) EncMapUint64BoolV(v map[uint64]bool, e *Encoder) {
 			i++
 		}
 		sort.Sort(uint64Slice(v2))
-		for _, k2 := range v2 {
+		var k2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
-			e.e.EncodeBool(v[k2])
+			e.encodeBool(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 uint64
+		var v2 bool
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeUint(k2)
 			e.mapElemValue()
-			e.e.EncodeBool(v2)
+			e.encodeBool(v2)
 		}
 	}
 	e.mapEnd()
@@ -1779,6 +2288,10 @@ func (e *Encoder) fastpathEncMapIntIntfR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapIntIntfV(rv2i(rv).(map[int]interface{}), e)
 }
 func (fastpathT) EncMapIntIntfV(v map[int]interface{}, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int, len(v))
@@ -1788,18 +2301,31 @@ func (fastpathT) EncMapIntIntfV(v map[int]interface{}, e *Encoder) {
 			i++
 		}
 		sort.Sort(intSlice(v2))
-		for _, k2 := range v2 {
+		var k2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
-			e.encode(v[k2])
+			e.encodeIntf(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int
+		var v2 interface{}
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
-			e.encode(v2)
+			e.encodeIntf(v2)
 		}
 	}
 	e.mapEnd()
@@ -1808,6 +2334,10 @@ func (e *Encoder) fastpathEncMapIntStringR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapIntStringV(rv2i(rv).(map[int]string), e)
 }
 func (fastpathT) EncMapIntStringV(v map[int]string, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int, len(v))
@@ -1817,14 +2347,27 @@ func (fastpathT) EncMapIntStringV(v map[int]string, e *Encoder) {
 			i++
 		}
 		sort.Sort(intSlice(v2))
-		for _, k2 := range v2 {
+		var k2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeString(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int
+		var v2 string
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -1837,6 +2380,10 @@ func (e *Encoder) fastpathEncMapIntBytesR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapIntBytesV(rv2i(rv).(map[int][]byte), e)
 }
 func (fastpathT) EncMapIntBytesV(v map[int][]byte, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int, len(v))
@@ -1846,14 +2393,27 @@ func (fastpathT) EncMapIntBytesV(v map[int][]byte, e *Encoder) {
 			i++
 		}
 		sort.Sort(intSlice(v2))
-		for _, k2 := range v2 {
+		var k2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeStringBytesRaw(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int
+		var v2 []byte
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -1866,6 +2426,10 @@ func (e *Encoder) fastpathEncMapIntUint8R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapIntUint8V(rv2i(rv).(map[int]uint8), e)
 }
 func (fastpathT) EncMapIntUint8V(v map[int]uint8, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int, len(v))
@@ -1875,14 +2439,27 @@ func (fastpathT) EncMapIntUint8V(v map[int]uint8, e *Encoder) {
 			i++
 		}
 		sort.Sort(intSlice(v2))
-		for _, k2 := range v2 {
+		var k2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeUint(uint64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int
+		var v2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -1895,6 +2472,10 @@ func (e *Encoder) fastpathEncMapIntUint64R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapIntUint64V(rv2i(rv).(map[int]uint64), e)
 }
 func (fastpathT) EncMapIntUint64V(v map[int]uint64, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int, len(v))
@@ -1904,14 +2485,27 @@ func (fastpathT) EncMapIntUint64V(v map[int]uint64, e *Encoder) {
 			i++
 		}
 		sort.Sort(intSlice(v2))
-		for _, k2 := range v2 {
+		var k2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeUint(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int
+		var v2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -1924,6 +2518,10 @@ func (e *Encoder) fastpathEncMapIntIntR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapIntIntV(rv2i(rv).(map[int]int), e)
 }
 func (fastpathT) EncMapIntIntV(v map[int]int, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int, len(v))
@@ -1933,14 +2531,27 @@ func (fastpathT) EncMapIntIntV(v map[int]int, e *Encoder) {
 			i++
 		}
 		sort.Sort(intSlice(v2))
-		for _, k2 := range v2 {
+		var k2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int
+		var v2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -1953,6 +2564,10 @@ func (e *Encoder) fastpathEncMapIntInt32R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapIntInt32V(rv2i(rv).(map[int]int32), e)
 }
 func (fastpathT) EncMapIntInt32V(v map[int]int32, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int, len(v))
@@ -1962,14 +2577,27 @@ func (fastpathT) EncMapIntInt32V(v map[int]int32, e *Encoder) {
 			i++
 		}
 		sort.Sort(intSlice(v2))
-		for _, k2 := range v2 {
+		var k2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int
+		var v2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -1982,6 +2610,10 @@ func (e *Encoder) fastpathEncMapIntFloat64R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapIntFloat64V(rv2i(rv).(map[int]float64), e)
 }
 func (fastpathT) EncMapIntFloat64V(v map[int]float64, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int, len(v))
@@ -1991,14 +2623,27 @@ func (fastpathT) EncMapIntFloat64V(v map[int]float64, e *Encoder) {
 			i++
 		}
 		sort.Sort(intSlice(v2))
-		for _, k2 := range v2 {
+		var k2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeFloat64(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int
+		var v2 float64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -2011,6 +2656,10 @@ func (e *Encoder) fastpathEncMapIntBoolR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapIntBoolV(rv2i(rv).(map[int]bool), e)
 }
 func (fastpathT) EncMapIntBoolV(v map[int]bool, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) || e.h.BoolSetAsArray {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int, len(v))
@@ -2020,18 +2669,31 @@ func (fastpathT) EncMapIntBoolV(v map[int]bool, e *Encoder) {
 			i++
 		}
 		sort.Sort(intSlice(v2))
-		for _, k2 := range v2 {
+		var k2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
-			e.e.EncodeBool(v[k2])
+			e.encodeBool(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int
+		var v2 bool
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
-			e.e.EncodeBool(v2)
+			e.encodeBool(v2)
 		}
 	}
 	e.mapEnd()
@@ -2040,6 +2702,10 @@ func (e *Encoder) fastpathEncMapInt32IntfR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapInt32IntfV(rv2i(rv).(map[int32]interface{}), e)
 }
 func (fastpathT) EncMapInt32IntfV(v map[int32]interface{}, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int32, len(v))
@@ -2049,18 +2715,31 @@ func (fastpathT) EncMapInt32IntfV(v map[int32]interface{}, e *Encoder) {
 			i++
 		}
 		sort.Sort(int32Slice(v2))
-		for _, k2 := range v2 {
+		var k2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
-			e.encode(v[k2])
+			e.encodeIntf(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int32
+		var v2 interface{}
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
-			e.encode(v2)
+			e.encodeIntf(v2)
 		}
 	}
 	e.mapEnd()
@@ -2069,6 +2748,10 @@ func (e *Encoder) fastpathEncMapInt32StringR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapInt32StringV(rv2i(rv).(map[int32]string), e)
 }
 func (fastpathT) EncMapInt32StringV(v map[int32]string, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int32, len(v))
@@ -2078,14 +2761,27 @@ func (fastpathT) EncMapInt32StringV(v map[int32]string, e *Encoder) {
 			i++
 		}
 		sort.Sort(int32Slice(v2))
-		for _, k2 := range v2 {
+		var k2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeString(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int32
+		var v2 string
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -2098,6 +2794,10 @@ func (e *Encoder) fastpathEncMapInt32BytesR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapInt32BytesV(rv2i(rv).(map[int32][]byte), e)
 }
 func (fastpathT) EncMapInt32BytesV(v map[int32][]byte, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int32, len(v))
@@ -2107,14 +2807,27 @@ func (fastpathT) EncMapInt32BytesV(v map[int32][]byte, e *Encoder) {
 			i++
 		}
 		sort.Sort(int32Slice(v2))
-		for _, k2 := range v2 {
+		var k2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeStringBytesRaw(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int32
+		var v2 []byte
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -2127,6 +2840,10 @@ func (e *Encoder) fastpathEncMapInt32Uint8R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapInt32Uint8V(rv2i(rv).(map[int32]uint8), e)
 }
 func (fastpathT) EncMapInt32Uint8V(v map[int32]uint8, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int32, len(v))
@@ -2136,14 +2853,27 @@ func (fastpathT) EncMapInt32Uint8V(v map[int32]uint8, e *Encoder) {
 			i++
 		}
 		sort.Sort(int32Slice(v2))
-		for _, k2 := range v2 {
+		var k2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeUint(uint64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int32
+		var v2 uint8
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -2156,6 +2886,10 @@ func (e *Encoder) fastpathEncMapInt32Uint64R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapInt32Uint64V(rv2i(rv).(map[int32]uint64), e)
 }
 func (fastpathT) EncMapInt32Uint64V(v map[int32]uint64, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int32, len(v))
@@ -2165,14 +2899,27 @@ func (fastpathT) EncMapInt32Uint64V(v map[int32]uint64, e *Encoder) {
 			i++
 		}
 		sort.Sort(int32Slice(v2))
-		for _, k2 := range v2 {
+		var k2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeUint(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int32
+		var v2 uint64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -2185,6 +2932,10 @@ func (e *Encoder) fastpathEncMapInt32IntR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapInt32IntV(rv2i(rv).(map[int32]int), e)
 }
 func (fastpathT) EncMapInt32IntV(v map[int32]int, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int32, len(v))
@@ -2194,14 +2945,27 @@ func (fastpathT) EncMapInt32IntV(v map[int32]int, e *Encoder) {
 			i++
 		}
 		sort.Sort(int32Slice(v2))
-		for _, k2 := range v2 {
+		var k2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int32
+		var v2 int
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -2214,6 +2978,10 @@ func (e *Encoder) fastpathEncMapInt32Int32R(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapInt32Int32V(rv2i(rv).(map[int32]int32), e)
 }
 func (fastpathT) EncMapInt32Int32V(v map[int32]int32, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int32, len(v))
@@ -2223,14 +2991,27 @@ func (fastpathT) EncMapInt32Int32V(v map[int32]int32, e *Encoder) {
 			i++
 		}
 		sort.Sort(int32Slice(v2))
-		for _, k2 := range v2 {
+		var k2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeInt(int64(v[k2]))
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int32
+		var v2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -2243,6 +3024,10 @@ func (e *Encoder) fastpathEncMapInt32Float64R(f *codecFnInfo, rv reflect.Value)
 	fastpathTV.EncMapInt32Float64V(rv2i(rv).(map[int32]float64), e)
 }
 func (fastpathT) EncMapInt32Float64V(v map[int32]float64, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int32, len(v))
@@ -2252,14 +3037,27 @@ func (fastpathT) EncMapInt32Float64V(v map[int32]float64, e *Encoder) {
 			i++
 		}
 		sort.Sort(int32Slice(v2))
-		for _, k2 := range v2 {
+		var k2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
 			e.e.EncodeFloat64(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int32
+		var v2 float64
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
@@ -2272,6 +3070,10 @@ func (e *Encoder) fastpathEncMapInt32BoolR(f *codecFnInfo, rv reflect.Value) {
 	fastpathTV.EncMapInt32BoolV(rv2i(rv).(map[int32]bool), e)
 }
 func (fastpathT) EncMapInt32BoolV(v map[int32]bool, e *Encoder) {
+	if e.h.MapKeyFilter != nil || e.h.SkipMapValueKinds != nil || e.h.KeyHandle != nil || e.kTruncates(len(v)) || e.h.BoolSetAsArray {
+		e.kMapFiltered(reflect.ValueOf(v))
+		return
+	}
 	e.mapStart(len(v))
 	if e.h.Canonical {
 		v2 := make([]int32, len(v))
@@ -2281,18 +3083,31 @@ func (fastpathT) EncMapInt32BoolV(v map[int32]bool, e *Encoder) {
 			i++
 		}
 		sort.Sort(int32Slice(v2))
-		for _, k2 := range v2 {
+		var k2 int32
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for _, k2 = range v2 {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
-			e.e.EncodeBool(v[k2])
+			e.encodeBool(v[k2])
 		}
 	} else {
-		for k2, v2 := range v {
+		var k2 int32
+		var v2 bool
+		defer func() {
+			if x := recover(); x != nil {
+				e.pathUnwind(x, k2)
+			}
+		}()
+		for k2, v2 = range v {
 			e.mapElemKey()
 			e.e.EncodeInt(int64(k2))
 			e.mapElemValue()
-			e.e.EncodeBool(v2)
+			e.encodeBool(v2)
 		}
 	}
 	e.mapEnd()
@@ -4111,6 +4926,9 @@ func (fastpathT) DecMapStringIntfL(v map[string]interface{}, containerLen int, d
 	for j := 0; (hasLen && j < containerLen) || !(hasLen || d.checkBreak()); j++ {
 		d.mapElemKey()
 		mk = d.stringZC(d.d.DecodeStringAsBytes())
+		if d.h.keyDictInv != nil {
+			mk = d.kKeyDict(mk)
+		}
 		d.mapElemValue()
 		if mapGet {
 			mv = v[mk]
@@ -4161,6 +4979,9 @@ func (fastpathT) DecMapStringStringL(v map[string]string, containerLen int, d *D
 	for j := 0; (hasLen && j < containerLen) || !(hasLen || d.checkBreak()); j++ {
 		d.mapElemKey()
 		mk = d.stringZC(d.d.DecodeStringAsBytes())
+		if d.h.keyDictInv != nil {
+			mk = d.kKeyDict(mk)
+		}
 		d.mapElemValue()
 		mv = d.stringZC(d.d.DecodeStringAsBytes())
 		v[mk] = mv
@@ -4207,6 +5028,9 @@ func (fastpathT) DecMapStringBytesL(v map[string][]byte, containerLen int, d *De
 	for j := 0; (hasLen && j < containerLen) || !(hasLen || d.checkBreak()); j++ {
 		d.mapElemKey()
 		mk = d.stringZC(d.d.DecodeStringAsBytes())
+		if d.h.keyDictInv != nil {
+			mk = d.kKeyDict(mk)
+		}
 		d.mapElemValue()
 		if mapGet {
 			mv = v[mk]
@@ -4257,6 +5081,9 @@ func (fastpathT) DecMapStringUint8L(v map[string]uint8, containerLen int, d *Dec
 	for j := 0; (hasLen && j < containerLen) || !(hasLen || d.checkBreak()); j++ {
 		d.mapElemKey()
 		mk = d.stringZC(d.d.DecodeStringAsBytes())
+		if d.h.keyDictInv != nil {
+			mk = d.kKeyDict(mk)
+		}
 		d.mapElemValue()
 		mv = uint8(chkOvf.UintV(d.d.DecodeUint64(), 8))
 		v[mk] = mv
@@ -4302,6 +5129,9 @@ func (fastpathT) DecMapStringUint64L(v map[string]uint64, containerLen int, d *D
 	for j := 0; (hasLen && j < containerLen) || !(hasLen || d.checkBreak()); j++ {
 		d.mapElemKey()
 		mk = d.stringZC(d.d.DecodeStringAsBytes())
+		if d.h.keyDictInv != nil {
+			mk = d.kKeyDict(mk)
+		}
 		d.mapElemValue()
 		mv = d.d.DecodeUint64()
 		v[mk] = mv
@@ -4347,6 +5177,9 @@ func (fastpathT) DecMapStringIntL(v map[string]int, containerLen int, d *Decoder
 	for j := 0; (hasLen && j < containerLen) || !(hasLen || d.checkBreak()); j++ {
 		d.mapElemKey()
 		mk = d.stringZC(d.d.DecodeStringAsBytes())
+		if d.h.keyDictInv != nil {
+			mk = d.kKeyDict(mk)
+		}
 		d.mapElemValue()
 		mv = int(chkOvf.IntV(d.d.DecodeInt64(), intBitsize))
 		v[mk] = mv
@@ -4392,6 +5225,9 @@ func (fastpathT) DecMapStringInt32L(v map[string]int32, containerLen int, d *Dec
 	for j := 0; (hasLen && j < containerLen) || !(hasLen || d.checkBreak()); j++ {
 		d.mapElemKey()
 		mk = d.stringZC(d.d.DecodeStringAsBytes())
+		if d.h.keyDictInv != nil {
+			mk = d.kKeyDict(mk)
+		}
 		d.mapElemValue()
 		mv = int32(chkOvf.IntV(d.d.DecodeInt64(), 32))
 		v[mk] = mv
@@ -4437,6 +5273,9 @@ func (fastpathT) DecMapStringFloat64L(v map[string]float64, containerLen int, d
 	for j := 0; (hasLen && j < containerLen) || !(hasLen || d.checkBreak()); j++ {
 		d.mapElemKey()
 		mk = d.stringZC(d.d.DecodeStringAsBytes())
+		if d.h.keyDictInv != nil {
+			mk = d.kKeyDict(mk)
+		}
 		d.mapElemValue()
 		mv = d.d.DecodeFloat64()
 		v[mk] = mv
@@ -4482,6 +5321,9 @@ func (fastpathT) DecMapStringBoolL(v map[string]bool, containerLen int, d *Decod
 	for j := 0; (hasLen && j < containerLen) || !(hasLen || d.checkBreak()); j++ {
 		d.mapElemKey()
 		mk = d.stringZC(d.d.DecodeStringAsBytes())
+		if d.h.keyDictInv != nil {
+			mk = d.kKeyDict(mk)
+		}
 		d.mapElemValue()
 		mv = d.d.DecodeBool()
 		v[mk] = mv
@@ -2340,9 +2340,11 @@ func genInternalEncCommandAsString(s string, vname string) string {
 	case "float64":
 		return "e.e.EncodeFloat64(" + vname + ")"
 	case "bool":
-		return "e.e.EncodeBool(" + vname + ")"
+		return "e.encodeBool(" + vname + ")"
 	// case "symbol":
 	// 	return "e.e.EncodeSymbol(" + vname + ")"
+	case "interface{}", "interface {}":
+		return "e.encodeIntf(" + vname + ")"
 	default:
 		return "e.encode(" + vname + ")"
 	}
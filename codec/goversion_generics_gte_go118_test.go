@@ -0,0 +1,125 @@
+// Copyright (c) 2012-2020 Ugorji Nwoke. All rights reserved.
+// Use of this source code is governed by a MIT license found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package codec
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Generic types are instantiated into distinct types (each with its own typeInfo),
+// and so must encode exactly like their monomorphized equivalents.
+
+type testGenericBox[T any] struct {
+	V  T
+	Vs []T `codec:"vs,omitempty"`
+	P  *T
+	M  map[string]T
+}
+
+type testGenericList[T any] []T
+
+type testGenericInner[T any] struct {
+	I T
+}
+
+type testGenericOuter[T any] struct {
+	testGenericInner[T]
+	Box testGenericBox[T]
+	L   testGenericList[T]
+}
+
+type testGenericBoxInt struct {
+	V  int
+	Vs []int `codec:"vs,omitempty"`
+	P  *int
+	M  map[string]int
+}
+
+type testGenericBoxString struct {
+	V  string
+	Vs []string `codec:"vs,omitempty"`
+	P  *string
+	M  map[string]string
+}
+
+type testGenericInnerInt struct {
+	I int
+}
+
+type testGenericOuterInt struct {
+	testGenericInnerInt
+	Box testGenericBoxInt
+	L   []int
+}
+
+func doTestGenericInstantiations(t *testing.T, h Handle) {
+	defer testSetup(t, &h)()
+	name := h.Name()
+	bh := testBasicHandle(h)
+	defer func(canonical bool) { bh.Canonical = canonical }(bh.Canonical)
+	bh.Canonical = true // maps are compared by their encoded bytes
+
+	n, s := 3, "c"
+	vi := testGenericBox[int]{V: 1, Vs: []int{2}, P: &n, M: map[string]int{"a": 1, "b": 2}}
+	vim := testGenericBoxInt{V: 1, Vs: []int{2}, P: &n, M: map[string]int{"a": 1, "b": 2}}
+	vs := testGenericBox[string]{V: "a", Vs: []string{"b"}, P: &s, M: map[string]string{"a": "x"}}
+	vsm := testGenericBoxString{V: "a", Vs: []string{"b"}, P: &s, M: map[string]string{"a": "x"}}
+	vo := testGenericOuter[int]{testGenericInner[int]{7}, vi, testGenericList[int]{8, 9}}
+	vom := testGenericOuterInt{testGenericInnerInt{7}, vim, []int{8, 9}}
+
+	for _, iterative := range []bool{false, true} {
+		bh.Iterative = iterative
+		testDeepEqualErr(testMarshalErr(vi, h, t, name+"-generic-int"),
+			testMarshalErr(vim, h, t, name+"-generic-int"), t, name+"-generic-int")
+		testDeepEqualErr(testMarshalErr(vs, h, t, name+"-generic-string"),
+			testMarshalErr(vsm, h, t, name+"-generic-string"), t, name+"-generic-string")
+		testDeepEqualErr(testMarshalErr(vo, h, t, name+"-generic-outer"),
+			testMarshalErr(vom, h, t, name+"-generic-outer"), t, name+"-generic-outer")
+		testDeepEqualErr(testMarshalErr(testGenericList[string]{"a", "b"}, h, t, name+"-generic-list"),
+			testMarshalErr([]string{"a", "b"}, h, t, name+"-generic-list"), t, name+"-generic-list")
+		// the zero values, where omitempty and nil pointers apply
+		testDeepEqualErr(testMarshalErr(testGenericBox[int]{}, h, t, name+"-generic-zero"),
+			testMarshalErr(testGenericBoxInt{}, h, t, name+"-generic-zero"), t, name+"-generic-zero")
+	}
+
+	var vi2 testGenericBox[int]
+	testUnmarshalErr(&vi2, testMarshalErr(vi, h, t, name+"-generic-int"), h, t, name+"-generic-int")
+	testDeepEqualErr(vi2, vi, t, name+"-generic-int")
+	var vs2 testGenericBox[string]
+	testUnmarshalErr(&vs2, testMarshalErr(vs, h, t, name+"-generic-string"), h, t, name+"-generic-string")
+	testDeepEqualErr(vs2, vs, t, name+"-generic-string")
+	var vo2 testGenericOuter[int]
+	testUnmarshalErr(&vo2, testMarshalErr(vo, h, t, name+"-generic-outer"), h, t, name+"-generic-outer")
+	testDeepEqualErr(vo2, vo, t, name+"-generic-outer")
+
+	// each instantiation has its own type info
+	testDeepEqualErr(bh.getTypeInfo(rt2id(reflect.TypeOf(vi)), reflect.TypeOf(vi)).sfi.source()[0].path.typ,
+		reflect.TypeOf(0), t, name+"-generic-typeinfo")
+	testDeepEqualErr(bh.getTypeInfo(rt2id(reflect.TypeOf(vs)), reflect.TypeOf(vs)).sfi.source()[0].path.typ,
+		reflect.TypeOf(""), t, name+"-generic-typeinfo")
+}
+
+func TestJsonGenericInstantiations(t *testing.T) {
+	doTestGenericInstantiations(t, testJsonH)
+}
+
+func TestCborGenericInstantiations(t *testing.T) {
+	doTestGenericInstantiations(t, testCborH)
+}
+
+func TestMsgpackGenericInstantiations(t *testing.T) {
+	doTestGenericInstantiations(t, testMsgpackH)
+}
+
+func TestBincGenericInstantiations(t *testing.T) {
+	doTestGenericInstantiations(t, testBincH)
+}
+
+func TestSimpleGenericInstantiations(t *testing.T) {
+	doTestGenericInstantiations(t, testSimpleH)
+}
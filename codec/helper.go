@@ -197,6 +197,7 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"math/big"
 	"reflect"
 	"runtime"
 	"sort"
@@ -598,6 +599,16 @@ type jsonUnmarshaler interface {
 	UnmarshalJSON([]byte) error
 }
 
+// mirror encoding.BinaryAppender and encoding.TextAppender (go 1.24) here,
+// so they are detected regardless of the go version.
+
+type binaryAppender interface {
+	AppendBinary(b []byte) ([]byte, error)
+}
+type textAppender interface {
+	AppendText(b []byte) ([]byte, error)
+}
+
 type isZeroer interface {
 	IsZero() bool
 }
@@ -611,6 +622,10 @@ type codecError struct {
 	name   string
 	pos    int
 	encode bool
+
+	// path is the location of the value being encoded when the error occurred
+	// e.g. items[3].meta.ts (see Encoder.errPath)
+	path string
 }
 
 func (e *codecError) Cause() error {
@@ -619,6 +634,9 @@ func (e *codecError) Cause() error {
 
 func (e *codecError) Error() string {
 	if e.encode {
+		if e.path != "" {
+			return fmt.Sprintf("%s encode error: %s: %v", e.name, e.path, e.err)
+		}
 		return fmt.Sprintf("%s encode error: %v", e.name, e.err)
 	}
 	return fmt.Sprintf("%s decode error [pos %d]: %v", e.name, e.pos, e.err)
@@ -629,7 +647,7 @@ func wrapCodecErr(in error, name string, numbytesread int, encode bool) (out err
 	if ok && x.pos == numbytesread && x.name == name && x.encode == encode {
 		return in
 	}
-	return &codecError{in, name, numbytesread, encode}
+	return &codecError{err: in, name: name, pos: numbytesread, encode: encode}
 }
 
 var (
@@ -645,6 +663,7 @@ var (
 	intfTyp        = intfSliceTyp.Elem()
 
 	reflectValTyp = reflect.TypeOf((*reflect.Value)(nil)).Elem()
+	errorTyp      = reflect.TypeOf((*error)(nil)).Elem()
 
 	stringTyp     = reflect.TypeOf("")
 	timeTyp       = reflect.TypeOf(time.Time{})
@@ -669,6 +688,11 @@ var (
 
 	selferTyp                = reflect.TypeOf((*Selfer)(nil)).Elem()
 	missingFielderTyp        = reflect.TypeOf((*MissingFielder)(nil)).Elem()
+	encodeAsArrayerTyp       = reflect.TypeOf((*EncodeAsArrayer)(nil)).Elem()
+	codecFielderTyp          = reflect.TypeOf((*CodecFielder)(nil)).Elem()
+	readerMarshalerTyp       = reflect.TypeOf((*CodecReaderMarshaler)(nil)).Elem()
+	stringerTyp              = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	sortInterfaceTyp         = reflect.TypeOf((*sort.Interface)(nil)).Elem()
 	iszeroTyp                = reflect.TypeOf((*isZeroer)(nil)).Elem()
 	isCodecEmptyerTyp        = reflect.TypeOf((*isCodecEmptyer)(nil)).Elem()
 	isSelferViaCodecgenerTyp = reflect.TypeOf((*isSelferViaCodecgener)(nil)).Elem()
@@ -679,6 +703,7 @@ var (
 	rawTypId        = rt2id(rawTyp)
 	intfTypId       = rt2id(intfTyp)
 	timeTypId       = rt2id(timeTyp)
+	reflectValTypId = rt2id(reflectValTyp)
 	stringTypId     = rt2id(stringTyp)
 
 	mapStrIntfTypId  = rt2id(mapStrIntfTyp)
@@ -752,6 +777,58 @@ type MissingFielder interface {
 	CodecMissingFields() map[string]interface{}
 }
 
+// CodecFielder defines the interface allowing a struct to provide the complete set of fields
+// it is encoded with e.g. from getter methods of a type whose fields are all unexported.
+//
+// Unlike MissingFielder (whose fields are added to those of the struct), the returned fields
+// replace the struct fields: an exported field is not encoded unless it is also returned.
+// The struct is always encoded as a map (ignoring the toarray option and StructToArray),
+// with its entries sorted by key (or per KeyDictionary if Canonical). Omitempty does not apply,
+// and an entry with an empty key is skipped.
+//
+// It only affects encoding: the map is decoded into the struct fields (and a MissingFielder) as usual.
+//
+// Note that the interface is completely ignored during codecgen.
+type CodecFielder interface {
+	// CodecFields returns the fields (and their values) to encode the struct with.
+	CodecFields() map[string]interface{}
+}
+
+// CodecReaderMarshaler defines the interface allowing a value to be encoded as bytes
+// read from an io.Reader, instead of from a []byte (as for encoding.BinaryMarshaler)
+// e.g. for a huge payload such as the contents of a file.
+//
+// CodecMarshalReader returns the reader, and the number of bytes it yields (or -1 if unknown).
+// The bytes are copied from the reader into the stream as they are read, without holding them
+// all in memory, when the format supports it for the length: a length must be known, except
+// in json (as base64) and cbor (as an indefinite-length byte string). Otherwise, they are read
+// fully, then encoded. It is an error if the reader yields a different number of bytes than returned.
+// The reader is read until io.EOF, and is not closed.
+//
+// It takes precedence over encoding.BinaryMarshaler (but not a Selfer or an extension),
+// and only affects encoding: the value is decoded as determined by its type
+// e.g. via encoding.BinaryUnmarshaler.
+//
+// Note that the interface is completely ignored during codecgen.
+type CodecReaderMarshaler interface {
+	CodecMarshalReader() (r io.Reader, length int64, err error)
+}
+
+// EncodeAsArrayer defines the interface allowing a struct value to choose,
+// per instance, whether it is encoded as an array or a map.
+//
+// The result overrides the static toarray tag option and the StructToArray handle option.
+//
+// Note that omitempty is honored only when the value is encoded as a map,
+// as an entry must be encoded for each field of an array to maintain its position.
+// Also, a struct which implements MissingFielder is always encoded as a map.
+//
+// Note that the interface is completely ignored during codecgen.
+type EncodeAsArrayer interface {
+	// CodecEncodeAsArray returns true if the struct should be encoded as an array.
+	CodecEncodeAsArray() bool
+}
+
 // MapBySlice is a tag interface that denotes the slice or array value should encode as a map
 // in the stream, and can be decoded from a map in the stream.
 //
@@ -797,8 +874,19 @@ type basicHandleRuntimeState struct {
 
 	intf2impls
 
+	typeNames
+
+	compactTypes
+
+	decimals
+
+	unions
+
 	mu sync.Mutex
 
+	// encPool holds the Encoders reused by EncodeMulti (each reset via ResetBytes).
+	encPool sync.Pool
+
 	jsonHandle   bool
 	binaryHandle bool
 
@@ -807,6 +895,15 @@ type basicHandleRuntimeState struct {
 	// will have been cached and the TimeNotBuiltin value will not be consulted thereafter.
 	timeBuiltin bool
 	_           bool // padding
+
+	// tagTypeInfos is initialized from StructTagName (and CallLazyFuncs), and used internally.
+	// It is kept per handle, so type information is not shared with handles
+	// configured with different struct tag keys (or which do not keep lazy func fields).
+	tagTypeInfos *TypeInfos
+
+	// keyDictInv is the inverse of KeyDictionary (code to key).
+	// An empty key denotes a code used for multiple keys.
+	keyDictInv map[string]string
 }
 
 // BasicHandle encapsulates the common options and extension functions.
@@ -821,6 +918,17 @@ type BasicHandle struct {
 	// If not configured, the default TypeInfos is used, which uses struct tag keys: codec, json
 	TypeInfos *TypeInfos
 
+	// StructTagName, if set, is the only struct tag key consulted for field configuration
+	// e.g. "db". The default keys (codec, json) are then ignored, and a field without
+	// a tag for this key is encoded using its field name.
+	//
+	// StructTagName takes precedence over TypeInfos.
+	//
+	// Note: DO NOT CHANGE AFTER FIRST USE.
+	//
+	// Once a Handle has been initialized (used), do not modify this option. It will be ignored.
+	StructTagName string
+
 	*basicHandleRuntimeState
 
 	// ---- cache line
@@ -904,6 +1012,25 @@ func (x *BasicHandle) basicInit() {
 	x.rtidFns.store(nil)
 	x.rtidFnsNoExt.store(nil)
 	x.timeBuiltin = !x.TimeNotBuiltin
+	x.tagTypeInfos = nil
+	if x.StructTagName != "" {
+		x.tagTypeInfos = NewTypeInfos([]string{x.StructTagName})
+	}
+	if x.CallLazyFuncs {
+		ti := NewTypeInfos(x.typeInfos().tags)
+		ti.lazyFuncs = true
+		x.tagTypeInfos = ti
+	}
+	x.keyDictInv = nil
+	if x.KeyDictionary != nil {
+		x.keyDictInv = make(map[string]string, len(x.KeyDictionary))
+		for k, v := range x.KeyDictionary {
+			if _, ok := x.keyDictInv[v]; ok {
+				k = ""
+			}
+			x.keyDictInv[v] = k
+		}
+	}
 }
 
 func (x *BasicHandle) init() {}
@@ -992,6 +1119,9 @@ func (x *BasicHandle) getBasicHandle() *BasicHandle {
 }
 
 func (x *BasicHandle) typeInfos() *TypeInfos {
+	if x.basicHandleRuntimeState != nil && x.tagTypeInfos != nil {
+		return x.tagTypeInfos
+	}
 	if x.TypeInfos != nil {
 		return x.TypeInfos
 	}
@@ -1101,6 +1231,10 @@ func (x *basicHandleRuntimeState) fnLoad(rt reflect.Type, rtid uintptr, tinfos *
 	} else if rtid == rawTypId {
 		fn.fe = (*Encoder).raw
 		fn.fd = (*Decoder).raw
+	} else if rtid == reflectValTypId {
+		// a reflect.Value (e.g. a slice element or field) is encoded as the value it holds
+		fn.fe = (*Encoder).kReflectValue
+		fn.fd = (*Decoder).kStruct
 	} else if rtid == rawExtTypId {
 		fn.fe = (*Encoder).rawExt
 		fn.fd = (*Decoder).rawExt
@@ -1163,6 +1297,7 @@ func (x *basicHandleRuntimeState) fnLoad(rt reflect.Type, rtid uintptr, tinfos *
 					rtid2 = rt2id(ti.key) // ti.key for arrays = reflect.SliceOf(ti.elem)
 				}
 				if idx := fastpathAvIndex(rtid2); idx != -1 {
+					fi.iterE = ti.elemkind == uint8(reflect.Interface)
 					fn.fe = fastpathAv[idx].encfn
 					fn.fd = fastpathAv[idx].decfn
 					fi.addrD = true
@@ -1175,6 +1310,7 @@ func (x *basicHandleRuntimeState) fnLoad(rt reflect.Type, rtid uintptr, tinfos *
 				// try to use mapping for underlying type
 				xfe, xrt := fnloadFastpathUnderlying(ti)
 				if xfe != nil {
+					fi.iterE = ti.elemkind == uint8(reflect.Interface)
 					xfnf := xfe.encfn
 					xfnf2 := xfe.decfn
 					if rk == reflect.Array {
@@ -1195,7 +1331,7 @@ func (x *basicHandleRuntimeState) fnLoad(rt reflect.Type, rtid uintptr, tinfos *
 						}
 					}
 					fn.fe = func(e *Encoder, xf *codecFnInfo, xrv reflect.Value) {
-						xfnf(e, xf, rvConvert(xrv, xrt))
+						xfnf(e, xf, rvConvert(e.kSorted(xrv, xf.ti), xrt))
 					}
 				}
 			}
@@ -1267,35 +1403,71 @@ func (x *basicHandleRuntimeState) fnLoad(rt reflect.Type, rtid uintptr, tinfos *
 				fn.fe = (*Encoder).kChan
 				fn.fd = (*Decoder).kChan
 			case reflect.Slice:
+				fi.iterE = true
 				fn.fe = (*Encoder).kSlice
 				fn.fd = (*Decoder).kSlice
 			case reflect.Array:
+				fi.iterE = true
 				fi.addrD = false // decode directly into array value (slice made from it)
 				fn.fe = (*Encoder).kArray
 				fn.fd = (*Decoder).kArray
 			case reflect.Struct:
+				fi.iterE = !(ti.flagMissingFielder || ti.flagMissingFielderPtr ||
+					ti.flagEncodeAsArrayer || ti.flagEncodeAsArrayerPtr ||
+					ti.flagCodecFielder || ti.flagCodecFielderPtr)
 				if ti.anyOmitEmpty ||
+					ti.anyRequires ||
+					ti.anyInline ||
+					ti.anyFieldOpt ||
+					ti.kvArray ||
+					ti.unwrap != nil ||
+					ti.anyUnsafe ||
 					ti.flagMissingFielder ||
-					ti.flagMissingFielderPtr {
+					ti.flagMissingFielderPtr ||
+					ti.flagEncodeAsArrayer ||
+					ti.flagEncodeAsArrayerPtr ||
+					ti.flagCodecFielder ||
+					ti.flagCodecFielderPtr {
 					fn.fe = (*Encoder).kStruct
 				} else {
 					fn.fe = (*Encoder).kStructNoOmitempty
 				}
 				fn.fd = (*Decoder).kStruct
 			case reflect.Map:
+				fi.iterE = true
 				fn.fe = (*Encoder).kMap
 				fn.fd = (*Decoder).kMap
 			case reflect.Interface:
 				// encode: reflect.Interface are handled already by preEncodeValue
 				fn.fd = (*Decoder).kInterface
 				fn.fe = (*Encoder).kErr
+			case reflect.Func:
+				// encode: reflect.Func is handled already by encodeValue
+				fn.fe = (*Encoder).kErr
+				fn.fd = (*Decoder).kFunc
 			default:
 				// reflect.Ptr and reflect.Interface are handled already by preEncodeValue
 				fn.fe = (*Encoder).kErr
 				fn.fd = (*Decoder).kErr
 			}
+			// a named integer with a String method may be encoded with its name (if VerboseEnums)
+			if ti.flagStringer && rk >= reflect.Int && rk <= reflect.Uint64 {
+				fn.fe = (*Encoder).kEnum
+			}
 		}
 	}
+	// a CodecReaderMarshaler is encoded from its reader (unless an extension or Selfer),
+	// but decoded as determined above
+	if (ti.flagReaderMarshaler || ti.flagReaderMarshalerPtr) && fi.xfFn == nil &&
+		!(ti.flagSelfer || ti.flagSelferPtr) {
+		fn.fe = (*Encoder).readerMarshal
+		fi.addrE, fi.iterE = ti.flagReaderMarshalerPtr, false
+	}
+	// a registered decimal type is encoded as a number, but decoded as determined above
+	if x.decimalFn(rtid) != nil {
+		fn.fe = (*Encoder).kDecimal
+		fi.addrE, fi.iterE = false, false
+	}
 	return
 }
 
@@ -1556,6 +1728,58 @@ func (z bigenHelper) writeUint64(w *encWr, v uint64) {
 	w.writen8(z.PutUint64(v))
 }
 
+// AppendVarint appends v to b as a protobuf-style base-128 varint,
+// and returns the extended slice.
+//
+// It is exposed for use by extensions (e.g. BytesExt) which need to write
+// protobuf-compatible values. To encode a signed value using two's complement
+// (as protobuf does for int32/int64), pass uint64(v). To encode a signed
+// value efficiently (as protobuf does for sint32/sint64), use AppendZigzagVarint.
+func AppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// AppendZigzagVarint appends v to b as a zigzag-encoded base-128 varint,
+// and returns the extended slice.
+//
+// zigzag encoding maps signed values to unsigned ones so that values
+// with a small absolute value have a small varint encoding e.g. -1 encodes as 1.
+func AppendZigzagVarint(b []byte, v int64) []byte {
+	return AppendVarint(b, uint64(v<<1)^uint64(v>>63))
+}
+
+// DecodeVarint decodes a base-128 varint from the start of b.
+//
+// It returns the value and the number of bytes read.
+// If n == 0, b is too short to contain a varint.
+// If n < 0, the value overflows a uint64, and -n is the number of bytes read.
+func DecodeVarint(b []byte) (v uint64, n int) {
+	var s uint
+	for i, c := range b {
+		if i == 9 && c > 1 { // 10th byte can only hold the highest bit of a uint64
+			return 0, -(i + 1)
+		}
+		if c < 0x80 {
+			return v | uint64(c)<<s, i + 1
+		}
+		v |= uint64(c&0x7f) << s
+		s += 7
+	}
+	return 0, 0
+}
+
+// DecodeZigzagVarint decodes a zigzag-encoded base-128 varint from the start of b.
+//
+// The returned n is interpreted as with DecodeVarint.
+func DecodeZigzagVarint(b []byte) (v int64, n int) {
+	u, n := DecodeVarint(b)
+	return int64(u>>1) ^ -int64(u&1), n
+}
+
 type extTypeTagFn struct {
 	rtid    uintptr
 	rtidptr uintptr
@@ -1672,6 +1896,266 @@ func (o intf2impls) intf2impl(rtid uintptr) (rv reflect.Value) {
 	return
 }
 
+type typeName struct {
+	rtid uintptr
+	name string
+}
+
+type typeNames []typeName
+
+// SetTypeName registers a name for a concrete type.
+//
+// When EncodeOptions.TypeFieldName is configured, a value of this type
+// held in an interface is encoded wrapped with its name (see TypeFieldName).
+// A pointer type is registered as its base type.
+//
+// Passing an empty name will clear the mapping.
+func (x *BasicHandle) SetTypeName(rt reflect.Type, name string) (err error) {
+	if x.isInited() {
+		return errHandleInited
+	}
+	if x.basicHandleRuntimeState == nil {
+		x.basicHandleRuntimeState = new(basicHandleRuntimeState)
+	}
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	if rt.Kind() == reflect.Interface {
+		return fmt.Errorf("codec.Handle.SetTypeName: Takes concrete type, not an interface: %v", rt)
+	}
+	rtid := rt2id(rt)
+	o := x.typeNames
+	for i := range o {
+		if o[i].rtid == rtid {
+			if name == "" {
+				x.typeNames = append(o[:i:i], o[i+1:]...)
+			} else {
+				o[i].name = name
+			}
+			return
+		}
+	}
+	if name != "" {
+		x.typeNames = append(o, typeName{rtid, name})
+	}
+	return
+}
+
+func (o typeNames) typeName(rtid uintptr) string {
+	for i := range o {
+		if o[i].rtid == rtid {
+			return o[i].name
+		}
+	}
+	return ""
+}
+
+type compactType struct {
+	rtid uintptr
+	id   uint8
+}
+
+type compactTypes []compactType
+
+// RegisterCompactType registers a compact type tag for the concrete type of v.
+//
+// When EncodeOptions.TaggedInterfaces is configured, a value of this type
+// held in an interface is encoded as a 2-element array: [id, value] (see TaggedInterfaces).
+// A pointer type is registered as its base type.
+//
+// It is an error if the id is already registered for another type.
+func (x *BasicHandle) RegisterCompactType(id uint8, v interface{}) (err error) {
+	if x.isInited() {
+		return errHandleInited
+	}
+	if v == nil {
+		return errors.New("codec.Handle.RegisterCompactType: Takes a non-nil value")
+	}
+	if x.basicHandleRuntimeState == nil {
+		x.basicHandleRuntimeState = new(basicHandleRuntimeState)
+	}
+	rt := reflect.TypeOf(v)
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	rtid := rt2id(rt)
+	o := x.compactTypes
+	for i := range o {
+		if o[i].id == id && o[i].rtid != rtid {
+			return fmt.Errorf("codec.Handle.RegisterCompactType: id %d is already registered for another type", id)
+		}
+	}
+	for i := range o {
+		if o[i].rtid == rtid {
+			o[i].id = id
+			return
+		}
+	}
+	x.compactTypes = append(o, compactType{rtid, id})
+	return
+}
+
+func (o compactTypes) compactTypeID(rtid uintptr) (id uint8, ok bool) {
+	for i := range o {
+		if o[i].rtid == rtid {
+			return o[i].id, true
+		}
+	}
+	return
+}
+
+// DecimalFunc returns the value of a decimal as mantissa * 10^exp e.g. 123.45 is (-2, 12345).
+type DecimalFunc func(v interface{}) (exp int64, mantissa *big.Int, err error)
+
+type decimal struct {
+	rtid uintptr
+	fn   DecimalFunc
+}
+
+type decimals []decimal
+
+// RegisterDecimal registers a function to get the value of a fixed-point decimal type,
+// so it is encoded as a number, and not as a string (e.g. via its encoding.TextMarshaler).
+//
+// In cbor, it is encoded as a decimal fraction (tag 4), and in json as a number
+// in decimal notation e.g. 123.45. Other formats do not support arbitrary precision
+// numbers, so it is encoded as the string in decimal notation.
+//
+// The decoding of the type is not affected.
+// A pointer type is registered as its base type. Passing a nil fn will clear the mapping.
+func (x *BasicHandle) RegisterDecimal(rt reflect.Type, fn DecimalFunc) (err error) {
+	if x.isInited() {
+		return errHandleInited
+	}
+	if x.basicHandleRuntimeState == nil {
+		x.basicHandleRuntimeState = new(basicHandleRuntimeState)
+	}
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	rtid := rt2id(rt)
+	o := x.decimals
+	for i := range o {
+		if o[i].rtid == rtid {
+			if fn == nil {
+				x.decimals = append(o[:i:i], o[i+1:]...)
+			} else {
+				o[i].fn = fn
+			}
+			return
+		}
+	}
+	if fn != nil {
+		x.decimals = append(o, decimal{rtid, fn})
+	}
+	return
+}
+
+func (o decimals) decimalFn(rtid uintptr) DecimalFunc {
+	for i := range o {
+		if o[i].rtid == rtid {
+			return o[i].fn
+		}
+	}
+	return nil
+}
+
+type unionKind struct {
+	kind    interface{}
+	payload reflect.Type
+}
+
+type union struct {
+	rtid         uintptr
+	kindField    string
+	payloadField string
+	kinds        []unionKind
+}
+
+type unions []union
+
+// RegisterUnion registers the type of the payload of a tagged union for one of its kinds.
+//
+// The union is a struct type (rt) with a kind field and a payload field of interface type,
+// named by their encoded names. When EncodeOptions.EnforceUnions is configured,
+// encoding a value of rt errors if its payload is not of the payload type registered
+// for the value of its kind field, or if that value is not registered
+// (so a malformed union is caught before it is written).
+//
+// kind must be of the type of the kind field (e.g. MyKind(1), not 1).
+// A nil payload is accepted for any registered kind. If payload is nil,
+// the kind carries no payload, so it must be nil. If payload is an interface type,
+// the payload must implement it; else it must be exactly of that type (e.g. *T is not T).
+//
+// It is an error if the kind or payload field differs from that of an earlier registration for rt.
+func (x *BasicHandle) RegisterUnion(rt reflect.Type, kindField, payloadField string,
+	kind interface{}, payload reflect.Type) (err error) {
+	if x.isInited() {
+		return errHandleInited
+	}
+	if rt.Kind() != reflect.Struct {
+		return fmt.Errorf("codec.Handle.RegisterUnion: Takes a struct type, got: %v", rt)
+	}
+	if x.basicHandleRuntimeState == nil {
+		x.basicHandleRuntimeState = new(basicHandleRuntimeState)
+	}
+	rtid := rt2id(rt)
+	o := x.unions
+	for i := range o {
+		if o[i].rtid != rtid {
+			continue
+		}
+		if o[i].kindField != kindField || o[i].payloadField != payloadField {
+			return fmt.Errorf("codec.Handle.RegisterUnion: %v is already registered with kind field %s and payload field %s",
+				rt, o[i].kindField, o[i].payloadField)
+		}
+		for j := range o[i].kinds {
+			if o[i].kinds[j].kind == kind {
+				o[i].kinds[j].payload = payload
+				return
+			}
+		}
+		o[i].kinds = append(o[i].kinds, unionKind{kind, payload})
+		return
+	}
+	x.unions = append(o, union{rtid, kindField, payloadField, []unionKind{{kind, payload}}})
+	return
+}
+
+func (o unions) union(rtid uintptr) *union {
+	for i := range o {
+		if o[i].rtid == rtid {
+			return &o[i]
+		}
+	}
+	return nil
+}
+
+// decimalString returns mantissa * 10^exp in decimal notation e.g. 123.45 for (-2, 12345).
+//
+// If it would need more than decimalMaxZeros zeros for padding, then
+// the exponent is written instead e.g. 12345e-100.
+func decimalString(exp int64, mantissa *big.Int) string {
+	const decimalMaxZeros = 64
+	s := mantissa.String()
+	var sign string
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+	if exp >= 0 {
+		if exp > decimalMaxZeros {
+			return sign + s + "e" + strconv.FormatInt(exp, 10)
+		}
+		return sign + s + strings.Repeat("0", int(exp))
+	}
+	if n := int64(len(s)); -exp < n {
+		return sign + s[:n+exp] + "." + s[n+exp:]
+	} else if -exp-n <= decimalMaxZeros {
+		return sign + "0." + strings.Repeat("0", int(-exp-n)) + s
+	}
+	return sign + s + "e" + strconv.FormatInt(exp, 10)
+}
+
 // structFieldinfopathNode is a node in a tree, which allows us easily
 // walk the anonymous path.
 //
@@ -1690,6 +2174,14 @@ type structFieldInfoPathNode struct {
 
 	encNameAsciiAlphaNum bool // the encName only contains ascii alphabet and numbers
 	omitEmpty            bool
+	keepEmpty            bool // never omitted if empty, even if OmitEmptyByDefault
+	set                  bool // encode a slice or array as a set (see Encoder.kSet)
+	reverse              bool // encode a slice or array in reverse order (see Encoder.kSeqOrdered)
+	unwrap               bool // encode (and decode) the struct as the value of this field alone
+	redact               bool // encode a placeholder in place of the value (see Encoder.kRedacted)
+	inline               bool // encode the fields of the struct in this interface field inline (see Encoder.kStructInline)
+	jsonString           bool // encode the value as a string of its json encoding (see Encoder.kJsonString)
+	unexportedPtr        bool // an embedded pointer to an unexported struct type
 
 	typ reflect.Type
 }
@@ -1726,6 +2218,9 @@ func (path *structFieldInfoPathNode) fieldAlloc(v reflect.Value) (rv2 reflect.Va
 		v = parent.fieldAlloc(v)
 		for j, k := uint8(0), parent.numderef; j < k; j++ {
 			if rvIsNil(v) {
+				if parent.unexportedPtr && !allowSetUnexportedEmbeddedPtr {
+					halt.errorf("cannot set embedded pointer to unexported struct: %v", rvType(v).Elem())
+				}
 				rvSetDirect(v, reflect.New(rvType(v).Elem()))
 			}
 			v = v.Elem()
@@ -1744,10 +2239,45 @@ type structFieldInfo struct {
 	// encNameAsciiAlphaNum and omitEmpty should be here,
 	// but are stored in structFieldInfoPathNode for tighter packaging.
 
+	// sortBy is the (encoded) name of the field of the elements to sort a slice or array by,
+	// from the "sortby=Name" option in the tag (see Encoder.kSeqOrdered).
+	sortBy string
+
+	// pad is the width to zero-pad an integer to, from the "pad=N" option in the tag
+	// (see Encoder.kPadInt).
+	pad uint8
+
+	// requiresName is the (encoded) name of the field which must be non-empty for this field
+	// to be encoded, from the "requires=Name" option in the tag. requires is that field,
+	// resolved once all the fields are known (see typeInfo.init).
+	requiresName string
+	requires     *structFieldInfo
+
+	// lenofName is the (encoded) name of the field whose length is encoded as the value
+	// of this (integer) field, from the "lenof=Name" option in the tag. lenof is that field,
+	// resolved once all the fields are known (see typeInfo.init and Encoder.kField).
+	lenofName string
+	lenof     *structFieldInfo
+
+	// comment holds the lines of the "comment=text" option in the tag,
+	// written before the key of the field in json (see JsonHandle.AllowComments).
+	comment []string
+
+	// index is the position of the field when the struct is encoded as an array,
+	// from the "index=N" option in the tag (if indexed). See typeInfo.init.
+	index   uint16
+	indexed bool
+
 	path structFieldInfoPathNode
 }
 
-func parseStructInfo(stag string) (toArray, omitEmpty bool, keytype valueType) {
+// hasValueOption reports whether the tag has an option for encoding the value
+// i.e. set, reverse, sortby, pad, redact or jsonstring.
+func (si *structFieldInfo) hasValueOption() bool {
+	return si.path.set || si.path.reverse || si.sortBy != "" || si.pad != 0 || si.path.redact || si.path.jsonString
+}
+
+func parseStructInfo(stag string) (toArray, omitEmpty, kvArray bool, keytype valueType) {
 	keytype = valueTypeString // default
 	if stag == "" {
 		return
@@ -1762,6 +2292,8 @@ func parseStructInfo(stag string) (toArray, omitEmpty bool, keytype valueType) {
 			omitEmpty = true
 		case "toarray":
 			toArray = true
+		case "kvarray":
+			kvArray = true
 		case "int":
 			keytype = valueTypeInt
 		case "uint":
@@ -1777,10 +2309,19 @@ func parseStructInfo(stag string) (toArray, omitEmpty bool, keytype valueType) {
 	return
 }
 
-func (si *structFieldInfo) parseTag(stag string) {
+// parseTag parses the options from the struct tag, returning an error for an invalid one.
+func (si *structFieldInfo) parseTag(stag string) (err error) {
 	if stag == "" {
 		return
 	}
+	// the comment is the last option, as its text may have commas
+	if i := strings.Index(stag, ",comment="); i >= 0 {
+		si.comment = strings.Split(strings.Replace(stag[i+len(",comment="):], `\n`, "\n", -1), "\n")
+		for j, s := range si.comment {
+			si.comment[j] = strings.TrimSuffix(s, "\r")
+		}
+		stag = stag[:i]
+	}
 	for i, s := range strings.Split(stag, ",") {
 		if i == 0 {
 			if s != "" {
@@ -1790,9 +2331,70 @@ func (si *structFieldInfo) parseTag(stag string) {
 			switch s {
 			case "omitempty":
 				si.path.omitEmpty = true
+			case "keepempty":
+				si.path.keepEmpty = true
+			case "set":
+				si.path.set = true
+			case "reverse":
+				si.path.reverse = true
+			case "unwrap":
+				si.path.unwrap = true
+			case "redact":
+				si.path.redact = true
+			case "inline":
+				si.path.inline = true
+			case "jsonstring":
+				si.path.jsonString = true
+			default:
+				if strings.HasPrefix(s, "sortby=") {
+					si.sortBy = s[len("sortby="):]
+				} else if strings.HasPrefix(s, "requires=") {
+					si.requiresName = s[len("requires="):]
+				} else if strings.HasPrefix(s, "lenof=") {
+					si.lenofName = s[len("lenof="):]
+				} else if strings.HasPrefix(s, "pad=") {
+					n, err := strconv.ParseUint(s[len("pad="):], 10, 8)
+					if err != nil {
+						return fmt.Errorf("invalid option %q: the width must be an integer from 0 to 255", s)
+					}
+					si.pad = uint8(n)
+				} else if strings.HasPrefix(s, "index=") {
+					n, err := strconv.ParseUint(s[len("index="):], 10, 16)
+					if err != nil {
+						return fmt.Errorf("invalid option %q: the index must be an integer from 0 to 65535", s)
+					}
+					si.index, si.indexed = uint16(n), true
+				}
 			}
 		}
 	}
+	return
+}
+
+// embedsTime reports whether the struct type embeds time.Time (or *time.Time),
+// directly or through other embedded structs, and so has its methods by promotion.
+// seen holds the struct types already checked, as an embedded pointer may refer back to them.
+func embedsTime(rt reflect.Type, seen []reflect.Type) bool {
+	for _, t := range seen {
+		if t == rt {
+			return false
+		}
+	}
+	seen = append(seen, rt)
+	for i, n := 0, rt.NumField(); i < n; i++ {
+		f := rt.Field(i)
+		if !f.Anonymous {
+			continue
+		}
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft == timeTyp || (ft.Kind() == reflect.Struct && embedsTime(ft, seen)) {
+			return true
+		}
+	}
+	return false
 }
 
 type sfiSortedByEncName []*structFieldInfo
@@ -1843,12 +2445,19 @@ type typeInfo struct {
 	chandir uint8
 
 	anyOmitEmpty bool      // true if a struct, and any of the fields are tagged "omitempty"
+	anyRequires  bool      // true if a struct, and any of the fields are tagged "requires=Name"
+	anyUnsafe    bool      // true if a struct, and any of the fields is a uintptr or unsafe.Pointer
+	anyInline    bool      // true if a struct, and any of the (interface) fields are tagged "inline"
+	anyFieldOpt  bool      // true if a struct, and any of the fields has a comment, lenof or value option (see hasValueOption)
 	toArray      bool      // whether this (struct) type should be encoded as an array
+	kvArray      bool      // whether this (struct) type, when encoded as a map, is framed as an array of keys and values
 	keyType      valueType // if struct, how is the field name stored in a stream? default is string
 	mbs          bool      // base type (T or *T) is a MapBySlice
 
 	sfi4Name map[string]*structFieldInfo // map. used for finding sfi given a name
 
+	unwrap *structFieldInfo // if a struct, the field tagged "unwrap" (if any)
+
 	*typeInfo4Container
 
 	// ---- cpu cache line boundary?
@@ -1895,6 +2504,20 @@ type typeInfo struct {
 	flagMissingFielder    bool
 	flagMissingFielderPtr bool
 
+	flagEncodeAsArrayer    bool
+	flagEncodeAsArrayerPtr bool
+
+	flagCodecFielder    bool
+	flagCodecFielderPtr bool
+
+	flagReaderMarshaler    bool
+	flagReaderMarshalerPtr bool
+
+	flagStringer bool // implements fmt.Stringer (not via a pointer)
+
+	flagSortable    bool // a slice type which implements sort.Interface
+	flagSortablePtr bool
+
 	infoFieldOmitempty bool
 
 	sfi structFieldInfos
@@ -1930,7 +2553,7 @@ func (ti *typeInfo) resolve(x []structFieldInfo, ss map[string]uint16) (n int) {
 }
 
 func (ti *typeInfo) init(x []structFieldInfo, n int) {
-	var anyOmitEmpty bool
+	var anyOmitEmpty, anyUnsafe, anyInline bool
 
 	// remove all the nils (non-ready)
 	m := make(map[string]*structFieldInfo, n)
@@ -1939,13 +2562,30 @@ func (ti *typeInfo) init(x []structFieldInfo, n int) {
 	z := y[n:]
 	y = y[:n]
 	n = 0
+	var unwrap *structFieldInfo
 	for i := range x {
 		if x[i].encName == "" {
 			continue
 		}
+		if x[i].path.unwrap {
+			if unwrap != nil {
+				halt.errorf("struct %v has more than 1 field tagged unwrap: %s, %s", ti.rt, unwrap.encName, x[i].encName)
+			}
+			unwrap = &w[n]
+		}
 		if !anyOmitEmpty && x[i].path.omitEmpty {
 			anyOmitEmpty = true
 		}
+		if !anyUnsafe && isUnsafeKind(x[i].path.typ) {
+			anyUnsafe = true
+		}
+		if x[i].path.inline {
+			if x[i].path.typ.Kind() == reflect.Interface {
+				anyInline = true
+			} else {
+				x[i].path.inline = false // only an interface field can be inlined
+			}
+		}
 		w[n] = x[i]
 		y[n] = &w[n]
 		m[x[i].encName] = &w[n]
@@ -1955,14 +2595,114 @@ func (ti *typeInfo) init(x []structFieldInfo, n int) {
 		halt.errorf("failure reading struct %v - expecting %d of %d valid fields, got %d", ti.rt, len(y), len(x), n)
 	}
 
+	var anyRequires bool
+	for i := range w {
+		si := &w[i]
+		if si.requiresName == "" {
+			continue
+		}
+		if si.requires = m[si.requiresName]; si.requires == nil {
+			halt.errorf("struct %v field %s requires unknown field: %s", ti.rt, si.encName, si.requiresName)
+		}
+		anyRequires = true
+	}
+	if anyRequires {
+		for i := range w {
+			for j, r := 0, w[i].requires; r != nil; j, r = j+1, r.requires {
+				if j == n {
+					halt.errorf("struct %v field %s has a cycle of requires", ti.rt, w[i].encName)
+				}
+			}
+		}
+	}
+
+	for i := range w {
+		if si := &w[i]; si.lenofName != "" {
+			ti.sfiLenOf(si, m)
+		}
+	}
+
+	for i := range w {
+		if si := &w[i]; si.comment != nil || si.lenof != nil || si.hasValueOption() {
+			ti.anyFieldOpt = true
+			break
+		}
+	}
+
+	ti.sfiIndexed(y)
+
 	copy(z, y)
 	sort.Sort(sfiSortedByEncName(z))
 
 	ti.anyOmitEmpty = anyOmitEmpty
+	ti.anyRequires = anyRequires
+	ti.anyUnsafe = anyUnsafe
+	ti.anyInline = anyInline
+	ti.unwrap = unwrap
 	ti.sfi.load(y, z)
 	ti.sfi4Name = m
 }
 
+// sfiLenOf resolves the field named by the "lenof=Name" option in the tag of si.
+// It is an error if si is not an integer, or the field Name does not exist or does not
+// have a length i.e. is not a string, slice, array, map or chan (or a pointer to one).
+func (ti *typeInfo) sfiLenOf(si *structFieldInfo, m map[string]*structFieldInfo) {
+	switch si.path.typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+	default:
+		halt.errorf("struct %v field %s has lenof but is not an integer: %v", ti.rt, si.encName, si.path.typ)
+	}
+	if si.lenof = m[si.lenofName]; si.lenof == nil {
+		halt.errorf("struct %v field %s has lenof unknown field: %s", ti.rt, si.encName, si.lenofName)
+	}
+	rt := si.lenof.path.typ
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	switch rt.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map, reflect.Chan:
+	default:
+		halt.errorf("struct %v field %s has lenof field %s which has no length: %v",
+			ti.rt, si.encName, si.lenofName, si.lenof.path.typ)
+	}
+}
+
+// sfiIndexed orders the fields (in declaration order) by the "index=N" option in their tags:
+// the indexed fields first, in order of their index, then the others in declaration order.
+// It is an error if the indices are not 0 to k-1 for the k indexed fields (i.e. a gap or duplicate).
+func (ti *typeInfo) sfiIndexed(y []*structFieldInfo) {
+	var k int
+	for _, si := range y {
+		if si.indexed {
+			k++
+		}
+	}
+	if k == 0 {
+		return
+	}
+	v := make([]*structFieldInfo, k, len(y))
+	for _, si := range y {
+		if !si.indexed {
+			continue
+		}
+		if int(si.index) >= k {
+			halt.errorf("struct %v field %s has index %d: expecting 0 to %d for its %d indexed fields",
+				ti.rt, si.encName, si.index, k-1, k)
+		}
+		if v[si.index] != nil {
+			halt.errorf("struct %v fields %s and %s have the same index %d", ti.rt, v[si.index].encName, si.encName, si.index)
+		}
+		v[si.index] = si
+	}
+	for _, si := range y {
+		if !si.indexed {
+			v = append(v, si)
+		}
+	}
+	copy(y, v)
+}
+
 // Handling flagCanTransient
 //
 // We support transient optimization if the kind of the type is
@@ -2032,6 +2772,8 @@ type TypeInfos struct {
 	_     uint64 // padding (cache-aligned)
 	tags  []string
 	_     uint64 // padding (cache-aligned)
+
+	lazyFuncs bool // keep struct fields which are lazy funcs (see CallLazyFuncs)
 }
 
 // NewTypeInfos creates a TypeInfos given a set of struct tags keys.
@@ -2143,12 +2885,38 @@ func (x *TypeInfos) load(rt reflect.Type) (pti *typeInfo) {
 	b1, b2 = implIntf(rt, jsonUnmarshalerTyp)
 	bset(b1, &ti.flagJsonUnmarshaler)
 	bset(b2, &ti.flagJsonUnmarshalerPtr)
+	if rk == reflect.Struct && rt != timeTyp && embedsTime(rt, nil) {
+		// the marshaling methods are (typically) promoted from the embedded time.Time,
+		// and would encode the struct as just that time, dropping its other fields.
+		ti.flagBinaryMarshaler, ti.flagBinaryMarshalerPtr = false, false
+		ti.flagBinaryUnmarshaler, ti.flagBinaryUnmarshalerPtr = false, false
+		ti.flagTextMarshaler, ti.flagTextMarshalerPtr = false, false
+		ti.flagTextUnmarshaler, ti.flagTextUnmarshalerPtr = false, false
+		ti.flagJsonMarshaler, ti.flagJsonMarshalerPtr = false, false
+		ti.flagJsonUnmarshaler, ti.flagJsonUnmarshalerPtr = false, false
+	}
 	b1, b2 = implIntf(rt, selferTyp)
 	bset(b1, &ti.flagSelfer)
 	bset(b2, &ti.flagSelferPtr)
 	b1, b2 = implIntf(rt, missingFielderTyp)
 	bset(b1, &ti.flagMissingFielder)
 	bset(b2, &ti.flagMissingFielderPtr)
+	b1, b2 = implIntf(rt, encodeAsArrayerTyp)
+	bset(b1, &ti.flagEncodeAsArrayer)
+	bset(b2, &ti.flagEncodeAsArrayerPtr)
+	b1, b2 = implIntf(rt, codecFielderTyp)
+	bset(b1, &ti.flagCodecFielder)
+	bset(b2, &ti.flagCodecFielderPtr)
+	b1, b2 = implIntf(rt, readerMarshalerTyp)
+	bset(b1, &ti.flagReaderMarshaler)
+	bset(b2, &ti.flagReaderMarshalerPtr)
+	b1, _ = implIntf(rt, stringerTyp)
+	bset(b1, &ti.flagStringer)
+	if rt.Kind() == reflect.Slice {
+		b1, b2 = implIntf(rt, sortInterfaceTyp)
+		bset(b1, &ti.flagSortable)
+		bset(b2, &ti.flagSortablePtr)
+	}
 	b1, b2 = implIntf(rt, iszeroTyp)
 	bset(b1, &ti.flagIsZeroer)
 	bset(b2, &ti.flagIsZeroerPtr)
@@ -2170,7 +2938,7 @@ func (x *TypeInfos) load(rt reflect.Type) (pti *typeInfo) {
 	case reflect.Struct:
 		var omitEmpty bool
 		if f, ok := rt.FieldByName(structInfoFieldName); ok {
-			ti.toArray, omitEmpty, ti.keyType = parseStructInfo(x.structTag(f.Tag))
+			ti.toArray, omitEmpty, ti.kvArray, ti.keyType = parseStructInfo(x.structTag(f.Tag))
 			ti.infoFieldOmitempty = omitEmpty
 		} else {
 			ti.keyType = valueTypeString
@@ -2292,10 +3060,13 @@ LOOP:
 		f := rt.Field(int(j))
 		fkind := f.Type.Kind()
 
-		// skip if a func type, or is unexported, or structTag value == "-"
+		// skip if a func type, or is unexported, or structTag value == "-".
+		// Note: unsafe.Pointer fields are kept, so that encoding them errors (see kStructCheckUnsafe).
 		switch fkind {
-		case reflect.Func, reflect.UnsafePointer:
-			continue LOOP
+		case reflect.Func:
+			if !(x.lazyFuncs && isLazyFuncType(f.Type)) {
+				continue LOOP
+			}
 		}
 
 		isUnexported := f.PkgPath != ""
@@ -2323,18 +3094,25 @@ LOOP:
 			for ft.Kind() == reflect.Ptr {
 				ft = ft.Elem()
 			}
-			isStruct := ft.Kind() == reflect.Struct
+			// time.Time is encoded as a value (not by its unexported fields),
+			// so an embedded time.Time is not inlined, but named by its type (Time).
+			isStruct := ft.Kind() == reflect.Struct && ft != timeTyp
 
 			// Ignore embedded fields of unexported non-struct types.
-			// Also, from go1.10, ignore pointers to unexported struct types
-			// because unmarshal cannot assign a new struct to an unexported field.
+			//
+			// The exported fields of an embedded pointer to an unexported struct type
+			// are still promoted (as in encoding/json). However, from go1.10,
+			// decode cannot assign a new struct to the unexported field if it is nil,
+			// and so it errors in that case (see fieldAlloc).
 			// See https://golang.org/issue/21357
-			if (isUnexported && !isStruct) || (!allowSetUnexportedEmbeddedPtr && isUnexported && isPtr) {
+			if isUnexported && !isStruct {
 				continue
 			}
 			doInline := stag == ""
 			if !doInline {
-				si.parseTag(stag)
+				if err := si.parseTag(stag); err != nil {
+					halt.errorf("struct %v field %s: %v", rt, f.Name, err)
+				}
 				parsed = true
 				doInline = si.encName == "" // si.isZero()
 			}
@@ -2365,6 +3143,8 @@ LOOP:
 						index:    j,
 						kind:     uint8(fkind),
 						numderef: numderef,
+
+						unexportedPtr: isUnexported && isPtr,
 					}
 					x.rget(ft, ftid, path2, pv, omitEmpty)
 				}
@@ -2372,8 +3152,10 @@ LOOP:
 			}
 		}
 
-		// after the anonymous dance: if an unexported field, skip
-		if isUnexported || f.Name == "" { // f.Name cannot be "", but defensively handle it
+		// after the anonymous dance: if an unexported field, skip.
+		// An embedded unexported struct (not pointer) with a name in its struct tag
+		// is kept as a named field (as in encoding/json).
+		if (isUnexported && !(f.Anonymous && fkind == reflect.Struct)) || f.Name == "" { // f.Name cannot be "", but defensively handle it
 			continue
 		}
 
@@ -2388,11 +3170,21 @@ LOOP:
 			encNameAsciiAlphaNum: true,
 			// note: omitEmpty might have been set in an earlier parseTag call, etc - so carry it forward
 			omitEmpty: si.path.omitEmpty,
+			keepEmpty: si.path.keepEmpty,
+			set:       si.path.set,
+			reverse:   si.path.reverse,
+			unwrap:    si.path.unwrap,
+			redact:    si.path.redact,
+			inline:    si.path.inline,
+
+			jsonString: si.path.jsonString,
 		}
 
 		if !parsed {
 			si.encName = f.Name
-			si.parseTag(stag)
+			if err := si.parseTag(stag); err != nil {
+				halt.errorf("struct %v field %s: %v", rt, f.Name, err)
+			}
 			parsed = true
 		} else if si.encName == "" {
 			si.encName = f.Name
@@ -2415,6 +3207,21 @@ LOOP:
 	}
 }
 
+// isLazyFuncType returns true if rt is a func() (interface{}, error) (see CallLazyFuncs).
+func isLazyFuncType(rt reflect.Type) bool {
+	return rt.Kind() == reflect.Func && rt.NumIn() == 0 && rt.NumOut() == 2 &&
+		rt.Out(0) == intfTyp && rt.Out(1) == errorTyp
+}
+
+// isUnsafeKind returns true if rt (or what it points to) is a uintptr or unsafe.Pointer
+// i.e. a memory address.
+func isUnsafeKind(rt reflect.Type) bool {
+	for rt.Kind() == reflect.Ptr {
+		rt = rt.Elem()
+	}
+	return rt.Kind() == reflect.Uintptr || rt.Kind() == reflect.UnsafePointer
+}
+
 func implIntf(rt, iTyp reflect.Type) (base bool, indir bool) {
 	// return rt.Implements(iTyp), reflect.PtrTo(rt).Implements(iTyp)
 
@@ -2449,6 +3256,8 @@ func panicValToErr(h errDecorator, v interface{}, err *error) {
 	}
 	switch xerr := v.(type) {
 	case nil:
+	case *ShortBufferError:
+		*err = xerr // bubble up, so the length is read without unwrapping it
 	case runtime.Error:
 		d, dok := h.(*Decoder)
 		if dok && d.bytes && isSliceBoundsError(xerr.Error()) {
@@ -2494,6 +3303,7 @@ type codecFnInfo struct {
 	addrD  bool
 	addrDf bool // force: if addrD, then decode function MUST take a ptr
 	addrE  bool
+	iterE  bool // encoding can be walked by the iterative encoder
 	// addrEf bool // force: if addrE, then encode function MUST take a ptr
 }
 
@@ -2944,6 +3754,43 @@ func (x *sfiRvFreelist) put(v []sfiRv) {
 	}
 }
 
+// bytesRvFreelist is a list of []bytesRv, used to sort values by their encoded bytes
+// (e.g. canonical map keys) without allocating a new slice each time.
+//
+// It is used similar to sfiRvFreelist.
+type bytesRvFreelist [][]bytesRv
+
+func (x *bytesRvFreelist) get(length int) (out []bytesRv) {
+	y := *x
+	for i := 0; i < len(y); i++ {
+		v := y[i]
+		if cap(v) >= length {
+			copy(y[i:], y[i+1:])
+			*x = y[:len(y)-1]
+			return v[:0]
+		}
+	}
+	return make([]bytesRv, 0, freelistCapacity(length))
+}
+
+func (x *bytesRvFreelist) put(v []bytesRv) {
+	// clear the entries, so we do not hold on to the values (or their encoded []byte)
+	for i := range v {
+		v[i] = bytesRv{}
+	}
+	v = v[:0]
+	y := append(*x, v)
+	*x = y
+	for i := 0; i < len(y)-1; i++ {
+		z := y[i]
+		if cap(z) > cap(v) {
+			copy(y[i+1:], y[i:])
+			y[i] = v
+			return
+		}
+	}
+}
+
 // ---- multiple interner implementations ----
 
 // Hard to tell which is most performant:
@@ -0,0 +1,128 @@
+// Copyright (c) 2012-2020 Ugorji Nwoke. All rights reserved.
+// Use of this source code is governed by a MIT license found in the LICENSE file.
+
+package codec
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+)
+
+var (
+	imagePointTyp     = reflect.TypeOf(image.Point{})
+	imageRectangleTyp = reflect.TypeOf(image.Rectangle{})
+	colorRGBATyp      = reflect.TypeOf(color.RGBA{})
+)
+
+// ImageExt is an extension which encodes image.Point, image.Rectangle and color.RGBA
+// compactly as arrays, i.e. [x,y], [x0,y0,x1,y1] and [r,g,b,a] respectively.
+//
+// Formats which use a BytesExt (e.g. msgpack, binc, simple) encode the array
+// as zigzag varints (for image.Point and image.Rectangle) or raw bytes (for color.RGBA).
+//
+// It is not registered by default. Register it via SetImageExts,
+// or via SetInterfaceExt/SetBytesExt on the handle for a subset of the types.
+var ImageExt Ext = imageExt{}
+
+// SetImageExts registers ImageExt on the handle for image.Point, image.Rectangle and color.RGBA,
+// using the tags: tag, tag+1 and tag+2 respectively.
+//
+// The tags must be valid extension tags for the format e.g. 0-127 for msgpack.
+func SetImageExts(h Handle, tag uint64) (err error) {
+	bh := h.getBasicHandle()
+	for i, rt := range [...]reflect.Type{imagePointTyp, imageRectangleTyp, colorRGBATyp} {
+		if err = bh.SetExt(rt, tag+uint64(i), ImageExt); err != nil {
+			return
+		}
+	}
+	return
+}
+
+type imageExt struct{}
+
+func (imageExt) WriteExt(v interface{}) (bs []byte) {
+	switch x := baseRV(v).Interface().(type) {
+	case image.Point:
+		bs = AppendZigzagVarint(bs, int64(x.X))
+		bs = AppendZigzagVarint(bs, int64(x.Y))
+	case image.Rectangle:
+		bs = AppendZigzagVarint(bs, int64(x.Min.X))
+		bs = AppendZigzagVarint(bs, int64(x.Min.Y))
+		bs = AppendZigzagVarint(bs, int64(x.Max.X))
+		bs = AppendZigzagVarint(bs, int64(x.Max.Y))
+	case color.RGBA:
+		bs = []byte{x.R, x.G, x.B, x.A}
+	default:
+		halt.errorf("image ext: unsupported type: %T", v)
+	}
+	return
+}
+
+func (imageExt) ReadExt(dst interface{}, src []byte) {
+	var xs [4]int
+	switch dst.(type) {
+	case *image.Point, *image.Rectangle:
+		var n int
+		for i := range xs {
+			if len(src) == 0 {
+				break
+			}
+			var v int64
+			v, n = DecodeZigzagVarint(src)
+			if n <= 0 {
+				halt.errorf("image ext: invalid varint at: %v", src)
+			}
+			xs[i] = int(v)
+			src = src[n:]
+		}
+	case *color.RGBA:
+		if len(src) != 4 {
+			halt.errorf("image ext: expected 4 bytes for color.RGBA, got: %d", len(src))
+		}
+		*(dst.(*color.RGBA)) = color.RGBA{src[0], src[1], src[2], src[3]}
+		return
+	}
+	imageExtUpdate(dst, xs)
+}
+
+func (imageExt) ConvertExt(v interface{}) interface{} {
+	switch x := baseRV(v).Interface().(type) {
+	case image.Point:
+		return []int{x.X, x.Y}
+	case image.Rectangle:
+		return []int{x.Min.X, x.Min.Y, x.Max.X, x.Max.Y}
+	case color.RGBA:
+		return []int{int(x.R), int(x.G), int(x.B), int(x.A)}
+	}
+	halt.errorf("image ext: unsupported type: %T", v)
+	return nil
+}
+
+func (imageExt) UpdateExt(dst interface{}, src interface{}) {
+	// src is the []int (returned by ConvertExt) which was decoded into
+	var xs [4]int
+	switch v := src.(type) {
+	case []int:
+		copy(xs[:], v)
+	case *[]int:
+		copy(xs[:], *v)
+	case nil:
+	default:
+		halt.errorf("image ext: expected []int, got: %T", src)
+	}
+	imageExtUpdate(dst, xs)
+}
+
+func imageExtUpdate(dst interface{}, xs [4]int) {
+	switch x := dst.(type) {
+	case *image.Point:
+		*x = image.Point{X: xs[0], Y: xs[1]}
+	case *image.Rectangle:
+		*x = image.Rectangle{Min: image.Point{X: xs[0], Y: xs[1]}, Max: image.Point{X: xs[2], Y: xs[3]}}
+	case *color.RGBA:
+		*x = color.RGBA{uint8(xs[0]), uint8(xs[1]), uint8(xs[2]), uint8(xs[3])}
+	default:
+		halt.errorf("image ext: unsupported type: %T", dst)
+	}
+}
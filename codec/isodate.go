@@ -0,0 +1,122 @@
+// Copyright (c) 2012-2020 Ugorji Nwoke. All rights reserved.
+// Use of this source code is governed by a MIT license found in the LICENSE file.
+
+package codec
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// TimeEncoding configures how a time.Time is encoded (see EncodeOptions).
+type TimeEncoding uint8
+
+const (
+	// TimeNative encodes a time per the format (e.g. an RFC3339 string in json),
+	// or per TimeLayout if set (default).
+	TimeNative TimeEncoding = iota
+	// TimeISOWeekDate encodes the date of a time as an ISO 8601 week date e.g. "2024-W05-3",
+	// i.e. the ISO week-numbering year, the week (01-53) and the day of the week (1 is Monday).
+	TimeISOWeekDate
+	// TimeOrdinalDate encodes the date of a time as an ISO 8601 ordinal date e.g. "2024-035",
+	// i.e. the year and the day of the year (001-366).
+	TimeOrdinalDate
+)
+
+// isoDateFormat formats the date of t (in its location) per te.
+//
+// The ISO week-numbering year may differ from the calendar year near its boundaries
+// e.g. 2024-12-30 (a Monday) is "2025-W01-1", and 2021-01-01 (a Friday) is "2020-W53-5".
+func isoDateFormat(te TimeEncoding, t time.Time) (s string, err error) {
+	year, week := t.Year(), 0
+	if te == TimeISOWeekDate {
+		year, week = t.ISOWeek()
+	}
+	if year < 0 || year > 9999 {
+		return "", fmt.Errorf("cannot encode the year %d of %v in an ISO 8601 date: not within 0000-9999", year, t)
+	}
+	b := make([]byte, 0, 10)
+	b = isoDateAppendInt(b, year, 4)
+	switch te {
+	case TimeISOWeekDate:
+		wday := int(t.Weekday())
+		if wday == 0 { // Sunday is the 7th day of the ISO week
+			wday = 7
+		}
+		b = append(b, '-', 'W')
+		b = isoDateAppendInt(b, week, 2)
+		b = append(b, '-', byte('0'+wday))
+	case TimeOrdinalDate:
+		b = append(b, '-')
+		b = isoDateAppendInt(b, t.YearDay(), 3)
+	default:
+		return "", fmt.Errorf("unknown TimeEncoding: %d", te)
+	}
+	return string(b), nil
+}
+
+// isoDateAppendInt appends the non-negative v, padded with zeros to width digits.
+func isoDateAppendInt(b []byte, v, width int) []byte {
+	s := strconv.Itoa(v)
+	for i := len(s); i < width; i++ {
+		b = append(b, '0')
+	}
+	return append(b, s...)
+}
+
+// isoDateParse parses a date formatted per te, as midnight UTC of that date.
+func isoDateParse(te TimeEncoding, s string) (t time.Time, err error) {
+	var year, week, wday, yday int
+	var ok bool
+	switch te {
+	case TimeISOWeekDate: // YYYY-Www-D
+		ok = len(s) == 10 && s[4] == '-' && s[5] == 'W' && s[8] == '-' &&
+			isoDateAtoi(s[:4], &year) && isoDateAtoi(s[6:8], &week) && isoDateAtoi(s[9:], &wday) &&
+			week >= 1 && week <= 53 && wday >= 1 && wday <= 7
+		if ok {
+			// January 4 is always in week 1, which starts on the Monday on or before it
+			jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, time.UTC)
+			jan4wday := int(jan4.Weekday())
+			if jan4wday == 0 {
+				jan4wday = 7
+			}
+			t = jan4.AddDate(0, 0, (week-1)*7+wday-jan4wday)
+			// week 53 exists only in a year which has 53 weeks
+			y2, w2 := t.ISOWeek()
+			ok = y2 == year && w2 == week
+		}
+	case TimeOrdinalDate: // YYYY-DDD
+		ok = len(s) == 8 && s[4] == '-' &&
+			isoDateAtoi(s[:4], &year) && isoDateAtoi(s[5:], &yday) && yday >= 1 && yday <= 366
+		if ok {
+			t = time.Date(year, time.January, yday, 0, 0, 0, 0, time.UTC)
+			ok = t.Year() == year // day 366 exists only in a leap year
+		}
+	default:
+		return t, fmt.Errorf("unknown TimeEncoding: %d", te)
+	}
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid ISO 8601 %s date: %q", isoDateName(te), s)
+	}
+	return
+}
+
+func isoDateName(te TimeEncoding) string {
+	if te == TimeISOWeekDate {
+		return "week"
+	}
+	return "ordinal"
+}
+
+// isoDateAtoi parses the decimal digits s into v, returning false if s has a non-digit.
+func isoDateAtoi(s string, v *int) bool {
+	*v = 0
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+		*v = *v*10 + int(s[i]-'0')
+	}
+	return true
+}
@@ -20,6 +20,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"math"
+	"math/big"
 	"reflect"
 	"strconv"
 	"time"
@@ -167,10 +168,24 @@ type jsonEncDriver struct {
 
 	ks bool // map key as string
 	is byte // integer as string
+	fs bool // float as string
+	bm bool // write the BOM before the first value
 
 	typical bool
 	rawext  bool // rawext configured on the handle
 
+	nt   []byte // NullToken configured on the handle
+	ntOK bool   // nt is valid
+
+	isep   []byte // ItemSeparator configured on the handle (nil if the default)
+	kvsep  []byte // KeyValueSeparator configured on the handle (nil if the default)
+	sepErr string // the separator which is invalid (if not LenientSeparators)
+
+	// b64 holds the bytes (b64n of them) carried over to the next piece of []byte
+	// written as base64 (see WriteBytesStart), as base64 encodes 3 bytes at a time.
+	b64  [3]byte
+	b64n uint8
+
 	s *bitset256 // safe set for characters (taking h.HTMLAsIs into consideration)
 
 	// buf *[]byte // used mostly for encoding []byte
@@ -214,7 +229,7 @@ func (e *jsonEncDriver) writeIndent() {
 
 func (e *jsonEncDriver) WriteArrayElem() {
 	if e.e.c != containerArrayStart {
-		e.e.encWr.writen1(',')
+		e.writeItemSep()
 	}
 	if e.d {
 		e.writeIndent()
@@ -223,7 +238,7 @@ func (e *jsonEncDriver) WriteArrayElem() {
 
 func (e *jsonEncDriver) WriteMapElemKey() {
 	if e.e.c != containerMapStart {
-		e.e.encWr.writen1(',')
+		e.writeItemSep()
 	}
 	if e.d {
 		e.writeIndent()
@@ -231,22 +246,94 @@ func (e *jsonEncDriver) WriteMapElemKey() {
 }
 
 func (e *jsonEncDriver) WriteMapElemValue() {
-	if e.d {
+	if e.kvsep != nil {
+		e.checkSeps()
+		e.e.encWr.writeb(e.kvsep)
+	} else if e.d {
 		e.e.encWr.writen2(':', ' ')
 	} else {
 		e.e.encWr.writen1(':')
 	}
 }
 
+// writeComment writes each line of a comment as a // line,
+// followed by the indent for the key after it (if AllowComments and indenting).
+func (e *jsonEncDriver) writeComment(lines []string) {
+	if !e.h.AllowComments || !e.d {
+		return
+	}
+	for _, s := range lines {
+		if s == "" {
+			e.e.encWr.writen2('/', '/')
+		} else {
+			e.e.encWr.writestr("// ")
+			e.e.encWr.writestr(s)
+		}
+		e.writeIndent()
+	}
+}
+
+func (e *jsonEncDriver) writeItemSep() {
+	if e.isep != nil {
+		e.checkSeps()
+		e.e.encWr.writeb(e.isep)
+	} else {
+		e.e.encWr.writen1(',')
+	}
+}
+
+func (e *jsonEncDriver) checkSeps() {
+	if e.sepErr != "" {
+		halt.errorf("invalid %s: must be the json separator with optional whitespace, unless LenientSeparators", e.sepErr)
+	}
+}
+
+// jsonValidSep reports whether v is the separator c, with optional (json) whitespace around it.
+func jsonValidSep(v []byte, c byte) bool {
+	var n int
+	for _, b := range v {
+		if b == c {
+			n++
+		} else if b != ' ' && b != '\t' && b != '\n' && b != '\r' {
+			return false
+		}
+	}
+	return n == 1
+}
+
 func (e *jsonEncDriver) EncodeNil() {
 	// We always encode nil as just null (never in quotes)
 	// This allows us to easily decode if a nil in the json stream
 	// ie if initial token is n.
 
 	// e.e.encWr.writeb(jsonLiteralNull)
+	if e.nt != nil {
+		if !e.ntOK {
+			halt.errorf("invalid NullToken: %q: must be null or a quoted string (which needs no escaping)", e.nt)
+		}
+		e.e.encWr.writeb(e.nt)
+		return
+	}
 	e.e.encWr.writen4([4]byte{'n', 'u', 'l', 'l'})
 }
 
+// jsonValidNullToken returns true if a NullToken is null or a quoted string
+// (without characters which need escaping).
+func jsonValidNullToken(v []byte) bool {
+	if bytes.Equal(v, jsonLiteralNull) {
+		return true
+	}
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return false
+	}
+	for _, c := range v[1 : len(v)-1] {
+		if c == '"' || c == '\\' || c < 0x20 {
+			return false
+		}
+	}
+	return true
+}
+
 func (e *jsonEncDriver) EncodeTime(t time.Time) {
 	// Do NOT use MarshalJSON, as it allocates internally.
 	// instead, we call AppendFormat directly, using our scratch buffer (e.b)
@@ -306,7 +393,7 @@ func (e *jsonEncDriver) EncodeBool(b bool) {
 
 func (e *jsonEncDriver) encodeFloat(f float64, bitsize, fmt byte, prec int8) {
 	var blen uint
-	if e.ks && e.e.c == containerMapKey {
+	if e.fs || (e.ks && e.e.c == containerMapKey) {
 		blen = 2 + uint(len(strconv.AppendFloat(e.b[1:1], f, fmt, int(prec), int(bitsize))))
 		// _ = e.b[:blen]
 		e.b[0] = '"'
@@ -317,7 +404,21 @@ func (e *jsonEncDriver) encodeFloat(f float64, bitsize, fmt byte, prec int8) {
 	}
 }
 
+// encodeFormatted writes s, as returned by a NumberFormatter, IntFormatter or UintFormatter.
+func (e *jsonEncDriver) encodeFormatted(s string) {
+	if e.ks && e.e.c == containerMapKey {
+		e.e.encWr.writeqstr(s)
+	} else {
+		e.e.encWr.writestr(s)
+	}
+}
+
 func (e *jsonEncDriver) EncodeFloat64(f float64) {
+	e.e.checkFloatSpecial(f)
+	if e.h.NumberFormatter != nil {
+		e.encodeFormatted(e.h.NumberFormatter(f))
+		return
+	}
 	if math.IsNaN(f) || math.IsInf(f, 0) {
 		e.EncodeNil()
 		return
@@ -327,6 +428,11 @@ func (e *jsonEncDriver) EncodeFloat64(f float64) {
 }
 
 func (e *jsonEncDriver) EncodeFloat32(f float32) {
+	e.e.checkFloatSpecial(float64(f))
+	if e.h.NumberFormatter != nil {
+		e.encodeFormatted(e.h.NumberFormatter(float64(f)))
+		return
+	}
 	if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
 		e.EncodeNil()
 		return
@@ -389,7 +495,22 @@ func (e *jsonEncDriver) encodeUint(neg bool, quotes bool, u uint64) {
 	e.e.encWr.writeb(a[i:])
 }
 
+// EncodeDecimal writes the decimal as a number in decimal notation e.g. 123.45
+// (quoted if a map key).
+func (e *jsonEncDriver) EncodeDecimal(exp int64, mantissa *big.Int) {
+	s := decimalString(exp, mantissa)
+	if e.ks && e.e.c == containerMapKey {
+		e.e.encWr.writeqstr(s)
+	} else {
+		e.e.encWr.writestr(s)
+	}
+}
+
 func (e *jsonEncDriver) EncodeInt(v int64) {
+	if e.h.IntFormatter != nil {
+		e.encodeFormatted(e.h.IntFormatter(v))
+		return
+	}
 	quotes := e.is == 'A' || e.is == 'L' && (v > 1<<53 || v < -(1<<53)) ||
 		(e.ks && e.e.c == containerMapKey)
 
@@ -413,6 +534,10 @@ func (e *jsonEncDriver) EncodeInt(v int64) {
 }
 
 func (e *jsonEncDriver) EncodeUint(v uint64) {
+	if e.h.UintFormatter != nil {
+		e.encodeFormatted(e.h.UintFormatter(v))
+		return
+	}
 	quotes := e.is == 'A' || e.is == 'L' && v > 1<<53 || (e.ks && e.e.c == containerMapKey)
 
 	if cpu32Bit {
@@ -433,10 +558,18 @@ func (e *jsonEncDriver) EncodeUint(v uint64) {
 
 func (e *jsonEncDriver) EncodeString(v string) {
 	if e.h.StringToRaw {
-		e.EncodeStringBytesRaw(bytesView(v))
+		if e.e.c != containerMapKey {
+			e.EncodeStringBytesRaw(bytesView(v))
+			return
+		}
+		// a json object key must be a string, so it cannot be written as raw bytes
+		if !utf8.ValidString(v) {
+			e.e.errorf("json: cannot encode map key with invalid UTF-8 as a string (StringToRaw): %q", v)
+		}
+		e.quoteStr(v)
 		return
 	}
-	e.quoteStr(v)
+	e.quoteStr(e.e.encodeUTF8(v))
 }
 
 func (e *jsonEncDriver) EncodeStringBytesRaw(v []byte) {
@@ -469,6 +602,47 @@ func (e *jsonEncDriver) EncodeStringBytesRaw(v []byte) {
 	e.e.encWr.writeb(bs)
 }
 
+// WriteBytesStart writes the start of a []byte as a base64 string, whose length need not be known.
+// It cannot stream one if a RawBytesExt is configured.
+func (e *jsonEncDriver) WriteBytesStart(length int64) bool {
+	if e.rawext {
+		return false
+	}
+	e.b64n = 0
+	e.e.encWr.writen1('"')
+	return true
+}
+
+func (e *jsonEncDriver) WriteBytesChunk(v []byte) {
+	if e.b64n != 0 {
+		k := copy(e.b64[e.b64n:], v)
+		if e.b64n += uint8(k); e.b64n < 3 {
+			return
+		}
+		e.writeBase64(e.b64[:])
+		v = v[k:]
+	}
+	n := len(v) / 3 * 3
+	e.writeBase64(v[:n])
+	e.b64n = uint8(copy(e.b64[:], v[n:]))
+}
+
+func (e *jsonEncDriver) WriteBytesEnd() {
+	e.writeBase64(e.b64[:e.b64n])
+	e.b64n = 0
+	e.e.encWr.writen1('"')
+}
+
+func (e *jsonEncDriver) writeBase64(v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	slen := base64.StdEncoding.EncodedLen(len(v))
+	bs := e.e.blist.peek(slen, false)[:slen]
+	base64.StdEncoding.Encode(bs, v)
+	e.e.encWr.writeb(bs)
+}
+
 // indent is done as below:
 //   - newline and indent are added before each mapKey or arrayElem
 //   - newline and indent are added before each ending,
@@ -482,6 +656,9 @@ func (e *jsonEncDriver) WriteArrayStart(length int) {
 }
 
 func (e *jsonEncDriver) WriteArrayEnd() {
+	if e.h.TrailingComma && e.e.c != containerArrayStart {
+		e.writeItemSep()
+	}
 	if e.d {
 		e.dl--
 		e.writeIndent()
@@ -496,7 +673,18 @@ func (e *jsonEncDriver) WriteMapStart(length int) {
 	e.e.encWr.writen1('{')
 }
 
+func (e *jsonEncDriver) WriteMapStartIndefinite() {
+	e.WriteMapStart(-1)
+}
+
+func (e *jsonEncDriver) WriteMapEndIndefinite() {
+	e.WriteMapEnd()
+}
+
 func (e *jsonEncDriver) WriteMapEnd() {
+	if e.h.TrailingComma && e.e.c != containerMapStart {
+		e.writeItemSep()
+	}
 	if e.d {
 		e.dl--
 		if e.e.c != containerMapStart {
@@ -581,6 +769,14 @@ func (e *jsonEncDriver) quoteStr(s string) {
 	w.writen1('"')
 }
 
+func (e *jsonEncDriver) atStartOfEncode() {
+	if e.bm {
+		e.bm = false
+		e.e.encWr.writen2(0xef, 0xbb)
+		e.e.encWr.writen1(0xbf)
+	}
+}
+
 func (e *jsonEncDriver) atEndOfEncode() {
 	if e.h.TermWhitespace {
 		var c byte = ' ' // default is that scalar is written, so output space
@@ -843,6 +1039,13 @@ func (d *jsonDecDriver) DecodeBool() (v bool) {
 	case 't':
 		d.readLit4True(d.d.decRd.readn3())
 		v = true
+	case '0', '1': // written when EncodeOptions.BoolAsInt
+		if fquot {
+			v = d.tok == '1'
+			d.tok = 0
+		} else {
+			v = d.d.boolFromInt()
+		}
 	default:
 		d.d.errorf("decode bool: got first char %c", d.tok)
 		// v = false // "unreachable"
@@ -1297,6 +1500,7 @@ func (d *jsonDecDriver) DecodeNaked() {
 // Note also that the float values for NaN, +Inf or -Inf are encoded as null,
 // as suggested by NOTE 4 of the ECMA-262 ECMAScript Language Specification 5.1 edition.
 // see http://www.ecma-international.org/publications/files/ECMA-ST/Ecma-262.pdf .
+// Set FloatSpecials to FloatSpecialsError (or FloatSpecialsPreserveNative) to return an error for them instead.
 type JsonHandle struct {
 	textEncodingType
 	BasicHandle
@@ -1317,8 +1521,21 @@ type JsonHandle struct {
 	//   - if 'A', then encode all integers as a json string
 	//             containing the exact integer representation as a decimal.
 	//   - else    encode all integers as a json number (default)
+	//
+	// Decoding into an integer always accepts a json string containing the integer,
+	// regardless of IntegerAsString, so the values round-trip.
 	IntegerAsString byte
 
+	// FloatAsString controls whether floats (float32 and float64) are encoded as a json string
+	// containing the shortest decimal representation which round-trips exactly.
+	//
+	// Use this when the consumer (e.g. javascript) may lose precision of the json numbers.
+	// Decoding a float from a json string is always supported, so this round-trips.
+	//
+	// Note that NaN and Infinity are still encoded as null, as they cannot be represented
+	// as a decimal.
+	FloatAsString bool
+
 	// HTMLCharsAsIs controls how to encode some special characters to html: < > &
 	//
 	// By default, we encode them as \uXXX
@@ -1337,12 +1554,74 @@ type JsonHandle struct {
 	// where multiple items are written to a stream.
 	TermWhitespace bool
 
+	// WriteBOM says that we write the UTF-8 byte order mark (EF BB BF)
+	// before the first value encoded after a Reset.
+	//
+	// Some (windows) tools expect it at the start of a json file.
+	// It is never written mid-stream i.e. by subsequent calls to Encode.
+	WriteBOM bool
+
 	// MapKeyAsString says to encode all map keys as strings.
 	//
 	// Use this to enforce strict json output.
 	// The only caveat is that nil value is ALWAYS written as null (never as "null")
 	MapKeyAsString bool
 
+	// NumberFormatter, if set, formats each float (float32 and float64) for display,
+	// e.g. with thousands separators or a fixed number of decimals: 1,234.50
+	//
+	// IntFormatter and UintFormatter do the same for signed and unsigned integers.
+	//
+	// The returned string is written verbatim (quoted if a map key and MapKeyAsString),
+	// and it is the caller's responsibility that it is valid. The output is typically
+	// not standard (parseable) json, so use these for display only e.g. a human-readable export.
+	NumberFormatter func(f float64) string
+	IntFormatter    func(i int64) string
+	UintFormatter   func(u uint64) string
+
+	// NullToken, if set, is written instead of null e.g. "NULL" (including the quotes),
+	// for a consumer which expects that. It is written wherever null is
+	// (e.g. for a nil value, or a NaN float).
+	//
+	// It must be null or a quoted string (which needs no escaping), so the output is still json;
+	// else encoding fails. Note that decoding does not treat it as nil.
+	NullToken []byte
+
+	// TrailingComma says to write a comma after the last element of each non-empty array and map
+	// e.g. [1,2,] and {"a":1,}, for a lenient consumer like a JSON5 parser
+	// (which also eases hand-editing the output).
+	//
+	// This is NOT standard json, and cannot be decoded by this package.
+	// An empty array or map is written without a comma i.e. [] and {}.
+	// If ItemSeparator is set, it is written in place of the comma.
+	TrailingComma bool
+
+	// AllowComments says to write the comment of each struct field tagged with the "comment=text"
+	// option as // lines before its key (as in JSONC) e.g. for a self-documenting config file.
+	// A `\n` in the text (or a newline) starts another line.
+	//
+	// This is NOT standard json, and cannot be decoded by this package.
+	// Comments are only written when indenting (see Indent), as in compact output
+	// a line comment would swallow the rest of it.
+	AllowComments bool
+
+	// ItemSeparator and KeyValueSeparator, if set, are written in place of the comma
+	// between the elements of an array (or the entries of a map), and of the colon
+	// between a key and its value, respectively e.g. ", " and " = ".
+	// None is written after the last element or entry (unless TrailingComma).
+	//
+	// If Indent is set, the newline and indentation follow the ItemSeparator,
+	// and the KeyValueSeparator replaces the ": " written when indenting.
+	//
+	// Each must be the json separator (',' or ':') with optional whitespace around it,
+	// so the output is still json; else encoding fails, unless LenientSeparators
+	// e.g. for a json-like dialect. Such output may not be decoded by this package.
+	ItemSeparator     string
+	KeyValueSeparator string
+
+	// LenientSeparators allows an ItemSeparator or KeyValueSeparator which is not valid json.
+	LenientSeparators bool
+
 	// _ uint64 // padding (cache line)
 
 	// Note: below, we store hardly-used items e.g. RawBytesExt.
@@ -1362,7 +1641,8 @@ func (h *JsonHandle) Name() string { return "json" }
 func (h *JsonHandle) desc(bd byte) string { return string(bd) }
 
 func (h *JsonHandle) typical() bool {
-	return h.Indent == 0 && !h.MapKeyAsString && h.IntegerAsString != 'A' && h.IntegerAsString != 'L'
+	return h.Indent == 0 && !h.MapKeyAsString && !h.FloatAsString &&
+		h.IntegerAsString != 'A' && h.IntegerAsString != 'L'
 }
 
 func (h *JsonHandle) newEncDriver() encDriver {
@@ -1403,10 +1683,29 @@ func (e *jsonEncDriver) reset() {
 		e.s = &jsonCharHtmlSafeSet
 	}
 	e.rawext = e.h.RawBytesExt != nil
+	e.nt, e.ntOK = nil, false
+	if len(e.h.NullToken) != 0 {
+		e.nt, e.ntOK = e.h.NullToken, jsonValidNullToken(e.h.NullToken)
+	}
+	e.isep, e.kvsep, e.sepErr = nil, nil, ""
+	if e.h.ItemSeparator != "" {
+		e.isep = []byte(e.h.ItemSeparator)
+		if !e.h.LenientSeparators && !jsonValidSep(e.isep, ',') {
+			e.sepErr = "ItemSeparator"
+		}
+	}
+	if e.h.KeyValueSeparator != "" {
+		e.kvsep = []byte(e.h.KeyValueSeparator)
+		if !e.h.LenientSeparators && !jsonValidSep(e.kvsep, ':') && e.sepErr == "" {
+			e.sepErr = "KeyValueSeparator"
+		}
+	}
 	e.di = int8(e.h.Indent)
 	e.d = e.h.Indent != 0
 	e.ks = e.h.MapKeyAsString
 	e.is = e.h.IntegerAsString
+	e.fs = e.h.FloatAsString
+	e.bm = e.h.WriteBOM
 }
 
 func (d *jsonDecDriver) resetState() {
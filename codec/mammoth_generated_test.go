@@ -3437,6 +3437,9 @@ func doTestMammoth(t *testing.T, h Handle) {
 		defer func(b bool) { mh.RawToString = b }(mh.RawToString)
 		mh.RawToString = true
 	}
+	bh := testBasicHandle(h)
+	defer func(b bool) { bh.AllowUintptr = b }(bh.AllowUintptr)
+	bh.AllowUintptr = true // TestMammoth has uintptr fields
 
 	name := h.Name()
 	var b []byte
@@ -24,6 +24,7 @@ import (
 	"net/rpc"
 	"reflect"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -248,11 +249,13 @@ func (e *msgpackEncDriver) EncodeBool(b bool) {
 }
 
 func (e *msgpackEncDriver) EncodeFloat32(f float32) {
+	e.e.checkFloatSpecial(float64(f))
 	e.e.encWr.writen1(mpFloat)
 	bigen.writeUint32(e.e.w(), math.Float32bits(f))
 }
 
 func (e *msgpackEncDriver) EncodeFloat64(f float64) {
+	e.e.checkFloatSpecial(f)
 	e.e.encWr.writen1(mpDouble)
 	bigen.writeUint64(e.e.w(), math.Float64bits(f))
 }
@@ -274,7 +277,7 @@ func (e *msgpackEncDriver) EncodeTime(t time.Time) {
 	} else {
 		l = 12
 	}
-	if e.h.WriteExt {
+	if e.h.WriteExt || e.h.TimeExt {
 		e.encodeExtPreamble(mpTimeExtTagU, l)
 	} else {
 		e.writeContainerLen(msgpackContainerRawLegacy, l)
@@ -358,6 +361,9 @@ func (e *msgpackEncDriver) WriteMapStart(length int) {
 
 func (e *msgpackEncDriver) EncodeString(s string) {
 	var ct msgpackContainerType
+	if !e.h.StringToRaw {
+		s = e.e.encodeUTF8(s)
+	}
 	if e.h.WriteExt {
 		if e.h.StringToRaw {
 			ct = msgpackContainerBin
@@ -379,7 +385,12 @@ func (e *msgpackEncDriver) EncodeStringBytesRaw(bs []byte) {
 		return
 	}
 	if e.h.WriteExt {
-		e.writeContainerLen(msgpackContainerBin, len(bs))
+		if e.h.RawToStringIfUTF8 && (e.h.RawToStringIfUTF8MaxLen <= 0 || len(bs) <= e.h.RawToStringIfUTF8MaxLen) &&
+			utf8.Valid(bs) {
+			e.writeContainerLen(msgpackContainerStr, len(bs))
+		} else {
+			e.writeContainerLen(msgpackContainerBin, len(bs))
+		}
 	} else {
 		e.writeContainerLen(msgpackContainerRawLegacy, len(bs))
 	}
@@ -388,6 +399,26 @@ func (e *msgpackEncDriver) EncodeStringBytesRaw(bs []byte) {
 	}
 }
 
+// WriteBytesStart writes the start of a byte string of a known length, as EncodeStringBytesRaw does.
+// It cannot stream one whose length is unknown, or which may be written as a string (RawToStringIfUTF8).
+func (e *msgpackEncDriver) WriteBytesStart(length int64) bool {
+	if length < 0 || length > math.MaxUint32 || (e.h.WriteExt && e.h.RawToStringIfUTF8) {
+		return false
+	}
+	if e.h.WriteExt {
+		e.writeContainerLen(msgpackContainerBin, int(length))
+	} else {
+		e.writeContainerLen(msgpackContainerRawLegacy, int(length))
+	}
+	return true
+}
+
+func (e *msgpackEncDriver) WriteBytesChunk(v []byte) {
+	e.e.encWr.writeb(v)
+}
+
+func (e *msgpackEncDriver) WriteBytesEnd() {}
+
 func (e *msgpackEncDriver) writeContainerLen(ct msgpackContainerType, l int) {
 	if ct.fixCutoff > 0 && l < int(ct.fixCutoff) {
 		e.e.encWr.writen1(ct.bFixMin | byte(l))
@@ -815,6 +846,8 @@ func (d *msgpackDecDriver) DecodeBool() (b bool) {
 		// b = false
 	} else if d.bd == mpTrue || d.bd == 1 {
 		b = true
+	} else if d.bd >= mpUint8 && d.bd <= mpInt64 {
+		return d.d.boolFromInt()
 	} else {
 		d.d.errorf("cannot decode bool: %s: %x/%s", msgBadDesc, d.bd, mpdesc(d.bd))
 	}
@@ -1092,6 +1125,28 @@ type MsgpackHandle struct {
 
 	// PositiveIntUnsigned says to encode positive integers as unsigned.
 	PositiveIntUnsigned bool
+
+	// TimeExt says to always encode a time.Time using the timestamp extension (type -1)
+	// defined by the spec, even if WriteExt=false.
+	//
+	// The smallest of the 32-bit, 64-bit and 96-bit forms which holds the time is used.
+	// Times before 1970 (or after 2514) always need the 96-bit form.
+	//
+	// As with WriteExt, the zero time is encoded as nil.
+	TimeExt bool
+
+	// RawToStringIfUTF8 says to encode a []byte which is valid UTF-8 as a str, and others as a bin.
+	// It is the inverse of StringToRaw, for consumers which distinguish text from binary by the msgpack type.
+	//
+	// An empty (non-nil) []byte is valid UTF-8, and so is encoded as an empty str.
+	// It only applies with WriteExt=true, as the old spec has no distinct bin type.
+	RawToStringIfUTF8 bool
+
+	// RawToStringIfUTF8MaxLen bounds the length of a []byte checked for RawToStringIfUTF8,
+	// as the check scans it all. A longer []byte is encoded as a bin without checking.
+	//
+	// If <= 0, all are checked.
+	RawToStringIfUTF8MaxLen int
 }
 
 // Name returns the name of the handle: msgpack
@@ -1115,6 +1170,23 @@ func (h *MsgpackHandle) newDecDriver() decDriver {
 	return d
 }
 
+// EncodeMsgpackExt encodes data as a msgpack ext of the given type, as a single value
+// e.g. from within CodecEncodeSelf, without implementing an Ext for a one-off extension.
+//
+// The ext is written in its smallest form: a fixext for a payload of 1, 2, 4, 8 or 16 bytes,
+// else an ext 8, 16 or 32. It is written so even if WriteExt is false.
+//
+// It is an error if the Encoder does not use a MsgpackHandle.
+func (e *Encoder) EncodeMsgpackExt(typ int8, data []byte) (err error) {
+	if _, ok := e.hh.(*MsgpackHandle); !ok {
+		return fmt.Errorf("cannot encode a msgpack ext with a %s handle", e.hh.Name())
+	}
+	if uint64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("cannot encode a msgpack ext of %d bytes: more than the maximum", len(data))
+	}
+	return e.Encode(&RawExt{Tag: uint64(uint8(typ)), Data: data})
+}
+
 //--------------------------------------------------
 
 type msgpackSpecRpcCodec struct {
@@ -0,0 +1,116 @@
+// Copyright (c) 2012-2020 Ugorji Nwoke. All rights reserved.
+// Use of this source code is governed by a MIT license found in the LICENSE file.
+
+package codec
+
+import (
+	"net"
+	"reflect"
+)
+
+var (
+	netIPTyp    = reflect.TypeOf(net.IP{})
+	netIPNetTyp = reflect.TypeOf(net.IPNet{})
+)
+
+// NetExt is an extension which encodes net.IP and net.IPNet as strings,
+// i.e. as returned by their String methods e.g. "192.0.2.1" and "192.0.2.0/24",
+// instead of as raw bytes (or base64 in json).
+//
+// An IPv4 address is written in its dotted form, whether held in 4 or 16 bytes,
+// and is decoded into its 16-byte form (as net.ParseIP returns). Compare them via net.IP.Equal.
+// A net.IPNet is decoded as written i.e. its IP keeps any host bits e.g. "192.0.2.1/24".
+// A nil net.IP is encoded as nil, and a zero net.IPNet as an empty string; both are decoded back.
+//
+// Formats which use a BytesExt (e.g. msgpack, binc, simple) encode the string as the bytes of the extension.
+//
+// It is not registered by default. Register it via SetNetExts, or via SetInterfaceExt/SetBytesExt
+// on the handle for one of the types. Register another extension for a type to override it.
+var NetExt Ext = netExt{}
+
+// SetNetExts registers NetExt on the handle for net.IP and net.IPNet,
+// using the tags: tag and tag+1 respectively.
+//
+// The tags must be valid extension tags for the format e.g. 0-127 for msgpack.
+func SetNetExts(h Handle, tag uint64) (err error) {
+	bh := h.getBasicHandle()
+	for i, rt := range [...]reflect.Type{netIPTyp, netIPNetTyp} {
+		if err = bh.SetExt(rt, tag+uint64(i), NetExt); err != nil {
+			return
+		}
+	}
+	return
+}
+
+type netExt struct{}
+
+// netExtString returns the string form of v, or "" if it is a nil (or empty) net.IP or a zero net.IPNet.
+func netExtString(v interface{}) string {
+	switch x := baseRV(v).Interface().(type) {
+	case net.IP:
+		if len(x) == 0 {
+			return ""
+		}
+		return x.String()
+	case net.IPNet:
+		if len(x.IP) == 0 && len(x.Mask) == 0 {
+			return ""
+		}
+		return x.String()
+	}
+	halt.errorf("net ext: unsupported type: %T", v)
+	return ""
+}
+
+func (netExt) WriteExt(v interface{}) []byte {
+	return []byte(netExtString(v))
+}
+
+func (netExt) ReadExt(dst interface{}, src []byte) {
+	netExtUpdate(dst, string(src))
+}
+
+func (netExt) ConvertExt(v interface{}) interface{} {
+	// always a string (even if empty), as decoding converts the value to decode into
+	return netExtString(v)
+}
+
+func (netExt) UpdateExt(dst interface{}, src interface{}) {
+	// src is the string (returned by ConvertExt) which was decoded into
+	switch v := src.(type) {
+	case string:
+		netExtUpdate(dst, v)
+	case []byte:
+		netExtUpdate(dst, string(v))
+	case nil:
+		netExtUpdate(dst, "")
+	default:
+		halt.errorf("net ext: expected string, got: %T", src)
+	}
+}
+
+func netExtUpdate(dst interface{}, s string) {
+	switch x := dst.(type) {
+	case *net.IP:
+		if s == "" {
+			*x = nil
+		} else if *x = net.ParseIP(s); *x == nil {
+			halt.errorf("net ext: invalid IP address: %q", s)
+		}
+	case *net.IPNet:
+		if s == "" {
+			*x = net.IPNet{}
+			return
+		}
+		ip, n, err := net.ParseCIDR(s)
+		if err != nil {
+			halt.errorf("net ext: invalid CIDR address: %q: %v", s, err)
+		}
+		if len(n.Mask) == net.IPv4len {
+			ip = ip.To4()
+		}
+		*x = net.IPNet{IP: ip, Mask: n.Mask} // keep the host bits, as written
+	default:
+		halt.errorf("net ext: unsupported type: %T", dst)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2012-2020 Ugorji Nwoke. All rights reserved.
+// Use of this source code is governed by a MIT license found in the LICENSE file.
+
+package codec
+
+import (
+	"reflect"
+	"sort"
+)
+
+// schemaMaxDepth bounds the walk, so a cyclic value or type (through pointers) still terminates.
+const schemaMaxDepth = 64
+
+// Schema describes the shape of an encoded value (see Encoder.EncodeWithSchema):
+// its kind and type, and those of the values nested within it, as a tree.
+//
+// The shape is that of the value, not just its declared type: a non-nil pointer or interface
+// is described by the value it holds e.g. the concrete type within an interface{}.
+//
+//   - a struct (other than time.Time) has a Field for each field encoded, named as encoded
+//     (including those which omitempty may omit), in the order encoded as an array.
+//   - a map with string keys has a Field for each entry, named by its key, in sorted order.
+//     This describes a dynamic map (e.g. a map[string]interface{}) as a struct.
+//     An empty one, or any other map, has an Elem which describes its value type.
+//   - a slice or array has an Elem, which describes its first element,
+//     or its element type if it is empty. A []byte or [N]byte is encoded as bytes,
+//     and has no Elem.
+//
+// A nil pointer has Kind reflect.Ptr, and a nil interface has Kind reflect.Invalid (and no Type).
+// Where no value is seen (e.g. an empty slice), the shape is that of the type,
+// where an interface has Kind reflect.Interface.
+//
+// A value with a custom encoding (Selfer, extension, Marshaler, etc) is described by its structure,
+// which may differ from what it encodes to.
+type Schema struct {
+	Name   string
+	Kind   reflect.Kind
+	Type   reflect.Type
+	Fields []Schema
+	Elem   *Schema
+}
+
+type schemaBuilder struct {
+	h *BasicHandle
+}
+
+func (z schemaBuilder) of(v interface{}) Schema {
+	rv, ok := v.(reflect.Value)
+	if !ok {
+		rv = reflect.ValueOf(v)
+	}
+	return z.value(rv, 0)
+}
+
+// value returns the shape of rv, walking the values it holds.
+func (z schemaBuilder) value(rv reflect.Value, depth int) (s Schema) {
+	for rv.Kind() == reflect.Interface && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() || rv.Kind() == reflect.Interface { // nil
+		return
+	}
+	if rv.Kind() == reflect.Ptr && !rv.IsNil() {
+		return z.value(rv.Elem(), depth)
+	}
+	rt := rv.Type()
+	s.Kind, s.Type = rt.Kind(), rt
+	if depth >= schemaMaxDepth {
+		return
+	}
+	depth++
+	switch s.Kind {
+	case reflect.Struct:
+		if rt == timeTyp {
+			return
+		}
+		ti := z.h.getTypeInfo(rt2id(rt), rt)
+		sis := ti.sfi.source()
+		s.Fields = make([]Schema, len(sis))
+		for i, si := range sis {
+			if rvf := si.path.field(rv); rvf.IsValid() {
+				s.Fields[i] = z.value(rvf, depth)
+			} else { // within a nil embedded pointer
+				s.Fields[i] = z.typ(si.path.typ, depth)
+			}
+			s.Fields[i].Name = si.encName
+		}
+	case reflect.Slice, reflect.Array:
+		if rt.Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		var elem Schema
+		if rv.Len() == 0 {
+			elem = z.typ(rt.Elem(), depth)
+		} else {
+			elem = z.value(rv.Index(0), depth)
+		}
+		s.Elem = &elem
+	case reflect.Map:
+		if rt.Key().Kind() != reflect.String || rv.Len() == 0 {
+			elem := z.typ(rt.Elem(), depth)
+			s.Elem = &elem
+			return
+		}
+		keys := rv.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		s.Fields = make([]Schema, len(keys))
+		for i, k := range keys {
+			s.Fields[i] = z.value(rv.MapIndex(k), depth)
+			s.Fields[i].Name = k.String()
+		}
+	}
+	return
+}
+
+// typ returns the shape of the type rt, where no value is seen.
+func (z schemaBuilder) typ(rt reflect.Type, depth int) (s Schema) {
+	s.Kind, s.Type = rt.Kind(), rt
+	if depth >= schemaMaxDepth {
+		return
+	}
+	depth++
+	switch s.Kind {
+	case reflect.Ptr:
+		return z.typ(rt.Elem(), depth)
+	case reflect.Struct:
+		if rt == timeTyp {
+			return
+		}
+		ti := z.h.getTypeInfo(rt2id(rt), rt)
+		sis := ti.sfi.source()
+		s.Fields = make([]Schema, len(sis))
+		for i, si := range sis {
+			s.Fields[i] = z.typ(si.path.typ, depth)
+			s.Fields[i].Name = si.encName
+		}
+	case reflect.Slice, reflect.Array, reflect.Map:
+		if s.Kind != reflect.Map && rt.Elem().Kind() == reflect.Uint8 {
+			return
+		}
+		elem := z.typ(rt.Elem(), depth)
+		s.Elem = &elem
+	}
+	return
+}
@@ -88,6 +88,7 @@ func (e *simpleEncDriver) EncodeBool(b bool) {
 }
 
 func (e *simpleEncDriver) EncodeFloat32(f float32) {
+	e.e.checkFloatSpecial(float64(f))
 	if e.h.EncZeroValuesAsNil && e.e.c != containerMapKey && f == 0.0 {
 		e.EncodeNil()
 		return
@@ -97,6 +98,7 @@ func (e *simpleEncDriver) EncodeFloat32(f float32) {
 }
 
 func (e *simpleEncDriver) EncodeFloat64(f float64) {
+	e.e.checkFloatSpecial(f)
 	if e.h.EncZeroValuesAsNil && e.e.c != containerMapKey && f == 0.0 {
 		e.EncodeNil()
 		return
@@ -204,6 +206,7 @@ func (e *simpleEncDriver) EncodeString(v string) {
 	if e.h.StringToRaw {
 		e.encLen(simpleVdByteArray, len(v))
 	} else {
+		v = e.e.encodeUTF8(v)
 		e.encLen(simpleVdString, len(v))
 	}
 	e.e.encWr.writestr(v)
@@ -219,6 +222,21 @@ func (e *simpleEncDriver) EncodeStringBytesRaw(v []byte) {
 	e.e.encWr.writeb(v)
 }
 
+// WriteBytesStart writes the start of a byte string of a known length, as EncodeStringBytesRaw does.
+func (e *simpleEncDriver) WriteBytesStart(length int64) bool {
+	if length < 0 || length > math.MaxUint32 {
+		return false
+	}
+	e.encLen(simpleVdByteArray, int(length))
+	return true
+}
+
+func (e *simpleEncDriver) WriteBytesChunk(v []byte) {
+	e.e.encWr.writeb(v)
+}
+
+func (e *simpleEncDriver) WriteBytesEnd() {}
+
 func (e *simpleEncDriver) EncodeTime(t time.Time) {
 	// if e.h.EncZeroValuesAsNil && e.c != containerMapKey && t.IsZero() {
 	if t.IsZero() {
@@ -379,6 +397,8 @@ func (d *simpleDecDriver) DecodeBool() (b bool) {
 	if d.bd == simpleVdFalse {
 	} else if d.bd == simpleVdTrue {
 		b = true
+	} else if d.bd >= simpleVdPosInt && d.bd <= simpleVdPosInt+3 {
+		return d.d.boolFromInt()
 	} else {
 		d.d.errorf("cannot decode bool - %s: %x", msgBadDesc, d.bd)
 	}
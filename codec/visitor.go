@@ -0,0 +1,128 @@
+// Copyright (c) 2012-2020 Ugorji Nwoke. All rights reserved.
+// Use of this source code is governed by a MIT license found in the LICENSE file.
+
+package codec
+
+import (
+	"reflect"
+	"time"
+)
+
+// TokenVisitor receives the tokens of the values encoded by an Encoder from NewEncoderVisitor,
+// in place of them being written as bytes in a format e.g. to build an alternative output
+// such as a syntax-highlighted dump. It turns the Encoder into a general value walker.
+//
+// A container is visited as its start (with its length), then each element (after WriteArrayElem),
+// or each key (after WriteMapElemKey) and value (after WriteMapElemValue), then its end.
+// The length is -1 for a map whose length is not known upfront (see EncodeMapFunc).
+//
+// An extension is visited per the handle: EncodeExt with the tag and the bytes of the extension
+// if the handle is binary (e.g. msgpack), else the tokens of the value it converts to (as in json).
+type TokenVisitor interface {
+	EncodeNil()
+	EncodeBool(b bool)
+	EncodeInt(i int64)
+	EncodeUint(u uint64)
+	EncodeFloat32(f float32)
+	EncodeFloat64(f float64)
+	EncodeString(s string)
+	EncodeBytes(b []byte)
+	EncodeTime(t time.Time)
+	EncodeExt(tag uint64, data []byte)
+
+	WriteArrayStart(length int)
+	WriteArrayElem()
+	WriteArrayEnd()
+
+	WriteMapStart(length int)
+	WriteMapElemKey()
+	WriteMapElemValue()
+	WriteMapEnd()
+}
+
+// NewEncoderVisitor returns an Encoder which calls the methods of v for each token
+// of the values it encodes, instead of writing them out (see TokenVisitor).
+//
+// The options of the handle apply as usual e.g. Canonical, omitempty, etc,
+// and whether a type is encoded via encoding.BinaryMarshaler (if the handle is binary)
+// or encoding.TextMarshaler. The format of the handle is otherwise ignored,
+// and options which frame the output (e.g. FrameLengthPrefix) do not apply.
+// Raw values cannot be encoded, as they are already bytes.
+//
+// Do not call Reset or ResetBytes on the Encoder, which are meaningless for it.
+func NewEncoderVisitor(v TokenVisitor, h Handle) *Encoder {
+	d := &visitorEncDriver{v: v}
+	d.e.e = d
+	d.e.init(h)
+	d.e.ResetBytes(&d.b)
+	return &d.e
+}
+
+// visitorEncDriver is the encDriver which passes each token to a TokenVisitor.
+type visitorEncDriver struct {
+	encDriverNoState
+	v TokenVisitor
+	b []byte // the output, to which nothing is written
+	e Encoder
+}
+
+func (d *visitorEncDriver) encoder() *Encoder {
+	return &d.e
+}
+
+func (d *visitorEncDriver) EncodeNil()              { d.v.EncodeNil() }
+func (d *visitorEncDriver) EncodeBool(b bool)       { d.v.EncodeBool(b) }
+func (d *visitorEncDriver) EncodeInt(i int64)       { d.v.EncodeInt(i) }
+func (d *visitorEncDriver) EncodeUint(u uint64)     { d.v.EncodeUint(u) }
+func (d *visitorEncDriver) EncodeFloat32(f float32) { d.v.EncodeFloat32(f) }
+func (d *visitorEncDriver) EncodeFloat64(f float64) { d.v.EncodeFloat64(f) }
+func (d *visitorEncDriver) EncodeString(s string)   { d.v.EncodeString(s) }
+func (d *visitorEncDriver) EncodeTime(t time.Time)  { d.v.EncodeTime(t) }
+
+func (d *visitorEncDriver) EncodeStringBytesRaw(v []byte) {
+	if v == nil {
+		d.v.EncodeNil()
+	} else {
+		d.v.EncodeBytes(v)
+	}
+}
+
+func (d *visitorEncDriver) EncodeExt(v interface{}, basetype reflect.Type, xtag uint64, ext Ext) {
+	if ext == SelfExt {
+		d.e.encodeValue(baseRV(v), d.e.h.fnNoExt(basetype))
+	} else if d.e.be {
+		if bs := ext.WriteExt(v); bs == nil {
+			d.v.EncodeNil()
+		} else {
+			d.v.EncodeExt(xtag, bs)
+		}
+	} else if v2 := ext.ConvertExt(v); v2 == nil {
+		d.v.EncodeNil()
+	} else {
+		d.e.encode(v2)
+	}
+}
+
+func (d *visitorEncDriver) EncodeRawExt(re *RawExt) {
+	if re.Data != nil {
+		d.v.EncodeExt(re.Tag, re.Data)
+	} else if re.Value == nil {
+		d.v.EncodeNil()
+	} else {
+		d.e.encode(re.Value)
+	}
+}
+
+func (d *visitorEncDriver) WriteArrayStart(length int) { d.v.WriteArrayStart(length) }
+func (d *visitorEncDriver) WriteArrayElem()            { d.v.WriteArrayElem() }
+func (d *visitorEncDriver) WriteArrayEnd()             { d.v.WriteArrayEnd() }
+func (d *visitorEncDriver) WriteMapStart(length int)   { d.v.WriteMapStart(length) }
+func (d *visitorEncDriver) WriteMapElemKey()           { d.v.WriteMapElemKey() }
+func (d *visitorEncDriver) WriteMapElemValue()         { d.v.WriteMapElemValue() }
+func (d *visitorEncDriver) WriteMapEnd()               { d.v.WriteMapEnd() }
+
+func (d *visitorEncDriver) WriteMapStartIndefinite() { d.v.WriteMapStart(-1) }
+func (d *visitorEncDriver) WriteMapEndIndefinite()   { d.v.WriteMapEnd() }
+
+var _ encDriverContainerTracker = (*visitorEncDriver)(nil)
+var _ encDriverIndefiniteMap = (*visitorEncDriver)(nil)
@@ -3,7 +3,10 @@
 
 package codec
 
-import "io"
+import (
+	"bytes"
+	"io"
+)
 
 // encWriter abstracts writing to a byte array or to an io.Writer.
 type encWriter interface {
@@ -25,16 +28,29 @@ type encWriter interface {
 type bufioEncWriter struct {
 	w io.Writer
 
+	// wx writes directly to w if it is a *bytes.Buffer (see reset).
+	// buf is then empty, so every write takes the flush branch, which checks wx;
+	// writes to any other io.Writer do not pay for the check.
+	wx bytesBufferEncWriter
+
 	buf []byte
 
 	n int
 
+	nf int // number of bytes flushed to w
+
 	b [16]byte // scratch buffer and padding (cache-aligned)
 }
 
 func (z *bufioEncWriter) reset(w io.Writer, bufsize int, blist *bytesFreelist) {
 	z.w = w
 	z.n = 0
+	z.nf = 0
+	bb, _ := w.(*bytes.Buffer)
+	if z.wx.reset(bb); bb != nil {
+		z.buf = z.buf[:0]
+		return
+	}
 	if bufsize <= 0 {
 		bufsize = defEncByteBufSize
 	}
@@ -58,6 +74,7 @@ func (z *bufioEncWriter) reset(w io.Writer, bufsize int, blist *bytesFreelist) {
 func (z *bufioEncWriter) flushErr() (err error) {
 	n, err := z.w.Write(z.buf[:z.n])
 	z.n -= n
+	z.nf += n
 	if z.n > 0 {
 		if err == nil {
 			err = io.ErrShortWrite
@@ -77,6 +94,10 @@ func (z *bufioEncWriter) writeb(s []byte) {
 LOOP:
 	a := len(z.buf) - z.n
 	if len(s) > a {
+		if z.wx.bb != nil {
+			z.wx.writeb(s)
+			return
+		}
 		z.n += copy(z.buf[z.n:], s[:a])
 		s = s[a:]
 		z.flush()
@@ -90,6 +111,10 @@ func (z *bufioEncWriter) writestr(s string) {
 LOOP:
 	a := len(z.buf) - z.n
 	if len(s) > a {
+		if z.wx.bb != nil {
+			z.wx.writestr(s)
+			return
+		}
 		z.n += copy(z.buf[z.n:], s[:a])
 		s = s[a:]
 		z.flush()
@@ -104,6 +129,10 @@ func (z *bufioEncWriter) writeqstr(s string) {
 	// z.writen1('"')
 
 	if z.n+len(s)+2 > len(z.buf) {
+		if z.wx.bb != nil {
+			z.wx.writeqstr(s)
+			return
+		}
 		z.flush()
 	}
 	z.buf[z.n] = '"'
@@ -123,6 +152,10 @@ LOOP:
 
 func (z *bufioEncWriter) writen1(b1 byte) {
 	if 1 > len(z.buf)-z.n {
+		if z.wx.bb != nil {
+			z.wx.writen1(b1)
+			return
+		}
 		z.flush()
 	}
 	z.buf[z.n] = b1
@@ -130,6 +163,10 @@ func (z *bufioEncWriter) writen1(b1 byte) {
 }
 func (z *bufioEncWriter) writen2(b1, b2 byte) {
 	if 2 > len(z.buf)-z.n {
+		if z.wx.bb != nil {
+			z.wx.writen2(b1, b2)
+			return
+		}
 		z.flush()
 	}
 	z.buf[z.n+1] = b2
@@ -138,6 +175,10 @@ func (z *bufioEncWriter) writen2(b1, b2 byte) {
 }
 func (z *bufioEncWriter) writen4(b [4]byte) {
 	if 4 > len(z.buf)-z.n {
+		if z.wx.bb != nil {
+			z.wx.writen4(b)
+			return
+		}
 		z.flush()
 	}
 	copy(z.buf[z.n:], b[:])
@@ -146,12 +187,20 @@ func (z *bufioEncWriter) writen4(b [4]byte) {
 
 func (z *bufioEncWriter) writen8(b [8]byte) {
 	if 8 > len(z.buf)-z.n {
+		if z.wx.bb != nil {
+			z.wx.writen8(b)
+			return
+		}
 		z.flush()
 	}
 	copy(z.buf[z.n:], b[:])
 	z.n += 8
 }
 
+func (z *bufioEncWriter) numwritten() int {
+	return z.nf + z.n + z.wx.n
+}
+
 func (z *bufioEncWriter) endErr() (err error) {
 	if z.n > 0 {
 		err = z.flushErr()
@@ -161,6 +210,82 @@ func (z *bufioEncWriter) endErr() (err error) {
 
 // ---------------------------------------------
 
+// bytesBufferEncWriter writes directly to a *bytes.Buffer, which is already an in-memory buffer,
+// so there is no copy through a bufioEncWriter, and nothing to flush at the end.
+type bytesBufferEncWriter struct {
+	bb *bytes.Buffer
+	n  int // number of bytes written
+}
+
+func (z *bytesBufferEncWriter) reset(bb *bytes.Buffer) {
+	z.bb = bb
+	z.n = 0
+}
+
+func (z *bytesBufferEncWriter) writeb(s []byte) {
+	z.bb.Write(s)
+	z.n += len(s)
+}
+func (z *bytesBufferEncWriter) writestr(s string) {
+	z.bb.WriteString(s)
+	z.n += len(s)
+}
+func (z *bytesBufferEncWriter) writeqstr(s string) {
+	z.bb.Grow(len(s) + 2)
+	z.bb.WriteByte('"')
+	z.bb.WriteString(s)
+	z.bb.WriteByte('"')
+	z.n += len(s) + 2
+}
+func (z *bytesBufferEncWriter) writen1(b1 byte) {
+	z.bb.WriteByte(b1)
+	z.n++
+}
+func (z *bytesBufferEncWriter) writen2(b1, b2 byte) {
+	z.bb.WriteByte(b1)
+	z.bb.WriteByte(b2)
+	z.n += 2
+}
+func (z *bytesBufferEncWriter) writen4(b [4]byte) {
+	z.bb.Write(b[:])
+	z.n += 4
+}
+func (z *bytesBufferEncWriter) writen8(b [8]byte) {
+	z.bb.Write(b[:])
+	z.n += 8
+}
+
+// ---------------------------------------------
+
+// encMultiWriter is an io.Writer which writes to each of its writers (see Encoder.ResetMulti).
+type encMultiWriter []io.Writer
+
+func (x encMultiWriter) Write(p []byte) (n int, err error) {
+	for _, w := range x {
+		if n, err = w.Write(p); err == nil && n != len(p) {
+			err = io.ErrShortWrite
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close closes each of its writers which is an io.Closer, returning the first error.
+func (x encMultiWriter) Close() (err error) {
+	for _, w := range x {
+		if c, ok := w.(io.Closer); ok {
+			if err2 := c.Close(); err == nil {
+				err = err2
+			}
+		}
+	}
+	return
+}
+
+// ---------------------------------------------
+
 // bytesEncAppender implements encWriter and can write to an byte slice.
 type bytesEncAppender struct {
 	b   []byte
@@ -193,6 +318,9 @@ func (z *bytesEncAppender) writen8(b [8]byte) {
 	z.b = append(z.b, b[:]...)
 	// z.b = append(z.b, b[0], b[1], b[2], b[3], b[4], b[5], b[6], b[7]) // prevents inlining encWr.writen4
 }
+func (z *bytesEncAppender) numwritten() int {
+	return len(z.b)
+}
 func (z *bytesEncAppender) endErr() error {
 	*(z.out) = z.b
 	return nil
@@ -215,6 +343,10 @@ type encWr struct {
 	seq   uint16 // sequencer (e.g. used by binc for symbols, etc)
 	wb    bytesEncAppender
 	wf    *bufioEncWriter
+
+	// wbFixed is true if wb must not grow beyond its capacity wbCap (if ResetBytesFixed).
+	wbFixed bool
+	wbCap   int
 }
 
 // MARKER: manually inline bytesEncAppender.writenx/writeqstr methods,
@@ -275,7 +407,20 @@ func (z *encWr) writen8(b [8]byte) {
 	}
 }
 
+func (z *encWr) numwritten() int {
+	if z.bytes {
+		return z.wb.numwritten()
+	}
+	return z.wf.numwritten()
+}
+
 func (z *encWr) endErr() error {
+	if z.bytes && z.wbFixed {
+		if cap(z.wb.b) != z.wbCap { // grown, as the output did not fit
+			return &ShortBufferError{N: len(z.wb.b)}
+		}
+		return nil
+	}
 	if z.bytes {
 		return z.wb.endErr()
 	}
@@ -142,6 +142,100 @@ func testJsonGroup(t *testing.T) {
 
 	t.Run("TestJsonInvalidUnicode", TestJsonInvalidUnicode)
 	t.Run("TestJsonNumberParsing", TestJsonNumberParsing)
+	t.Run("TestJsonFloatAsString", TestJsonFloatAsString)
+	t.Run("TestJsonStructTagName", TestJsonStructTagName)
+	t.Run("TestJsonTypeFieldName", TestJsonTypeFieldName)
+	t.Run("TestJsonMapDecorator", TestJsonMapDecorator)
+	t.Run("TestJsonIterative", TestJsonIterative)
+	t.Run("TestJsonEncodeWithFieldOffsets", TestJsonEncodeWithFieldOffsets)
+	t.Run("TestJsonEncodeReflectValue", TestJsonEncodeReflectValue)
+	t.Run("TestJsonStringKeyLess", TestJsonStringKeyLess)
+	t.Run("TestJsonImageExt", TestJsonImageExt)
+	t.Run("TestJsonWriteBOM", TestJsonWriteBOM)
+	t.Run("TestJsonEncodeSliceAsMap", TestJsonEncodeSliceAsMap)
+	t.Run("TestJsonKeyDictionary", TestJsonKeyDictionary)
+	t.Run("TestJsonTimePrecision", TestJsonTimePrecision)
+	t.Run("TestJsonStructFieldSet", TestJsonStructFieldSet)
+	t.Run("TestJsonEmptyArrayAsNull", TestJsonEmptyArrayAsNull)
+	t.Run("TestJsonRecordPrefixSuffix", TestJsonRecordPrefixSuffix)
+	t.Run("TestJsonEncoderResetState", TestJsonEncoderResetState)
+	t.Run("TestJsonEncodeUintptr", TestJsonEncodeUintptr)
+	t.Run("TestJsonCanonicalKeyBufHint", TestJsonCanonicalKeyBufHint)
+	t.Run("TestJsonEncodeToBytesBuffer", TestJsonEncodeToBytesBuffer)
+	t.Run("TestJsonMapKeyFilter", TestJsonMapKeyFilter)
+	t.Run("TestJsonOnUnsupported", TestJsonOnUnsupported)
+	t.Run("TestJsonEncoderResetMulti", TestJsonEncoderResetMulti)
+	t.Run("TestJsonStructUnexportedEmbedded", TestJsonStructUnexportedEmbedded)
+	t.Run("TestJsonEncodeErrorPath", TestJsonEncodeErrorPath)
+	t.Run("TestJsonTaggedInterfaces", TestJsonTaggedInterfaces)
+	t.Run("TestJsonBoolAsInt", TestJsonBoolAsInt)
+	t.Run("TestJsonEncodeContext", TestJsonEncodeContext)
+	t.Run("TestJsonRegisterDecimal", TestJsonRegisterDecimal)
+	t.Run("TestJsonEmptyStructHandling", TestJsonEmptyStructHandling)
+	t.Run("TestJsonNumberFormatter", TestJsonNumberFormatter)
+	t.Run("TestJsonStructFieldOrder", TestJsonStructFieldOrder)
+	t.Run("TestJsonEncodeMerged", TestJsonEncodeMerged)
+	t.Run("TestJsonSchemaVersion", TestJsonSchemaVersion)
+	t.Run("TestJsonEncodeNoFlush", TestJsonEncodeNoFlush)
+	t.Run("TestJsonStructUnwrap", TestJsonStructUnwrap)
+	t.Run("TestJsonEncoderClose", TestJsonEncoderClose)
+	t.Run("TestJsonStringToRawMapKeys", TestJsonStringToRawMapKeys)
+	t.Run("TestJsonStructFieldPad", TestJsonStructFieldPad)
+	t.Run("TestJsonEncodeMapFunc", TestJsonEncodeMapFunc)
+	t.Run("TestJsonNullToken", TestJsonNullToken)
+	t.Run("TestJsonCallLazyFuncs", TestJsonCallLazyFuncs)
+	t.Run("TestJsonStructEncodeAsArray", TestJsonStructEncodeAsArray)
+	t.Run("TestJsonSortSortables", TestJsonSortSortables)
+	t.Run("TestJsonFloatSpecials", TestJsonFloatSpecials)
+	t.Run("TestJsonEncodeMapKV", TestJsonEncodeMapKV)
+	t.Run("TestJsonFrameLengthPrefix", TestJsonFrameLengthPrefix)
+	t.Run("TestJsonMapKeyHandle", TestJsonMapKeyHandle)
+	t.Run("TestJsonStructFieldRequires", TestJsonStructFieldRequires)
+	t.Run("TestJsonShareReferences", TestJsonShareReferences)
+	t.Run("TestJsonValidateUTF8", TestJsonValidateUTF8)
+	t.Run("TestJsonPreserveNilVsEmpty", TestJsonPreserveNilVsEmpty)
+	t.Run("TestJsonEncodeWithFieldBytes", TestJsonEncodeWithFieldBytes)
+	t.Run("TestJsonTimeLayout", TestJsonTimeLayout)
+	t.Run("TestJsonStructSliceFast", TestJsonStructSliceFast)
+	t.Run("TestJsonStructFieldRedact", TestJsonStructFieldRedact)
+	t.Run("TestJsonEstimateSize", TestJsonEstimateSize)
+	t.Run("TestJsonMarshalAppender", TestJsonMarshalAppender)
+	t.Run("TestJsonUnionPayload", TestJsonUnionPayload)
+	t.Run("TestJsonTrailingComma", TestJsonTrailingComma)
+	t.Run("TestJsonEncodeFields", TestJsonEncodeFields)
+	t.Run("TestJsonStructFieldInline", TestJsonStructFieldInline)
+	t.Run("TestJsonNetExt", TestJsonNetExt)
+	t.Run("TestJsonMapSetAsArray", TestJsonMapSetAsArray)
+	t.Run("TestJsonMaxCollectionElements", TestJsonMaxCollectionElements)
+	t.Run("TestJsonEmbeddedTime", TestJsonEmbeddedTime)
+	t.Run("TestJsonPointerDepthLimit", TestJsonPointerDepthLimit)
+	t.Run("TestJsonCodecFielder", TestJsonCodecFielder)
+	t.Run("TestJsonWrapScalarsKey", TestJsonWrapScalarsKey)
+	t.Run("TestJsonCanonicalMaxKeyBytes", TestJsonCanonicalMaxKeyBytes)
+	t.Run("TestJsonEncodeMapFromKeys", TestJsonEncodeMapFromKeys)
+	t.Run("TestJsonSeparators", TestJsonSeparators)
+	t.Run("TestJsonChecksumTrailer", TestJsonChecksumTrailer)
+	t.Run("TestJsonStructFieldJsonString", TestJsonStructFieldJsonString)
+	t.Run("TestJsonOmitEmptyByDefault", TestJsonOmitEmptyByDefault)
+	t.Run("TestJsonEncodeMulti", TestJsonEncodeMulti)
+	t.Run("TestJsonStructFieldIndex", TestJsonStructFieldIndex)
+	t.Run("TestJsonStructFieldLenOf", TestJsonStructFieldLenOf)
+	t.Run("TestJsonEncodeNoExt", TestJsonEncodeNoExt)
+	t.Run("TestJsonSkipMapValueKinds", TestJsonSkipMapValueKinds)
+	t.Run("TestJsonMaxKeysPerMap", TestJsonMaxKeysPerMap)
+	t.Run("TestJsonReaderMarshaler", TestJsonReaderMarshaler)
+	t.Run("TestJsonZeroAsNull", TestJsonZeroAsNull)
+	t.Run("TestJsonFixedInnerSlice", TestJsonFixedInnerSlice)
+	t.Run("TestJsonStructKVArray", TestJsonStructKVArray)
+	t.Run("TestJsonTokenVisitor", TestJsonTokenVisitor)
+	t.Run("TestJsonEncodeWithSchema", TestJsonEncodeWithSchema)
+	t.Run("TestJsonVerboseEnums", TestJsonVerboseEnums)
+	t.Run("TestJsonErrorOnSharedPointers", TestJsonErrorOnSharedPointers)
+	t.Run("TestJsonTimeEncoding", TestJsonTimeEncoding)
+	t.Run("TestJsonEncodeNonDefault", TestJsonEncodeNonDefault)
+	t.Run("TestJsonResetBytesFixed", TestJsonResetBytesFixed)
+	t.Run("TestJsonAllowComments", TestJsonAllowComments)
+	t.Run("TestJsonIterativeOptions", TestJsonIterativeOptions)
 }
 
 func testJsonGroupV(t *testing.T) {
@@ -184,6 +278,93 @@ func testBincGroup(t *testing.T) {
 	t.Run("TestBincNumbers", TestBincNumbers)
 	t.Run("TestBincDesc", TestBincDesc)
 	t.Run("TestBincStructFieldInfoToArray", TestBincStructFieldInfoToArray)
+	t.Run("TestBincStructTagName", TestBincStructTagName)
+	t.Run("TestBincTypeFieldName", TestBincTypeFieldName)
+	t.Run("TestBincMapDecorator", TestBincMapDecorator)
+	t.Run("TestBincIterative", TestBincIterative)
+	t.Run("TestBincEncodeWithFieldOffsets", TestBincEncodeWithFieldOffsets)
+	t.Run("TestBincEncodeReflectValue", TestBincEncodeReflectValue)
+	t.Run("TestBincStringKeyLess", TestBincStringKeyLess)
+	t.Run("TestBincImageExt", TestBincImageExt)
+	t.Run("TestBincEncodeSliceAsMap", TestBincEncodeSliceAsMap)
+	t.Run("TestBincKeyDictionary", TestBincKeyDictionary)
+	t.Run("TestBincTimePrecision", TestBincTimePrecision)
+	t.Run("TestBincStructFieldSet", TestBincStructFieldSet)
+	t.Run("TestBincEmptyArrayAsNull", TestBincEmptyArrayAsNull)
+	t.Run("TestBincRecordPrefixSuffix", TestBincRecordPrefixSuffix)
+	t.Run("TestBincEncoderResetState", TestBincEncoderResetState)
+	t.Run("TestBincEncodeUintptr", TestBincEncodeUintptr)
+	t.Run("TestBincCanonicalKeyBufHint", TestBincCanonicalKeyBufHint)
+	t.Run("TestBincEncodeToBytesBuffer", TestBincEncodeToBytesBuffer)
+	t.Run("TestBincMapKeyFilter", TestBincMapKeyFilter)
+	t.Run("TestBincOnUnsupported", TestBincOnUnsupported)
+	t.Run("TestBincEncoderResetMulti", TestBincEncoderResetMulti)
+	t.Run("TestBincStructUnexportedEmbedded", TestBincStructUnexportedEmbedded)
+	t.Run("TestBincEncodeErrorPath", TestBincEncodeErrorPath)
+	t.Run("TestBincTaggedInterfaces", TestBincTaggedInterfaces)
+	t.Run("TestBincBoolAsInt", TestBincBoolAsInt)
+	t.Run("TestBincEncodeContext", TestBincEncodeContext)
+	t.Run("TestBincRegisterDecimal", TestBincRegisterDecimal)
+	t.Run("TestBincEmptyStructHandling", TestBincEmptyStructHandling)
+	t.Run("TestBincStructFieldOrder", TestBincStructFieldOrder)
+	t.Run("TestBincEncodeMerged", TestBincEncodeMerged)
+	t.Run("TestBincSchemaVersion", TestBincSchemaVersion)
+	t.Run("TestBincEncodeNoFlush", TestBincEncodeNoFlush)
+	t.Run("TestBincCanonicalIntfKeys", TestBincCanonicalIntfKeys)
+	t.Run("TestBincStructUnwrap", TestBincStructUnwrap)
+	t.Run("TestBincEncoderClose", TestBincEncoderClose)
+	t.Run("TestBincStringToRawMapKeys", TestBincStringToRawMapKeys)
+	t.Run("TestBincStructFieldPad", TestBincStructFieldPad)
+	t.Run("TestBincEncodeMapFunc", TestBincEncodeMapFunc)
+	t.Run("TestBincCallLazyFuncs", TestBincCallLazyFuncs)
+	t.Run("TestBincStructEncodeAsArray", TestBincStructEncodeAsArray)
+	t.Run("TestBincSortSortables", TestBincSortSortables)
+	t.Run("TestBincFloatSpecials", TestBincFloatSpecials)
+	t.Run("TestBincEncodeMapKV", TestBincEncodeMapKV)
+	t.Run("TestBincFrameLengthPrefix", TestBincFrameLengthPrefix)
+	t.Run("TestBincMapKeyHandle", TestBincMapKeyHandle)
+	t.Run("TestBincStructFieldRequires", TestBincStructFieldRequires)
+	t.Run("TestBincValidateUTF8", TestBincValidateUTF8)
+	t.Run("TestBincPreserveNilVsEmpty", TestBincPreserveNilVsEmpty)
+	t.Run("TestBincEncodeWithFieldBytes", TestBincEncodeWithFieldBytes)
+	t.Run("TestBincTimeLayout", TestBincTimeLayout)
+	t.Run("TestBincStructSliceFast", TestBincStructSliceFast)
+	t.Run("TestBincStructFieldRedact", TestBincStructFieldRedact)
+	t.Run("TestBincEstimateSize", TestBincEstimateSize)
+	t.Run("TestBincMarshalAppender", TestBincMarshalAppender)
+	t.Run("TestBincUnionPayload", TestBincUnionPayload)
+	t.Run("TestBincEncodeFields", TestBincEncodeFields)
+	t.Run("TestBincStructFieldInline", TestBincStructFieldInline)
+	t.Run("TestBincNetExt", TestBincNetExt)
+	t.Run("TestBincMapSetAsArray", TestBincMapSetAsArray)
+	t.Run("TestBincMaxCollectionElements", TestBincMaxCollectionElements)
+	t.Run("TestBincEmbeddedTime", TestBincEmbeddedTime)
+	t.Run("TestBincPointerDepthLimit", TestBincPointerDepthLimit)
+	t.Run("TestBincCodecFielder", TestBincCodecFielder)
+	t.Run("TestBincWrapScalarsKey", TestBincWrapScalarsKey)
+	t.Run("TestBincCanonicalMaxKeyBytes", TestBincCanonicalMaxKeyBytes)
+	t.Run("TestBincEncodeMapFromKeys", TestBincEncodeMapFromKeys)
+	t.Run("TestBincChecksumTrailer", TestBincChecksumTrailer)
+	t.Run("TestBincStructFieldJsonString", TestBincStructFieldJsonString)
+	t.Run("TestBincOmitEmptyByDefault", TestBincOmitEmptyByDefault)
+	t.Run("TestBincEncodeMulti", TestBincEncodeMulti)
+	t.Run("TestBincStructFieldIndex", TestBincStructFieldIndex)
+	t.Run("TestBincStructFieldLenOf", TestBincStructFieldLenOf)
+	t.Run("TestBincEncodeNoExt", TestBincEncodeNoExt)
+	t.Run("TestBincSkipMapValueKinds", TestBincSkipMapValueKinds)
+	t.Run("TestBincMaxKeysPerMap", TestBincMaxKeysPerMap)
+	t.Run("TestBincReaderMarshaler", TestBincReaderMarshaler)
+	t.Run("TestBincZeroAsNull", TestBincZeroAsNull)
+	t.Run("TestBincFixedInnerSlice", TestBincFixedInnerSlice)
+	t.Run("TestBincStructKVArray", TestBincStructKVArray)
+	t.Run("TestBincTokenVisitor", TestBincTokenVisitor)
+	t.Run("TestBincEncodeWithSchema", TestBincEncodeWithSchema)
+	t.Run("TestBincVerboseEnums", TestBincVerboseEnums)
+	t.Run("TestBincErrorOnSharedPointers", TestBincErrorOnSharedPointers)
+	t.Run("TestBincTimeEncoding", TestBincTimeEncoding)
+	t.Run("TestBincEncodeNonDefault", TestBincEncodeNonDefault)
+	t.Run("TestBincResetBytesFixed", TestBincResetBytesFixed)
+	t.Run("TestBincIterativeOptions", TestBincIterativeOptions)
 }
 
 func testBincGroupV(t *testing.T) {
@@ -229,6 +410,94 @@ func testCborGroup(t *testing.T) {
 
 	t.Run("TestCborHalfFloat", TestCborHalfFloat)
 	t.Run("TestCborSkipTags", TestCborSkipTags)
+	t.Run("TestCborStructTagName", TestCborStructTagName)
+	t.Run("TestCborTypeFieldName", TestCborTypeFieldName)
+	t.Run("TestCborMapDecorator", TestCborMapDecorator)
+	t.Run("TestCborIterative", TestCborIterative)
+	t.Run("TestCborEncodeWithFieldOffsets", TestCborEncodeWithFieldOffsets)
+	t.Run("TestCborEncodeReflectValue", TestCborEncodeReflectValue)
+	t.Run("TestCborStringKeyLess", TestCborStringKeyLess)
+	t.Run("TestCborImageExt", TestCborImageExt)
+	t.Run("TestCborEncodeSliceAsMap", TestCborEncodeSliceAsMap)
+	t.Run("TestCborKeyDictionary", TestCborKeyDictionary)
+	t.Run("TestCborTimePrecision", TestCborTimePrecision)
+	t.Run("TestCborStructFieldSet", TestCborStructFieldSet)
+	t.Run("TestCborEmptyArrayAsNull", TestCborEmptyArrayAsNull)
+	t.Run("TestCborRecordPrefixSuffix", TestCborRecordPrefixSuffix)
+	t.Run("TestCborEncoderResetState", TestCborEncoderResetState)
+	t.Run("TestCborEncodeUintptr", TestCborEncodeUintptr)
+	t.Run("TestCborCanonicalKeyBufHint", TestCborCanonicalKeyBufHint)
+	t.Run("TestCborEncodeToBytesBuffer", TestCborEncodeToBytesBuffer)
+	t.Run("TestCborMapKeyFilter", TestCborMapKeyFilter)
+	t.Run("TestCborOnUnsupported", TestCborOnUnsupported)
+	t.Run("TestCborEncoderResetMulti", TestCborEncoderResetMulti)
+	t.Run("TestCborStructUnexportedEmbedded", TestCborStructUnexportedEmbedded)
+	t.Run("TestCborEncodeErrorPath", TestCborEncodeErrorPath)
+	t.Run("TestCborTaggedInterfaces", TestCborTaggedInterfaces)
+	t.Run("TestCborBoolAsInt", TestCborBoolAsInt)
+	t.Run("TestCborEncodeContext", TestCborEncodeContext)
+	t.Run("TestCborRegisterDecimal", TestCborRegisterDecimal)
+	t.Run("TestCborEmptyStructHandling", TestCborEmptyStructHandling)
+	t.Run("TestCborStructFieldOrder", TestCborStructFieldOrder)
+	t.Run("TestCborEncodeMerged", TestCborEncodeMerged)
+	t.Run("TestCborSchemaVersion", TestCborSchemaVersion)
+	t.Run("TestCborEncodeNoFlush", TestCborEncodeNoFlush)
+	t.Run("TestCborCanonicalIntfKeys", TestCborCanonicalIntfKeys)
+	t.Run("TestCborStructUnwrap", TestCborStructUnwrap)
+	t.Run("TestCborEncoderClose", TestCborEncoderClose)
+	t.Run("TestCborStringToRawMapKeys", TestCborStringToRawMapKeys)
+	t.Run("TestCborStructFieldPad", TestCborStructFieldPad)
+	t.Run("TestCborEncodeMapFunc", TestCborEncodeMapFunc)
+	t.Run("TestCborCallLazyFuncs", TestCborCallLazyFuncs)
+	t.Run("TestCborStructEncodeAsArray", TestCborStructEncodeAsArray)
+	t.Run("TestCborSortSortables", TestCborSortSortables)
+	t.Run("TestCborFloatSpecials", TestCborFloatSpecials)
+	t.Run("TestCborEncodeMapKV", TestCborEncodeMapKV)
+	t.Run("TestCborFrameLengthPrefix", TestCborFrameLengthPrefix)
+	t.Run("TestCborMapKeyHandle", TestCborMapKeyHandle)
+	t.Run("TestCborStructFieldRequires", TestCborStructFieldRequires)
+	t.Run("TestCborShareReferences", TestCborShareReferences)
+	t.Run("TestCborValidateUTF8", TestCborValidateUTF8)
+	t.Run("TestCborPreserveNilVsEmpty", TestCborPreserveNilVsEmpty)
+	t.Run("TestCborEncodeWithFieldBytes", TestCborEncodeWithFieldBytes)
+	t.Run("TestCborTimeLayout", TestCborTimeLayout)
+	t.Run("TestCborStructSliceFast", TestCborStructSliceFast)
+	t.Run("TestCborStructFieldRedact", TestCborStructFieldRedact)
+	t.Run("TestCborEstimateSize", TestCborEstimateSize)
+	t.Run("TestCborMarshalAppender", TestCborMarshalAppender)
+	t.Run("TestCborUnionPayload", TestCborUnionPayload)
+	t.Run("TestCborEncodeFields", TestCborEncodeFields)
+	t.Run("TestCborStructFieldInline", TestCborStructFieldInline)
+	t.Run("TestCborNetExt", TestCborNetExt)
+	t.Run("TestCborMapSetAsArray", TestCborMapSetAsArray)
+	t.Run("TestCborMaxCollectionElements", TestCborMaxCollectionElements)
+	t.Run("TestCborEmbeddedTime", TestCborEmbeddedTime)
+	t.Run("TestCborPointerDepthLimit", TestCborPointerDepthLimit)
+	t.Run("TestCborCodecFielder", TestCborCodecFielder)
+	t.Run("TestCborWrapScalarsKey", TestCborWrapScalarsKey)
+	t.Run("TestCborCanonicalMaxKeyBytes", TestCborCanonicalMaxKeyBytes)
+	t.Run("TestCborEncodeMapFromKeys", TestCborEncodeMapFromKeys)
+	t.Run("TestCborChecksumTrailer", TestCborChecksumTrailer)
+	t.Run("TestCborStructFieldJsonString", TestCborStructFieldJsonString)
+	t.Run("TestCborOmitEmptyByDefault", TestCborOmitEmptyByDefault)
+	t.Run("TestCborEncodeMulti", TestCborEncodeMulti)
+	t.Run("TestCborStructFieldIndex", TestCborStructFieldIndex)
+	t.Run("TestCborStructFieldLenOf", TestCborStructFieldLenOf)
+	t.Run("TestCborEncodeNoExt", TestCborEncodeNoExt)
+	t.Run("TestCborSkipMapValueKinds", TestCborSkipMapValueKinds)
+	t.Run("TestCborMaxKeysPerMap", TestCborMaxKeysPerMap)
+	t.Run("TestCborReaderMarshaler", TestCborReaderMarshaler)
+	t.Run("TestCborZeroAsNull", TestCborZeroAsNull)
+	t.Run("TestCborFixedInnerSlice", TestCborFixedInnerSlice)
+	t.Run("TestCborStructKVArray", TestCborStructKVArray)
+	t.Run("TestCborTokenVisitor", TestCborTokenVisitor)
+	t.Run("TestCborEncodeWithSchema", TestCborEncodeWithSchema)
+	t.Run("TestCborVerboseEnums", TestCborVerboseEnums)
+	t.Run("TestCborErrorOnSharedPointers", TestCborErrorOnSharedPointers)
+	t.Run("TestCborTimeEncoding", TestCborTimeEncoding)
+	t.Run("TestCborEncodeNonDefault", TestCborEncodeNonDefault)
+	t.Run("TestCborResetBytesFixed", TestCborResetBytesFixed)
+	t.Run("TestCborIterativeOptions", TestCborIterativeOptions)
 }
 
 func testCborGroupV(t *testing.T) {
@@ -273,6 +542,97 @@ func testMsgpackGroup(t *testing.T) {
 	t.Run("TestMsgpackStructFieldInfoToArray", TestMsgpackStructFieldInfoToArray)
 
 	t.Run("TestMsgpackDecodeMapAndExtSizeMismatch", TestMsgpackDecodeMapAndExtSizeMismatch)
+	t.Run("TestMsgpackStructTagName", TestMsgpackStructTagName)
+	t.Run("TestMsgpackTypeFieldName", TestMsgpackTypeFieldName)
+	t.Run("TestMsgpackMapDecorator", TestMsgpackMapDecorator)
+	t.Run("TestMsgpackIterative", TestMsgpackIterative)
+	t.Run("TestMsgpackEncodeWithFieldOffsets", TestMsgpackEncodeWithFieldOffsets)
+	t.Run("TestMsgpackEncodeReflectValue", TestMsgpackEncodeReflectValue)
+	t.Run("TestMsgpackStringKeyLess", TestMsgpackStringKeyLess)
+	t.Run("TestMsgpackImageExt", TestMsgpackImageExt)
+	t.Run("TestMsgpackEncodeSliceAsMap", TestMsgpackEncodeSliceAsMap)
+	t.Run("TestMsgpackKeyDictionary", TestMsgpackKeyDictionary)
+	t.Run("TestMsgpackTimePrecision", TestMsgpackTimePrecision)
+	t.Run("TestMsgpackTimeExt", TestMsgpackTimeExt)
+	t.Run("TestMsgpackStructFieldSet", TestMsgpackStructFieldSet)
+	t.Run("TestMsgpackEmptyArrayAsNull", TestMsgpackEmptyArrayAsNull)
+	t.Run("TestMsgpackRecordPrefixSuffix", TestMsgpackRecordPrefixSuffix)
+	t.Run("TestMsgpackEncoderResetState", TestMsgpackEncoderResetState)
+	t.Run("TestMsgpackEncodeUintptr", TestMsgpackEncodeUintptr)
+	t.Run("TestMsgpackCanonicalKeyBufHint", TestMsgpackCanonicalKeyBufHint)
+	t.Run("TestMsgpackEncodeToBytesBuffer", TestMsgpackEncodeToBytesBuffer)
+	t.Run("TestMsgpackMapKeyFilter", TestMsgpackMapKeyFilter)
+	t.Run("TestMsgpackOnUnsupported", TestMsgpackOnUnsupported)
+	t.Run("TestMsgpackEncoderResetMulti", TestMsgpackEncoderResetMulti)
+	t.Run("TestMsgpackStructUnexportedEmbedded", TestMsgpackStructUnexportedEmbedded)
+	t.Run("TestMsgpackEncodeErrorPath", TestMsgpackEncodeErrorPath)
+	t.Run("TestMsgpackTaggedInterfaces", TestMsgpackTaggedInterfaces)
+	t.Run("TestMsgpackBoolAsInt", TestMsgpackBoolAsInt)
+	t.Run("TestMsgpackEncodeContext", TestMsgpackEncodeContext)
+	t.Run("TestMsgpackRegisterDecimal", TestMsgpackRegisterDecimal)
+	t.Run("TestMsgpackEmptyStructHandling", TestMsgpackEmptyStructHandling)
+	t.Run("TestMsgpackStructFieldOrder", TestMsgpackStructFieldOrder)
+	t.Run("TestMsgpackEncodeMerged", TestMsgpackEncodeMerged)
+	t.Run("TestMsgpackSchemaVersion", TestMsgpackSchemaVersion)
+	t.Run("TestMsgpackEncodeNoFlush", TestMsgpackEncodeNoFlush)
+	t.Run("TestMsgpackCanonicalIntfKeys", TestMsgpackCanonicalIntfKeys)
+	t.Run("TestMsgpackStructUnwrap", TestMsgpackStructUnwrap)
+	t.Run("TestMsgpackEncoderClose", TestMsgpackEncoderClose)
+	t.Run("TestMsgpackStringToRawMapKeys", TestMsgpackStringToRawMapKeys)
+	t.Run("TestMsgpackStructFieldPad", TestMsgpackStructFieldPad)
+	t.Run("TestMsgpackEncodeMapFunc", TestMsgpackEncodeMapFunc)
+	t.Run("TestMsgpackCallLazyFuncs", TestMsgpackCallLazyFuncs)
+	t.Run("TestMsgpackStructEncodeAsArray", TestMsgpackStructEncodeAsArray)
+	t.Run("TestMsgpackSortSortables", TestMsgpackSortSortables)
+	t.Run("TestMsgpackFloatSpecials", TestMsgpackFloatSpecials)
+	t.Run("TestMsgpackEncodeMapKV", TestMsgpackEncodeMapKV)
+	t.Run("TestMsgpackFrameLengthPrefix", TestMsgpackFrameLengthPrefix)
+	t.Run("TestMsgpackMapKeyHandle", TestMsgpackMapKeyHandle)
+	t.Run("TestMsgpackStructFieldRequires", TestMsgpackStructFieldRequires)
+	t.Run("TestMsgpackShareReferences", TestMsgpackShareReferences)
+	t.Run("TestMsgpackValidateUTF8", TestMsgpackValidateUTF8)
+	t.Run("TestMsgpackPreserveNilVsEmpty", TestMsgpackPreserveNilVsEmpty)
+	t.Run("TestMsgpackEncodeWithFieldBytes", TestMsgpackEncodeWithFieldBytes)
+	t.Run("TestMsgpackTimeLayout", TestMsgpackTimeLayout)
+	t.Run("TestMsgpackStructSliceFast", TestMsgpackStructSliceFast)
+	t.Run("TestMsgpackStructFieldRedact", TestMsgpackStructFieldRedact)
+	t.Run("TestMsgpackEstimateSize", TestMsgpackEstimateSize)
+	t.Run("TestMsgpackMarshalAppender", TestMsgpackMarshalAppender)
+	t.Run("TestMsgpackUnionPayload", TestMsgpackUnionPayload)
+	t.Run("TestMsgpackRawToStringIfUTF8", TestMsgpackRawToStringIfUTF8)
+	t.Run("TestMsgpackEncodeFields", TestMsgpackEncodeFields)
+	t.Run("TestMsgpackStructFieldInline", TestMsgpackStructFieldInline)
+	t.Run("TestMsgpackNetExt", TestMsgpackNetExt)
+	t.Run("TestMsgpackMapSetAsArray", TestMsgpackMapSetAsArray)
+	t.Run("TestMsgpackMaxCollectionElements", TestMsgpackMaxCollectionElements)
+	t.Run("TestMsgpackEmbeddedTime", TestMsgpackEmbeddedTime)
+	t.Run("TestMsgpackPointerDepthLimit", TestMsgpackPointerDepthLimit)
+	t.Run("TestMsgpackCodecFielder", TestMsgpackCodecFielder)
+	t.Run("TestMsgpackEncodeExt", TestMsgpackEncodeExt)
+	t.Run("TestMsgpackWrapScalarsKey", TestMsgpackWrapScalarsKey)
+	t.Run("TestMsgpackCanonicalMaxKeyBytes", TestMsgpackCanonicalMaxKeyBytes)
+	t.Run("TestMsgpackEncodeMapFromKeys", TestMsgpackEncodeMapFromKeys)
+	t.Run("TestMsgpackChecksumTrailer", TestMsgpackChecksumTrailer)
+	t.Run("TestMsgpackStructFieldJsonString", TestMsgpackStructFieldJsonString)
+	t.Run("TestMsgpackOmitEmptyByDefault", TestMsgpackOmitEmptyByDefault)
+	t.Run("TestMsgpackEncodeMulti", TestMsgpackEncodeMulti)
+	t.Run("TestMsgpackStructFieldIndex", TestMsgpackStructFieldIndex)
+	t.Run("TestMsgpackStructFieldLenOf", TestMsgpackStructFieldLenOf)
+	t.Run("TestMsgpackEncodeNoExt", TestMsgpackEncodeNoExt)
+	t.Run("TestMsgpackSkipMapValueKinds", TestMsgpackSkipMapValueKinds)
+	t.Run("TestMsgpackMaxKeysPerMap", TestMsgpackMaxKeysPerMap)
+	t.Run("TestMsgpackReaderMarshaler", TestMsgpackReaderMarshaler)
+	t.Run("TestMsgpackZeroAsNull", TestMsgpackZeroAsNull)
+	t.Run("TestMsgpackFixedInnerSlice", TestMsgpackFixedInnerSlice)
+	t.Run("TestMsgpackStructKVArray", TestMsgpackStructKVArray)
+	t.Run("TestMsgpackTokenVisitor", TestMsgpackTokenVisitor)
+	t.Run("TestMsgpackEncodeWithSchema", TestMsgpackEncodeWithSchema)
+	t.Run("TestMsgpackVerboseEnums", TestMsgpackVerboseEnums)
+	t.Run("TestMsgpackErrorOnSharedPointers", TestMsgpackErrorOnSharedPointers)
+	t.Run("TestMsgpackTimeEncoding", TestMsgpackTimeEncoding)
+	t.Run("TestMsgpackEncodeNonDefault", TestMsgpackEncodeNonDefault)
+	t.Run("TestMsgpackResetBytesFixed", TestMsgpackResetBytesFixed)
+	t.Run("TestMsgpackIterativeOptions", TestMsgpackIterativeOptions)
 }
 
 func testMsgpackGroupV(t *testing.T) {
@@ -314,6 +674,93 @@ func testSimpleGroup(t *testing.T) {
 	t.Run("TestSimpleNumbers", TestSimpleNumbers)
 	t.Run("TestSimpleDesc", TestSimpleDesc)
 	t.Run("TestSimpleStructFieldInfoToArray", TestSimpleStructFieldInfoToArray)
+	t.Run("TestSimpleStructTagName", TestSimpleStructTagName)
+	t.Run("TestSimpleTypeFieldName", TestSimpleTypeFieldName)
+	t.Run("TestSimpleMapDecorator", TestSimpleMapDecorator)
+	t.Run("TestSimpleIterative", TestSimpleIterative)
+	t.Run("TestSimpleEncodeWithFieldOffsets", TestSimpleEncodeWithFieldOffsets)
+	t.Run("TestSimpleEncodeReflectValue", TestSimpleEncodeReflectValue)
+	t.Run("TestSimpleStringKeyLess", TestSimpleStringKeyLess)
+	t.Run("TestSimpleImageExt", TestSimpleImageExt)
+	t.Run("TestSimpleEncodeSliceAsMap", TestSimpleEncodeSliceAsMap)
+	t.Run("TestSimpleKeyDictionary", TestSimpleKeyDictionary)
+	t.Run("TestSimpleTimePrecision", TestSimpleTimePrecision)
+	t.Run("TestSimpleStructFieldSet", TestSimpleStructFieldSet)
+	t.Run("TestSimpleEmptyArrayAsNull", TestSimpleEmptyArrayAsNull)
+	t.Run("TestSimpleRecordPrefixSuffix", TestSimpleRecordPrefixSuffix)
+	t.Run("TestSimpleEncoderResetState", TestSimpleEncoderResetState)
+	t.Run("TestSimpleEncodeUintptr", TestSimpleEncodeUintptr)
+	t.Run("TestSimpleCanonicalKeyBufHint", TestSimpleCanonicalKeyBufHint)
+	t.Run("TestSimpleEncodeToBytesBuffer", TestSimpleEncodeToBytesBuffer)
+	t.Run("TestSimpleMapKeyFilter", TestSimpleMapKeyFilter)
+	t.Run("TestSimpleOnUnsupported", TestSimpleOnUnsupported)
+	t.Run("TestSimpleEncoderResetMulti", TestSimpleEncoderResetMulti)
+	t.Run("TestSimpleStructUnexportedEmbedded", TestSimpleStructUnexportedEmbedded)
+	t.Run("TestSimpleEncodeErrorPath", TestSimpleEncodeErrorPath)
+	t.Run("TestSimpleTaggedInterfaces", TestSimpleTaggedInterfaces)
+	t.Run("TestSimpleBoolAsInt", TestSimpleBoolAsInt)
+	t.Run("TestSimpleEncodeContext", TestSimpleEncodeContext)
+	t.Run("TestSimpleRegisterDecimal", TestSimpleRegisterDecimal)
+	t.Run("TestSimpleEmptyStructHandling", TestSimpleEmptyStructHandling)
+	t.Run("TestSimpleStructFieldOrder", TestSimpleStructFieldOrder)
+	t.Run("TestSimpleEncodeMerged", TestSimpleEncodeMerged)
+	t.Run("TestSimpleSchemaVersion", TestSimpleSchemaVersion)
+	t.Run("TestSimpleEncodeNoFlush", TestSimpleEncodeNoFlush)
+	t.Run("TestSimpleCanonicalIntfKeys", TestSimpleCanonicalIntfKeys)
+	t.Run("TestSimpleStructUnwrap", TestSimpleStructUnwrap)
+	t.Run("TestSimpleEncoderClose", TestSimpleEncoderClose)
+	t.Run("TestSimpleStringToRawMapKeys", TestSimpleStringToRawMapKeys)
+	t.Run("TestSimpleStructFieldPad", TestSimpleStructFieldPad)
+	t.Run("TestSimpleEncodeMapFunc", TestSimpleEncodeMapFunc)
+	t.Run("TestSimpleCallLazyFuncs", TestSimpleCallLazyFuncs)
+	t.Run("TestSimpleStructEncodeAsArray", TestSimpleStructEncodeAsArray)
+	t.Run("TestSimpleSortSortables", TestSimpleSortSortables)
+	t.Run("TestSimpleFloatSpecials", TestSimpleFloatSpecials)
+	t.Run("TestSimpleEncodeMapKV", TestSimpleEncodeMapKV)
+	t.Run("TestSimpleFrameLengthPrefix", TestSimpleFrameLengthPrefix)
+	t.Run("TestSimpleMapKeyHandle", TestSimpleMapKeyHandle)
+	t.Run("TestSimpleStructFieldRequires", TestSimpleStructFieldRequires)
+	t.Run("TestSimpleValidateUTF8", TestSimpleValidateUTF8)
+	t.Run("TestSimplePreserveNilVsEmpty", TestSimplePreserveNilVsEmpty)
+	t.Run("TestSimpleEncodeWithFieldBytes", TestSimpleEncodeWithFieldBytes)
+	t.Run("TestSimpleTimeLayout", TestSimpleTimeLayout)
+	t.Run("TestSimpleStructSliceFast", TestSimpleStructSliceFast)
+	t.Run("TestSimpleStructFieldRedact", TestSimpleStructFieldRedact)
+	t.Run("TestSimpleEstimateSize", TestSimpleEstimateSize)
+	t.Run("TestSimpleMarshalAppender", TestSimpleMarshalAppender)
+	t.Run("TestSimpleUnionPayload", TestSimpleUnionPayload)
+	t.Run("TestSimpleEncodeFields", TestSimpleEncodeFields)
+	t.Run("TestSimpleStructFieldInline", TestSimpleStructFieldInline)
+	t.Run("TestSimpleNetExt", TestSimpleNetExt)
+	t.Run("TestSimpleMapSetAsArray", TestSimpleMapSetAsArray)
+	t.Run("TestSimpleMaxCollectionElements", TestSimpleMaxCollectionElements)
+	t.Run("TestSimpleEmbeddedTime", TestSimpleEmbeddedTime)
+	t.Run("TestSimplePointerDepthLimit", TestSimplePointerDepthLimit)
+	t.Run("TestSimpleCodecFielder", TestSimpleCodecFielder)
+	t.Run("TestSimpleWrapScalarsKey", TestSimpleWrapScalarsKey)
+	t.Run("TestSimpleCanonicalMaxKeyBytes", TestSimpleCanonicalMaxKeyBytes)
+	t.Run("TestSimpleEncodeMapFromKeys", TestSimpleEncodeMapFromKeys)
+	t.Run("TestSimpleChecksumTrailer", TestSimpleChecksumTrailer)
+	t.Run("TestSimpleStructFieldJsonString", TestSimpleStructFieldJsonString)
+	t.Run("TestSimpleOmitEmptyByDefault", TestSimpleOmitEmptyByDefault)
+	t.Run("TestSimpleEncodeMulti", TestSimpleEncodeMulti)
+	t.Run("TestSimpleStructFieldIndex", TestSimpleStructFieldIndex)
+	t.Run("TestSimpleStructFieldLenOf", TestSimpleStructFieldLenOf)
+	t.Run("TestSimpleEncodeNoExt", TestSimpleEncodeNoExt)
+	t.Run("TestSimpleSkipMapValueKinds", TestSimpleSkipMapValueKinds)
+	t.Run("TestSimpleMaxKeysPerMap", TestSimpleMaxKeysPerMap)
+	t.Run("TestSimpleReaderMarshaler", TestSimpleReaderMarshaler)
+	t.Run("TestSimpleZeroAsNull", TestSimpleZeroAsNull)
+	t.Run("TestSimpleFixedInnerSlice", TestSimpleFixedInnerSlice)
+	t.Run("TestSimpleStructKVArray", TestSimpleStructKVArray)
+	t.Run("TestSimpleTokenVisitor", TestSimpleTokenVisitor)
+	t.Run("TestSimpleEncodeWithSchema", TestSimpleEncodeWithSchema)
+	t.Run("TestSimpleVerboseEnums", TestSimpleVerboseEnums)
+	t.Run("TestSimpleErrorOnSharedPointers", TestSimpleErrorOnSharedPointers)
+	t.Run("TestSimpleTimeEncoding", TestSimpleTimeEncoding)
+	t.Run("TestSimpleEncodeNonDefault", TestSimpleEncodeNonDefault)
+	t.Run("TestSimpleResetBytesFixed", TestSimpleResetBytesFixed)
+	t.Run("TestSimpleIterativeOptions", TestSimpleIterativeOptions)
 }
 
 func testSimpleGroupV(t *testing.T) {
@@ -346,6 +793,7 @@ func testNonHandlesGroup(t *testing.T) {
 	t.Run("TestMultipleEncDec", TestMultipleEncDec)
 	t.Run("TestAllErrWriter", TestAllErrWriter)
 	t.Run("TestMapRangeIndex", TestMapRangeIndex)
+	t.Run("TestVarint", TestVarint)
 }
 
 func TestCodecSuite(t *testing.T) {